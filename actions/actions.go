@@ -0,0 +1,201 @@
+// Package actions maps inputs to the things autoscan can do.
+//
+// Every input source (GPIO buttons, LCD plate keys, the terminal, HTTP,
+// input devices) reports named inputs to a Dispatcher, which looks up
+// what action the input is bound to and runs the handler for it. Which
+// inputs trigger which actions is configuration, see config.Station.
+//
+// Input names are "<source>:<name>":
+//
+//	gpio:<pin>:press    Button went down.
+//	gpio:<pin>:release  Button went up.
+//	gpio:<pin>:tap      Short press and release.
+//	gpio:<pin>:long     Button held down.
+//	gpio:<a>+<b>:chord  Two buttons held down at once. Lowest pin first.
+//	lcd:<key>           LCD plate key: select, up, down, left or right.
+//	term:<key>          Key on the terminal UI, e.g. term:s or term:up. See package term.
+//	http:<name>         POST to /api/input?name=<name> in the web UI.
+//	key:<name>          Key on an input device, e.g. key:b or key:f13. See package evdev.
+//
+// Keys and buttons pressed on the web UI's LCD page run what the input is
+// bound to, but are recorded as from "web:<input>", e.g. web:gpio:5:tap.
+//
+// Actions are "<action>" or "<action>:<argument>". See the constants.
+package actions
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Actions.
+const (
+	Start       = "start"       // Start a scan. Argument is the profile name, optionally with ":<scanner>" to override its scanner.
+	Cancel      = "cancel"      // Cancel the running scan. Optional argument is the scanner.
+	Ack         = "ack"         // Acknowledge an error. Optional argument is the scanner.
+	Finish      = "finish"      // Stop scanning, and upload the pages so far. Optional argument is the scanner.
+	Destination = "destination" // Upload the next scans to a destination in the station config. No argument for the default.
+	User        = "user"        // Upload the next scans to a user's folder in the station config. No argument for the default.
+	Menu        = "menu"        // Open the LCD menu, or go back a level.
+	MenuNext    = "menu-next"   // Next menu item.
+	MenuPrev    = "menu-prev"   // Previous menu item.
+	MenuSelect  = "menu-select" // Select the menu item.
+	PageNext    = "page-next"   // Next page of a long LCD message.
+	PagePrev    = "page-prev"   // Previous page of a long LCD message.
+	Reboot      = "reboot"      // Reboot the machine.
+	Shutdown    = "shutdown"    // Shut down the machine.
+)
+
+var known = map[string]bool{
+	Start:       true,
+	Cancel:      true,
+	Ack:         true,
+	Finish:      true,
+	Destination: true,
+	User:        true,
+	Menu:        true,
+	MenuNext:    true,
+	MenuPrev:    true,
+	MenuSelect:  true,
+	PageNext:    true,
+	PagePrev:    true,
+	Reboot:      true,
+	Shutdown:    true,
+}
+
+// Handler runs an action. arg is the part after the colon, if any, and
+// from is what triggered it, e.g. the input name.
+type Handler func(arg, from string) error
+
+// Dispatcher runs the actions that inputs are bound to.
+type Dispatcher struct {
+	// Audit trail. If set, every action run is written to it, with
+	// what triggered it and how it went.
+	Audit io.Writer
+
+	mutex    sync.Mutex
+	bindings map[string]string
+	handlers map[string]Handler
+}
+
+// New creates a Dispatcher with no bindings or handlers.
+func New() *Dispatcher {
+	return &Dispatcher{
+		bindings: make(map[string]string),
+		handlers: make(map[string]Handler),
+	}
+}
+
+// split splits an action into name and argument.
+func split(action string) (string, string) {
+	if n := strings.Index(action, ":"); n >= 0 {
+		return action[:n], action[n+1:]
+	}
+	return action, ""
+}
+
+// Bind binds an input to an action, replacing any previous binding.
+// An empty action unbinds the input.
+func (d *Dispatcher) Bind(input, action string) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if action == "" {
+		delete(d.bindings, input)
+		return nil
+	}
+	if err := Check(action); err != nil {
+		return fmt.Errorf("input %q: %v", input, err)
+	}
+	d.bindings[input] = action
+	return nil
+}
+
+// Check returns an error if action is not a known action.
+func Check(action string) error {
+	if name, _ := split(action); !known[name] {
+		return fmt.Errorf("unknown action %q", action)
+	}
+	return nil
+}
+
+// Power returns true if the action reboots or shuts down, which mustn't
+// happen by accident. Such actions can only be bound to deliberate
+// inputs, and need confirming in the LCD menu.
+func Power(action string) bool {
+	name, _ := split(action)
+	return name == Reboot || name == Shutdown
+}
+
+// Deliberate returns true if the input is hard to trigger by accident:
+// a long press or a chord of GPIO buttons. Other sources, like HTTP,
+// can name any input, so are never deliberate.
+func Deliberate(input string) bool {
+	return strings.HasPrefix(input, "gpio:") && (strings.HasSuffix(input, ":long") || strings.HasSuffix(input, ":chord"))
+}
+
+// Handle sets the handler for an action.
+func (d *Dispatcher) Handle(action string, h Handler) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.handlers[action] = h
+}
+
+// Input runs the action bound to the input, if any. Unbound inputs are ignored.
+func (d *Dispatcher) Input(input string) error {
+	return d.InputFrom(input, input)
+}
+
+// InputFrom is like Input, for an input pressed somewhere else, e.g. a
+// button clicked on the web UI. from is passed on to Do.
+func (d *Dispatcher) InputFrom(from, input string) error {
+	d.mutex.Lock()
+	action, ok := d.bindings[input]
+	d.mutex.Unlock()
+	if !ok {
+		return nil
+	}
+	log.Printf("Input %q: %s", from, action)
+	if err := d.Do(from, action); err != nil {
+		log.Printf("Input %q: %v", from, err)
+		return err
+	}
+	return nil
+}
+
+// Do runs an action. from is what triggered it, for the audit trail,
+// e.g. the input name.
+func (d *Dispatcher) Do(from, action string) error {
+	name, arg := split(action)
+	d.mutex.Lock()
+	h := d.handlers[name]
+	d.mutex.Unlock()
+	err := fmt.Errorf("action %q not available", action)
+	if h != nil {
+		err = h(arg, from)
+		if err != nil {
+			err = fmt.Errorf("action %q: %v", action, err)
+		}
+	}
+	d.audit(from, action, err)
+	return err
+}
+
+// audit writes to the audit trail, if any.
+func (d *Dispatcher) audit(from, action string, err error) {
+	if d.Audit == nil {
+		return
+	}
+	res := "ok"
+	if err != nil {
+		res = err.Error()
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if _, err := fmt.Fprintf(d.Audit, "%s %s %s: %s\n", time.Now().Format(time.RFC3339), from, action, res); err != nil {
+		log.Printf("Writing audit trail: %v", err)
+	}
+}
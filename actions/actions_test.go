@@ -0,0 +1,68 @@
+package actions
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDispatcher(t *testing.T) {
+	d := New()
+	var got []string
+	d.Handle(Start, func(arg, from string) error {
+		got = append(got, arg+" from "+from)
+		return nil
+	})
+
+	if err := d.Bind("gpio:5:tap", "start:single"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Bind("lcd:up", "reboot"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Bind("lcd:down", "explode"); err == nil {
+		t.Errorf("Bound unknown action")
+	}
+
+	if err := d.Input("gpio:5:tap"); err != nil {
+		t.Error(err)
+	}
+	if err := d.Input("gpio:6:tap"); err != nil {
+		t.Errorf("Unbound input: %v", err)
+	}
+	if err := d.Input("lcd:up"); err == nil {
+		t.Errorf("Action without handler succeeded")
+	}
+
+	// Rebind and unbind.
+	d.Bind("gpio:5:tap", "start:duplex")
+	d.Input("gpio:5:tap")
+	d.Bind("gpio:5:tap", "")
+	d.Input("gpio:5:tap")
+
+	if len(got) != 2 || got[0] != "single from gpio:5:tap" || got[1] != "duplex from gpio:5:tap" {
+		t.Errorf("Started profiles %q, want single and duplex from gpio:5:tap", got)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	d := New()
+	var audit strings.Builder
+	d.Audit = &audit
+	d.Handle(Ack, func(string, string) error { return nil })
+	d.Bind("lcd:up", Ack)
+	d.Input("lcd:up")
+	d.Do("lcd:menu", Reboot)
+
+	lines := strings.Split(strings.TrimSpace(audit.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Audit trail:\n%s", audit.String())
+	}
+	for n, want := range []string{
+		` lcd:up ack: ok`,
+		` lcd:menu reboot: action "reboot" not available`,
+	} {
+		if !strings.HasSuffix(lines[n], want) {
+			t.Errorf("Audit line %q, want suffix %q", lines[n], want)
+		}
+	}
+}
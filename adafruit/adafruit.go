@@ -2,88 +2,473 @@
 //
 // https://learn.adafruit.com/adafruit-16x2-character-lcd-plus-keypad-for-raspberry-pi/overview
 //
-// 'Select' button scans single-sided.
-// 'Right' button scans double-sided.
-// 'Up' button resets (acks) error message.
+// Keys are reported as inputs "lcd:select", "lcd:up", "lcd:down",
+// "lcd:left" and "lcd:right". By default 'Select' scans single-sided,
+// 'Right' scans double-sided, 'Up' acks an error message, 'Down' pages
+// through long messages, and 'Left' opens the menu. See Menu.
+//
+// See Screen for how events are rendered on the 16x2 characters.
 package adafruit
 
 import (
-	"bufio"
-	"flag"
 	"fmt"
-	"io"
 	"log"
-	"os"
-	"os/exec"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/ThomasHabets/autoscan/backend"
+	"github.com/ThomasHabets/autoscan/i2c"
 )
 
-var (
-	adafruitLCDBinary = flag.String("adafruit_lcd_binary", "/opt/autoscan/bin/lcd.py", "Path to LCD.py binary.")
+// keyPoll is how often to check the keys. The plate doesn't wire the
+// port expander's interrupt pins to the Pi, so they have to be polled.
+const keyPoll = 50 * time.Millisecond
+
+// Width is the number of characters per line.
+const Width = 16
+
+// Color is a backlight colour.
+type Color byte
+
+// Backlight colours.
+const (
+	Off     Color = 0
+	Red     Color = 1 << 0
+	Green   Color = 1 << 1
+	Blue    Color = 1 << 2
+	Magenta Color = Red | Blue
+	White   Color = Red | Green | Blue
 )
 
+func (c Color) String() string {
+	switch c {
+	case Off:
+		return "off"
+	case Red:
+		return "red"
+	case Green:
+		return "green"
+	case Blue:
+		return "blue"
+	case Magenta:
+		return "magenta"
+	case White:
+		return "white"
+	}
+	return fmt.Sprintf("rgb(%d,%d,%d)", c&Red, c&Green>>1, c&Blue>>2)
+}
+
+// Render returns the backlight colour and the two lines to show for
+// an event. Lines may be longer than Width.
+func Render(ev backend.Event) (Color, [2]string) {
+	pages := fmt.Sprintf("%d pages", ev.Pages)
+	if ev.Pages == 1 {
+		pages = "1 page"
+	}
+	switch ev.Kind {
+	case backend.Ready:
+		if ev.AckedBy != "" {
+			return Green, [2]string{"Autoscan ready", fmt.Sprintf("Acked by %s %s", ev.AckedBy, ev.Time.Format("15:04"))}
+		}
+		return Green, [2]string{"Autoscan ready", ""}
+	case backend.JobStarted:
+		switch ev.Profile {
+		case "single":
+			return Blue, [2]string{"Scanning...", "Single sided"}
+		case "duplex":
+			return Blue, [2]string{"Scanning...", "Double sided"}
+		}
+		return Blue, [2]string{"Scanning...", ev.Profile}
+	case backend.JobProgress, backend.JobStage:
+		switch ev.Stage {
+		case backend.CONVERTING:
+			return Blue, [2]string{"Converting...", pages}
+		case backend.UPLOADING:
+			return Blue, [2]string{"Uploading...", pages}
+		}
+		return Blue, [2]string{"Scanning...", pages}
+	case backend.JobFinished:
+		if ev.Spooled {
+			return Magenta, [2]string{"Re-auth needed", "Scan kept locally"}
+		}
+		return Green, [2]string{"Ready", "Uploaded " + pages}
+	case backend.JobFailed:
+		switch ev.ErrKind {
+		case backend.Cancelled:
+			return Green, [2]string{"Ready", "Scan cancelled"}
+		case backend.Jam:
+			return Red, [2]string{"Failed!", "Paper jam"}
+		case backend.NoPaper:
+			return Red, [2]string{"Failed!", "No paper"}
+		case backend.CoverOpen:
+			return Red, [2]string{"Failed!", "Cover open"}
+		case backend.Busy:
+			return Red, [2]string{"Failed!", "Scanner busy"}
+		}
+		if ev.Err != nil {
+			return Red, [2]string{"Failed!", ev.Err.Error()}
+		}
+		return Red, [2]string{"Failed!", string(ev.ErrKind)}
+	case backend.NeedsReauth:
+		return Magenta, [2]string{"Re-auth needed", "Use web setup"}
+	}
+	return Blue, [2]string{ev.String(), ""}
+}
+
+// clean makes a line printable on the display.
+func clean(s string) string {
+	return strings.NewReplacer("|", " ", "\n", " ").Replace(s)
+}
+
+// Inputs is where key presses are sent. Implemented by *actions.Dispatcher.
+type Inputs interface {
+	InputFrom(from, name string) error
+}
+
+// Health is told when the LCD stops and starts working. Implemented by
+// *backend.Backend.
+type Health interface {
+	SetDegraded(what string, err error)
+}
+
+// How long to wait between attempts to re-initialize a broken plate.
+const (
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+)
+
+// menuTimeout is how long the menu stays open without a key press.
+const menuTimeout = 30 * time.Second
+
 // adafruit implements the backend.UI interface.
+//
+// I2C errors, e.g. from a loose cable or the plate losing power, don't
+// stop autoscan. Run() re-initializes the plate with backoff, and shows
+// the latest event again once it works.
 type adafruit struct {
-	b      *backend.Backend
-	cmd    *exec.Cmd
-	stdin  io.Writer
-	stdout io.Reader
+	in     Inputs
+	health Health
+
+	mutex  sync.Mutex
+	plate  *Plate
+	screen *Screen
+	err    error         // Non-nil while the plate is broken.
+	last   backend.Event // Latest event, to go back to from the menu.
+
+	// Nil if there's no menu.
+	menu     *Menu
+	do       func(from, action string) error
+	menuUsed time.Time
 }
 
-// New creates a new adafruit object.
-func New(b *backend.Backend) (*adafruit, error) {
-	cmd := exec.Command(*adafruitLCDBinary)
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return nil, fmt.Errorf("creating stdout pipe: %v", err)
+// nullDisplay is the display of an emulated plate. What's on it is
+// kept by the Screen.
+type nullDisplay struct{}
+
+func (nullDisplay) SetColor(Color) error          { return nil }
+func (nullDisplay) Print(int, string) error       { return nil }
+func (nullDisplay) CreateChar(int, [8]byte) error { return nil }
+
+// New sets up the LCD plate at addr on bus. If the plate doesn't work
+// yet, it's reported to health and retried by Run().
+//
+// If bus is nil the plate is only emulated, with keys pressed by Press(),
+// e.g. for showing it in the web UI without one attached.
+func New(bus i2c.Bus, addr uint16, in Inputs, health Health) *adafruit {
+	if bus == nil {
+		return &adafruit{
+			in:     in,
+			health: health,
+			screen: NewScreen(nullDisplay{}),
+		}
+	}
+	p := newPlate(bus, addr)
+	a := &adafruit{
+		in:     in,
+		health: health,
+		plate:  p,
+		screen: NewScreen(p),
+	}
+	if err := a.plate.Init(); err != nil {
+		log.Printf("LCD not working, will retry: %v", err)
+		a.err = err
 	}
-	stdin, err := cmd.StdinPipe()
+	return a
+}
+
+// SetDim sets how long the backlight stays on when idle. Zero never dims.
+func (a *adafruit) SetDim(d time.Duration) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.screen.Dim = d
+}
+
+// SetMenu adds a menu, with do running the actions in it. from is the
+// key or input that selected the action.
+func (a *adafruit) SetMenu(m *Menu, do func(from, action string) error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.menu = m
+	a.do = do
+}
+
+// draw updates the plate, unless it's broken. Only call under mutex lock.
+func (a *adafruit) draw() {
+	if a.err != nil {
+		return
+	}
+	if err := a.screen.Draw(time.Now()); err != nil {
+		log.Printf("LCD stopped working: %v", err)
+		a.err = err
+	}
+}
+
+// Show implements backend.UI.
+func (a *adafruit) Show(ev backend.Event) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.last = ev
+	if a.menuOpen() {
+		return
+	}
+	a.screen.Show(ev, time.Now())
+	a.draw()
+}
+
+// menuOpen returns true if the menu is open. Only call under mutex lock.
+func (a *adafruit) menuOpen() bool {
+	return a.menu != nil && a.menu.IsOpen()
+}
+
+// updateMenu shows the menu, or the latest event if the menu has been
+// closed. Only call under mutex lock.
+func (a *adafruit) updateMenu() {
+	now := time.Now()
+	a.menuUsed = now
+	if a.menuOpen() {
+		title, text := a.menu.Lines()
+		a.screen.ShowText(White, title, text, now)
+	} else {
+		a.screen.Show(a.last, now)
+	}
+	a.draw()
+}
+
+// OpenMenu opens the menu, or goes back a level if it's open. For the
+// menu action.
+func (a *adafruit) OpenMenu() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.menu == nil {
+		return
+	}
+	if a.menu.IsOpen() {
+		a.menu.Back()
+	} else {
+		a.menu.Open()
+	}
+	a.updateMenu()
+}
+
+// MoveMenu moves delta items in the menu. For the menu-next and
+// menu-prev actions.
+func (a *adafruit) MoveMenu(delta int) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if !a.menuOpen() {
+		return
+	}
+	a.menu.Move(delta)
+	a.updateMenu()
+}
+
+// SelectMenu selects the menu item. For the menu-select action, with the
+// input that triggered it.
+func (a *adafruit) SelectMenu(from string) {
+	action := func() string {
+		a.mutex.Lock()
+		defer a.mutex.Unlock()
+		if !a.menuOpen() {
+			return ""
+		}
+		action := a.menu.Select()
+		a.updateMenu()
+		return action
+	}()
+	if action == "" {
+		return
+	}
+	// Not under lock, since actions call into the backend.
+	err := a.do(from, action)
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
 	if err != nil {
-		return nil, fmt.Errorf("creating stdin pipe: %v", err)
+		log.Printf("Menu: %v", err)
+		a.menu.Failed(err)
+	} else {
+		a.menu.Close()
+	}
+	a.updateMenu()
+}
+
+// menuKey navigates the open menu with a key pressed on src, "lcd" or
+// "web:lcd".
+func (a *adafruit) menuKey(k Key, src string) {
+	switch k {
+	case Up:
+		a.MoveMenu(-1)
+	case Down:
+		a.MoveMenu(1)
+	case Select, Right:
+		a.SelectMenu(src + ":" + k.String())
+	case Left:
+		a.OpenMenu()
+	}
+}
+
+// Lines returns what the display shows, and the backlight colour.
+// Progress bar characters are 1 to 5, see Unicode().
+func (a *adafruit) Lines() (Color, [2]string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.screen.Shown()
+}
+
+// Press presses a key by name, e.g. "select", as if on the plate. It's
+// for the web UI, so the key is reported as from "web:lcd:<key>".
+func (a *adafruit) Press(name string) error {
+	for k := Select; k <= Left; k++ {
+		if k.String() == name {
+			func() {
+				a.mutex.Lock()
+				defer a.mutex.Unlock()
+				a.screen.Wake(time.Now())
+				a.draw()
+			}()
+			a.press(k, "web:lcd")
+			return nil
+		}
 	}
-	cmd.Stderr = os.Stderr
-	if err := cmd.Start(); err != nil {
-		return nil, fmt.Errorf("starting lcd binary %q: %v", *adafruitLCDBinary, err)
+	return fmt.Errorf("no such LCD key %q", name)
+}
+
+// press navigates the menu if it's open, or reports the key as an input.
+// src is where it was pressed, "lcd" or "web:lcd".
+func (a *adafruit) press(k Key, src string) {
+	open := func() bool {
+		a.mutex.Lock()
+		defer a.mutex.Unlock()
+		return a.menuOpen()
+	}()
+	if open {
+		a.menuKey(k, src)
+		return
 	}
-	return &adafruit{
-		b:      b,
-		cmd:    cmd,
-		stdin:  stdin,
-		stdout: stdout,
-	}, nil
+	// Errors are logged by the dispatcher.
+	a.in.InputFrom(src+":"+k.String(), "lcd:"+k.String())
+}
+
+// Page moves delta pages through a long message. For the page-next and
+// page-prev actions.
+func (a *adafruit) Page(delta int) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.screen.Page(delta, time.Now())
+	a.draw()
 }
 
-func (a *adafruit) Msg(status, msg string) {
-	colors := "1|0|0"
-	switch status {
-	case "FAILED":
-		colors = "1|0|0"
-	case "IDLE":
-		colors = "0|1|0"
-	case "ACTIVE":
-		colors = "0|0|1"
+// reinit tries to get a broken plate working again, showing what it
+// showed before.
+func (a *adafruit) reinit() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if err := a.plate.Init(); err != nil {
+		a.err = err
+		return err
 	}
-	fmt.Fprintf(a.stdin, "%s|%s\n", colors, msg)
+	a.screen.Invalidate()
+	if err := a.screen.Draw(time.Now()); err != nil {
+		a.err = err
+		return err
+	}
+	a.err = nil
+	log.Printf("LCD working again")
+	return nil
 }
 
+// Run implements backend.UI, reporting key presses as inputs, animating
+// the screen, and re-initializing the plate when broken. Forever.
 func (a *adafruit) Run() {
+	var last byte
+	var reported error
+	backoff := minBackoff
+	tick := time.Now()
 	for {
-		reader := bufio.NewReader(a.stdout)
-		l, err := reader.ReadString('\n')
+		err := func() error {
+			a.mutex.Lock()
+			defer a.mutex.Unlock()
+			return a.err
+		}()
+		// Report changes here, since Show() may be called with the
+		// backend mutex held.
+		if (err == nil) != (reported == nil) {
+			a.health.SetDegraded("lcd", err)
+			reported = err
+		}
+		if err != nil {
+			time.Sleep(backoff)
+			if err := a.reinit(); err != nil {
+				backoff *= 2
+				if backoff > maxBackoff {
+					backoff = maxBackoff
+				}
+				continue
+			}
+			backoff = minBackoff
+			// Keys held during re-init aren't presses.
+			last = keyMask
+			continue
+		}
+
+		time.Sleep(keyPoll)
+		keys, err := func() (byte, error) {
+			a.mutex.Lock()
+			defer a.mutex.Unlock()
+			now := time.Now()
+			if now.Sub(tick) >= ScrollStep {
+				tick = now
+				a.screen.Tick()
+			}
+			if a.menuOpen() && now.Sub(a.menuUsed) >= menuTimeout {
+				a.menu.Close()
+				a.updateMenu()
+			}
+			if a.plate == nil {
+				a.draw()
+				return 0, nil
+			}
+			keys, err := a.plate.Keys()
+			if err != nil {
+				log.Printf("LCD stopped working: %v", err)
+				a.err = err
+				return 0, err
+			}
+			if keys&^last != 0 {
+				a.screen.Wake(now)
+			}
+			a.draw()
+			return keys, nil
+		}()
 		if err != nil {
-			log.Fatalf("Reading from LCD process: %v", err)
+			continue
 		}
-		l = strings.Trim(l, "\n ")
-		switch l {
-		case "SELECT":
-			a.b.Run(false)
-		case "RIGHT":
-			a.b.Run(true)
-		case "UP":
-			// Clear error message.
-			a.Msg("IDLE", "Autoscan ready|")
+		pressed := keys &^ last
+		last = keys
+		for k := Select; k <= Left; k++ {
+			if pressed&(1<<uint(k)) != 0 {
+				a.press(k, "lcd")
+			}
 		}
 	}
 }
@@ -0,0 +1,250 @@
+package adafruit
+
+// The LCD menu. While it's open the keys navigate it instead of doing
+// what they're bound to: Up and Down move, Select and Right select,
+// and Left goes back.
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/ThomasHabets/autoscan/actions"
+	"github.com/ThomasHabets/autoscan/backend"
+	"github.com/ThomasHabets/autoscan/config"
+)
+
+// Status is what the menu can show. Implemented by *backend.Backend.
+type Status interface {
+	Status() (backend.State, error)
+	LastResult() *backend.Result
+	Spooled() int
+}
+
+// What menu items can show.
+const (
+	ShowLastResult = "last-result" // How the last scan went.
+	ShowSpooled    = "spooled"     // Scans waiting to be uploaded.
+	ShowHostname   = "hostname"
+	ShowIP         = "ip" // IP addresses, except loopback.
+)
+
+// DefaultMenu is the menu if the station config doesn't have one.
+var DefaultMenu = []config.MenuItem{
+	{Label: "Scan single", Action: actions.Start + ":single"},
+	{Label: "Scan duplex", Action: actions.Start + ":duplex"},
+	{Label: "Last scan", Show: ShowLastResult},
+	{Label: "Uploads waiting", Show: ShowSpooled},
+	{Label: "Network", Items: []config.MenuItem{
+		{Label: "Hostname", Show: ShowHostname},
+		{Label: "IP address", Show: ShowIP},
+	}},
+	{Label: "Maintenance", Items: []config.MenuItem{
+		{Label: "Reboot", Action: actions.Reboot, Confirm: true},
+		{Label: "Shut down", Action: actions.Shutdown, Confirm: true},
+	}},
+}
+
+// checkMenu returns an error if any menu item is invalid.
+func checkMenu(items []config.MenuItem) error {
+	if len(items) == 0 {
+		return fmt.Errorf("empty menu")
+	}
+	for _, it := range items {
+		n := 0
+		if it.Action != "" {
+			n++
+			if err := actions.Check(it.Action); err != nil {
+				return fmt.Errorf("menu item %q: %v", it.Label, err)
+			}
+		}
+		if it.Show != "" {
+			n++
+			switch it.Show {
+			case ShowLastResult, ShowSpooled, ShowHostname, ShowIP:
+			default:
+				return fmt.Errorf("menu item %q: can't show %q", it.Label, it.Show)
+			}
+		}
+		if it.Confirm && it.Action == "" {
+			return fmt.Errorf("menu item %q: only actions can be confirmed", it.Label)
+		}
+		if actions.Power(it.Action) && !it.Confirm {
+			return fmt.Errorf("menu item %q: %q must be confirmed", it.Label, it.Action)
+		}
+		if it.Items != nil {
+			n++
+			if err := checkMenu(it.Items); err != nil {
+				return fmt.Errorf("menu item %q: %v", it.Label, err)
+			}
+		}
+		if n != 1 {
+			return fmt.Errorf("menu item %q: must have exactly one of action, show and items", it.Label)
+		}
+	}
+	return nil
+}
+
+// menuLevel is an open menu or submenu.
+type menuLevel struct {
+	title  string
+	items  []config.MenuItem
+	cursor int
+}
+
+// Menu is a tree of menu items. Not thread safe.
+type Menu struct {
+	status Status
+	root   []config.MenuItem
+	levels []menuLevel // Empty when closed.
+
+	// Non-empty when showing information, or why an action failed.
+	infoTitle, info string
+
+	// Action waiting to be confirmed by selecting again.
+	confirm *config.MenuItem
+}
+
+// NewMenu creates a closed menu.
+func NewMenu(items []config.MenuItem, status Status) (*Menu, error) {
+	if err := checkMenu(items); err != nil {
+		return nil, err
+	}
+	return &Menu{
+		status: status,
+		root:   items,
+	}, nil
+}
+
+// IsOpen returns true if the menu is open.
+func (m *Menu) IsOpen() bool {
+	return len(m.levels) > 0
+}
+
+// Open opens the menu at the top.
+func (m *Menu) Open() {
+	m.levels = []menuLevel{{title: "Menu", items: m.root}}
+	m.info = ""
+	m.confirm = nil
+}
+
+// Close closes the menu.
+func (m *Menu) Close() {
+	m.levels = nil
+	m.info = ""
+	m.confirm = nil
+}
+
+// Back goes back a level, closing the menu from the top.
+func (m *Menu) Back() {
+	if m.info != "" || m.confirm != nil {
+		m.info = ""
+		m.confirm = nil
+		return
+	}
+	if len(m.levels) > 0 {
+		m.levels = m.levels[:len(m.levels)-1]
+	}
+}
+
+// Move moves delta items, wrapping around.
+func (m *Menu) Move(delta int) {
+	if !m.IsOpen() || m.info != "" || m.confirm != nil {
+		return
+	}
+	l := &m.levels[len(m.levels)-1]
+	n := len(l.items)
+	l.cursor = ((l.cursor+delta)%n + n) % n
+}
+
+// Select opens a submenu or shows information, or returns the action
+// to run. The caller should then Close() the menu, or show why the
+// action failed with Failed(). Actions that need confirmation are
+// returned when selected a second time.
+func (m *Menu) Select() string {
+	if m.confirm != nil {
+		action := m.confirm.Action
+		m.confirm = nil
+		return action
+	}
+	if !m.IsOpen() || m.info != "" {
+		return ""
+	}
+	l := m.levels[len(m.levels)-1]
+	it := l.items[l.cursor]
+	switch {
+	case it.Confirm:
+		m.confirm = &l.items[l.cursor]
+	case it.Items != nil:
+		m.levels = append(m.levels, menuLevel{title: it.Label, items: it.Items})
+	case it.Show != "":
+		m.infoTitle, m.info = it.Label, m.show(it.Show)
+	default:
+		return it.Action
+	}
+	return ""
+}
+
+// Failed shows why the selected action failed.
+func (m *Menu) Failed(err error) {
+	m.infoTitle, m.info = "Failed!", err.Error()
+}
+
+// Lines returns what to show on the two lines.
+func (m *Menu) Lines() (string, string) {
+	if m.info != "" {
+		return m.infoTitle, m.info
+	}
+	if m.confirm != nil {
+		return m.confirm.Label + "?", "Select: yes"
+	}
+	if !m.IsOpen() {
+		return "", ""
+	}
+	l := m.levels[len(m.levels)-1]
+	pos := fmt.Sprintf("%d/%d", l.cursor+1, len(l.items))
+	title := l.title
+	if w := Width - len(pos) - 1; len(title) > w {
+		title = title[:w]
+	}
+	return fmt.Sprintf("%-*s %s", Width-len(pos)-1, title, pos), ">" + l.items[l.cursor].Label
+}
+
+// show returns the information to show.
+func (m *Menu) show(what string) string {
+	switch what {
+	case ShowLastResult:
+		if _, err := m.status.Status(); err != nil {
+			return "Failed: " + err.Error()
+		}
+		if res := m.status.LastResult(); res != nil {
+			return res.Title
+		}
+		return "No scans yet"
+	case ShowSpooled:
+		return fmt.Sprintf("%d scans", m.status.Spooled())
+	case ShowHostname:
+		h, err := os.Hostname()
+		if err != nil {
+			return err.Error()
+		}
+		return h
+	case ShowIP:
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return err.Error()
+		}
+		var ret []string
+		for _, a := range addrs {
+			if ip, ok := a.(*net.IPNet); ok && !ip.IP.IsLoopback() {
+				ret = append(ret, ip.IP.String())
+			}
+		}
+		if len(ret) == 0 {
+			return "No network"
+		}
+		return strings.Join(ret, " ")
+	}
+	return what
+}
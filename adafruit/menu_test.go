@@ -0,0 +1,152 @@
+package adafruit
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ThomasHabets/autoscan/backend"
+	"github.com/ThomasHabets/autoscan/config"
+	"github.com/ThomasHabets/autoscan/i2c"
+)
+
+type fakeStatus struct{}
+
+func (fakeStatus) Status() (backend.State, error) { return backend.IDLE, nil }
+func (fakeStatus) Spooled() int                   { return 2 }
+func (fakeStatus) LastResult() *backend.Result {
+	return &backend.Result{Title: "Scan 2026-10-18.pdf"}
+}
+
+func TestCheckMenu(t *testing.T) {
+	for _, items := range [][]config.MenuItem{
+		nil,
+		{{Label: "Nothing"}},
+		{{Label: "Explode", Action: "explode"}},
+		{{Label: "Secrets", Show: "password"}},
+		{{Label: "Both", Action: "ack", Show: "ip"}},
+		{{Label: "Empty", Items: []config.MenuItem{}}},
+		{{Label: "Sure?", Show: "ip", Confirm: true}},
+		{{Label: "Off", Action: "shutdown"}},
+		{{Label: "Restart", Items: []config.MenuItem{{Label: "Now", Action: "reboot:force"}}}},
+	} {
+		if _, err := NewMenu(items, fakeStatus{}); err == nil {
+			t.Errorf("Menu %+v accepted", items)
+		}
+	}
+	if _, err := NewMenu(DefaultMenu, fakeStatus{}); err != nil {
+		t.Errorf("Default menu: %v", err)
+	}
+}
+
+func TestMenu(t *testing.T) {
+	m, err := NewMenu(DefaultMenu, fakeStatus{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := func() string {
+		l1, l2 := m.Lines()
+		return l1 + "|" + l2
+	}
+	m.Open()
+	if got, want := lines(), "Menu         1/6|>Scan single"; got != want {
+		t.Errorf("Opened menu shows %q, want %q", got, want)
+	}
+	m.Move(-2)
+	m.Select()
+	if got, want := lines(), "Network      1/2|>Hostname"; got != want {
+		t.Errorf("Submenu shows %q, want %q", got, want)
+	}
+	m.Back()
+	m.Move(-2)
+	m.Select()
+	if got, want := lines(), "Last scan|Scan 2026-10-18.pdf"; got != want {
+		t.Errorf("Info shows %q, want %q", got, want)
+	}
+	m.Back()
+	m.Move(-2)
+	if got := m.Select(); got != "start:single" {
+		t.Errorf("Selected %q, want start:single", got)
+	}
+	m.Failed(errors.New("no such profile"))
+	if got, want := lines(), "Failed!|no such profile"; got != want {
+		t.Errorf("Failure shows %q, want %q", got, want)
+	}
+	m.Back()
+	m.Back()
+	if m.IsOpen() {
+		t.Errorf("Menu still open after going back from the top")
+	}
+
+	// Reboot needs confirmation.
+	m.Open()
+	m.Move(-1)
+	m.Select()
+	if got := m.Select(); got != "" {
+		t.Errorf("Selected %q without confirmation", got)
+	}
+	if got, want := lines(), "Reboot?|Select: yes"; got != want {
+		t.Errorf("Confirmation shows %q, want %q", got, want)
+	}
+	m.Back()
+	m.Select()
+	if got := m.Select(); got != "reboot" {
+		t.Errorf("Confirmed %q, want reboot", got)
+	}
+}
+
+func TestMenuKeys(t *testing.T) {
+	bus := i2c.NewFake()
+	fp := &fakePlate{}
+	bus.Add(Addr, fp)
+	in := &fakeInputs{inputs: make(chan string, 10)}
+	a := New(bus, Addr, in, &fakeHealth{reports: make(chan string, 10)})
+	m, err := NewMenu([]config.MenuItem{
+		{Label: "Uploads", Show: ShowSpooled},
+		{Label: "Ack", Action: "ack"},
+	}, fakeStatus{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan string, 10)
+	a.SetMenu(m, func(from, action string) error {
+		done <- from + " " + action
+		return nil
+	})
+	go a.Run()
+	a.Show(backend.Event{Kind: backend.Ready})
+
+	// Keys go to the dispatcher until the menu is opened.
+	press := func(k Key) {
+		t.Helper()
+		fp.press(1 << k)
+		time.Sleep(5 * keyPoll)
+		fp.press(0)
+		time.Sleep(5 * keyPoll)
+	}
+	press(Down)
+	if got := <-in.inputs; got != "lcd:down" {
+		t.Errorf("Got input %q, want lcd:down", got)
+	}
+	a.OpenMenu()
+	press(Select)
+	if _, l1, l2 := fp.lines(); l1 != "Uploads" || l2 != "2 scans" {
+		t.Errorf("LCD shows %q / %q", l1, l2)
+	}
+	press(Left)
+	press(Down)
+	press(Right)
+	if got := <-done; got != "lcd:right ack" {
+		t.Errorf("Menu ran %q, want ack from lcd:right", got)
+	}
+	// Closed, showing the latest event.
+	if _, l1, _ := fp.lines(); !strings.HasPrefix(l1, "Autoscan ready") {
+		t.Errorf("LCD shows %q after the menu", l1)
+	}
+	select {
+	case got := <-in.inputs:
+		t.Errorf("Menu key sent input %q", got)
+	default:
+	}
+}
@@ -0,0 +1,250 @@
+package adafruit
+
+// Driver for the Adafruit RGB 16x2 LCD plate: an HD44780 LCD in 4-bit
+// mode, an RGB backlight and five keys, all on an MCP23017 port
+// expander on I2C.
+//
+// MCP23017 pins, port A:
+//   0-4  Keys select, right, down, up, left. Active low.
+//   6-7  Backlight red, green. Active low.
+// Port B:
+//   0    Backlight blue. Active low.
+//   1-4  LCD D7, D6, D5, D4.
+//   5-7  LCD E, RW, RS.
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ThomasHabets/autoscan/i2c"
+)
+
+// Addr is the default I2C address of the plate.
+const Addr = 0x20
+
+// MCP23017 registers, with IOCON.BANK=0.
+const (
+	regIODIRA = 0x00
+	regIODIRB = 0x01
+	regGPPUA  = 0x0C
+	regGPIOA  = 0x12
+	regOLATA  = 0x14
+	regOLATB  = 0x15
+)
+
+// Port A bits.
+const (
+	keyMask   = 0x1F
+	lightRed  = 1 << 6
+	lightGrn  = 1 << 7
+	lightBlue = 1 << 0 // Port B.
+)
+
+// Port B LCD bits.
+const (
+	lcdE  = 1 << 5
+	lcdRS = 1 << 7
+)
+
+// HD44780 commands.
+const (
+	cmdClear       = 0x01
+	cmdEntryMode   = 0x06 // Increment, no shift.
+	cmdDisplayOn   = 0x0C // Display on, cursor and blink off.
+	cmdFunctionSet = 0x28 // 4-bit, 2 lines, 5x8 font.
+	cmdSetCGRAM    = 0x40
+	cmdSetDDRAM    = 0x80
+)
+
+// Key is a key on the plate.
+type Key int
+
+// Keys, in port A bit order.
+const (
+	Select Key = iota
+	Right
+	Down
+	Up
+	Left
+)
+
+func (k Key) String() string {
+	switch k {
+	case Select:
+		return "select"
+	case Right:
+		return "right"
+	case Down:
+		return "down"
+	case Up:
+		return "up"
+	case Left:
+		return "left"
+	}
+	return "unknown"
+}
+
+// Plate is an Adafruit RGB 16x2 LCD plate.
+type Plate struct {
+	bus  i2c.Bus
+	addr uint16
+
+	// Output latch shadows, so that the backlight and LCD don't
+	// clobber each other.
+	portA, portB byte
+}
+
+// NewPlate initializes the plate at addr on bus.
+func NewPlate(bus i2c.Bus, addr uint16) (*Plate, error) {
+	p := newPlate(bus, addr)
+	if err := p.Init(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// newPlate returns a plate that's not yet initialized.
+func newPlate(bus i2c.Bus, addr uint16) *Plate {
+	return &Plate{
+		bus:  bus,
+		addr: addr,
+		// Backlight off.
+		portA: lightRed | lightGrn,
+		portB: lightBlue,
+	}
+}
+
+func (p *Plate) write(reg, v byte) error {
+	if err := p.bus.Tx(p.addr, []byte{reg, v}, nil); err != nil {
+		return fmt.Errorf("LCD plate: %v", err)
+	}
+	return nil
+}
+
+// Init sets up the port expander and the LCD. Also used to recover
+// after the plate has lost power.
+func (p *Plate) Init() error {
+	for _, rv := range [][2]byte{
+		{regIODIRA, keyMask},
+		{regIODIRB, 0},
+		{regGPPUA, keyMask},
+		{regOLATA, p.portA},
+		{regOLATB, p.portB},
+	} {
+		if err := p.write(rv[0], rv[1]); err != nil {
+			return err
+		}
+	}
+	// Into 4-bit mode, whatever mode it was in before.
+	for _, n := range []byte{3, 3, 3, 2} {
+		if err := p.nibble(n, false); err != nil {
+			return err
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	for _, c := range []byte{cmdFunctionSet, cmdDisplayOn, cmdEntryMode} {
+		if err := p.command(c); err != nil {
+			return err
+		}
+	}
+	return p.Clear()
+}
+
+// nibble writes four bits to the LCD, and pulses E to latch them.
+func (p *Plate) nibble(n byte, rs bool) error {
+	// D4-D7 are wired in reverse order, on bits 4-1.
+	v := p.portB & lightBlue
+	for i := uint(0); i < 4; i++ {
+		if n&(1<<i) != 0 {
+			v |= 1 << (4 - i)
+		}
+	}
+	if rs {
+		v |= lcdRS
+	}
+	if err := p.write(regOLATB, v|lcdE); err != nil {
+		return err
+	}
+	if err := p.write(regOLATB, v); err != nil {
+		return err
+	}
+	p.portB = v
+	return nil
+}
+
+func (p *Plate) send(b byte, rs bool) error {
+	if err := p.nibble(b>>4, rs); err != nil {
+		return err
+	}
+	return p.nibble(b&0xF, rs)
+}
+
+func (p *Plate) command(c byte) error {
+	return p.send(c, false)
+}
+
+// Clear clears the display.
+func (p *Plate) Clear() error {
+	if err := p.command(cmdClear); err != nil {
+		return err
+	}
+	// Clear is slow.
+	time.Sleep(2 * time.Millisecond)
+	return nil
+}
+
+// Print writes s at the start of line 0 or 1. Characters are bytes in
+// the LCD's character set, which is ASCII for the printable range.
+func (p *Plate) Print(line int, s string) error {
+	if err := p.command(cmdSetDDRAM | byte(line*0x40)); err != nil {
+		return err
+	}
+	for i := 0; i < len(s); i++ {
+		if err := p.send(s[i], true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetColor sets the backlight colour.
+func (p *Plate) SetColor(c Color) error {
+	p.portA |= lightRed | lightGrn
+	if c&Red != 0 {
+		p.portA &^= lightRed
+	}
+	if c&Green != 0 {
+		p.portA &^= lightGrn
+	}
+	if err := p.write(regOLATA, p.portA); err != nil {
+		return err
+	}
+	p.portB |= lightBlue
+	if c&Blue != 0 {
+		p.portB &^= lightBlue
+	}
+	return p.write(regOLATB, p.portB)
+}
+
+// CreateChar defines custom character n (0-7) from eight rows of five
+// pixels. Use it by printing byte n.
+func (p *Plate) CreateChar(n int, rows [8]byte) error {
+	if err := p.command(cmdSetCGRAM | byte(n&7)<<3); err != nil {
+		return err
+	}
+	for _, r := range rows {
+		if err := p.send(r&0x1F, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Keys returns the keys that are held down, as a bitmask of 1<<Key.
+func (p *Plate) Keys() (byte, error) {
+	r := make([]byte, 1)
+	if err := p.bus.Tx(p.addr, []byte{regGPIOA}, r); err != nil {
+		return 0, fmt.Errorf("LCD plate: %v", err)
+	}
+	return ^r[0] & keyMask, nil
+}
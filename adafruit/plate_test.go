@@ -0,0 +1,276 @@
+package adafruit
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ThomasHabets/autoscan/backend"
+	"github.com/ThomasHabets/autoscan/i2c"
+)
+
+// fakePlate emulates the MCP23017 and the HD44780 wired to it.
+type fakePlate struct {
+	mutex sync.Mutex
+	regs  [0x16]byte
+	keys  byte // Held down, as 1<<Key.
+
+	// HD44780.
+	fourBit bool
+	half    bool // Have the high nibble of a 4-bit transfer.
+	high    byte
+	cgram   bool
+	addr    int
+	ddram   [0x80]byte
+	chars   [64]byte
+}
+
+// Tx implements i2c.Device. The first byte written is the register,
+// and the rest are written to it and the following registers.
+func (f *fakePlate) Tx(w, r []byte) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if len(w) == 0 {
+		return fmt.Errorf("no register")
+	}
+	reg := int(w[0])
+	for _, v := range w[1:] {
+		if reg == regOLATB {
+			f.portB(f.regs[reg], v)
+		}
+		f.regs[reg] = v
+		reg++
+	}
+	for n := range r {
+		v := f.regs[reg]
+		if reg == regGPIOA {
+			v = f.regs[regOLATA]&^f.regs[regIODIRA] | ^f.keys&keyMask
+		}
+		r[n] = v
+		reg++
+	}
+	return nil
+}
+
+// portB handles writes to the LCD, which latches data when E falls.
+func (f *fakePlate) portB(old, v byte) {
+	if old&lcdE == 0 || v&lcdE != 0 {
+		return
+	}
+	var n byte
+	for i := uint(0); i < 4; i++ {
+		if v&(1<<(4-i)) != 0 {
+			n |= 1 << i
+		}
+	}
+	rs := v&lcdRS != 0
+	if !f.fourBit {
+		// 8-bit mode, only the high nibble is wired.
+		f.lcd(n<<4, rs)
+		return
+	}
+	if !f.half {
+		f.high, f.half = n, true
+		return
+	}
+	f.half = false
+	f.lcd(f.high<<4|n, rs)
+}
+
+func (f *fakePlate) lcd(b byte, rs bool) {
+	switch {
+	case rs && f.cgram:
+		f.chars[f.addr&63] = b
+		f.addr++
+	case rs:
+		f.ddram[f.addr&0x7F] = b
+		f.addr++
+	case b&0x80 != 0:
+		f.cgram, f.addr = false, int(b&0x7F)
+	case b&0x40 != 0:
+		f.cgram, f.addr = true, int(b&0x3F)
+	case b&0x20 != 0:
+		f.fourBit = b&0x10 == 0
+	case b == cmdClear:
+		for n := range f.ddram {
+			f.ddram[n] = ' '
+		}
+		f.cgram, f.addr = false, 0
+	}
+}
+
+func (f *fakePlate) lines() (Color, string, string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	c := Off
+	if f.regs[regOLATA]&lightRed == 0 {
+		c |= Red
+	}
+	if f.regs[regOLATA]&lightGrn == 0 {
+		c |= Green
+	}
+	if f.regs[regOLATB]&lightBlue == 0 {
+		c |= Blue
+	}
+	return c, strings.TrimRight(string(f.ddram[0:16]), " "), strings.TrimRight(string(f.ddram[0x40:0x50]), " ")
+}
+
+func (f *fakePlate) press(keys byte) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.keys = keys
+}
+
+type fakeInputs struct {
+	inputs chan string
+}
+
+func (f *fakeInputs) InputFrom(from, name string) error {
+	f.inputs <- from
+	return nil
+}
+
+// fakeHealth sends degraded reports on a channel, "" for working.
+type fakeHealth struct {
+	reports chan string
+}
+
+func (f *fakeHealth) SetDegraded(what string, err error) {
+	if err == nil {
+		f.reports <- ""
+		return
+	}
+	f.reports <- what + ": " + err.Error()
+}
+
+func waitReport(t *testing.T, h *fakeHealth, want string) {
+	t.Helper()
+	select {
+	case got := <-h.reports:
+		if got != want {
+			t.Fatalf("Health report %q, want %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for health report %q", want)
+	}
+}
+
+func TestPlate(t *testing.T) {
+	bus := i2c.NewFake()
+	fp := &fakePlate{}
+	bus.Add(Addr, fp)
+	p, err := NewPlate(bus, Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fp.fourBit {
+		t.Fatalf("LCD not in 4-bit mode after init")
+	}
+	if err := p.SetColor(Magenta); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Print(0, "Hello"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Print(1, "world"); err != nil {
+		t.Fatal(err)
+	}
+	if c, l1, l2 := fp.lines(); c != Magenta || l1 != "Hello" || l2 != "world" {
+		t.Errorf("Plate shows %v %q / %q", c, l1, l2)
+	}
+	if err := p.CreateChar(1, [8]byte{1, 2, 3, 4, 5, 6, 7, 8}); err != nil {
+		t.Fatal(err)
+	}
+	if got := fp.chars[8:16]; string(got) != "\x01\x02\x03\x04\x05\x06\x07\x08" {
+		t.Errorf("Custom char = %v", got)
+	}
+
+	fp.press(1<<Up | 1<<Select)
+	if keys, err := p.Keys(); err != nil || keys != 1<<Up|1<<Select {
+		t.Errorf("Keys() = %b, %v", keys, err)
+	}
+
+	bus.SetError(fmt.Errorf("unplugged"))
+	if err := p.Print(0, "Hello"); err == nil {
+		t.Errorf("Print() succeeded on broken bus")
+	}
+}
+
+func TestUI(t *testing.T) {
+	bus := i2c.NewFake()
+	fp := &fakePlate{}
+	bus.Add(Addr, fp)
+	in := &fakeInputs{inputs: make(chan string, 10)}
+	a := New(bus, Addr, in, &fakeHealth{reports: make(chan string, 10)})
+	go a.Run()
+
+	a.Show(backend.Event{Kind: backend.JobFailed, ErrKind: backend.Jam})
+	if c, l1, l2 := fp.lines(); c != Red || l1 != "Failed!" || l2 != "Paper jam" {
+		t.Errorf("LCD shows %v %q / %q", c, l1, l2)
+	}
+	// Shorter text overwrites it all.
+	a.Show(backend.Event{Kind: backend.Ready})
+	if c, l1, l2 := fp.lines(); c != Green || l1 != "Autoscan ready" || l2 != "" {
+		t.Errorf("LCD shows %v %q / %q", c, l1, l2)
+	}
+
+	// Held key is one input.
+	fp.press(1 << Right)
+	select {
+	case got := <-in.inputs:
+		if got != "lcd:right" {
+			t.Errorf("Got input %q, want lcd:right", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for key press")
+	}
+	select {
+	case got := <-in.inputs:
+		t.Errorf("Got repeated input %q", got)
+	case <-time.After(5 * keyPoll):
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	bus := i2c.NewFake()
+	fp := &fakePlate{}
+	bus.Add(Addr, fp)
+	bus.SetError(fmt.Errorf("unplugged"))
+	h := &fakeHealth{reports: make(chan string, 10)}
+	a := New(bus, Addr, &fakeInputs{inputs: make(chan string, 10)}, h)
+	go a.Run()
+	waitReport(t, h, "lcd: LCD plate: unplugged")
+
+	// Shown when the plate works again.
+	a.Show(backend.Event{Kind: backend.NeedsReauth})
+	bus.SetError(nil)
+	waitReport(t, h, "")
+	if c, l1, l2 := fp.lines(); c != Magenta || l1 != "Re-auth needed" || l2 != "Use web setup" {
+		t.Errorf("LCD shows %v %q / %q", c, l1, l2)
+	}
+
+	// Breaks while running.
+	bus.SetError(fmt.Errorf("power lost"))
+	waitReport(t, h, "lcd: LCD plate: power lost")
+}
+
+func TestEmulated(t *testing.T) {
+	in := &fakeInputs{inputs: make(chan string, 10)}
+	a := New(nil, Addr, in, nil)
+	go a.Run()
+	a.Show(backend.Event{Kind: backend.Ready})
+	if c, lines := a.Lines(); c != Green || lines[0] != "Autoscan ready" {
+		t.Errorf("Shows %s %q", c, lines)
+	}
+	if err := a.Press("up"); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-in.inputs; got != "web:lcd:up" {
+		t.Errorf("Got input %q, want web:lcd:up", got)
+	}
+	if err := a.Press("middle"); err == nil {
+		t.Errorf("Pressed nonexistent key")
+	}
+}
@@ -0,0 +1,310 @@
+package adafruit
+
+// Rendering events on the 16x2 display. Lines that don't fit are
+// marquee-scrolled, long errors are split into pages, running jobs
+// get a progress bar, and the backlight turns off when idle.
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ThomasHabets/autoscan/backend"
+)
+
+// Display is a 16x2 character display with custom characters.
+// Implemented by *Plate.
+type Display interface {
+	SetColor(c Color) error
+	Print(line int, s string) error
+	CreateChar(n int, rows [8]byte) error
+}
+
+const (
+	// ScrollStep is how often to Tick() the screen. Marquees move one
+	// character per step, and pause for scrollPause steps at each end.
+	ScrollStep  = 300 * time.Millisecond
+	scrollPause = 5
+
+	// DefaultDim is how long the backlight stays on when idle.
+	DefaultDim = 5 * time.Minute
+)
+
+// Progress bar characters 1-5 have that many of the five pixel columns
+// lit. Character 0 is not used, since it's easy to mistake for a string
+// terminator.
+func barGlyph(n int) [8]byte {
+	var rows [8]byte
+	for i := range rows {
+		rows[i] = 0x1F &^ (0x1F >> uint(n))
+	}
+	return rows
+}
+
+// Unicode returns a line from the display with the progress bar
+// characters as Unicode blocks, for showing it somewhere else.
+func Unicode(s string) string {
+	blocks := []rune(" ▏▍▌▊█")
+	var ret strings.Builder
+	for _, c := range []byte(s) {
+		if int(c) < len(blocks) {
+			ret.WriteRune(blocks[c])
+		} else {
+			ret.WriteByte(c)
+		}
+	}
+	return ret.String()
+}
+
+// bar returns a progress bar w characters wide, for f from 0 to 1.
+func bar(w int, f float64) string {
+	px := int(f*float64(w*5) + 0.5)
+	b := make([]byte, w)
+	for i := range b {
+		n := px - i*5
+		switch {
+		case n <= 0:
+			b[i] = ' '
+		case n >= 5:
+			b[i] = 5
+		default:
+			b[i] = byte(n)
+		}
+	}
+	return string(b)
+}
+
+// busyBar returns a bar w characters wide with a block bouncing back
+// and forth, for when progress isn't known.
+func busyBar(w, step int) string {
+	b := []byte(strings.Repeat(" ", w))
+	if w < 2 {
+		return string(b)
+	}
+	p := step % (2 * (w - 1))
+	if p >= w {
+		p = 2*(w-1) - p
+	}
+	b[p] = 5
+	return string(b)
+}
+
+// marquee returns the part of s to show at step, if it's longer than Width.
+func marquee(s string, step int) string {
+	over := len(s) - Width
+	if over <= 0 {
+		return s
+	}
+	p := step%(over+2*scrollPause) - scrollPause
+	if p < 0 {
+		p = 0
+	}
+	if p > over {
+		p = over
+	}
+	return s[p : p+Width]
+}
+
+// wrap splits s into lines of at most w characters, at spaces if possible.
+func wrap(s string, w int) []string {
+	var ret []string
+	line := ""
+	for _, word := range strings.Fields(s) {
+		for len(word) > w {
+			if line != "" {
+				ret = append(ret, line)
+				line = ""
+			}
+			ret = append(ret, word[:w])
+			word = word[w:]
+		}
+		switch {
+		case line == "":
+			line = word
+		case len(line)+1+len(word) <= w:
+			line += " " + word
+		default:
+			ret = append(ret, line)
+			line = word
+		}
+	}
+	if line != "" || len(ret) == 0 {
+		ret = append(ret, line)
+	}
+	return ret
+}
+
+// content is what to show for an event.
+type content struct {
+	color Color
+	title string
+	pages []string // Second line, one per page.
+
+	// If bar is set, the second line ends with a progress bar. fraction
+	// is from 0 to 1, or negative if not known.
+	bar      bool
+	fraction float64
+}
+
+// layout returns how to show an event.
+func layout(ev backend.Event) content {
+	c, lines := Render(ev)
+	ret := content{
+		color: c,
+		title: clean(lines[0]),
+		pages: []string{clean(lines[1])},
+	}
+	switch ev.Kind {
+	case backend.JobProgress, backend.JobStage:
+		ret.bar = true
+		ret.fraction = -1
+		if ev.Size > 0 {
+			ret.fraction = float64(ev.Uploaded) / float64(ev.Size)
+		}
+	case backend.JobFailed:
+		if len(ret.pages[0]) > Width {
+			ret.pages = wrap(ret.pages[0], Width)
+		}
+	}
+	return ret
+}
+
+// Screen renders events on a Display. Changes are written by Draw().
+// Not thread safe.
+type Screen struct {
+	// Dim turns the backlight off after this long with nothing
+	// happening, unless a job is running. Zero never dims.
+	Dim time.Duration
+
+	d       Display
+	content content
+	page    int
+	step    int       // Ticks since the content or page changed.
+	active  time.Time // When something last happened.
+
+	// What's on the display, to only write what changed.
+	valid bool
+	color Color
+	lines [2]string
+	chars bool // Progress bar characters are loaded.
+}
+
+// NewScreen creates a screen that renders to d.
+func NewScreen(d Display) *Screen {
+	return &Screen{
+		Dim:     DefaultDim,
+		d:       d,
+		content: content{pages: []string{""}},
+	}
+}
+
+// Show sets the event to show, from the first page.
+func (s *Screen) Show(ev backend.Event, now time.Time) {
+	s.content = layout(ev)
+	s.page = 0
+	s.step = 0
+	s.active = now
+}
+
+// ShowText sets text to show, e.g. a menu.
+func (s *Screen) ShowText(c Color, title, text string, now time.Time) {
+	s.content = content{
+		color: c,
+		title: clean(title),
+		pages: []string{clean(text)},
+	}
+	s.page = 0
+	s.step = 0
+	s.active = now
+}
+
+// Page moves delta pages forward or back through a long message.
+func (s *Screen) Page(delta int, now time.Time) {
+	n := len(s.content.pages)
+	s.page = ((s.page+delta)%n + n) % n
+	s.step = 0
+	s.active = now
+}
+
+// Wake turns the backlight back on, e.g. on a key press.
+func (s *Screen) Wake(now time.Time) {
+	s.active = now
+}
+
+// Tick moves marquees and busy bars along. Call every ScrollStep.
+func (s *Screen) Tick() {
+	s.step++
+}
+
+// Invalidate makes the next Draw() write everything, e.g. after the
+// display has been reset.
+func (s *Screen) Invalidate() {
+	s.valid = false
+	s.chars = false
+}
+
+// Shown returns the backlight colour and lines last drawn.
+func (s *Screen) Shown() (Color, [2]string) {
+	return s.color, s.lines
+}
+
+// Draw writes to the display whatever has changed.
+func (s *Screen) Draw(now time.Time) error {
+	c := s.content
+	title := c.title
+	if n := len(c.pages); n > 1 {
+		ind := fmt.Sprintf("%d/%d", s.page+1, n)
+		w := Width - len(ind) - 1
+		if len(title) > w {
+			title = title[:w]
+		}
+		title = fmt.Sprintf("%-*s %s", w, title, ind)
+	}
+	text := c.pages[0]
+	if s.page < len(c.pages) {
+		text = c.pages[s.page]
+	}
+	if c.bar {
+		if w := Width - len(text) - 1; w > 0 {
+			if c.fraction < 0 {
+				text += " " + busyBar(w, s.step)
+			} else {
+				text += " " + bar(w, c.fraction)
+			}
+		}
+		if !s.chars {
+			for n := 1; n <= 5; n++ {
+				if err := s.d.CreateChar(n, barGlyph(n)); err != nil {
+					return err
+				}
+			}
+			s.chars = true
+		}
+	}
+	lines := [2]string{marquee(title, s.step), marquee(text, s.step)}
+
+	color := c.color
+	if s.Dim > 0 && !c.bar && now.Sub(s.active) >= s.Dim {
+		color = Off
+	}
+	if !s.valid || color != s.color {
+		if err := s.d.SetColor(color); err != nil {
+			s.valid = false
+			return err
+		}
+		s.color = color
+	}
+	for n, l := range lines {
+		if s.valid && l == s.lines[n] {
+			continue
+		}
+		// Pad, to overwrite what was there.
+		if err := s.d.Print(n, fmt.Sprintf("%-*s", Width, l)); err != nil {
+			s.valid = false
+			return err
+		}
+		s.lines[n] = l
+	}
+	s.valid = true
+	return nil
+}
@@ -0,0 +1,183 @@
+package adafruit
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ThomasHabets/autoscan/backend"
+)
+
+// fakeDisplay remembers what's shown, and counts writes.
+type fakeDisplay struct {
+	color  Color
+	lines  [2]string
+	chars  map[int][8]byte
+	writes int
+}
+
+func (f *fakeDisplay) SetColor(c Color) error {
+	f.color = c
+	f.writes++
+	return nil
+}
+
+func (f *fakeDisplay) Print(line int, s string) error {
+	if len(s) != Width {
+		return fmt.Errorf("printed %q, not %d characters", s, Width)
+	}
+	f.lines[line] = s
+	f.writes++
+	return nil
+}
+
+func (f *fakeDisplay) CreateChar(n int, rows [8]byte) error {
+	if f.chars == nil {
+		f.chars = make(map[int][8]byte)
+	}
+	f.chars[n] = rows
+	f.writes++
+	return nil
+}
+
+func TestMarquee(t *testing.T) {
+	s := "Scan kept locally!"
+	seen := map[string]bool{}
+	for step := 0; step < 20; step++ {
+		got := marquee(s, step)
+		if len(got) != Width {
+			t.Fatalf("Step %d: %q is not %d characters", step, got, Width)
+		}
+		seen[got] = true
+	}
+	for _, want := range []string{"Scan kept locall", "can kept locally", "an kept locally!"} {
+		if !seen[want] {
+			t.Errorf("Never showed %q", want)
+		}
+	}
+	if got := marquee("Short", 7); got != "Short" {
+		t.Errorf("Short line scrolled to %q", got)
+	}
+}
+
+func TestWrap(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want []string
+	}{
+		{"", []string{""}},
+		{"short", []string{"short"}},
+		{"exit status 7: Document feeder out of documents", []string{"exit status 7:", "Document feeder", "out of documents"}},
+		{"a 0123456789abcdefXYZ", []string{"a", "0123456789abcdef", "XYZ"}},
+	} {
+		if got := wrap(test.in, Width); fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("wrap(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestBar(t *testing.T) {
+	for _, test := range []struct {
+		w    int
+		f    float64
+		want string
+	}{
+		{4, 0, "    "},
+		{4, 0.5, "\x05\x05  "},
+		{4, 0.6, "\x05\x05\x02 "},
+		{4, 1, "\x05\x05\x05\x05"},
+	} {
+		if got := bar(test.w, test.f); got != test.want {
+			t.Errorf("bar(%d, %v) = %q, want %q", test.w, test.f, got, test.want)
+		}
+	}
+	if got, want := barGlyph(2), [8]byte{0x18, 0x18, 0x18, 0x18, 0x18, 0x18, 0x18, 0x18}; got != want {
+		t.Errorf("barGlyph(2) = %v, want %v", got, want)
+	}
+	for step := 0; step < 10; step++ {
+		if got := busyBar(4, step); strings.Count(got, "\x05") != 1 {
+			t.Errorf("busyBar(4, %d) = %q", step, got)
+		}
+	}
+}
+
+func TestScreen(t *testing.T) {
+	d := &fakeDisplay{}
+	s := NewScreen(d)
+	now := time.Now()
+
+	// Upload progress.
+	s.Show(backend.Event{Kind: backend.JobProgress, Stage: backend.UPLOADING, Pages: 3, Uploaded: 1, Size: 2}, now)
+	if err := s.Draw(now); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := d.lines[1], "3 pages \x05\x05\x05\x05    "; got != want {
+		t.Errorf("Progress line %q, want %q", got, want)
+	}
+	if len(d.chars) != 5 {
+		t.Errorf("Loaded %d bar characters, want 5", len(d.chars))
+	}
+
+	// Nothing changed, nothing written.
+	writes := d.writes
+	if err := s.Draw(now); err != nil {
+		t.Fatal(err)
+	}
+	if d.writes != writes {
+		t.Errorf("Redrawing unchanged screen wrote %d times", d.writes-writes)
+	}
+
+	// Long errors are paged.
+	s.Show(backend.Event{Kind: backend.JobFailed, Err: errors.New("exit status 1: scanner on fire, call the brigade")}, now)
+	var got []string
+	for i := 0; i < 4; i++ {
+		if err := s.Draw(now); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, strings.TrimRight(d.lines[0]+"|"+d.lines[1], " "))
+		s.Page(1, now)
+	}
+	want := []string{
+		"Failed!      1/3|exit status 1:",
+		"Failed!      2/3|scanner on fire,",
+		"Failed!      3/3|call the brigade",
+		"Failed!      1/3|exit status 1:",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("Pages:\n%q\nwant\n%q", got, want)
+	}
+	// On page 2, back past the first page.
+	s.Page(-2, now)
+	s.Draw(now)
+	if !strings.HasSuffix(d.lines[0], "3/3") {
+		t.Errorf("Paging back from first page shows %q, want last page", d.lines[0])
+	}
+
+	// Dims when idle, and wakes up.
+	s.Dim = time.Minute
+	s.Show(backend.Event{Kind: backend.Ready}, now)
+	s.Draw(now.Add(time.Second))
+	if d.color != Green {
+		t.Errorf("Color %v, want green", d.color)
+	}
+	later := now.Add(2 * time.Minute)
+	s.Draw(later)
+	if d.color != Off {
+		t.Errorf("Color %v after idle, want off", d.color)
+	}
+	s.Wake(later)
+	s.Draw(later)
+	if d.color != Green {
+		t.Errorf("Color %v after wake, want green", d.color)
+	}
+
+	// Everything is rewritten after invalidating.
+	d.lines = [2]string{}
+	s.Invalidate()
+	s.Draw(later)
+	if got := strings.TrimSpace(d.lines[0]); got != "Autoscan ready" {
+		t.Errorf("After invalidate shows %q", got)
+	}
+}
@@ -11,83 +11,102 @@ Example usage:
 package main
 
 import (
+	"context"
 	"flag"
-	"fmt"
-	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"net/http/fcgi"
 	"os"
-	"path"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
-	drivedulib "github.com/ThomasHabets/drive-du/lib"
-	oauth "golang.org/x/oauth2"
-	drive "google.golang.org/api/drive/v2"
-
+	"github.com/ThomasHabets/autoscan/actions"
 	"github.com/ThomasHabets/autoscan/adafruit"
 	"github.com/ThomasHabets/autoscan/backend"
-	//"github.com/ThomasHabets/autoscan/backend/leds"
+	"github.com/ThomasHabets/autoscan/backend/leds"
 	"github.com/ThomasHabets/autoscan/buttons"
+	"github.com/ThomasHabets/autoscan/config"
+	"github.com/ThomasHabets/autoscan/evdev"
+	"github.com/ThomasHabets/autoscan/fake"
+	"github.com/ThomasHabets/autoscan/gpio"
+	"github.com/ThomasHabets/autoscan/i2c"
+	"github.com/ThomasHabets/autoscan/term"
 	"github.com/ThomasHabets/autoscan/web"
 )
 
-const (
-	// BasePath is where are the GPIO special files are.
-	BasePath   = "/sys/class/gpio"
-	scope      = "https://www.googleapis.com/auth/drive"
-	accessType = "offline"
-)
-
 var (
 	listen     = flag.String("listen", "", "Address to listen to.")
 	listenFCGI = flag.String("listen_fcgi", "", "FCGI Address to listen to.")
 	socketPath = flag.String("socket", "", "UNIX socket to listen to for FCGI.")
 
 	logfile    = flag.String("logfile", "", "Where to log. If not specified will log to stdout.")
-	configFile = flag.String("config", ".autoscan", "Config file.")
-	configure  = flag.Bool("configure", false, "Create config file.")
+	configFile = flag.String("config", ".autoscan", "Config file. Written by the setup page in the web UI.")
 	tmplDir    = flag.String("templates", "", "Directory with HTML templates.")
 	staticDir  = flag.String("static", "", "Directory with static files.")
+	spoolDir   = flag.String("spool_dir", ".autoscan.spool", "Directory to keep scans in until they can be uploaded, e.g. while Google Drive needs re-authorizing. Must survive reboots, so not on a tmpfs.")
+	failFile   = flag.String("failure_file", ".autoscan.failure", "File to keep the latest scan failure in until it's acknowledged, across restarts. Empty to not.")
+
+	// The Google endpoints can be overridden to run against a fake server.
+	oauthAuthURL  = flag.String("oauth_auth_url", config.DefaultAuthURL, "OAuth authorization URL.")
+	oauthTokenURL = flag.String("oauth_token_url", config.DefaultTokenURL, "OAuth token URL.")
+	oauthRedirect = flag.String("oauth_redirect", "", "OAuth redirect URL for Google account setup. Default is a loopback URL derived from the request.")
+	driveEndpoint = flag.String("drive_endpoint", "", "Google Drive API base URL. Empty means the default.")
+
+	// Upload settings.
+	uploadChunkSize = flag.Int("upload_chunk_size", 8<<20, "Upload files larger than this many bytes in resumable chunks. Rounded up to a multiple of 256KiB.")
+	uploadRetry     = flag.Duration("upload_retry", backend.DefaultRetryDeadline, "How long to keep retrying starting each upload, and each upload chunk, on network errors.")
+	spoolRetry      = flag.Duration("spool_retry", time.Minute, "How long to wait before retrying uploads of scans that couldn't be uploaded. Doubles each time, up to an hour.")
+	convertToDocs   = flag.Bool("convert_to_docs", false, "Have Google Drive convert scans to Google Docs documents (OCR).")
 
 	useButtons  = flag.Bool("use_buttons", false, "Enable buttons.")
 	useLEDs     = flag.Bool("use_leds", false, "Use LEDs.")
 	useAdafruit = flag.Bool("use_adafruit", false, "Use Adafruit 16x2 LCD display.")
+	useLogUI    = flag.Bool("use_log_ui", false, "Log everything shown on the other UIs.")
+
+	useTerm      = flag.Bool("use_term", false, "Show the LCD and status on the terminal, and read keys from it. For running over SSH, or developing without the LCD.")
+	inputDevices = flag.String("input_devices", "", "Comma separated input devices to read keys from, such as USB foot pedals, e.g. /dev/input/by-id/usb-PCsensor_FootSwitch-event-kbd.")
 
 	// Externals
 	scanimage = flag.String("scanimage", "scanimage", "Scanimage binary from SANE.")
 	convert   = flag.String("convert", "convert", "Convert binary from ImageMagick.")
 
+	i2cBus       = flag.String("i2c_bus", "/dev/i2c-1", "I2C bus device for the Adafruit LCD plate.")
+	adafruitAddr = flag.Int("adafruit_addr", adafruit.Addr, "I2C address of the Adafruit LCD plate.")
+	lcdDim       = flag.Duration("lcd_dim", adafruit.DefaultDim, "Turn off the LCD backlight after this long idle. 0 to never.")
+
+	gpioChip        = flag.String("gpio_chip", "/dev/gpiochip0", "GPIO character device for buttons and LEDs.")
+	buttonBias      = flag.String("button_bias", "pull-down", "Bias for button pins: as-is, disabled, pull-up or pull-down.")
+	buttonActiveLow = flag.Bool("button_active_low", false, "Buttons pull the pin low when pressed. Use with -button_bias=pull-up.")
+	buttonDebounce  = flag.Duration("button_debounce", buttons.DefaultDebounce, "How long a button must be stable to count as pressed or released.")
+	buttonLongPress = flag.Duration("button_long_press", buttons.DefaultLongPress, "How long to hold a button for a long press.")
+
 	pinButtonSingle = flag.Int("pin_single", 5, "GPIO PIN for 'scan single'.")
 	pinButtonDuplex = flag.Int("pin_duplex", 6, "GPIO PIN for 'scan duplex'.")
 	pinButton3      = flag.Int("pin_ack", 24, "GPIO PIN for 'ACK'.")
 	pinButton4      = flag.Int("pin_reboot", 25, "GPIO PIN for 'reboot'.")
 
-	pinLED1a = flag.Int("pin_led1_a", 27, "GPIO PIN for LED 1 PIN 1/2.")
-	pinLED1b = flag.Int("pin_led1_b", 23, "GPIO PIN for LED 1 PIN 2/2.")
+	pinLED1a = flag.Int("pin_led1_a", 27, "GPIO PIN for status LED red.")
+	pinLED1b = flag.Int("pin_led1_b", 23, "GPIO PIN for status LED green.")
 
-	pinLED2a = flag.Int("pin_led2_a", 17, "GPIO PIN for LED 2 PIN 1/2.")
-	pinLED2b = flag.Int("pin_led2_b", 22, "GPIO PIN for LED 2 PIN 2/2.")
+	pinLED2a = flag.Int("pin_led2_a", 17, "GPIO PIN for progress LED red.")
+	pinLED2b = flag.Int("pin_led2_b", 22, "GPIO PIN for progress LED green.")
 )
 
-type nullUI struct{}
-
-func (*nullUI) Msg(status, msg string) {}
-func (*nullUI) Run()                   {}
-
-func oauthConfig(id, secret string) *oauth.Config {
-	return &oauth.Config{
-		ClientID:     id,
-		ClientSecret: secret,
-		Endpoint: oauth.Endpoint{
-			AuthURL:  "https://accounts.google.com/o/oauth2/auth",
-			TokenURL: "https://accounts.google.com/o/oauth2/token",
-		},
-		Scopes:      []string{scope},
-		RedirectURL: "urn:ietf:wg:oauth:2.0:oob",
-		//AccessType:   "offline",
+// logUI is a UI that logs events.
+type logUI struct{}
+
+func (*logUI) Show(ev backend.Event) { log.Printf("UI: %v", ev) }
+func (*logUI) Run()                  {}
+
+// googleEndpoints returns the Google endpoints from the flags.
+func googleEndpoints() config.Endpoints {
+	return config.Endpoints{
+		AuthURL:  *oauthAuthURL,
+		TokenURL: *oauthTokenURL,
+		Drive:    *driveEndpoint,
 	}
 }
 
@@ -118,109 +137,15 @@ func servePort(m *http.ServeMux) error {
 	return http.ListenAndServe(*listen, m)
 }
 
-type config struct {
-	clientID, clientSecret, refreshToken string
-	parent                               string
-}
-
-func readConfig() (*config, error) {
-	b, err := ioutil.ReadFile(*configFile)
-	if err != nil {
-		return nil, err
-	}
-	s := strings.SplitN(strings.Trim(string(b), "\n\r "), "\n", 4)
-	return &config{
-		clientID:     s[0],
-		clientSecret: s[1],
-		refreshToken: s[2],
-		parent:       s[3],
-	}, nil
-}
-
-func export(n int) error {
-	if err := func() error {
-		f, err := os.OpenFile(path.Join(BasePath, "export"), os.O_WRONLY, 0660)
-		if err != nil {
-			return err
-		}
-		defer f.Close()
-		fmt.Fprintf(f, "%d\n", n)
-		return nil
-	}(); err != nil {
-		return err
-	}
-	start := time.Now()
-	for {
-		time.Sleep(50 * time.Millisecond)
-		_, err := os.Stat(path.Join(BasePath, fmt.Sprintf("gpio%d", n), "direction"))
-		if err != nil {
-			if time.Since(start) > 10*time.Second {
-				return err
-			}
-			continue
-		}
-		_, err = os.Stat(path.Join(BasePath, fmt.Sprintf("gpio%d", n), "value"))
-		if err != nil {
-			if time.Since(start) > 10*time.Second {
-				return err
-			}
-			continue
-		}
-		return nil
-	}
-}
-
-func setDirection(n int, dir string) error {
-	start := time.Now()
-	if err := func() error {
-		for {
-			f, err := os.OpenFile(path.Join(BasePath, fmt.Sprintf("gpio%d", n), "direction"), os.O_WRONLY, 0660)
-			if err != nil {
-				if time.Since(start) > 10*time.Second {
-					return err
-				}
-				time.Sleep(50 * time.Millisecond)
-				continue
-			}
-			defer f.Close()
-			fmt.Fprintf(f, dir+"\n")
-			return nil
-		}
-	}(); err != nil {
-		return err
-	}
-	for {
-		s, err := ioutil.ReadFile(path.Join(BasePath, fmt.Sprintf("gpio%d", n), "direction"))
-		if err != nil {
-			return err
-		}
-		if string(s) == dir+"\n" {
-			return nil
-		}
-		time.Sleep(50 * time.Millisecond)
-	}
-}
-
 func main() {
+	// In simulation mode this program is also the fake scanimage and convert.
+	fake.Main()
+
 	flag.Parse()
 
 	if *configFile == "" {
 		log.Fatalf("-config is mandatory")
 	}
-	if *configure {
-		conf, err := drivedulib.Configure(scope, "offline", "", "")
-		if err != nil {
-			log.Fatalf("Failed to configure: %v", err)
-		}
-		folder, err := drivedulib.ReadLine("Folder ID: ")
-		if err != nil {
-			log.Fatalf("Unable to read folder ID: %v", err)
-		}
-		if err := ioutil.WriteFile(*configFile, []byte(fmt.Sprintf("%s\n%s\n%s\n%s\n", conf.OAuth.ClientID, conf.OAuth.ClientSecret, conf.OAuth.RefreshToken, folder)), 0600); err != nil {
-			log.Fatalf("Failed to write config file: %v", err)
-		}
-		return
-	}
 
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
 
@@ -246,107 +171,200 @@ func main() {
 		}
 	}
 
-	if *useButtons || *useAdafruit || *useLEDs {
-		// Set up GPIO ports race-free.
-		for _, n := range []int{
-			*pinLED1a,
-			*pinLED1b,
-			*pinLED2a,
-			*pinLED2b,
-		} {
-			if err := export(n); err != nil {
-				log.Fatalf("export(%d): %v", n, err)
-			}
-			if err := setDirection(n, "out"); err != nil {
-				log.Fatalf("setDirection(%d, out): %v", n, err)
-			}
-		}
-		for _, n := range []int{
-			*pinButtonSingle,
-			*pinButtonDuplex,
-			*pinButton3,
-			*pinButton4,
-		} {
-			if err := export(n); err != nil {
-				log.Fatalf("export(%d): %v", n, err)
-			}
-			if err := setDirection(n, "in"); err != nil {
-				log.Fatalf("setDirection(%d, in): %v", n, err)
-			}
-		}
+	if *simulate && (*useButtons || *useAdafruit || *useLEDs) {
+		log.Printf("Simulating, so not using any buttons, LEDs or LCD.")
+		*useButtons, *useAdafruit, *useLEDs = false, false, false
 	}
 
-	if *useLEDs {
-		/*
-			// Status LED: Blink when this daemon is running.
-			status := make(chan leds.LEDMode)
-			_, err := leds.LEDController(*pinLED1a, *pinLED1b, status)
-			if err != nil {
-				log.Fatalf("Status LED: %v", err)
-			}
-			status <- leds.GREEN
-			status <- leds.BLINK
-
-			// Progress LED:
-			// * Solid green or red showing last status, ready for new scan.
-			// * Blinking green while "in progress".
-			progress := make(chan leds.LEDMode)
-			_, err = leds.LEDController(*pinLED2a, *pinLED2b, progress)
-			if err != nil {
-				log.Fatalf("Progress LED: %v", err)
-			}
-			progress <- leds.GREEN
-		*/
+	// Things to undo on exit, in reverse order.
+	var atExit []func()
+
+	var chip gpio.Chip
+	if *useButtons || *useLEDs {
+		var err error
+		if chip, err = gpio.Open(*gpioChip); err != nil {
+			log.Fatalf("Opening GPIO chip: %v", err)
+		}
+		// Release the lines on exit, or they stay busy until the
+		// process is fully gone.
+		atExit = append(atExit, func() {
+			log.Printf("Releasing GPIO lines.")
+			chip.Close()
+		})
 	}
 
-	cfg, err := readConfig()
+	st, err := readStation(*stationFile)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("Reading station config: %v", err)
 	}
-	authedClient, err := drivedulib.Connect(drivedulib.ConfigOAuth{
-		ClientID:     cfg.clientID,
-		ClientSecret: cfg.clientSecret,
-		RefreshToken: cfg.refreshToken,
-	}, scope, accessType)
+	scanners, err := newScanners(st)
 	if err != nil {
+		log.Fatalf("Station config %q: %v", *stationFile, err)
+	}
+	if *useLogUI {
+		scannerFor(scanners, uiLog).ui.Add(&logUI{})
+	}
+
+	driveConfig := *configFile
+	cfg, err := config.ReadDrive(*configFile)
+	switch {
+	case *simulate:
+		if driveConfig, err = startSimulation(scanners); err != nil {
+			log.Fatalf("Starting simulation: %v", err)
+		}
+	case os.IsNotExist(err):
+		log.Printf("No config file %q. Set up Google Drive in the web UI.", *configFile)
+	case err != nil:
 		log.Fatal(err)
+	case !cfg.Complete():
+		log.Printf("Google Drive setup in %q not finished. Finish it in the web UI.", *configFile)
+	default:
+		cfg.Endpoints = googleEndpoints()
+		d, err := cfg.Service(context.Background())
+		if err != nil {
+			log.Fatalf("Creating Google Drive client: %v", err)
+		}
+		for _, s := range scanners {
+			s.b.SetDrive(d, cfg.Parent)
+		}
 	}
-	d, err := drive.New(authedClient)
+
+	dispatcher, err := newDispatcher(scanners, st)
 	if err != nil {
-		log.Fatalf("Creating Google Drive client: %v", err)
+		log.Fatalf("Station config %q: %v", *stationFile, err)
 	}
-
-	b := backend.Backend{
-		Scanimage: *scanimage,
-		Convert:   *convert,
-		ParentDir: cfg.parent,
-		Drive:     d,
-		UI:        &nullUI{},
-		//Progress:  progress,
+	if *checkProfiles {
+		if err := checkScanners(scanners, profiles(st)); err != nil {
+			log.Fatalf("Station config %q: %v", *stationFile, err)
+		}
 	}
 
-	f := web.New(d, cfg.parent, *tmplDir, *staticDir, &b)
+	f := web.New(*tmplDir, *staticDir, scanners[0].b, driveConfig, dispatcher)
+	f.Endpoints = googleEndpoints()
+	f.OAuthRedirect = *oauthRedirect
+	f.Profiles = profileNames(st)
+	f.SetSANE(*scanimage)
+	if len(scanners) > 1 {
+		for _, s := range scanners {
+			f.AddScanner(s.name, s.b)
+		}
+	}
 
 	if *useButtons {
-		btns, err := buttons.New(*pinButtonSingle, *pinButtonDuplex, *pinButton3, *pinButton4)
+		bias, ok := gpio.ParseBias(*buttonBias)
+		if !ok {
+			log.Fatalf("Invalid -button_bias %q", *buttonBias)
+		}
+		btns, err := buttons.New(chip, gpio.InputConfig{
+			Bias:      bias,
+			ActiveLow: *buttonActiveLow,
+		}, *pinButtonSingle, *pinButtonDuplex, *pinButton3, *pinButton4)
 		if err != nil {
 			log.Fatalf("Setting up buttons: %v", err)
 		}
-		btns.Backend = &b
-		//btns.Progress = progress
+		btns.Inputs = dispatcher
+		btns.Debounce = *buttonDebounce
+		btns.LongPress = *buttonLongPress
 		go btns.Run()
 	}
 
-	if *useAdafruit {
-		btns, err := adafruit.New(&b)
+	if *inputDevices != "" {
+		for _, path := range strings.Split(*inputDevices, ",") {
+			go evdev.New(path, dispatcher).Run()
+		}
+	}
+
+	if *useLEDs {
+		s := scannerFor(scanners, uiLEDs)
+		l, err := leds.New(chip, *pinLED1a, *pinLED1b, *pinLED2a, *pinLED2b, s.b)
 		if err != nil {
-			log.Fatalf("Setting up adafruit: %v", err)
+			log.Fatalf("Setting up LEDs: %v", err)
 		}
-		go btns.Run()
-		b.UI = btns
+		s.ui.Add(l)
+	}
+
+	// Without a plate the LCD is emulated, for the LCD web page.
+	var bus i2c.Bus
+	if *useAdafruit {
+		var err error
+		if bus, err = i2c.Open(*i2cBus); err != nil {
+			log.Fatalf("Opening I2C bus: %v", err)
+		}
+	}
+	lcdScanner := scannerFor(scanners, uiLCD)
+	lcd := adafruit.New(bus, uint16(*adafruitAddr), dispatcher, lcdScanner.b)
+	lcd.SetDim(*lcdDim)
+	dispatcher.Handle(actions.PageNext, func(string, string) error {
+		lcd.Page(1)
+		return nil
+	})
+	dispatcher.Handle(actions.PagePrev, func(string, string) error {
+		lcd.Page(-1)
+		return nil
+	})
+
+	menu, err := adafruit.NewMenu(stationMenu(st), lcdScanner.b)
+	if err != nil {
+		log.Fatalf("Station config %q: %v", *stationFile, err)
+	}
+	lcd.SetMenu(menu, dispatcher.Do)
+	dispatcher.Handle(actions.Menu, func(string, string) error {
+		lcd.OpenMenu()
+		return nil
+	})
+	dispatcher.Handle(actions.MenuNext, func(string, string) error {
+		lcd.MoveMenu(1)
+		return nil
+	})
+	dispatcher.Handle(actions.MenuPrev, func(string, string) error {
+		lcd.MoveMenu(-1)
+		return nil
+	})
+	dispatcher.Handle(actions.MenuSelect, func(_, from string) error {
+		lcd.SelectMenu(from)
+		return nil
+	})
+	lcdScanner.ui.Add(lcd)
+	// The buttons work on the LCD page even if there aren't any.
+	f.SetLCD(lcd, []web.Button{
+		{Label: "Single", Pin: *pinButtonSingle},
+		{Label: "Duplex", Pin: *pinButtonDuplex},
+		{Label: "Ack", Pin: *pinButton3},
+		{Label: "Reboot", Pin: *pinButton4},
+	})
+
+	if *useTerm {
+		s := scannerFor(scanners, uiTerm)
+		t := term.New(os.Stdin, os.Stdout, dispatcher, s.b)
+		if *logfile == "" {
+			// Show the log below the LCD, instead of messing it up.
+			log.SetOutput(t)
+		}
+		atExit = append(atExit, func() {
+			t.Close()
+			log.SetOutput(os.Stderr)
+		})
+		s.ui.Add(t)
+	}
+
+	// Undo what needs undoing when killed.
+	if len(atExit) > 0 {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			s := <-sigs
+			// Backwards, so the terminal is restored before logging.
+			for n := len(atExit) - 1; n >= 0; n-- {
+				atExit[n]()
+			}
+			log.Printf("Got %v, exiting.", s)
+			os.Exit(1)
+		}()
 	}
 
-	b.UI.Msg("IDLE", "Autoscan Ready.|Just started.")
+	for _, s := range scanners {
+		s.b.ShowStatus()
+	}
 	log.Printf("Running.")
 
 	if *listen != "" {
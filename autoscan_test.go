@@ -1,9 +1,855 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/ThomasHabets/autoscan/actions"
+	"github.com/ThomasHabets/autoscan/adafruit"
+	"github.com/ThomasHabets/autoscan/backend"
+	"github.com/ThomasHabets/autoscan/config"
+	"github.com/ThomasHabets/autoscan/fake"
+	"github.com/ThomasHabets/autoscan/web"
 )
 
+func TestMain(m *testing.M) {
+	fake.Main()
+	os.Exit(m.Run())
+}
+
 // TestBuilds just makes sure it builds.
 func TestBuilds(t *testing.T) {
 }
+
+type apiStatus struct {
+	State    backend.State
+	LastFail string
+	LastURL  string
+	Reauth   string
+	Spooled  int
+}
+
+// waitStatus polls the status API until the scan is done.
+func waitStatus(t *testing.T, base string, done func(*apiStatus) bool) *apiStatus {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		resp, err := http.Get(base + "/api/status")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var s apiStatus
+		err = json.NewDecoder(resp.Body).Decode(&s)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if done(&s) {
+			return &s
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for scan. Last status: %+v", s)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestScanToDrive runs a scan from the web UI, through the fake
+// scanner and convert, to the fake Drive.
+func TestScanToDrive(t *testing.T) {
+	d := fake.NewDrive()
+	defer d.Close()
+	folder := d.AddFolder("Scans", fake.RootID)
+
+	scanimage, convert, err := fake.Scanner{Sheets: 2}.Install(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Drive{
+		ClientID:     "fake-client",
+		ClientSecret: "fake-secret",
+		RefreshToken: "fake-refresh-token",
+		Parent:       folder,
+		Endpoints:    d.Endpoints(),
+	}
+	cfgFile := path.Join(t.TempDir(), "autoscan.conf")
+	if err := cfg.Write(cfgFile); err != nil {
+		t.Fatal(err)
+	}
+	svc, err := cfg.Service(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lcd := &fake.LCD{}
+	b := &backend.Backend{
+		Scanner:       &backend.Scanimage{Path: scanimage},
+		Convert:       convert,
+		SpoolDir:      t.TempDir(),
+		UI:            lcd,
+		RetryDeadline: time.Minute,
+	}
+	b.SetDrive(svc, folder)
+	dispatcher, err := newDispatcher([]*scanner{{name: "default", b: b}}, &config.Station{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var audit bytes.Buffer
+	dispatcher.Audit = &audit
+	s := httptest.NewServer(web.New("web/templates", "web/static", b, cfgFile, dispatcher).Mux)
+	defer s.Close()
+
+	// A network blip shouldn't matter.
+	d.FailUploads(1)
+
+	resp, err := http.PostForm(s.URL+"/scan", url.Values{"double": {"Double sided"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if !strings.Contains(audit.String(), " web:scan start:duplex: ok\n") {
+		t.Errorf("Audit trail %q, want the scan started from the web UI", audit.String())
+	}
+	st := waitStatus(t, s.URL, func(s *apiStatus) bool {
+		return s.State == backend.IDLE && (s.LastURL != "" || s.LastFail != "")
+	})
+	if st.LastFail != "" {
+		t.Fatalf("Scan failed: %s", st.LastFail)
+	}
+
+	files := d.Files(folder)
+	if len(files) != 1 {
+		t.Fatalf("Want 1 uploaded file, got %d: %+v", len(files), files)
+	}
+	if got, want := files[0].MimeType, "application/pdf"; got != want {
+		t.Errorf("MimeType = %q, want %q", got, want)
+	}
+	if got, want := strings.Count(string(files[0].Content), "/Type /Page "), 4; got != want {
+		t.Errorf("Got %d pages, want %d", got, want)
+	}
+	if !strings.HasSuffix(st.LastURL, files[0].ID) {
+		t.Errorf("LastURL = %q, want link to %q", st.LastURL, files[0].ID)
+	}
+	resp, err = http.Get(st.LastURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, files[0].Content) {
+		t.Errorf("LastURL serves %s: %.20q", resp.Status, body)
+	}
+	if _, l1, l2 := lcd.Lines(); l1 != "Ready" || l2 != "Uploaded 4 pages" {
+		t.Errorf("LCD shows %q / %q after scan", l1, l2)
+	}
+
+	// The "last scan" page shows the thumbnail.
+	resp, err = http.Get(s.URL + "/last")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if want := "/thumbnails/" + files[0].ID; !strings.Contains(string(body), want) {
+		t.Errorf("/last doesn't contain %q:\n%s", want, body)
+	}
+}
+
+// TestJam checks that the UI is told what went wrong.
+func TestJam(t *testing.T) {
+	d := fake.NewDrive()
+	defer d.Close()
+	cfg := &config.Drive{ClientID: "c", ClientSecret: "s", RefreshToken: "r", Endpoints: d.Endpoints()}
+	svc, err := cfg.Service(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanimage, convert, err := fake.Scanner{Sheets: 3, Jam: 2}.Install(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lcd := &fake.LCD{}
+	b := &backend.Backend{
+		Scanner:  &backend.Scanimage{Path: scanimage},
+		Convert:  convert,
+		SpoolDir: t.TempDir(),
+		UI:       lcd,
+	}
+	b.SetDrive(svc, fake.RootID)
+	err = b.Run(false)
+	if got, want := backend.KindOf(err), backend.Jam; got != want {
+		t.Errorf("Error kind %q, want %q. Error: %v", got, want, err)
+	}
+	if _, l1, l2 := lcd.Lines(); l1 != "Failed!" || l2 != "Paper jam" {
+		t.Errorf("LCD shows %q / %q after jam", l1, l2)
+	}
+}
+
+// TestFlatbed scans from a flatbed-only scanner, with a profile for it.
+func TestFlatbed(t *testing.T) {
+	d := fake.NewDrive()
+	defer d.Close()
+	cfg := &config.Drive{ClientID: "c", ClientSecret: "s", RefreshToken: "r", Endpoints: d.Endpoints()}
+	svc, err := cfg.Service(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanimage, convert, err := fake.Scanner{Flatbed: true}.Install(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lcd := &fake.LCD{}
+	b := &backend.Backend{
+		Scanner:  &backend.Scanimage{Path: scanimage},
+		Convert:  convert,
+		SpoolDir: t.TempDir(),
+		UI:       lcd,
+	}
+	b.SetDrive(svc, fake.RootID)
+	scanners := []*scanner{{name: "flatbed", b: b}}
+	st := &config.Station{Profiles: map[string]config.Profile{"photo": {Source: "Flatbed", Mode: "Gray"}}}
+	if err := checkScanners(scanners, profiles(st)); err == nil || !strings.Contains(err.Error(), `"source" can't be "ADF`) {
+		t.Errorf("Built-in feeder profiles on a flatbed: %v", err)
+	}
+	if err := checkScanners(scanners, map[string]config.Profile{"photo": st.Profiles["photo"]}); err != nil {
+		t.Errorf("Flatbed profile: %v", err)
+	}
+
+	dispatcher, err := newDispatcher(scanners, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dispatcher.Do("test", actions.Start+":photo"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for len(d.Files(fake.RootID)) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	files := d.Files(fake.RootID)
+	if len(files) != 1 {
+		_, l1, l2 := lcd.Lines()
+		t.Fatalf("Want 1 uploaded file, got %d. LCD shows %q / %q", len(files), l1, l2)
+	}
+	if got := strings.Count(string(files[0].Content), "/Type /Page "); got != 1 {
+		t.Errorf("Got %d pages, want 1", got)
+	}
+}
+
+// TestSpoolRetry checks that scans that failed to upload are retried
+// later, without a new scan.
+func TestSpoolRetry(t *testing.T) {
+	d := fake.NewDrive()
+	defer d.Close()
+	cfg := &config.Drive{ClientID: "c", ClientSecret: "s", RefreshToken: "r", Endpoints: d.Endpoints()}
+	svc, err := cfg.Service(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanimage, convert, err := fake.Scanner{Sheets: 1}.Install(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &backend.Backend{
+		Scanner:       &backend.Scanimage{Path: scanimage},
+		Convert:       convert,
+		SpoolDir:      t.TempDir(),
+		SpoolRetry:    time.Second,
+		RetryDeadline: time.Nanosecond,
+		UI:            &fake.LCD{},
+	}
+	b.SetDrive(svc, fake.RootID)
+
+	// Likely in the same second, so with the same title. Down until
+	// both are spooled, in case a retry comes in between.
+	d.FailUploads(1000)
+	for n := 0; n < 2; n++ {
+		if err := b.Run(false); backend.KindOf(err) != backend.UploadError {
+			t.Fatalf("Scan %d with Drive down: %v", n, err)
+		}
+	}
+	if got := b.Spooled(); got != 2 {
+		t.Fatalf("Spooled %d scans, want 2", got)
+	}
+	d.FailUploads(0)
+	deadline := time.Now().Add(10 * time.Second)
+	for b.Spooled() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Still %d scans spooled", b.Spooled())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	files := d.Files(fake.RootID)
+	if len(files) != 2 {
+		t.Fatalf("Uploaded %d files, want 2", len(files))
+	}
+	for _, f := range files {
+		if !strings.HasPrefix(f.Name, "Scan ") || !strings.HasSuffix(f.Name, ".pdf") {
+			t.Errorf("Uploaded as %q", f.Name)
+		}
+	}
+}
+
+// TestFakeSetup goes through the Google account setup against the
+// fake Drive, like in simulation mode.
+func TestFakeSetup(t *testing.T) {
+	d := fake.NewDrive()
+	defer d.Close()
+	b := &backend.Backend{}
+	fn := path.Join(t.TempDir(), "autoscan.conf")
+	f := web.New("web/templates", "web/static", b, fn, nil)
+	f.Endpoints = d.Endpoints()
+	s := httptest.NewServer(f.Mux)
+	defer s.Close()
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	resp, err := noRedirect.PostForm(s.URL+"/setup", url.Values{
+		"authorize":     {"1"},
+		"client_id":     {"fake-client"},
+		"client_secret": {"fake-secret"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	resp, err = noRedirect.Get(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback := resp.Header.Get("Location")
+	if !strings.Contains(callback, "/oauth2callback?") {
+		t.Fatalf("Fake authorization redirected to %q", callback)
+	}
+	resp, err = noRedirect.PostForm(s.URL+"/setup", url.Values{"finish": {"1"}, "url": {callback}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("Finishing setup: %s", resp.Status)
+	}
+	cfg, err := config.ReadDrive(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.Authorized() {
+		t.Errorf("Not authorized after setup: %+v", cfg)
+	}
+}
+
+// slowScanner scans two pages, is cut off in the middle of the third,
+// and waits for the feeder until cancelled.
+type slowScanner struct{}
+
+func (slowScanner) Scan(ctx context.Context, _ []backend.Option, dir string) error {
+	page := "P5\n# SANE data follows\n2 2\n255\n"
+	for n, data := range []string{"abcd", "abcd", "ab"} {
+		if err := ioutil.WriteFile(path.Join(dir, fmt.Sprintf("out%d.pnm", n+1)), []byte(page+data), 0600); err != nil {
+			return err
+		}
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestFinish(t *testing.T) {
+	d := fake.NewDrive()
+	defer d.Close()
+	cfg := &config.Drive{ClientID: "c", ClientSecret: "s", RefreshToken: "r", Endpoints: d.Endpoints()}
+	svc, err := cfg.Service(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, convert, err := fake.Scanner{}.Install(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lcd := &fake.LCD{}
+	b := &backend.Backend{
+		Scanner:  slowScanner{},
+		Convert:  convert,
+		SpoolDir: t.TempDir(),
+		UI:       lcd,
+	}
+	b.SetDrive(svc, fake.RootID)
+	if err := b.Finish(); err == nil {
+		t.Errorf("Finished with no scan running")
+	}
+	res := make(chan error)
+	go func() { res <- b.Run(false) }()
+	deadline := time.Now().Add(10 * time.Second)
+	for b.Finish() != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Scan never started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := <-res; err != nil {
+		t.Fatal(err)
+	}
+	if _, _, l2 := lcd.Lines(); l2 != "Uploaded 2 pages" {
+		t.Errorf("LCD shows %q after finishing", l2)
+	}
+}
+
+// TestFakeScanners checks that fake scanners don't share settings.
+func TestFakeScanners(t *testing.T) {
+	sheets := []int{1, 3}
+	var paths []string
+	for _, n := range sheets {
+		scanimage, _, err := fake.Scanner{Sheets: n}.Install(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, scanimage)
+	}
+	for i, scanimage := range paths {
+		dir := t.TempDir()
+		if err := (&backend.Scanimage{Path: scanimage}).Scan(context.Background(), nil, dir); err != nil {
+			t.Fatal(err)
+		}
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != sheets[i] {
+			t.Errorf("Fake with %d sheets scanned %d pages", sheets[i], len(files))
+		}
+	}
+}
+
+func TestScanners(t *testing.T) {
+	for _, st := range []config.Station{
+		{Scanners: []config.Scanner{{Name: "a/b"}}},
+		{Scanners: []config.Scanner{{Name: "a"}, {Name: "a"}}},
+		{Scanners: []config.Scanner{{Name: "a", UIs: []string{"oled"}}}},
+		{Scanners: []config.Scanner{{Name: "a", UIs: []string{"lcd"}}, {Name: "b", UIs: []string{"lcd"}}}},
+		{Profiles: map[string]config.Profile{"photo": {Scanner: "flatbed"}}},
+		{Scanners: []config.Scanner{{Name: "a", Saned: "pi", ESCL: "http://printer/eSCL"}}},
+	} {
+		if _, err := newScanners(&st); err == nil {
+			t.Errorf("Accepted %+v", st)
+		}
+	}
+
+	defer func(old string) { *failFile = old }(*failFile)
+	*failFile = path.Join(t.TempDir(), "failure")
+	st := &config.Station{
+		Scanners: []config.Scanner{
+			{Name: "feeder"},
+			{Name: "flatbed", Device: "genesys", UIs: []string{"lcd"}},
+		},
+		Profiles: map[string]config.Profile{"photo": {Scanner: "flatbed"}},
+	}
+	scanners, err := newScanners(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := scannerFor(scanners, uiLCD).name; got != "flatbed" {
+		t.Errorf("LCD shows %q, want flatbed", got)
+	}
+	if got := scannerFor(scanners, uiLEDs).name; got != "feeder" {
+		t.Errorf("LEDs show %q, want feeder", got)
+	}
+	feeder, flatbed := scanners[0].b, scanners[1].b
+	if feeder.SpoolDir == flatbed.SpoolDir || feeder.FailureFile == flatbed.FailureFile {
+		t.Errorf("Scanners share spool dir %q or failure file %q", feeder.SpoolDir, feeder.FailureFile)
+	}
+	for _, b := range []*backend.Backend{feeder, flatbed} {
+		if b.SpoolDir == "" || strings.HasPrefix(b.SpoolDir, os.TempDir()) {
+			t.Errorf("Spool dir %q may not survive a reboot", b.SpoolDir)
+		}
+	}
+
+	d, err := newDispatcher(scanners, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Do("test", "cancel"); err == nil || !strings.Contains(err.Error(), "nothing to cancel") {
+		t.Errorf("Cancel with nothing running: %v", err)
+	}
+	if err := d.Do("test", "ack:scanner3"); err == nil || !strings.Contains(err.Error(), "no such scanner") {
+		t.Errorf("Ack of nonexistent scanner: %v", err)
+	}
+}
+
+// TestPowerBindings checks that reboot and shutdown can only be bound
+// to inputs that are hard to hit by mistake.
+func TestPowerBindings(t *testing.T) {
+	scanners := []*scanner{{name: "default", b: &backend.Backend{}}}
+	for _, in := range []string{"lcd:select", "term:r", "key:a", "http:x", "http:reboot:long", "http:a+b:chord", "key:power:long", "gpio:25:tap"} {
+		st := &config.Station{Bindings: map[string]string{in: actions.Shutdown}}
+		if _, err := newDispatcher(scanners, st); err == nil {
+			t.Errorf("Shutdown bound to %q", in)
+		}
+	}
+	for _, in := range []string{"gpio:25:long", "gpio:24+25:chord"} {
+		st := &config.Station{Bindings: map[string]string{in: actions.Reboot + ":force"}}
+		if _, err := newDispatcher(scanners, st); err != nil {
+			t.Errorf("Reboot bound to %q: %v", in, err)
+		}
+	}
+
+	// Not from the web UI, even when bound.
+	d, err := newDispatcher(scanners, &config.Station{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.InputFrom("web:gpio:25:long", "gpio:25:long"); err == nil || !strings.Contains(err.Error(), "web UI") {
+		t.Errorf("Reboot from the web UI: %v", err)
+	}
+	if err := d.Do("http:reboot", actions.Reboot); err == nil || !strings.Contains(err.Error(), "HTTP") {
+		t.Errorf("Reboot over HTTP: %v", err)
+	}
+}
+
+// TestDestinations checks that scans go to the destination or user
+// picked, also when spooled, and to a profile's own folder.
+func TestDestinations(t *testing.T) {
+	d := fake.NewDrive()
+	defer d.Close()
+	cfg := &config.Drive{ClientID: "c", ClientSecret: "s", RefreshToken: "r", Endpoints: d.Endpoints()}
+	svc, err := cfg.Service(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanimage, convert, err := fake.Scanner{Sheets: 1}.Install(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &backend.Backend{
+		Scanner:       &backend.Scanimage{Path: scanimage},
+		Convert:       convert,
+		SpoolDir:      t.TempDir(),
+		SpoolRetry:    time.Second,
+		RetryDeadline: time.Nanosecond,
+		UI:            &fake.LCD{},
+	}
+	scans := d.AddFolder("Scans", fake.RootID)
+	b.SetDrive(svc, scans)
+	taxes := d.AddFolder("Taxes", fake.RootID)
+	alice := d.AddFolder("Alice", fake.RootID)
+	receipts := d.AddFolder("Receipts", fake.RootID)
+	st := &config.Station{
+		Profiles:     map[string]config.Profile{"receipts": {Folder: receipts}},
+		Destinations: map[string]string{"taxes": taxes},
+		Users:        map[string]string{"alice": alice},
+	}
+	scanners := []*scanner{{name: "default", b: b}}
+	dispatcher, err := newDispatcher(scanners, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wait := func(what string, done func() bool) {
+		deadline := time.Now().Add(10 * time.Second)
+		for !done() {
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for %s", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	scan := func(pick, profile, folder string, want int) {
+		if err := dispatcher.Do("test", pick); err != nil {
+			t.Fatal(err)
+		}
+		if err := dispatcher.Do("test", actions.Start+":"+profile); err != nil {
+			t.Fatal(err)
+		}
+		wait(fmt.Sprintf("%s scan after %q", profile, pick), func() bool { return len(d.Files(folder)) == want })
+		wait("scan to finish", func() bool { s, _ := b.Status(); return s == backend.IDLE })
+	}
+	scan(actions.Destination+":taxes", "single", taxes, 1)
+	scan(actions.Destination+":taxes", "receipts", receipts, 1)
+	scan(actions.Destination, "single", scans, 1)
+
+	// Spooled scans keep where they're going.
+	d.FailUploads(1000)
+	if err := dispatcher.Do("test", actions.User+":alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dispatcher.Do("test", actions.Start+":single"); err != nil {
+		t.Fatal(err)
+	}
+	wait("scan to be spooled", func() bool { return b.Spooled() == 1 })
+	if err := dispatcher.Do("test", actions.User); err != nil {
+		t.Fatal(err)
+	}
+	d.FailUploads(0)
+	wait("spooled scan to be uploaded", func() bool { return len(d.Files(alice)) == 1 })
+	if n := len(d.Files(scans)); n != 1 {
+		t.Errorf("%d scans in the default folder, want 1", n)
+	}
+
+	if err := dispatcher.Do("test", actions.User+":bob"); err == nil {
+		t.Error("Picked a user that doesn't exist")
+	}
+	for _, bad := range []*config.Station{
+		{Bindings: map[string]string{"key:b": actions.User + ":bob"}},
+		{Menu: []config.MenuItem{{Label: "To bob", Action: actions.Destination + ":bob"}}},
+	} {
+		if _, err := newDispatcher(scanners, bad); err == nil {
+			t.Errorf("No error picking bob with %+v", bad)
+		}
+	}
+
+	// The built-in menu gets submenus to pick them.
+	if _, err := adafruit.NewMenu(stationMenu(st), b); err != nil {
+		t.Error(err)
+	}
+	var labels []string
+	for _, it := range stationMenu(st) {
+		labels = append(labels, it.Label)
+	}
+	if got, want := strings.Join(labels, ","), "Scan single,Scan duplex,Last scan,Uploads waiting,Network,Destination,User,Maintenance"; got != want {
+		t.Errorf("Menu %q, want %q", got, want)
+	}
+}
+
+func TestCheckScanners(t *testing.T) {
+	dir := t.TempDir()
+	scanimage, _, err := fake.Scanner{}.Install(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flatbed := path.Join(dir, "flatbed")
+	if err := ioutil.WriteFile(flatbed, []byte(`#!/bin/sh
+cat <<EOF
+All options specific to device 'genesys':
+  Scan Mode:
+    --mode Color|Gray [Color]
+    --source Flatbed [Flatbed]
+    --resolution 75|150|300|600dpi [75]
+EOF
+`), 0755); err != nil {
+		t.Fatal(err)
+	}
+	e := fake.NewESCL(fake.Scanner{})
+	defer e.Close()
+	scanners := []*scanner{
+		{name: "feeder", b: &backend.Backend{Scanner: &backend.Scanimage{Path: scanimage}}},
+		{name: "printer", b: &backend.Backend{Scanner: &backend.ESCL{URL: e.URL()}}},
+		{name: "flatbed", b: &backend.Backend{Scanner: &backend.Scanimage{Path: flatbed}}},
+		{name: "off", b: &backend.Backend{Scanner: &backend.Scanimage{Path: path.Join(dir, "missing")}}},
+	}
+	st := &config.Station{Profiles: map[string]config.Profile{
+		"offline": {Scanner: "off", Duplex: true},
+		"printer": {Scanner: "printer", Duplex: true},
+		"gray":    {Scanner: "printer", Mode: "Gray", Resolution: 200},
+		"lineart": {Scanner: "feeder", Mode: "Lineart", Resolution: 600, Source: "ADF Back"},
+	}}
+	if err := checkScanners(scanners, profiles(st)); err != nil {
+		t.Errorf("Profiles of the fake scanner: %v", err)
+	}
+	st.Profiles["fine"] = config.Profile{Scanner: "feeder", Resolution: 1200}
+	err = checkScanners(scanners, profiles(st))
+	if err == nil || !strings.Contains(err.Error(), `"resolution" can't be "1200"`) {
+		t.Errorf("Profile with too high resolution: %v", err)
+	}
+	delete(st.Profiles, "fine")
+
+	st.Profiles["photo"] = config.Profile{Scanner: "flatbed"}
+	err = checkScanners(scanners, profiles(st))
+	if err == nil || !strings.Contains(err.Error(), `"source" can't be "ADF Front"`) {
+		t.Errorf("Profile for a flatbed scanner with a feeder source: %v", err)
+	}
+}
+
+func TestDevices(t *testing.T) {
+	scanimage, _, err := fake.Scanner{}.Install(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := fake.NewESCL(fake.Scanner{})
+	defer e.Close()
+	feeder := &backend.Backend{Scanner: &backend.Scanimage{Path: scanimage, Device: fake.Device}}
+	f := web.New("web/templates", "web/static", feeder, "", nil)
+	f.AddScanner("feeder", feeder)
+	f.AddScanner("printer", &backend.Backend{Scanner: &backend.ESCL{URL: e.URL()}})
+	f.SetSANE(scanimage)
+	ts := httptest.NewServer(f.Mux)
+	defer ts.Close()
+
+	type device struct {
+		Scanner    string
+		Configured bool
+		Name       string
+		Options    []struct{ Name, Value string }
+		Err        string
+	}
+	getDevices := func() []device {
+		t.Helper()
+		resp, err := http.Get(ts.URL + "/api/devices")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var devs []device
+		if err := json.NewDecoder(resp.Body).Decode(&devs); err != nil {
+			t.Fatal(err)
+		}
+		return devs
+	}
+	// The configured ones, with the options their drivers list. The
+	// one scanimage finds is the feeder.
+	devs := getDevices()
+	if len(devs) != 2 || devs[0].Scanner != "feeder" || devs[0].Name != fake.Device || devs[1].Scanner != "printer" || devs[1].Name != e.URL() {
+		t.Fatalf("Got devices %+v", devs)
+	}
+	for _, d := range devs {
+		if !d.Configured || d.Err != "" || len(d.Options) == 0 {
+			t.Errorf("Device %+v", d)
+		}
+	}
+	if got, want := len(devs[0].Options), 7; got != want {
+		t.Errorf("Got %d options, want %d: %+v", got, want, devs[0].Options)
+	}
+
+	// Found, but not configured.
+	feeder.Scanner = &backend.Scanimage{Path: scanimage, Device: "other"}
+	devs = getDevices()
+	if len(devs) != 3 || devs[2].Configured || devs[2].Name != fake.Device || devs[2].Options != nil {
+		t.Fatalf("Got devices %+v", devs)
+	}
+
+	resp, err := http.Get(ts.URL + "/devices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "ADF Front|ADF Back|ADF Duplex"; !strings.Contains(string(body), want) {
+		t.Errorf("/devices doesn't contain %q:\n%s", want, body)
+	}
+}
+
+// TestSaned scans from a fake saned, through the backend.
+func TestSaned(t *testing.T) {
+	d := fake.NewDrive()
+	defer d.Close()
+	cfg := &config.Drive{ClientID: "c", ClientSecret: "s", RefreshToken: "r", Endpoints: d.Endpoints()}
+	svc, err := cfg.Service(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, convert, err := fake.Scanner{}.Install(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		scanner fake.Scanner
+		duplex  bool
+		kind    backend.ErrorKind
+	}{
+		{fake.Scanner{Sheets: 2}, true, ""},
+		{fake.Scanner{Sheets: 3, Jam: 2}, false, backend.Jam},
+		{fake.Scanner{}, false, backend.NoPaper},
+	} {
+		saned, err := fake.NewSaned(test.scanner)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer saned.Close()
+		lcd := &fake.LCD{}
+		b := &backend.Backend{
+			Scanner:  &backend.Saned{Addr: saned.Addr()},
+			Convert:  convert,
+			SpoolDir: t.TempDir(),
+			UI:       lcd,
+		}
+		b.SetDrive(svc, fake.RootID)
+		err = b.Run(test.duplex)
+		if test.kind != "" {
+			if got := backend.KindOf(err); got != test.kind {
+				t.Errorf("%+v: error kind %q, want %q. Error: %v", test.scanner, got, test.kind, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%+v: %v", test.scanner, err)
+		}
+		if _, _, l2 := lcd.Lines(); l2 != "Uploaded 4 pages" {
+			t.Errorf("%+v: LCD shows %q after scan", test.scanner, l2)
+		}
+		if got := saned.Settings(); got["source"] != "ADF Duplex" || got["mode"] != "Color" || got["resolution"] != "300" {
+			t.Errorf("Scanned with settings %v", got)
+		}
+	}
+}
+
+// TestESCL scans from a fake eSCL scanner, through the backend.
+func TestESCL(t *testing.T) {
+	d := fake.NewDrive()
+	defer d.Close()
+	cfg := &config.Drive{ClientID: "c", ClientSecret: "s", RefreshToken: "r", Endpoints: d.Endpoints()}
+	svc, err := cfg.Service(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, convert, err := fake.Scanner{}.Install(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		scanner  fake.Scanner
+		profile  config.Profile
+		kind     backend.ErrorKind
+		uploaded string
+		settings string
+		settle   int
+	}{
+		{fake.Scanner{Sheets: 2}, config.Profile{Duplex: true}, "", "Uploaded 4 pages", "Feeder true RGB24 300", 0},
+		{fake.Scanner{Sheets: 3, Jam: 2}, config.Profile{}, backend.Jam, "", "", 0},
+		{fake.Scanner{}, config.Profile{}, backend.NoPaper, "", "", 0},
+		{fake.Scanner{}, config.Profile{Source: "Flatbed", Mode: "Gray", Resolution: 200}, "", "Uploaded 1 page", "Platen  Grayscale8 200", 0},
+		// Still Processing after the last page, then Completed.
+		{fake.Scanner{Sheets: 1}, config.Profile{}, "", "Uploaded 1 page", "Feeder  RGB24 300", 2},
+	} {
+		e := fake.NewESCL(test.scanner)
+		e.Settle = test.settle
+		defer e.Close()
+		lcd := &fake.LCD{}
+		b := &backend.Backend{
+			Scanner:  &backend.ESCL{URL: e.URL()},
+			Convert:  convert,
+			SpoolDir: t.TempDir(),
+			UI:       lcd,
+		}
+		b.SetDrive(svc, fake.RootID)
+		err = b.RunProfile("test", test.profile)
+		if test.kind != "" {
+			if got := backend.KindOf(err); got != test.kind {
+				t.Errorf("%+v: error kind %q, want %q. Error: %v", test.scanner, got, test.kind, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%+v: %v", test.scanner, err)
+		}
+		if _, _, l2 := lcd.Lines(); l2 != test.uploaded {
+			t.Errorf("%+v: LCD shows %q after scan, want %q", test.scanner, l2, test.uploaded)
+		}
+		got := e.Settings()
+		if s := strings.Join([]string{got["InputSource"], got["Duplex"], got["ColorMode"], got["XResolution"]}, " "); s != test.settings {
+			t.Errorf("%+v: scanned with settings %q, want %q", test.profile, s, test.settings)
+		}
+	}
+}
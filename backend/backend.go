@@ -1,25 +1,36 @@
 // Package backend implements the scanning, converting and uploading.
 //
 // The UI is outsourced to the "UI" interface, which is implemented by
-// the Adafruit display, and the LED interface (well, not yet). The
-// web UI polls for status via backend.Status(), currently.
+// the Adafruit display and the LEDs. MultiUI sends to several at once.
+// The web UI polls for status via backend.Status(), currently.
 //
 // Triggering a scan is done by calling backend.Run().
+//
+// If the Google Drive credentials stop working, scans are spooled
+// locally until the account is re-authorized in the web UI. See spool.go.
 package backend
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"path"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	drive "google.golang.org/api/drive/v2"
+	drive "google.golang.org/api/drive/v3"
+
+	"github.com/ThomasHabets/autoscan/config"
 )
 
 // State describes what the backend is doing.
@@ -36,24 +47,64 @@ const (
 // A Backend takes care of the actual scanning/converting/uploading process.
 type Backend struct {
 	// Must all be set.
-	Scanimage string
-	Convert   string
-	ParentDir string
-	Drive     *drive.Service
-	UI        UI
+	Scanner Scanner
+	Convert string
+	UI      UI
+
+	// Name of the scanner, for the log, if there's more than one.
+	Name string
+
+	// Where to keep scans until they can be uploaded. Default is in
+	// os.TempDir(), which may not survive a reboot.
+	SpoolDir string
+
+	// How long to wait before retrying to upload them, doubling each
+	// time it fails, up to an hour. Zero means a minute.
+	SpoolRetry time.Duration
+
+	// Upload settings. Files larger than ChunkSize are uploaded in
+	// chunks. Starting the upload and each chunk are retried for up to
+	// RetryDeadline. Zero means defaults, see DefaultRetryDeadline.
+	ChunkSize     int
+	RetryDeadline time.Duration
+
+	// Have Google Drive convert the PDF to a Google Docs document.
+	ConvertToDocs bool
+
+	// Where to keep the latest failure across restarts. Empty to not.
+	FailureFile string
 
 	// Read by external flows, mutex protected.
-	mutex    sync.Mutex
-	state    State
-	lastFail error
-}
+	mutex      sync.Mutex
+	state      State
+	lastFail   error    // Of the running or last job.
+	failure    *Failure // Latest failure, until acknowledged.
+	lastResult *Result
+	cancel     context.CancelFunc // Cancels the running scan, if any.
+	finish     context.CancelFunc // Ends scanning early, keeping the pages.
+	job        Event              // The running job, for job events.
+
+	// Set by SetDrive(), mutex protected. Nil until Google Drive is set up.
+	drive     *drive.Service
+	parentDir string
+
+	// Mutex protected. reauth is non-nil while Google Drive needs to
+	// be re-authorized, and spooling is set while the spool is being
+	// uploaded. spoolTimer is set while a retry is scheduled, after
+	// spoolDelay.
+	reauth     error
+	spooling   bool
+	spoolTimer *time.Timer
+	spoolDelay time.Duration
 
-// UI is the physical UI for autoscan.
-type UI interface {
-	Msg(status, msg string)
-	Run()
+	// Mutex protected. Non-essential parts that aren't working, e.g.
+	// the LCD, by name.
+	degraded map[string]error
 }
 
+// ErrCancelled is returned by Run() if the scan was cancelled.
+var ErrCancelled = errors.New("scan cancelled")
+
 // Set the initial state of the Backend.
 // Only call under mutex lock. Safe to call multiple times.
 func (b *Backend) init() {
@@ -62,123 +113,331 @@ func (b *Backend) init() {
 	}
 }
 
-func (b *Backend) scan(duplex bool, dir string) error {
-	log.Printf("Starting scan. duplex=%t", duplex)
+// SetDrive sets the Google Drive client and the folder to upload to.
+// Safe to call at any time, e.g. when set up or changed in the web UI.
+// Clears any need to re-authorize, and starts uploading spooled scans.
+func (b *Backend) SetDrive(d *drive.Service, parent string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.drive = d
+	b.parentDir = parent
+	if d == nil {
+		return
+	}
+	if b.reauth != nil {
+		b.reauth = nil
+		b.show(Event{Kind: Ready})
+	}
+	go b.uploadSpooled()
+}
+
+// Drive returns the Google Drive client and folder ID, or nil if not set up.
+func (b *Backend) Drive() (*drive.Service, string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.drive, b.parentDir
+}
+
+// showJob sends an event about the running job. Only call under mutex lock.
+func (b *Backend) showJob(ev Event) {
+	ev.Profile, ev.Duplex, ev.Pages = b.job.Profile, b.job.Duplex, b.job.Pages
+	ev.Stage, ev.Uploaded, ev.Size = b.job.Stage, b.job.Uploaded, b.job.Size
+	b.show(ev)
+}
+
+// setStage moves the running job on to a new stage. Only call under mutex lock.
+func (b *Backend) setStage(s State) {
+	b.state = s
+	b.job.Stage = s
+	b.showJob(Event{Kind: JobStage})
+}
+
+// setUploaded updates how much of the running job has been uploaded.
+func (b *Backend) setUploaded(n, size int64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.job.Uploaded, b.job.Size = n, size
+	b.showJob(Event{Kind: JobProgress})
+}
+
+// setPages updates the number of pages in the running job.
+func (b *Backend) setPages(n int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if n == b.job.Pages {
+		return
+	}
+	b.job.Pages = n
+	b.showJob(Event{Kind: JobProgress})
+}
+
+// isPage returns true if a file is a scanned page. See Scanner.
+func isPage(fn string) bool {
+	return strings.HasSuffix(fn, ".pnm") || strings.HasSuffix(fn, ".jpg")
+}
 
-	// Start scan.
-	args := []string{
-		"--format", "PNM",
-		"--resolution", "300",
-		"--mode", "Color",
-		"-b",
+// countPages returns the number of pages scanned so far into dir.
+func countPages(dir string) int {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0
 	}
-	if duplex {
-		args = append(args, "--source", "ADF Duplex")
-	} else {
-		args = append(args, "--source", "ADF Front")
+	n := 0
+	for _, fi := range files {
+		if isPage(fi.Name()) {
+			n++
+		}
 	}
-	var stdout,stderr bytes.Buffer
-	cmd := exec.Command(b.Scanimage, args...)
-	cmd.Dir = dir
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-	err := cmd.Run()
+	return n
+}
+
+// watchPages reports scanned pages until done is closed.
+func (b *Backend) watchPages(dir string, done <-chan struct{}) {
+	t := time.NewTicker(500 * time.Millisecond)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			b.setPages(countPages(dir))
+		}
+	}
+}
+
+// Option is a scanner option, named like in scanimage but without the
+// dashes.
+type Option struct {
+	Name, Value string
+}
+
+// ScanOptions returns the scanner options scans with the profile are
+// made with.
+func ScanOptions(p config.Profile) []Option {
+	res, mode, source := p.Resolution, p.Mode, p.Source
+	if res == 0 {
+		res = 300
+	}
+	if mode == "" {
+		mode = "Color"
+	}
+	if source == "" {
+		source = "ADF Front"
+		if p.Duplex {
+			source = "ADF Duplex"
+		}
+	}
+	return []Option{
+		{"resolution", strconv.Itoa(res)},
+		{"mode", mode},
+		{"source", source},
+	}
+}
+
+func (b *Backend) scan(ctx context.Context, p config.Profile, dir string) error {
+	opts := ScanOptions(p)
+	log.Printf("Starting scan. scanner=%q options=%v", b.Name, opts)
+
+	scanCtx, finish := context.WithCancel(ctx)
+	defer finish()
+	func() {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		b.finish = finish
+	}()
+	defer func() {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		b.finish = nil
+	}()
+
+	done := make(chan struct{})
+	go b.watchPages(dir, done)
+	err := b.Scanner.Scan(scanCtx, opts, dir)
+	close(done)
 
 	// Check scan status.
 	switch {
-	case err == nil:
-		log.Printf("That's odd, expected eventual error code 7, not 0.")
-	case err.Error() == "exit status 7":
-		log.Printf("Scan finished successfully.")
-	default:
-		return fmt.Errorf("scanning failed: %v; stdout=%q / stderr=%q", err, stdout.String(), stderr.String())
+	case ctx.Err() != nil:
+		return ErrCancelled
+	case scanCtx.Err() != nil:
+		// Finished early. The page being scanned may be cut off.
+		if err := removePartial(dir); err != nil {
+			return jobError(LocalStoreError, err)
+		}
+		b.setPages(countPages(dir))
+		log.Printf("Scan finished early.")
+		return nil
+	case err != nil:
+		b.setPages(countPages(dir))
+		return err
+	}
+	b.setPages(countPages(dir))
+	log.Printf("Scan finished successfully.")
+	return nil
+}
+
+// removePartial removes PNM pages that were cut off while being
+// written, going by the size in their header.
+func removePartial(dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		if !strings.HasSuffix(fi.Name(), ".pnm") {
+			continue
+		}
+		fn := path.Join(dir, fi.Name())
+		if ok, err := pnmComplete(fn); err != nil || ok {
+			continue
+		}
+		log.Printf("Removing partly scanned page %q", fn)
+		if err := os.Remove(fn); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func (b *Backend) convert(dir string) error {
+// pnmComplete returns true if a PNM file has all the pixels its header
+// says it has.
+func pnmComplete(fn string) (bool, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	r := bufio.NewReader(f)
+	magic := pnmToken(r)
+	fields := 3 // Width, height and max value.
+	if magic == "P4" {
+		fields = 2
+	}
+	v := []int64{1, 1, 1}
+	for n := 0; n < fields; n++ {
+		if v[n], err = strconv.ParseInt(pnmToken(r), 10, 64); err != nil {
+			return false, nil
+		}
+	}
+	w, h, depth := v[0], v[1], int64(1)
+	if v[2] > 255 {
+		depth = 2
+	}
+	var size int64
+	switch magic {
+	case "P4":
+		size = (w + 7) / 8 * h
+	case "P5":
+		size = w * h * depth
+	case "P6":
+		size = 3 * w * h * depth
+	default:
+		return false, fmt.Errorf("%q is not a binary PNM file", fn)
+	}
+	off, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return false, err
+	}
+	return st.Size()-(off-int64(r.Buffered())) >= size, nil
+}
+
+// pnmToken reads a PNM header field, skipping comments, and the one
+// whitespace byte after it.
+func pnmToken(r *bufio.Reader) string {
+	var tok []byte
+	for {
+		c, err := r.ReadByte()
+		switch {
+		case err != nil:
+			return string(tok)
+		case c == '#' && len(tok) == 0:
+			r.ReadString('\n')
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			if len(tok) > 0 {
+				return string(tok)
+			}
+		default:
+			tok = append(tok, c)
+		}
+	}
+}
+
+func (b *Backend) convert(ctx context.Context, dir string) error {
 	func() {
 		b.mutex.Lock()
 		defer b.mutex.Unlock()
-		b.state = CONVERTING
+		b.setStage(CONVERTING)
 	}()
 	files, err := ioutil.ReadDir(dir)
 	if err != nil {
-		return err
+		return jobError(LocalStoreError, err)
 	}
-	const ext = ".pnm"
-
 	var inFiles []string
 	for _, fn := range files {
 		in := path.Join(dir, fn.Name())
-		if strings.HasSuffix(in, ext) {
+		if isPage(in) {
 			inFiles = append(inFiles, in)
 		}
 	}
 	sort.Slice(inFiles, func(a, b int) bool { return inFiles[a] < inFiles[b] })
 	sort.SliceStable(inFiles, func(a, b int) bool { return len(inFiles[a]) < len(inFiles[b]) })
 	if len(inFiles) == 0 {
-		return fmt.Errorf("zero pages scanned")
+		return jobError(NoPaper, fmt.Errorf("zero pages scanned"))
 	}
-	cmd := exec.Command(b.Convert, inFiles...)
+	cmd := exec.CommandContext(ctx, b.Convert, inFiles...)
 	// Optional: -quality
-	cmd.Args = append(cmd.Args, "-compress","jpeg","out.pdf")
+	cmd.Args = append(cmd.Args, "-compress", "jpeg", "out.pdf")
 	cmd.Dir = dir
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
 	log.Printf("Running %q %q", "convert", cmd.Args)
 	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("running %q %q: %v. Stderr: %q", "convert", cmd.Args, err, stderr.String())
+		if ctx.Err() != nil {
+			return ErrCancelled
+		}
+		return jobError(ConvertError, fmt.Errorf("running %q %q: %v. Stderr: %q", "convert", cmd.Args, err, stderr.String()))
 	}
 	for _, in := range inFiles {
 		if err := os.Remove(in); err != nil {
-			return fmt.Errorf("deleting pnm (%q) after convert: %v", in, err)
+			return jobError(LocalStoreError, fmt.Errorf("deleting page (%q) after convert: %v", in, err))
 		}
 	}
 	return nil
 }
 
-func (b *Backend) upload(dir string) error {
-	func() {
-		b.mutex.Lock()
-		defer b.mutex.Unlock()
-		b.state = UPLOADING
-	}()
-
-	fullName := path.Join(dir, "out.pdf")
-
-	now := time.Now().Format(time.RFC3339)
-	
-	title := fmt.Sprintf("Scan %s.pdf", now)
-	log.Printf("Uploading %q as %q", fullName, title)
-
-	// Upload one file.
-	inf, err := os.Open(fullName)
-	if err != nil {
-		return fmt.Errorf("open(%q): %v", fullName, err)
-	}
-	defer inf.Close()
-	if _, err := b.Drive.Files.Insert(&drive.File{
-		Title:       title,
-		Description: fmt.Sprintf("Scanned by autoscan on %s", now),
-		Parents:     []*drive.ParentReference{{Id: b.ParentDir}},
-		MimeType:    "application/pdf",
-	}).Media(inf).Do(); err != nil {
-		return fmt.Errorf("Drive.Files.Insert(): %v", err)
-	}
-	return nil
-}
-
 // Run runs one scanning round (scan, convert, upload).
 // If a round is already running, return error and do nothing.
 func (b *Backend) Run(duplex bool) error {
-	log.Printf("Scan run triggered in backend.")
+	profile := "single"
+	if duplex {
+		profile = "duplex"
+	}
+	return b.RunProfile(profile, config.Profile{Duplex: duplex})
+}
+
+// RunProfile is Run(), with a scan profile and its name to show in the
+// UI. The scan is uploaded to the profile's folder, if set.
+func (b *Backend) RunProfile(profile string, p config.Profile) error {
+	log.Printf("Scan run triggered in backend. Profile %q", profile)
 	errout := func(err error) {
+		if err == ErrCancelled {
+			log.Printf("Scan run cancelled.")
+			return
+		}
 		b.mutex.Lock()
 		defer b.mutex.Unlock()
 		b.lastFail = err
+		b.setFailure(err)
 		log.Printf("Scan run failed: %v", err)
 	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cancelled := func() bool { return ctx.Err() != nil }
 
 	// Setup state.
 	if err := func() error {
@@ -188,35 +447,41 @@ func (b *Backend) Run(duplex bool) error {
 		if b.state != IDLE {
 			return fmt.Errorf("state not idle, can't start scan now. state: %s", b.state)
 		}
+		if b.drive == nil {
+			return fmt.Errorf("no Google Drive set up, can't start scan. Set it up in the web UI")
+		}
 
 		b.state = SCANNING
 		b.lastFail = nil
+		b.cancel = cancel
+		b.job = Event{Profile: profile, Duplex: p.Duplex, Stage: SCANNING}
+		b.showJob(Event{Kind: JobStarted})
 		return nil
 	}(); err != nil {
 		return err
 	}
-	if duplex {
-		b.UI.Msg("ACTIVE", "Scanning...|Double sided")
-	} else {
-		b.UI.Msg("ACTIVE", "Scanning...|Single sided")
-	}
 
 	// When done, reset to IDLE.
+	var result *Result
 	defer func() {
 		b.mutex.Lock()
 		defer b.mutex.Unlock()
 		b.state = IDLE
-		if b.lastFail == nil {
-			b.UI.Msg("IDLE", "Ready|Last scan succeeded")
-		} else {
-			b.UI.Msg("FAILED", "Failed!|"+b.lastFail.Error())
+		b.cancel = nil
+		switch {
+		case cancelled():
+			b.showJob(Event{Kind: JobFailed, Err: ErrCancelled, ErrKind: Cancelled})
+		case b.lastFail != nil:
+			b.showJob(Event{Kind: JobFailed, Err: b.lastFail, ErrKind: KindOf(b.lastFail)})
+		default:
+			b.showJob(Event{Kind: JobFinished, Result: result, Spooled: result == nil})
 		}
 	}()
 
 	// Create temp dir.
 	dir, err := ioutil.TempDir("", "autoscan-")
 	if err != nil {
-		err = fmt.Errorf("creating tempdir: %v", err)
+		err = jobError(LocalStoreError, fmt.Errorf("creating tempdir: %v", err))
 		errout(err)
 		return err
 	}
@@ -225,33 +490,149 @@ func (b *Backend) Run(duplex bool) error {
 		os.RemoveAll(dir)
 	}()
 
-	if err := b.scan(duplex, dir); err != nil {
+	if err := b.scan(ctx, p, dir); err != nil {
 		errout(err)
 		return err
 	}
 
 	// Convert.
-	b.UI.Msg("ACTIVE", "Converting...|")
-	if err := b.convert(dir); err != nil {
+	if err := b.convert(ctx, dir); err != nil {
 		errout(err)
 		return err
 	}
 
-	// Upload.
-	b.UI.Msg("ACTIVE", "Uploading...|")
-	if err := b.upload(dir); err != nil {
+	// Past this point the scan is kept, so it's too late to cancel.
+	if err := func() error {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		b.cancel = nil
+		if cancelled() {
+			return ErrCancelled
+		}
+		return nil
+	}(); err != nil {
 		errout(err)
 		return err
 	}
 
+	// Upload, or spool if that's not possible right now.
+	now := time.Now()
+	fn := path.Join(dir, "out.pdf")
+	title := fmt.Sprintf("Scan %s.pdf", now.Format(time.RFC3339))
+	if err := b.Reauth(); err != nil {
+		log.Printf("Google Drive needs re-authorization, not uploading: %v", err)
+		if err := b.spool(fn, title, p.Folder); err != nil {
+			err = jobError(LocalStoreError, err)
+			errout(err)
+			return err
+		}
+		return nil
+	}
+	func() {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		b.setStage(UPLOADING)
+	}()
+	res, err := b.upload(fn, title, p.Folder, now, b.setUploaded)
+	if err != nil {
+		// Not verified as uploaded, so keep it.
+		if serr := b.spool(fn, title, p.Folder); serr != nil {
+			err = jobError(LocalStoreError, fmt.Errorf("%v. Also failed to keep local copy: %v", err, serr))
+			errout(err)
+			return err
+		}
+		if !isAuthError(err) {
+			b.retrySpooled()
+			err = jobError(UploadError, err)
+			errout(err)
+			return err
+		}
+		b.needReauth(err)
+		return nil
+	}
+	func() {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		b.lastResult = res
+	}()
+	result = res
+
+	// Drive works, so take the chance to upload anything left over.
+	if b.Spooled() > 0 {
+		go b.uploadSpooled()
+	}
+	return nil
+}
+
+// Finish ends scanning the running scan, keeping the pages scanned so
+// far, which are then converted and uploaded as usual. E.g. to not wait
+// for a feeder that doesn't notice it's empty.
+func (b *Backend) Finish() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.finish == nil {
+		return fmt.Errorf("nothing to finish in state %s", b.state)
+	}
+	log.Printf("Finishing scan.")
+	b.finish()
+	return nil
+}
+
+// Cancel cancels the running scan. Uploads can't be cancelled, since
+// the scan would then be lost.
+func (b *Backend) Cancel() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.cancel == nil {
+		return fmt.Errorf("nothing to cancel in state %s", b.state)
+	}
+	log.Printf("Cancelling scan.")
+	b.cancel()
 	return nil
 }
 
-// Status returns the state and last error of the backend.
-// Both return values are valid, even if error is non-nil.
+// SetDegraded records that a non-essential part isn't working, or that
+// it works again if err is nil. Scanning still works while degraded.
+func (b *Backend) SetDegraded(what string, err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err == nil {
+		delete(b.degraded, what)
+		return
+	}
+	if b.degraded == nil {
+		b.degraded = make(map[string]error)
+	}
+	b.degraded[what] = err
+}
+
+// Degraded returns the parts that aren't working, and why.
+func (b *Backend) Degraded() map[string]error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	ret := make(map[string]error)
+	for k, v := range b.degraded {
+		ret[k] = v
+	}
+	return ret
+}
+
+// LastResult returns where the last successful scan was uploaded, or nil if none.
+func (b *Backend) LastResult() *Result {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.lastResult
+}
+
+// Status returns the state of the backend, and the unacknowledged
+// failure, if any. Both return values are valid, even if error is non-nil.
 func (b *Backend) Status() (State, error) {
 	b.mutex.Lock()
 	defer b.mutex.Unlock()
 	b.init()
-	return b.state, b.lastFail
+	if b.failure == nil || b.failure.Acked() {
+		return b.state, nil
+	}
+	f := *b.failure
+	return b.state, &f
 }
@@ -0,0 +1,256 @@
+package backend
+
+// The eSCL driver, for network scanners that don't need SANE.
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ThomasHabets/autoscan/escl"
+	"github.com/ThomasHabets/autoscan/sane"
+)
+
+// esclModes maps scanimage modes to eSCL colour modes.
+var esclModes = map[string]string{
+	"Lineart": escl.BlackAndWhite1,
+	"Gray":    escl.Grayscale8,
+	"Color":   escl.RGB24,
+}
+
+// esclFormat is what pages are asked for as.
+const esclFormat = "image/jpeg"
+
+// ESCL scans from a network scanner over eSCL, also known as AirScan.
+type ESCL struct {
+	// Where the eSCL service is, e.g. "http://printer.local/eSCL".
+	URL string
+}
+
+// esclSettings returns the eSCL settings for scan options, checked
+// against what the scanner can do.
+func esclSettings(caps *escl.Capabilities, opts []Option) (escl.Settings, error) {
+	s := escl.Settings{
+		Source:     escl.Feeder,
+		ColorMode:  escl.RGB24,
+		Resolution: 300,
+		Format:     esclFormat,
+	}
+	for _, o := range opts {
+		switch o.Name {
+		case "source":
+			switch o.Value {
+			case "ADF Front":
+				s.Source, s.Duplex = escl.Feeder, false
+			case "ADF Duplex":
+				s.Source, s.Duplex = escl.Feeder, true
+			case "Flatbed":
+				s.Source, s.Duplex = escl.Platen, false
+			default:
+				return s, fmt.Errorf("no eSCL source for %q", o.Value)
+			}
+		case "mode":
+			m, ok := esclModes[o.Value]
+			if !ok {
+				return s, fmt.Errorf("no eSCL colour mode for %q", o.Value)
+			}
+			s.ColorMode = m
+		case "resolution":
+			r, err := strconv.Atoi(o.Value)
+			if err != nil {
+				return s, fmt.Errorf("bad resolution %q", o.Value)
+			}
+			s.Resolution = r
+		default:
+			return s, fmt.Errorf("option %q can't be set over eSCL", o.Name)
+		}
+	}
+	ic := caps.Input(s.Source, s.Duplex)
+	switch {
+	case ic == nil:
+		return s, fmt.Errorf("scanner has no %s source (duplex=%t)", s.Source, s.Duplex)
+	case !hasString(ic.ColorModes(), s.ColorMode):
+		return s, fmt.Errorf("scanner can't scan in %s, only %v", s.ColorMode, ic.ColorModes())
+	case !ic.SupportsResolution(s.Resolution):
+		return s, fmt.Errorf("scanner can't scan at %d DPI", s.Resolution)
+	case !hasString(ic.DocumentFormats(), esclFormat):
+		return s, fmt.Errorf("scanner can't send %s, only %v", esclFormat, ic.DocumentFormats())
+	}
+	// All of it. Feeders scan the size of the paper.
+	s.Width, s.Height = ic.MaxWidth, ic.MaxHeight
+	return s, nil
+}
+
+func hasString(l []string, s string) bool {
+	for _, x := range l {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Scan implements Scanner.
+func (e *ESCL) Scan(ctx context.Context, opts []Option, dir string) error {
+	c := &escl.Client{URL: e.URL}
+	caps, err := c.Capabilities(ctx)
+	if err != nil {
+		return jobError(ScannerError, fmt.Errorf("%s: %v", e.URL, err))
+	}
+	s, err := esclSettings(caps, opts)
+	if err != nil {
+		return jobError(ScannerError, fmt.Errorf("%s: %v", e.URL, err))
+	}
+	job, err := c.Scan(ctx, s)
+	if err != nil {
+		// E.g. refused because the feeder is empty, which the
+		// status tells.
+		kind := ScannerError
+		if se, ok := err.(*escl.StatusError); ok && se.Busy() {
+			kind = Busy
+			if st, serr := c.Status(ctx); serr == nil && adfKind(st.ADFState) != ScannerError {
+				kind = adfKind(st.ADFState)
+			}
+		}
+		return jobError(kind, fmt.Errorf("creating scan job: %v", err))
+	}
+	finished := false
+	defer func() {
+		if finished {
+			return
+		}
+		// Don't leave the scanner busy, even when cancelled.
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := job.Cancel(ctx); err != nil {
+			log.Printf("Cancelling eSCL scan job: %v", err)
+		}
+	}()
+	for n := 1; ; n++ {
+		b, typ, err := job.NextDocument(ctx)
+		if err == escl.ErrNoMoreDocuments {
+			finished = true
+			st, err := esclFinish(ctx, c, job)
+			if err != nil {
+				return jobError(ScannerError, fmt.Errorf("getting status of scan job: %v", err))
+			}
+			return esclResult(st, st.Job(job))
+		}
+		if err != nil {
+			return jobError(ScannerError, fmt.Errorf("getting page %d from %s: %v", n, e.URL, err))
+		}
+		if typ != "" && !strings.HasPrefix(typ, esclFormat) {
+			return jobError(ScannerError, fmt.Errorf("page %d is %s, not %s", n, typ, esclFormat))
+		}
+		if err := ioutil.WriteFile(path.Join(dir, fmt.Sprintf("out%d.jpg", n)), b, 0600); err != nil {
+			return jobError(LocalStoreError, err)
+		}
+	}
+}
+
+// esclFinishTimeout is how long a job that has no more pages may stay
+// Pending or Processing, e.g. while the last sheet is ejected.
+const esclFinishTimeout = 30 * time.Second
+
+// esclFinish returns the status of the scanner once the job is no
+// longer Pending or Processing, or has been for esclFinishTimeout.
+// Meanwhile the backend stays SCANNING.
+func esclFinish(ctx context.Context, c *escl.Client, job *escl.Job) (*escl.Status, error) {
+	deadline := time.Now().Add(esclFinishTimeout)
+	for {
+		st, err := c.Status(ctx)
+		if err != nil {
+			return nil, err
+		}
+		j := st.Job(job)
+		if j == nil || (j.State != escl.JobPending && j.State != escl.JobProcessing) || time.Now().After(deadline) {
+			return st, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(escl.DefaultRetry):
+		}
+	}
+}
+
+// esclResult returns the error, if any, of a job that has no more
+// pages, from its state. Completed is done, and Canceled and Aborted
+// are failures, of a kind from the state of the feeder. Still Pending
+// or Processing means the scanner is stuck on it, so Busy.
+func esclResult(st *escl.Status, job *escl.JobInfo) error {
+	if job == nil {
+		// Forgotten, so presumably done.
+		return nil
+	}
+	reasons := strings.Join(job.Reasons, ", ")
+	switch job.State {
+	case escl.JobCompleted:
+		return nil
+	case escl.JobPending, escl.JobProcessing:
+		return jobError(Busy, fmt.Errorf("scan job still %s after %v with no more pages (%s)", job.State, esclFinishTimeout, reasons))
+	case escl.JobCanceled:
+		return jobError(Cancelled, fmt.Errorf("scan job cancelled on the scanner (%s)", reasons))
+	case escl.JobAborted:
+		return jobError(adfKind(st.ADFState), fmt.Errorf("scan job aborted (%s), feeder state %s", reasons, st.ADFState))
+	}
+	return jobError(ScannerError, fmt.Errorf("scan job %s, but has no more pages", job.State))
+}
+
+// adfKind returns the kind of error a feeder state is.
+func adfKind(state string) ErrorKind {
+	switch state {
+	case escl.AdfJam:
+		return Jam
+	case escl.AdfEmpty:
+		return NoPaper
+	case escl.AdfDoorOpen, escl.AdfHatchOpen:
+		return CoverOpen
+	}
+	return ScannerError
+}
+
+// Options lists what the scanner can do, as the scanimage options
+// that ESCL.Scan takes.
+func (e *ESCL) Options(ctx context.Context) ([]sane.Option, error) {
+	caps, err := (&escl.Client{URL: e.URL}).Capabilities(ctx)
+	if err != nil {
+		return nil, err
+	}
+	source := sane.Option{Name: "source", Group: "eSCL", Help: caps.MakeAndModel}
+	mode := sane.Option{Name: "mode", Group: "eSCL"}
+	res := sane.Option{Name: "resolution", Group: "eSCL", Unit: "dpi"}
+	for _, in := range []struct {
+		name string
+		caps *escl.InputCaps
+	}{
+		{"Flatbed", caps.Input(escl.Platen, false)},
+		{"ADF Front", caps.Input(escl.Feeder, false)},
+		{"ADF Duplex", caps.Input(escl.Feeder, true)},
+	} {
+		if in.caps == nil {
+			continue
+		}
+		source.List = append(source.List, in.name)
+		for _, m := range []string{"Lineart", "Gray", "Color"} {
+			if hasString(in.caps.ColorModes(), esclModes[m]) && !hasString(mode.List, m) {
+				mode.List = append(mode.List, m)
+			}
+		}
+		for _, r := range in.caps.Resolutions() {
+			if s := strconv.Itoa(r); !hasString(res.List, s) {
+				res.List = append(res.List, s)
+			}
+		}
+		if min, max, step, ok := in.caps.ResolutionRange(); ok && len(res.List) == 0 {
+			res.Range = true
+			res.Min, res.Max, res.Step = float64(min), float64(max), float64(step)
+		}
+	}
+	return []sane.Option{source, mode, res}, nil
+}
@@ -0,0 +1,32 @@
+package backend
+
+import (
+	"testing"
+
+	"github.com/ThomasHabets/autoscan/escl"
+)
+
+func TestESCLResult(t *testing.T) {
+	for _, test := range []struct {
+		state string
+		adf   string
+		kind  ErrorKind
+	}{
+		{escl.JobCompleted, escl.AdfEmpty, ""},
+		{escl.JobPending, escl.AdfEmpty, Busy},
+		{escl.JobProcessing, escl.AdfEmpty, Busy},
+		{escl.JobCanceled, escl.AdfEmpty, Cancelled},
+		{escl.JobAborted, escl.AdfJam, Jam},
+	} {
+		err := esclResult(&escl.Status{ADFState: test.adf}, &escl.JobInfo{State: test.state})
+		if test.kind == "" {
+			if err != nil {
+				t.Errorf("%s: %v, want success", test.state, err)
+			}
+			continue
+		}
+		if got := KindOf(err); got != test.kind {
+			t.Errorf("%s: error kind %q, want %q. Error: %v", test.state, got, test.kind, err)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package backend
+
+// Failures stay until someone acknowledges them, even if later scans
+// work. They're kept across restarts in Backend.FailureFile.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+// Failure is a failed scan job.
+type Failure struct {
+	Time    time.Time
+	Profile string
+	Err     string
+	Kind    ErrorKind
+
+	// Who acknowledged it and when, e.g. the input "lcd:up". Empty
+	// until acknowledged.
+	AckedBy string
+	AckedAt time.Time
+}
+
+// Error implements error.
+func (f *Failure) Error() string { return f.Err }
+
+// Acked returns true if the failure has been acknowledged.
+func (f *Failure) Acked() bool { return f.AckedBy != "" }
+
+// setFailure records that the running job failed. Only call under mutex lock.
+func (b *Backend) setFailure(err error) {
+	b.failure = &Failure{
+		Time:    time.Now(),
+		Profile: b.job.Profile,
+		Err:     err.Error(),
+		Kind:    KindOf(err),
+	}
+	b.saveFailure()
+}
+
+// saveFailure writes the failure to FailureFile, if set. Only call under mutex lock.
+func (b *Backend) saveFailure() {
+	if b.FailureFile == "" {
+		return
+	}
+	if err := func() error {
+		data, err := json.Marshal(b.failure)
+		if err != nil {
+			return err
+		}
+		tmp := b.FailureFile + ".tmp"
+		if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+			return err
+		}
+		return os.Rename(tmp, b.FailureFile)
+	}(); err != nil {
+		log.Printf("Saving failure to %q: %v", b.FailureFile, err)
+	}
+}
+
+// LoadFailure reads the failure kept by an earlier run, if any.
+func (b *Backend) LoadFailure() error {
+	if b.FailureFile == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(b.FailureFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var f *Failure
+	if err := json.Unmarshal(data, &f); err != nil {
+		return fmt.Errorf("parsing %q: %v", b.FailureFile, err)
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failure = f
+	return nil
+}
+
+// Failure returns the latest failure, acknowledged or not, or nil if none.
+func (b *Backend) Failure() *Failure {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.failure == nil {
+		return nil
+	}
+	f := *b.failure
+	return &f
+}
+
+// Ack acknowledges the failure. who is what acknowledged it, e.g. the
+// input name.
+func (b *Backend) Ack(who string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.init()
+	if b.failure == nil || b.failure.Acked() {
+		return fmt.Errorf("no failure to acknowledge")
+	}
+	log.Printf("Failure acknowledged by %s: %v", who, b.failure)
+	f := *b.failure
+	f.AckedBy, f.AckedAt = who, time.Now()
+	b.failure = &f
+	b.saveFailure()
+	if b.state == IDLE {
+		b.show(Event{Kind: Ready, AckedBy: who})
+	}
+	return nil
+}
+
+// ShowStatus shows the unacknowledged failure, if any, or that the
+// backend is ready. E.g. at startup.
+func (b *Backend) ShowStatus() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if f := b.failure; f != nil && !f.Acked() {
+		b.show(Event{
+			Kind:    JobFailed,
+			Profile: f.Profile,
+			Err:     errors.New(f.Err),
+			ErrKind: f.Kind,
+		})
+		return
+	}
+	b.show(Event{Kind: Ready})
+}
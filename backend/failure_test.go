@@ -0,0 +1,60 @@
+package backend
+
+import (
+	"errors"
+	"path"
+	"testing"
+)
+
+func TestFailure(t *testing.T) {
+	fn := path.Join(t.TempDir(), "failure")
+	b := &Backend{FailureFile: fn}
+	func() {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		b.job = Event{Profile: "single"}
+		b.setFailure(jobError(Jam, errors.New("jammed")))
+		// A later successful job doesn't clear it.
+		b.lastFail = nil
+	}()
+	if _, err := b.Status(); err == nil || err.Error() != "jammed" {
+		t.Errorf("Status() error %v, want jammed", err)
+	}
+
+	// Kept across restarts.
+	ui := &chanUI{msgs: make(chan string, 10)}
+	b = &Backend{FailureFile: fn, UI: ui}
+	if err := b.LoadFailure(); err != nil {
+		t.Fatal(err)
+	}
+	b.ShowStatus()
+	if got, want := <-ui.msgs, "job failed (jam): jammed"; got != want {
+		t.Errorf("Showed %q, want %q", got, want)
+	}
+
+	if err := b.Ack("lcd:up"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := <-ui.msgs, "ready, failure acknowledged by lcd:up"; got != want {
+		t.Errorf("Showed %q, want %q", got, want)
+	}
+	if _, err := b.Status(); err != nil {
+		t.Errorf("Status() error %v after ack", err)
+	}
+	if err := b.Ack("http:ack"); err == nil {
+		t.Errorf("Acked twice")
+	}
+
+	// Who acked is kept too.
+	b = &Backend{FailureFile: fn}
+	if err := b.LoadFailure(); err != nil {
+		t.Fatal(err)
+	}
+	f := b.Failure()
+	if f == nil || f.AckedBy != "lcd:up" || f.AckedAt.IsZero() || f.Profile != "single" || f.Kind != Jam {
+		t.Errorf("Loaded failure %+v", f)
+	}
+	if _, err := b.Status(); err != nil {
+		t.Errorf("Status() error %v for acked failure", err)
+	}
+}
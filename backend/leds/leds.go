@@ -1,87 +1,190 @@
-// Package leds should implement backend.UI, but not yet.
-// This code is no longer called, but should be fixable.
+// Package leds implements backend.UI with two bicolour LEDs.
 //
-// But I have an Adafruit 16x2 instead, so don't hold your breath.
+// The status LED shows that the daemon is alive, and things that need
+// attention outside of any one scan:
+//
+//	Green heartbeat       All is well.
+//	Blinking red          Google Drive needs re-authorization.
+//	Alternating red/green Scans are waiting to be uploaded.
+//
+// The progress LED shows the scan:
+//
+//	Solid green     Ready. Last scan, if any, succeeded.
+//	Fast green      Scanning.
+//	Slow green      Converting.
+//	Green/red       Uploading.
+//	Solid red       A scan failed, and it has not been acked.
+//
+// Each LED has two pins, where pin A lights red and pin B green.
 package leds
 
 import (
 	"fmt"
+	"log"
 	"time"
 
-	"github.com/davecheney/gpio"
+	"github.com/ThomasHabets/autoscan/backend"
+	"github.com/ThomasHabets/autoscan/gpio"
 )
 
-// LEDMode is a what the LED is doing.
-// TODO: This is a bit ugly and untrue since blinking is orthogonal to colour.
-type LEDMode string
+// Tick is how often the LEDs step through their patterns.
+const Tick = time.Second / 8
+
+// A pattern is what an LED shows in each tick, repeating. 'R' is red,
+// 'G' is green and anything else is off.
+type pattern string
 
-// LEDMode "commands".
+// Patterns. All are one second long.
 const (
-	RED      LEDMode = "RED"
-	GREEN    LEDMode = "GREEN"
-	BLINK    LEDMode = "BLINK"
-	OFF      LEDMode = "OFF"
-	SHUTDOWN LEDMode = "SHUTDOWN"
+	heartbeat  pattern = "GG......"
+	attention  pattern = "RRRR...."
+	pending    pattern = "GGGGRRRR"
+	ready      pattern = "G"
+	failed     pattern = "R"
+	scanning   pattern = "GG..GG.."
+	converting pattern = "GGGG...."
+	uploading  pattern = "GGGGRRRR"
 )
 
-// LEDController opens GPIO ports and runs forever, keeping this LED up to date.
-// Send SHUTDOWN to stop this goroutine.
-// Returns a channel notifying that it's done and won't be touching the GPIO ports anymore.
-func LEDController(a, b int, control <-chan LEDMode) (<-chan struct{}, error) {
-	mode := GREEN
-	blink := false
-	blinkOn := false
-	ledA, err := gpio.OpenPin(a, gpio.ModeOutput)
-	if err != nil {
-		return nil, fmt.Errorf("opening LED pin %d: %v", a, err)
+// Source is what the LEDs show the state of. Implemented by *backend.Backend.
+type Source interface {
+	Status() (backend.State, error)
+	Reauth() error
+	Spooled() int
+}
+
+// patterns returns the patterns for the status and progress LEDs.
+func patterns(state backend.State, failure, reauth error, spooled int) (pattern, pattern) {
+	status := heartbeat
+	switch {
+	case reauth != nil:
+		status = attention
+	case spooled > 0:
+		status = pending
 	}
-	ledB, err := gpio.OpenPin(b, gpio.ModeOutput)
-	if err != nil {
-		return nil, fmt.Errorf("opening heartbeat LED pin %d: %v", b, err)
+	progress := ready
+	switch {
+	case state == backend.SCANNING:
+		progress = scanning
+	case state == backend.CONVERTING:
+		progress = converting
+	case state == backend.UPLOADING:
+		progress = uploading
+	case failure != nil:
+		progress = failed
 	}
-	maybe := func() {
-		blinkOn = !blinkOn
-		if blink && !blinkOn {
-			ledA.Clear()
-			ledB.Clear()
-			return
+	return status, progress
+}
+
+// led is one bicolour LED.
+type led struct {
+	a, b gpio.Output
+}
+
+func (l *led) show(p pattern, step int) error {
+	c := p[step%len(p)]
+	if err := l.a.Set(c == 'R'); err != nil {
+		return err
+	}
+	return l.b.Set(c == 'G')
+}
+
+// LEDs is a status and a progress LED. It implements backend.UI.
+type LEDs struct {
+	src      Source
+	lines    []gpio.Output
+	status   led
+	progress led
+	update   chan struct{}
+
+	// Only touched by the Run() goroutine.
+	step                           int
+	statusPattern, progressPattern pattern
+}
+
+// New requests the GPIO lines for the status LED (pins sa, sb) and the
+// progress LED (pins pa, pb).
+func New(chip gpio.Chip, sa, sb, pa, pb int, src Source) (*LEDs, error) {
+	l := &LEDs{
+		src:    src,
+		update: make(chan struct{}, 1),
+	}
+	var pins []gpio.Output
+	for _, p := range []int{sa, sb, pa, pb} {
+		o, err := chip.Output(p, false)
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("opening LED pin %d: %v", p, err)
+		}
+		pins = append(pins, o)
+		l.lines = append(l.lines, o)
+	}
+	l.status = led{a: pins[0], b: pins[1]}
+	l.progress = led{a: pins[2], b: pins[3]}
+	l.refresh()
+	return l, nil
+}
+
+// Close turns off the LEDs and releases the GPIO lines.
+func (l *LEDs) Close() error {
+	var ret error
+	for _, o := range l.lines {
+		o.Set(false)
+		if err := o.Close(); err != nil && ret == nil {
+			ret = err
 		}
-		switch mode {
-		case RED:
-			ledA.Set()
-			ledB.Clear()
-		case GREEN:
-			ledA.Clear()
-			ledB.Set()
-		case OFF:
-			ledA.Clear()
-			ledB.Clear()
+	}
+	l.lines = nil
+	return ret
+}
+
+// Show implements backend.UI. The LEDs show the backend state rather
+// than the event, so this just triggers a refresh. It's called with
+// the backend mutex held, so it must not block or call the backend.
+func (l *LEDs) Show(ev backend.Event) {
+	select {
+	case l.update <- struct{}{}:
+	default:
+	}
+}
+
+// refresh picks patterns from the backend state.
+func (l *LEDs) refresh() {
+	state, failure := l.src.Status()
+	l.statusPattern, l.progressPattern = patterns(state, failure, l.src.Reauth(), l.src.Spooled())
+}
+
+// show sets the LEDs for the current step, and moves on to the next.
+func (l *LEDs) show() {
+	for _, x := range []struct {
+		led *led
+		p   pattern
+	}{
+		{&l.status, l.statusPattern},
+		{&l.progress, l.progressPattern},
+	} {
+		if err := x.led.show(x.p, l.step); err != nil {
+			log.Printf("Setting LED: %v", err)
 		}
 	}
-	done := make(chan struct{})
-	go func() {
-		defer func() {
-			ledA.Close()
-			ledB.Close()
-			close(done)
-		}()
-
-		for {
-			select {
-			case <-time.After(time.Second / 2):
-			case m := <-control:
-				switch m {
-				case SHUTDOWN:
-					return
-				case BLINK:
-					blink = true
-				default:
-					blink = false
-					mode = m
-				}
+	l.step = (l.step + 1) % len(heartbeat)
+}
+
+// Run implements backend.UI. Runs forever, updating the LEDs.
+func (l *LEDs) Run() {
+	t := time.NewTicker(Tick)
+	defer t.Stop()
+	for {
+		select {
+		case <-l.update:
+			l.refresh()
+		case <-t.C:
+			// Catch state the backend doesn't send events about,
+			// like the spool emptying.
+			if l.step == 0 {
+				l.refresh()
 			}
-			maybe()
+			l.show()
 		}
-	}()
-	return done, nil
+	}
 }
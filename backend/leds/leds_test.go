@@ -0,0 +1,85 @@
+package leds
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ThomasHabets/autoscan/backend"
+	"github.com/ThomasHabets/autoscan/gpio"
+)
+
+type fakeSource struct {
+	state    backend.State
+	lastFail error
+	reauth   error
+	spooled  int
+}
+
+func (f *fakeSource) Status() (backend.State, error) { return f.state, f.lastFail }
+func (f *fakeSource) Reauth() error                  { return f.reauth }
+func (f *fakeSource) Spooled() int                   { return f.spooled }
+
+// colours returns what the LEDs showed during one pattern cycle.
+func colours(t *testing.T, l *LEDs, chip *gpio.Fake) (string, string) {
+	t.Helper()
+	var status, progress []byte
+	c := func(a, b int) byte {
+		av, _ := chip.Get(a)
+		bv, _ := chip.Get(b)
+		switch {
+		case av && bv:
+			t.Fatalf("LED on pins %d/%d both red and green", a, b)
+		case av:
+			return 'R'
+		case bv:
+			return 'G'
+		}
+		return '.'
+	}
+	l.refresh()
+	for i := 0; i < len(heartbeat); i++ {
+		l.show()
+		status = append(status, c(1, 2))
+		progress = append(progress, c(3, 4))
+	}
+	return string(status), string(progress)
+}
+
+func TestLEDs(t *testing.T) {
+	chip := gpio.NewFake()
+	src := &fakeSource{state: backend.IDLE}
+	l, err := New(chip, 1, 2, 3, 4, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name             string
+		src              fakeSource
+		status, progress string
+	}{
+		{"idle", fakeSource{state: backend.IDLE}, "GG......", "GGGGGGGG"},
+		{"scanning", fakeSource{state: backend.SCANNING}, "GG......", "GG..GG.."},
+		{"converting", fakeSource{state: backend.CONVERTING}, "GG......", "GGGG...."},
+		{"uploading", fakeSource{state: backend.UPLOADING}, "GG......", "GGGGRRRR"},
+		{"failed", fakeSource{state: backend.IDLE, lastFail: errors.New("jam")}, "GG......", "RRRRRRRR"},
+		{"reauth", fakeSource{state: backend.IDLE, reauth: errors.New("revoked"), spooled: 1}, "RRRR....", "GGGGGGGG"},
+		{"spooled", fakeSource{state: backend.IDLE, spooled: 2}, "GGGGRRRR", "GGGGGGGG"},
+	} {
+		*src = test.src
+		status, progress := colours(t, l, chip)
+		if status != test.status {
+			t.Errorf("%s: status LED %q, want %q", test.name, status, test.status)
+		}
+		if progress != test.progress {
+			t.Errorf("%s: progress LED %q, want %q", test.name, progress, test.progress)
+		}
+	}
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := chip.Get(1); ok {
+		t.Errorf("LED pin still requested after Close()")
+	}
+}
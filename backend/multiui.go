@@ -0,0 +1,93 @@
+package backend
+
+import (
+	"log"
+	"sync"
+)
+
+// uiQueueSize is how many events can be waiting for one UI before
+// the oldest are dropped.
+const uiQueueSize = 16
+
+// queuedUI is one UI in a MultiUI.
+type queuedUI struct {
+	ui    UI
+	queue chan Event
+
+	// Mutex protected by MultiUI.mutex.
+	dead bool
+}
+
+// MultiUI sends every event to any number of UIs.
+//
+// Each UI gets its own queue and goroutine, so a slow or stuck UI
+// doesn't block the scan, or the other UIs. If a UI falls behind the
+// oldest events are dropped, since the newest one is the current
+// state. A UI that panics is logged and dropped.
+type MultiUI struct {
+	mutex sync.Mutex
+	uis   []*queuedUI
+}
+
+// Add adds a UI, and starts running it.
+func (m *MultiUI) Add(ui UI) {
+	q := &queuedUI{
+		ui:    ui,
+		queue: make(chan Event, uiQueueSize),
+	}
+	func() {
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		m.uis = append(m.uis, q)
+	}()
+	go m.guard(q, "running", ui.Run)
+	go m.guard(q, "sending to", func() {
+		for ev := range q.queue {
+			ui.Show(ev)
+		}
+	})
+}
+
+// guard runs f, and drops the UI if it panics.
+func (m *MultiUI) guard(q *queuedUI, what string, f func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("UI crashed %s %T, dropping it: %v", what, q.ui, r)
+			m.mutex.Lock()
+			defer m.mutex.Unlock()
+			if !q.dead {
+				q.dead = true
+				close(q.queue)
+			}
+		}
+	}()
+	f()
+}
+
+// Show implements UI. Never blocks.
+func (m *MultiUI) Show(ev Event) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, q := range m.uis {
+		if q.dead {
+			continue
+		}
+		for {
+			select {
+			case q.queue <- ev:
+			default:
+				// Full. Drop the oldest and try again.
+				select {
+				case <-q.queue:
+					log.Printf("UI %T is behind, dropping event.", q.ui)
+				default:
+				}
+				continue
+			}
+			break
+		}
+	}
+}
+
+// Run implements UI. Does nothing, since UIs are run when they're added.
+func (m *MultiUI) Run() {}
@@ -0,0 +1,65 @@
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+// chanUI sends events on a channel.
+type chanUI struct {
+	msgs chan string
+}
+
+func (c *chanUI) Show(ev Event) { c.msgs <- ev.String() }
+func (c *chanUI) Run()          {}
+
+// panicUI crashes on the first event.
+type panicUI struct{}
+
+func (*panicUI) Show(ev Event) { panic("LCD on fire") }
+func (*panicUI) Run()          {}
+
+func TestMultiUI(t *testing.T) {
+	stuck := &chanUI{msgs: make(chan string)}
+	good := &chanUI{msgs: make(chan string, 100)}
+	m := &MultiUI{}
+	m.Add(stuck)
+	m.Add(&panicUI{})
+	m.Add(good)
+
+	// Neither the stuck nor the crashing UI blocks anything.
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 3*uiQueueSize; i++ {
+			m.Show(Event{Kind: JobProgress, Pages: i})
+		}
+		m.Show(Event{Kind: Ready})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Show() blocked")
+	}
+	waitMsg(t, good.msgs, "ready")
+
+	// The stuck UI eventually gets the newest message, but not all.
+	if n := waitMsg(t, stuck.msgs, "ready"); n > uiQueueSize+1 {
+		t.Errorf("Stuck UI got %d messages, expected old ones to be dropped", n)
+	}
+}
+
+// waitMsg waits for a message, and returns how many were received.
+func waitMsg(t *testing.T, msgs <-chan string, want string) int {
+	t.Helper()
+	for n := 1; ; n++ {
+		select {
+		case got := <-msgs:
+			if got == want {
+				return n
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %q", want)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package backend
+
+// Scanner drivers.
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+
+	"github.com/ThomasHabets/autoscan/sane"
+)
+
+// Scanner scans pages. Implemented by Scanimage, Saned and ESCL.
+type Scanner interface {
+	// Scan scans all pages in the feeder into dir, as PNM or JPEG
+	// files that sort in page order by length and then name, e.g.
+	// out1.pnm, out2.pnm ... out10.pnm. An empty feeder isn't an
+	// error, there are just no pages. Errors should be JobErrors.
+	Scan(ctx context.Context, opts []Option, dir string) error
+}
+
+// OptionLister is a Scanner that can list the options of its device.
+// Implemented by Scanimage, Saned and ESCL.
+type OptionLister interface {
+	Options(ctx context.Context) ([]sane.Option, error)
+}
+
+// Scanimage scans by running scanimage from SANE.
+type Scanimage struct {
+	// Scanimage binary or wrapper script.
+	Path string
+
+	// SANE device, passed as -d. Empty for scanimage's default.
+	Device string
+}
+
+// Scan implements Scanner.
+func (s *Scanimage) Scan(ctx context.Context, opts []Option, dir string) error {
+	args := []string{
+		"--format", "PNM",
+		"-b",
+	}
+	if s.Device != "" {
+		args = append(args, "-d", s.Device)
+	}
+	for _, o := range opts {
+		args = append(args, "--"+o.Name, o.Value)
+	}
+	if flatbed(opts) {
+		// Else it scans the same page forever.
+		args = append(args, "--batch-count=1")
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, s.Path, args...)
+	cmd.Dir = dir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	switch {
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case err == nil:
+		if !flatbed(opts) {
+			log.Printf("That's odd, expected eventual error code 7, not 0.")
+		}
+	case err.Error() == "exit status 7":
+		// Out of paper, so done.
+	default:
+		return jobError(scanimageErrorKind(err), fmt.Errorf("scanning failed: %v; stdout=%q / stderr=%q", err, stdout.String(), stderr.String()))
+	}
+	return nil
+}
+
+// Options lists the options of the device.
+func (s *Scanimage) Options(ctx context.Context) ([]sane.Option, error) {
+	return sane.Options(ctx, s.Path, s.Device)
+}
+
+// Saned scans from another host running saned, over the SANE network
+// protocol.
+type Saned struct {
+	// Host, or host:port.
+	Addr string
+
+	// SANE device on that host. Empty for its first.
+	Device string
+}
+
+// open connects to saned, and opens the device.
+func (s *Saned) open(ctx context.Context) (*sane.Client, *sane.Handle, error) {
+	c, err := sane.Dial(ctx, s.Addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	dev := s.Device
+	if dev == "" {
+		devs, err := c.Devices(ctx)
+		if err != nil {
+			c.Close()
+			return nil, nil, fmt.Errorf("listing devices of %s: %v", s.Addr, err)
+		}
+		if len(devs) == 0 {
+			c.Close()
+			return nil, nil, fmt.Errorf("%s has no devices", s.Addr)
+		}
+		dev = devs[0].Name
+	}
+	h, err := c.Open(ctx, dev)
+	if err != nil {
+		c.Close()
+		return nil, nil, fmt.Errorf("%s: %v", s.Addr, err)
+	}
+	return c, h, nil
+}
+
+// Scan implements Scanner.
+func (s *Saned) Scan(ctx context.Context, opts []Option, dir string) error {
+	c, h, err := s.open(ctx)
+	if err != nil {
+		return jobError(saneErrorKind(err), err)
+	}
+	defer c.Close()
+	defer h.Close(ctx)
+	for _, o := range opts {
+		if err := h.Set(ctx, o.Name, o.Value); err != nil {
+			return jobError(saneErrorKind(err), fmt.Errorf("%s: %v", s.Addr, err))
+		}
+	}
+	// Ends the batch, including after errors.
+	defer h.Cancel(ctx)
+	for n := 1; ; n++ {
+		p, err := h.Read(ctx)
+		if err == sane.StatusNoDocs {
+			return nil
+		}
+		if err != nil {
+			return jobError(saneErrorKind(err), fmt.Errorf("scanning page %d from %s: %v", n, s.Addr, err))
+		}
+		if err := writePNM(path.Join(dir, fmt.Sprintf("out%d.pnm", n)), p); err != nil {
+			return jobError(LocalStoreError, err)
+		}
+		if flatbed(opts) {
+			return nil
+		}
+	}
+}
+
+// flatbed returns true if the options scan from a flatbed, which has one
+// page, instead of a feeder.
+func flatbed(opts []Option) bool {
+	for _, o := range opts {
+		if o.Name == "source" && o.Value == "Flatbed" {
+			return true
+		}
+	}
+	return false
+}
+
+// Options lists the options of the device.
+func (s *Saned) Options(ctx context.Context) ([]sane.Option, error) {
+	c, h, err := s.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	defer h.Close(ctx)
+	return h.Options(ctx)
+}
+
+// writePNM writes a page to a file.
+func writePNM(fn string, p *sane.Page) error {
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	if err := p.WritePNM(f); err != nil {
+		f.Close()
+		return fmt.Errorf("writing %q: %v", fn, err)
+	}
+	return f.Close()
+}
+
+// saneErrorKind returns the kind of an error from saned.
+func saneErrorKind(err error) ErrorKind {
+	var st sane.Status
+	if errors.As(err, &st) {
+		return statusKind(int(st))
+	}
+	return ScannerError
+}
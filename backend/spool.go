@@ -0,0 +1,235 @@
+package backend
+
+// Scans that can't be uploaded, or where the upload couldn't be
+// verified, are moved to the spool directory. If the Google Drive
+// credentials stopped working (refresh token expired or revoked) they're
+// uploaded when the account has been re-authorized, which calls
+// SetDrive(). Otherwise after the next successful upload, or when
+// retried after a while, backing off while Drive can't be reached.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	oauth "golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// How long to wait before retrying spooled uploads, by default.
+	// Doubles each time it fails, up to maxSpoolRetry.
+	defaultSpoolRetry = time.Minute
+	maxSpoolRetry     = time.Hour
+)
+
+// isAuthError returns true if err means that the user has to authorize autoscan again.
+// Other errors, like the network being down, are not auth errors.
+func isAuthError(err error) bool {
+	var re *oauth.RetrieveError
+	if errors.As(err, &re) {
+		switch re.ErrorCode {
+		case "invalid_grant", "invalid_client", "unauthorized_client":
+			return true
+		}
+		return re.Response != nil && re.Response.StatusCode == http.StatusUnauthorized
+	}
+	var ge *googleapi.Error
+	if errors.As(err, &ge) {
+		return ge.Code == http.StatusUnauthorized
+	}
+	return false
+}
+
+// needReauth enters the sticky "needs re-authorization" condition.
+func (b *Backend) needReauth(err error) {
+	log.Printf("Google Drive needs re-authorization: %v", err)
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.reauth = err
+	b.show(Event{Kind: NeedsReauth, Err: err, ErrKind: AuthError})
+}
+
+// Reauth returns the auth error if Google Drive needs to be re-authorized, or nil.
+func (b *Backend) Reauth() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.reauth
+}
+
+func (b *Backend) spoolDir() string {
+	if b.SpoolDir != "" {
+		return b.SpoolDir
+	}
+	return path.Join(os.TempDir(), "autoscan-spool")
+}
+
+// Spooled returns the number of scans waiting to be uploaded.
+func (b *Backend) Spooled() int {
+	files, err := ioutil.ReadDir(b.spoolDir())
+	if err != nil {
+		return 0
+	}
+	return len(files)
+}
+
+// spool moves fn to the spool directory, to be uploaded later as title
+// into folder, or the default folder if empty.
+func (b *Backend) spool(fn, title, folder string) error {
+	dir := b.spoolDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("creating spool dir %q: %v", dir, err)
+	}
+	// Titles are only to the second, so add a unique suffix, and
+	// the folder if not the default. See spoolTitle() and
+	// spoolFolder().
+	pattern := title + "."
+	if folder != "" {
+		pattern += "*" + spoolFolderSep + folder
+	}
+	f, err := ioutil.TempFile(dir, pattern)
+	if err != nil {
+		return fmt.Errorf("creating spool file: %v", err)
+	}
+	f.Close()
+	out := f.Name()
+	log.Printf("Spooling %q as %q", fn, out)
+	if err := os.Rename(fn, out); err == nil {
+		return nil
+	}
+	// Probably different filesystems.
+	if err := copyFile(fn, out); err != nil {
+		os.Remove(out)
+		return fmt.Errorf("spooling %q: %v", fn, err)
+	}
+	return nil
+}
+
+// spoolTitle returns the title to upload a spooled file as, which is
+// its name without the unique suffix. Files spooled by older versions
+// have no suffix.
+func spoolTitle(name string) string {
+	if i := strings.LastIndex(name, ".pdf."); i >= 0 {
+		return name[:i+len(".pdf")]
+	}
+	return name
+}
+
+// spoolFolderSep separates the unique suffix of a spooled file from
+// the folder it's to be uploaded to. Drive folder IDs have no dots.
+const spoolFolderSep = ".to-"
+
+// spoolFolder returns the folder to upload a spooled file to, or empty
+// for the default.
+func spoolFolder(name string) string {
+	if i := strings.LastIndex(name, spoolFolderSep); i >= 0 {
+		return name[i+len(spoolFolderSep):]
+	}
+	return ""
+}
+
+func copyFile(from, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(to, os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// retrySpooled schedules uploading the spool again, unless already
+// scheduled. The delay doubles each time, until the spool has been
+// uploaded.
+func (b *Backend) retrySpooled() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.spoolTimer != nil {
+		return
+	}
+	switch {
+	case b.spoolDelay == 0:
+		b.spoolDelay = b.SpoolRetry
+		if b.spoolDelay <= 0 {
+			b.spoolDelay = defaultSpoolRetry
+		}
+	case b.spoolDelay < maxSpoolRetry:
+		b.spoolDelay *= 2
+		if b.spoolDelay > maxSpoolRetry {
+			b.spoolDelay = maxSpoolRetry
+		}
+	}
+	log.Printf("Retrying spooled uploads in %v", b.spoolDelay)
+	b.spoolTimer = time.AfterFunc(b.spoolDelay, func() {
+		func() {
+			b.mutex.Lock()
+			defer b.mutex.Unlock()
+			b.spoolTimer = nil
+		}()
+		b.uploadSpooled()
+	})
+}
+
+// uploadSpooled uploads and deletes spooled scans, until done or one
+// fails. If one fails, other than for needing re-authorization, it's
+// retried later.
+func (b *Backend) uploadSpooled() {
+	if !func() bool {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		if b.spooling || b.reauth != nil {
+			return false
+		}
+		b.spooling = true
+		return true
+	}() {
+		return
+	}
+	defer func() {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		b.spooling = false
+	}()
+
+	dir := b.spoolDir()
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Reading spool dir %q: %v", dir, err)
+		}
+		return
+	}
+	for _, fi := range files {
+		fn := path.Join(dir, fi.Name())
+		if _, err := b.upload(fn, spoolTitle(fi.Name()), spoolFolder(fi.Name()), fi.ModTime(), nil); err != nil {
+			log.Printf("Uploading spooled scan %q: %v", fn, err)
+			if isAuthError(err) {
+				b.needReauth(err)
+				return
+			}
+			b.retrySpooled()
+			return
+		}
+		if err := os.Remove(fn); err != nil {
+			log.Printf("Deleting uploaded spooled scan %q: %v", fn, err)
+			return
+		}
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.spoolDelay = 0
+}
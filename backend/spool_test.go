@@ -0,0 +1,71 @@
+package backend
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+
+	oauth "golang.org/x/oauth2"
+	drive "google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+)
+
+func TestUploadAuthErrors(t *testing.T) {
+	m := http.NewServeMux()
+	m.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "invalid_grant", "error_description": "Token has been expired or revoked."}`))
+	})
+	m.HandleFunc("/upload/drive/v3/files", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error": {"code": 401, "message": "Invalid Credentials"}}`, http.StatusUnauthorized)
+	})
+	s := httptest.NewServer(m)
+	defer s.Close()
+
+	fn := path.Join(t.TempDir(), "out.pdf")
+	if err := ioutil.WriteFile(fn, []byte("%PDF-1.4\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	conf := &oauth.Config{Endpoint: oauth.Endpoint{TokenURL: s.URL + "/token"}}
+	for _, test := range []struct {
+		name   string
+		client *http.Client
+		want   bool
+	}{
+		{"revoked", conf.Client(context.Background(), &oauth.Token{RefreshToken: "old"}), true},
+		{"401", conf.Client(context.Background(), &oauth.Token{AccessToken: "bad", Expiry: time.Now().Add(time.Hour)}), true},
+	} {
+		d, err := drive.NewService(context.Background(), option.WithHTTPClient(test.client), option.WithEndpoint(s.URL+"/drive/v3/"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := &Backend{SpoolDir: t.TempDir()}
+		b.SetDrive(d, "parent")
+		_, err = b.upload(fn, "test.pdf", "", time.Now(), nil)
+		if err == nil {
+			t.Fatalf("%s: upload succeeded", test.name)
+		}
+		if got := isAuthError(err); got != test.want {
+			t.Errorf("%s: isAuthError(%v) = %t, want %t", test.name, err, got, test.want)
+		}
+	}
+
+	// Network errors are not auth errors.
+	s.Close()
+	d, err := drive.NewService(context.Background(), option.WithHTTPClient(http.DefaultClient), option.WithEndpoint(s.URL+"/drive/v3/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Don't retry for the default minute.
+	b := &Backend{SpoolDir: t.TempDir(), RetryDeadline: time.Millisecond}
+	b.SetDrive(d, "parent")
+	if _, err := b.upload(fn, "test.pdf", "", time.Now(), nil); err == nil || isAuthError(err) {
+		t.Errorf("network error: got %v, want non-auth error", err)
+	}
+}
@@ -0,0 +1,199 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+// UI is the physical UI for autoscan. Each UI renders events in its
+// own way, e.g. the LCD truncates them to fit 16x2 characters.
+type UI interface {
+	// Show shows an event. Called with the backend mutex held, so
+	// must not call back into the backend. Use MultiUI to not block.
+	Show(ev Event)
+	Run()
+}
+
+// EventKind is what happened.
+type EventKind int
+
+// Event kinds.
+const (
+	// Ready to scan. Sent at startup, and when a failure has been
+	// acked (see AckedBy) or Google Drive re-authorized.
+	Ready EventKind = iota + 1
+
+	JobStarted  // A scan job started. Profile and Duplex are set.
+	JobStage    // The job moved on to Stage.
+	JobProgress // Pages have been scanned, or bytes uploaded.
+	JobFinished // Scan uploaded, or kept locally if Spooled.
+	JobFailed   // Job failed with Err, of kind ErrKind.
+
+	// Google Drive needs to be re-authorized in the web UI.
+	NeedsReauth
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case Ready:
+		return "ready"
+	case JobStarted:
+		return "started"
+	case JobStage:
+		return "stage"
+	case JobProgress:
+		return "progress"
+	case JobFinished:
+		return "finished"
+	case JobFailed:
+		return "failed"
+	case NeedsReauth:
+		return "needs-reauth"
+	}
+	return "unknown"
+}
+
+// ErrorKind is what kind of failure a job had, so that UIs can show
+// something more useful than the error text.
+type ErrorKind string
+
+// Error kinds.
+const (
+	OtherError      ErrorKind = "other"
+	Cancelled       ErrorKind = "cancelled"
+	NoPaper         ErrorKind = "no-paper"
+	Jam             ErrorKind = "jam"
+	CoverOpen       ErrorKind = "cover-open"
+	Busy            ErrorKind = "busy"
+	ScannerError    ErrorKind = "scanner"
+	ConvertError    ErrorKind = "convert"
+	UploadError     ErrorKind = "upload"
+	AuthError       ErrorKind = "auth"
+	LocalStoreError ErrorKind = "local-store"
+)
+
+// JobError is an error with a kind.
+type JobError struct {
+	Kind ErrorKind
+	Err  error
+}
+
+func (e *JobError) Error() string { return e.Err.Error() }
+func (e *JobError) Unwrap() error { return e.Err }
+
+// jobError wraps err with a kind.
+func jobError(kind ErrorKind, err error) error {
+	return &JobError{Kind: kind, Err: err}
+}
+
+// KindOf returns the kind of a job error.
+func KindOf(err error) ErrorKind {
+	if err == ErrCancelled {
+		return Cancelled
+	}
+	var je *JobError
+	if errors.As(err, &je) {
+		return je.Kind
+	}
+	return OtherError
+}
+
+// scanimageErrorKind returns the kind of a scanimage exit error, from
+// its SANE status code exit code.
+func scanimageErrorKind(err error) ErrorKind {
+	var ee *exec.ExitError
+	if !errors.As(err, &ee) {
+		return ScannerError
+	}
+	return statusKind(ee.ExitCode())
+}
+
+// statusKind returns the kind of error a SANE status code is.
+func statusKind(code int) ErrorKind {
+	switch code {
+	case 3:
+		return Busy
+	case 6:
+		return Jam
+	case 7:
+		return NoPaper
+	case 8:
+		return CoverOpen
+	}
+	return ScannerError
+}
+
+// Event is something for the UI to show.
+type Event struct {
+	Kind EventKind
+	Time time.Time
+
+	// Job events.
+	Profile string
+	Duplex  bool
+	Stage   State // What the job is doing.
+	Pages   int   // Pages scanned so far.
+
+	// Bytes uploaded so far, of Size. Only known for files uploaded
+	// in chunks, see Backend.ChunkSize.
+	Uploaded, Size int64
+
+	// JobFinished.
+	Result  *Result // Nil if Spooled.
+	Spooled bool    // Kept locally, to be uploaded later.
+
+	// JobFailed and NeedsReauth.
+	Err     error
+	ErrKind ErrorKind
+
+	// Ready, after a failure was acknowledged. E.g. the input "lcd:up".
+	AckedBy string
+}
+
+func (e Event) String() string {
+	switch e.Kind {
+	case JobStarted:
+		return fmt.Sprintf("job started, profile %q duplex=%t", e.Profile, e.Duplex)
+	case JobStage:
+		return fmt.Sprintf("job %s", e.Stage)
+	case JobProgress:
+		if e.Size > 0 {
+			return fmt.Sprintf("job uploaded %d/%d bytes", e.Uploaded, e.Size)
+		}
+		return fmt.Sprintf("job scanned %d pages", e.Pages)
+	case JobFinished:
+		if e.Spooled {
+			return fmt.Sprintf("job finished, %d pages kept locally", e.Pages)
+		}
+		return fmt.Sprintf("job finished, %d pages uploaded", e.Pages)
+	case JobFailed:
+		return fmt.Sprintf("job failed (%s): %v", e.ErrKind, e.Err)
+	case NeedsReauth:
+		return fmt.Sprintf("needs re-authorization: %v", e.Err)
+	case Ready:
+		if e.AckedBy != "" {
+			return "ready, failure acknowledged by " + e.AckedBy
+		}
+	}
+	return e.Kind.String()
+}
+
+// show sends an event to the UI, if any. Only call under mutex lock.
+func (b *Backend) show(ev Event) {
+	if b.UI == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	b.UI.Show(ev)
+}
+
+// Show sends an event to the UI, e.g. Ready at startup.
+func (b *Backend) Show(ev Event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.show(ev)
+}
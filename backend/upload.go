@@ -0,0 +1,183 @@
+package backend
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	drive "google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	docsMimeType = "application/vnd.google-apps.document"
+
+	// How many times to try uploading if the checksum doesn't match.
+	uploadAttempts = 3
+
+	// First delay before retrying after a transient error. Doubles each time.
+	retryDelay = 250 * time.Millisecond
+
+	// DefaultRetryDeadline is how long to retry uploads on transient
+	// errors, if Backend.RetryDeadline is zero.
+	DefaultRetryDeadline = time.Minute
+)
+
+// Result is where a scan ended up.
+type Result struct {
+	Time   time.Time
+	Title  string
+	FileID string
+	URL    string
+}
+
+// isTransient returns true if err may go away if the upload is retried.
+func isTransient(err error) bool {
+	if isAuthError(err) {
+		return false
+	}
+	var ge *googleapi.Error
+	if errors.As(err, &ge) {
+		return ge.Code == http.StatusTooManyRequests || ge.Code >= 500
+	}
+	var ne net.Error
+	return errors.As(err, &ne)
+}
+
+func md5File(fn string) (string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// upload uploads one file to Google Drive, and verifies that what
+// arrived has the same checksum as the local file. The local file
+// must not be deleted unless this returns success. It goes into folder,
+// or the folder set by SetDrive() if empty. If progress is not nil it's
+// called with bytes uploaded so far, and the file size.
+func (b *Backend) upload(fn, title, folder string, scanned time.Time, progress func(n, size int64)) (*Result, error) {
+	d, parent := b.Drive()
+	if d == nil {
+		return nil, fmt.Errorf("no Google Drive set up")
+	}
+	if folder != "" {
+		parent = folder
+	}
+	sum, err := md5File(fn)
+	if err != nil {
+		return nil, fmt.Errorf("checksumming %q: %v", fn, err)
+	}
+	deadline := time.Now().Add(b.retryDeadline())
+	delay := retryDelay
+	for attempt := 1; ; attempt++ {
+		f, err := b.uploadOnce(d, parent, fn, title, scanned, progress)
+		if err != nil {
+			// Chunks of resumable uploads are retried by the Drive
+			// client, but starting the upload isn't.
+			if !isTransient(err) || time.Now().Add(delay).After(deadline) {
+				return nil, err
+			}
+			log.Printf("Upload failed, retrying in %v: %v", delay, err)
+			time.Sleep(delay)
+			delay *= 2
+			attempt--
+			continue
+		}
+		res := &Result{
+			Time:   scanned,
+			Title:  f.Name,
+			FileID: f.Id,
+			URL:    f.WebViewLink,
+		}
+		if b.ConvertToDocs {
+			// Converted documents have no checksum. The best we can do is
+			// trust that Drive didn't return success unless it got it all.
+			log.Printf("Uploaded %q as %q, converted so can't verify checksum", fn, f.Id)
+			return res, nil
+		}
+		if f.Md5Checksum == sum {
+			log.Printf("Uploaded %q as %q, checksum %s verified", fn, f.Id, sum)
+			return res, nil
+		}
+		err = fmt.Errorf("checksum mismatch uploading %q: local %s, remote %s", fn, sum, f.Md5Checksum)
+		log.Printf("Attempt %d/%d: %v", attempt, uploadAttempts, err)
+		if derr := d.Files.Delete(f.Id).SupportsAllDrives(true).Do(); derr != nil {
+			log.Printf("Deleting bad upload %q: %v", f.Id, derr)
+		}
+		if attempt == uploadAttempts {
+			return nil, err
+		}
+	}
+}
+
+// retryDeadline returns how long to retry uploads on transient errors.
+func (b *Backend) retryDeadline() time.Duration {
+	if b.RetryDeadline <= 0 {
+		return DefaultRetryDeadline
+	}
+	return b.RetryDeadline
+}
+
+func (b *Backend) uploadOnce(d *drive.Service, parent, fn, title string, scanned time.Time, progress func(n, size int64)) (*drive.File, error) {
+	log.Printf("Uploading %q as %q into %q", fn, title, parent)
+
+	inf, err := os.Open(fn)
+	if err != nil {
+		return nil, fmt.Errorf("open(%q): %v", fn, err)
+	}
+	defer inf.Close()
+	f := &drive.File{
+		Name:        title,
+		Description: fmt.Sprintf("Scanned by autoscan on %s", scanned.Format(time.RFC3339)),
+		Parents:     []string{parent},
+		MimeType:    "application/pdf",
+	}
+	if b.ConvertToDocs {
+		// Google Drive converts PDFs by OCR.
+		f.Name = strings.TrimSuffix(title, ".pdf")
+		f.MimeType = docsMimeType
+	}
+	chunkSize := b.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = googleapi.DefaultUploadChunkSize
+	}
+	opts := []googleapi.MediaOption{
+		googleapi.ContentType("application/pdf"),
+		googleapi.ChunkSize(chunkSize),
+		googleapi.ChunkRetryDeadline(b.retryDeadline()),
+	}
+	call := d.Files.Create(f).Media(inf, opts...)
+	if progress != nil {
+		st, err := inf.Stat()
+		if err != nil {
+			return nil, fmt.Errorf("stat(%q): %v", fn, err)
+		}
+		// Total is not known to the Drive client, since it's given a reader.
+		call.ProgressUpdater(func(current, _ int64) {
+			progress(current, st.Size())
+		})
+	}
+	ret, err := call.SupportsAllDrives(true).
+		Fields("id,name,md5Checksum,webViewLink").
+		Do()
+	if err != nil {
+		// %w, so that isAuthError() can see what kind of error it is.
+		return nil, fmt.Errorf("Drive.Files.Create(): %w", err)
+	}
+	return ret, nil
+}
@@ -0,0 +1,113 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+
+	drive "google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+)
+
+func TestUploadChecksumRetry(t *testing.T) {
+	fn := path.Join(t.TempDir(), "out.pdf")
+	if err := ioutil.WriteFile(fn, []byte("%PDF-1.4\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sum, err := md5File(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var uploads int
+	var deleted []string
+	m := http.NewServeMux()
+	m.HandleFunc("/upload/drive/v3/files", func(w http.ResponseWriter, r *http.Request) {
+		uploads++
+		md5 := sum
+		if uploads == 1 {
+			md5 = "corrupted"
+		}
+		id := fmt.Sprintf("file-%d", uploads)
+		json.NewEncoder(w).Encode(map[string]string{
+			"id":          id,
+			"md5Checksum": md5,
+			"webViewLink": "https://drive.example.com/" + id,
+		})
+	})
+	m.HandleFunc("/drive/v3/files/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "DELETE" {
+			http.NotFound(w, r)
+			return
+		}
+		deleted = append(deleted, path.Base(r.URL.Path))
+		w.WriteHeader(http.StatusNoContent)
+	})
+	s := httptest.NewServer(m)
+	defer s.Close()
+
+	d, err := drive.NewService(context.Background(), option.WithHTTPClient(http.DefaultClient), option.WithEndpoint(s.URL+"/drive/v3/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &Backend{SpoolDir: t.TempDir()}
+	b.SetDrive(d, "parent")
+	res, err := b.upload(fn, "test.pdf", "", time.Now(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := uploads, 2; got != want {
+		t.Errorf("uploads = %d, want %d", got, want)
+	}
+	if got, want := fmt.Sprint(deleted), "[file-1]"; got != want {
+		t.Errorf("deleted = %s, want %s", got, want)
+	}
+	if got, want := res.FileID, "file-2"; got != want {
+		t.Errorf("FileID = %q, want %q", got, want)
+	}
+	if got, want := res.URL, "https://drive.example.com/file-2"; got != want {
+		t.Errorf("URL = %q, want %q", got, want)
+	}
+}
+
+// TestUploadStartRetry checks that a transient error starting the upload
+// is retried with the default deadline.
+func TestUploadStartRetry(t *testing.T) {
+	fn := path.Join(t.TempDir(), "out.pdf")
+	if err := ioutil.WriteFile(fn, []byte("%PDF-1.4\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sum, err := md5File(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var uploads int
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uploads++
+		if uploads == 1 {
+			http.Error(w, "Try again.", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id": "file", "md5Checksum": sum})
+	}))
+	defer s.Close()
+
+	d, err := drive.NewService(context.Background(), option.WithHTTPClient(http.DefaultClient), option.WithEndpoint(s.URL+"/drive/v3/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &Backend{SpoolDir: t.TempDir()}
+	b.SetDrive(d, "parent")
+	if _, err := b.upload(fn, "test.pdf", "", time.Now(), nil); err != nil {
+		t.Fatal(err)
+	}
+	if uploads != 2 {
+		t.Errorf("uploads = %d, want 2", uploads)
+	}
+}
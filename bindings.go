@@ -0,0 +1,327 @@
+package main
+
+// Wiring inputs to actions. The defaults match how autoscan has always
+// behaved, and the -station config file can change any of it.
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ThomasHabets/autoscan/actions"
+	"github.com/ThomasHabets/autoscan/adafruit"
+	"github.com/ThomasHabets/autoscan/backend"
+	"github.com/ThomasHabets/autoscan/config"
+	"github.com/ThomasHabets/autoscan/power"
+)
+
+var (
+	stationFile = flag.String("station", "", "JSON file with scan profiles and input bindings. Default is built-in bindings only.")
+	auditLog    = flag.String("audit_log", "", "File to record every action run in, and what triggered it.")
+
+	rebootCommand   = flag.String("reboot_command", "", "Command to reboot, e.g. 'sudo reboot'. Default is to ask systemd-logind over D-Bus.")
+	poweroffCommand = flag.String("poweroff_command", "", "Command to shut down, e.g. 'sudo poweroff'. Default is to ask systemd-logind over D-Bus.")
+)
+
+// defaultBindings returns the built-in input to action bindings.
+func defaultBindings() map[string]string {
+	return map[string]string{
+		fmt.Sprintf("gpio:%d:tap", *pinButtonSingle):  actions.Start + ":single",
+		fmt.Sprintf("gpio:%d:long", *pinButtonSingle): actions.Start + ":duplex",
+		fmt.Sprintf("gpio:%d:tap", *pinButtonDuplex):  actions.Start + ":duplex",
+		fmt.Sprintf("gpio:%d:tap", *pinButton3):       actions.Ack,
+		fmt.Sprintf("gpio:%d:long", *pinButton4):      actions.Reboot,
+
+		"lcd:select": actions.Start + ":single",
+		"lcd:right":  actions.Start + ":duplex",
+		"lcd:up":     actions.Ack,
+		"lcd:down":   actions.PageNext,
+		"lcd:left":   actions.Menu,
+
+		"term:s": actions.Start + ":single",
+		"term:d": actions.Start + ":duplex",
+		"term:c": actions.Cancel,
+		"term:f": actions.Finish,
+		"term:a": actions.Ack,
+
+		"http:single": actions.Start + ":single",
+		"http:duplex": actions.Start + ":duplex",
+		"http:cancel": actions.Cancel,
+		"http:finish": actions.Finish,
+		"http:ack":    actions.Ack,
+	}
+}
+
+// readStation reads the station config, or returns an empty one if there's no file.
+func readStation(fn string) (*config.Station, error) {
+	if fn == "" {
+		return &config.Station{}, nil
+	}
+	return config.ReadStation(fn)
+}
+
+// profileNames returns the names of the scan profiles in st, other than
+// the built-in ones, sorted.
+func profileNames(st *config.Station) []string {
+	var ret []string
+	for name := range st.Profiles {
+		if name != "single" && name != "duplex" {
+			ret = append(ret, name)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// profiles returns the built-in scan profiles, and those in st.
+func profiles(st *config.Station) map[string]config.Profile {
+	ret := map[string]config.Profile{
+		"single": {Duplex: false},
+		"duplex": {Duplex: true},
+	}
+	for name, p := range st.Profiles {
+		ret[name] = p
+	}
+	return ret
+}
+
+// picked is the destination or user that scans are uploaded to, for
+// profiles without a folder of their own. Empty is the folder set up in
+// the web UI.
+type picked struct {
+	mutex  sync.Mutex
+	folder string
+}
+
+// get returns the picked folder, or empty for the default.
+func (p *picked) get() string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.folder
+}
+
+// handler returns a handler for the destination or user action,
+// picking a folder by name, or the default if there's no argument.
+func (p *picked) handler(what string, folders map[string]string) actions.Handler {
+	return func(arg, from string) error {
+		folder := ""
+		if arg != "" {
+			var ok bool
+			if folder, ok = folders[arg]; !ok {
+				return fmt.Errorf("no such %s %q", what, arg)
+			}
+		}
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		p.folder = folder
+		log.Printf("Uploading to %s %q, folder %q, as picked by %s", what, arg, folder, from)
+		return nil
+	}
+}
+
+// checkPick returns an error if action picks a destination or user
+// that st doesn't have.
+func checkPick(st *config.Station, action string) error {
+	name, arg := action, ""
+	if n := strings.Index(action, ":"); n >= 0 {
+		name, arg = action[:n], action[n+1:]
+	}
+	if arg == "" {
+		return nil
+	}
+	switch name {
+	case actions.Destination:
+		if _, ok := st.Destinations[arg]; !ok {
+			return fmt.Errorf("no such destination %q", arg)
+		}
+	case actions.User:
+		if _, ok := st.Users[arg]; !ok {
+			return fmt.Errorf("no such user %q", arg)
+		}
+	}
+	return nil
+}
+
+// checkMenuPicks returns an error if a menu item picks a destination or
+// user that st doesn't have.
+func checkMenuPicks(st *config.Station, items []config.MenuItem) error {
+	for _, it := range items {
+		if err := checkPick(st, it.Action); err != nil {
+			return fmt.Errorf("menu item %q: %v", it.Label, err)
+		}
+		if err := checkMenuPicks(st, it.Items); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pickMenu returns a submenu picking one of names with action, or the
+// default.
+func pickMenu(label, action string, folders map[string]string) config.MenuItem {
+	var names []string
+	for name := range folders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ret := config.MenuItem{Label: label, Items: []config.MenuItem{{Label: "Default", Action: action}}}
+	for _, name := range names {
+		ret.Items = append(ret.Items, config.MenuItem{Label: name, Action: action + ":" + name})
+	}
+	return ret
+}
+
+// stationMenu returns the LCD menu in st, or else the built-in one with
+// submenus for picking the destinations and users in st, if any.
+func stationMenu(st *config.Station) []config.MenuItem {
+	if st.Menu != nil {
+		return st.Menu
+	}
+	ret := append([]config.MenuItem{}, adafruit.DefaultMenu...)
+	// Before Maintenance, which is last.
+	last := ret[len(ret)-1]
+	ret = ret[:len(ret)-1]
+	if len(st.Destinations) > 0 {
+		ret = append(ret, pickMenu("Destination", actions.Destination, st.Destinations))
+	}
+	if len(st.Users) > 0 {
+		ret = append(ret, pickMenu("User", actions.User, st.Users))
+	}
+	return append(ret, last)
+}
+
+// newDispatcher creates a dispatcher with the default bindings
+// overridden by st, and handlers for the actions the backends can do.
+func newDispatcher(scanners []*scanner, st *config.Station) (*actions.Dispatcher, error) {
+	d := actions.New()
+	if *auditLog != "" {
+		f, err := os.OpenFile(*auditLog, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0660)
+		if err != nil {
+			return nil, fmt.Errorf("opening audit log: %v", err)
+		}
+		d.Audit = f
+	}
+	defaults := defaultBindings()
+	if len(scanners) > 1 {
+		// For the status page of each scanner.
+		for _, s := range scanners {
+			defaults["http:ack:"+s.name] = actions.Ack + ":" + s.name
+			defaults["http:cancel:"+s.name] = actions.Cancel + ":" + s.name
+		}
+	}
+	for _, bs := range []map[string]string{defaults, st.Bindings} {
+		for in, a := range bs {
+			if actions.Power(a) && !actions.Deliberate(in) {
+				return nil, fmt.Errorf("input %q: %q needs a long press or a chord of GPIO buttons", in, a)
+			}
+			if err := d.Bind(in, a); err != nil {
+				return nil, err
+			}
+			if err := checkPick(st, a); err != nil {
+				return nil, fmt.Errorf("input %q: %v", in, err)
+			}
+		}
+	}
+	if err := checkMenuPicks(st, st.Menu); err != nil {
+		return nil, err
+	}
+
+	profiles := profiles(st)
+	pick := &picked{}
+	d.Handle(actions.Start, func(arg, _ string) error {
+		name, sname := arg, ""
+		if n := strings.Index(arg, ":"); n >= 0 {
+			name, sname = arg[:n], arg[n+1:]
+		}
+		p, ok := profiles[name]
+		if !ok {
+			return fmt.Errorf("no such profile %q", name)
+		}
+		if sname == "" {
+			sname = p.Scanner
+		}
+		if p.Folder == "" {
+			p.Folder = pick.get()
+		}
+		s := scanners[0]
+		if sname != "" {
+			if s = findScanner(scanners, sname); s == nil {
+				return fmt.Errorf("no such scanner %q", sname)
+			}
+		}
+		// Scans take a while, and inputs must keep working to cancel.
+		go func() {
+			if err := s.b.RunProfile(name, p); err != nil {
+				log.Printf("Scan with profile %q: %v", name, err)
+			}
+		}()
+		return nil
+	})
+	d.Handle(actions.Cancel, eachScanner(scanners, func(b *backend.Backend, _ string) error { return b.Cancel() }))
+	d.Handle(actions.Finish, eachScanner(scanners, func(b *backend.Backend, _ string) error { return b.Finish() }))
+	d.Handle(actions.Ack, eachScanner(scanners, (*backend.Backend).Ack))
+	d.Handle(actions.Destination, pick.handler("destination", st.Destinations))
+	d.Handle(actions.User, pick.handler("user", st.Users))
+	pw := &power.Power{
+		RebootCommand:   strings.Fields(*rebootCommand),
+		PoweroffCommand: strings.Fields(*poweroffCommand),
+	}
+	d.Handle(actions.Reboot, powerHandler(scanners, actions.Reboot, pw.Reboot))
+	d.Handle(actions.Shutdown, powerHandler(scanners, actions.Shutdown, pw.Poweroff))
+	return d, nil
+}
+
+// eachScanner returns a handler running f on the scanner named by the
+// argument, or on all of them if there's no argument. It works if f
+// works for any of them, e.g. cancelling whichever scans are running.
+func eachScanner(scanners []*scanner, f func(b *backend.Backend, from string) error) actions.Handler {
+	return func(arg, from string) error {
+		if arg != "" {
+			s := findScanner(scanners, arg)
+			if s == nil {
+				return fmt.Errorf("no such scanner %q", arg)
+			}
+			return f(s.b, from)
+		}
+		var ret error
+		ok := false
+		for _, s := range scanners {
+			if err := f(s.b, from); err == nil {
+				ok = true
+			} else if ret == nil {
+				ret = err
+			}
+		}
+		if ok {
+			return nil
+		}
+		return ret
+	}
+}
+
+// powerHandler returns a handler for reboot or shutdown. It refuses
+// while a scan is running, unless the argument is "force", and always
+// from the web UI and HTTP, which anyone on the network can use.
+func powerHandler(scanners []*scanner, name string, f func() error) actions.Handler {
+	return func(arg, from string) error {
+		if strings.HasPrefix(from, "web:") || strings.HasPrefix(from, "http:") {
+			return fmt.Errorf("not allowed from the web UI or HTTP")
+		}
+		switch arg {
+		case "", "force":
+		default:
+			return fmt.Errorf("unknown argument %q, only \"force\" is allowed", arg)
+		}
+		for _, s := range scanners {
+			if st, _ := s.b.Status(); st != backend.IDLE && arg != "force" {
+				return fmt.Errorf("scan in progress (%s). Use %s:force to %s anyway", st, name, name)
+			}
+		}
+		log.Printf("%s requested by %s", name, from)
+		return f()
+	}
+}
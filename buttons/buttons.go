@@ -1,140 +1,115 @@
-// Package buttons is not used, currently. It's half of the LED based interface.
-// See comments there.
+// Package buttons is half of the LED based interface: GPIO buttons.
+// See comments in the leds package.
 package buttons
 
 /*
 
-Buttons
- Duplex    Starts autoscan -feeder.
- Single   Starts autoscan in single-page mode. Autoscan handles the UI from there.
+Buttons report inputs named after their GPIO pin to an action
+dispatcher, which decides what they do. See package actions.
 
-Undecided:
+Default wiring (see autoscan.go):
+ Single   Tap: scan single-sided. Hold: scan double-sided.
+ Duplex   Tap: scan double-sided.
  ACK      If something goes wrong the status LED will blink until ACK is pressed.
- Reboot   Reboots the raspberry pi.
+ Reboot   Hold: reboots the raspberry pi.
 
 */
 import (
-	"bufio"
 	"fmt"
 	"log"
-	"os"
-	"path"
 	"time"
 
-	"github.com/ThomasHabets/autoscan/backend"
-	"github.com/ThomasHabets/autoscan/backend/leds"
+	"github.com/ThomasHabets/autoscan/gpio"
 )
 
-// Buttons keeps track of the buttons and notifies backend and LEDs.
-type Buttons struct {
-	Backend  *backend.Backend
-	Progress chan<- leds.LEDMode
-
-	Duplex *input
-	Single *input
-	ACK    *input
-	Reboot *input
+// Inputs is where button events are sent. Implemented by *actions.Dispatcher.
+type Inputs interface {
+	Input(name string) error
 }
 
-type button int
-
-const (
-	single button = iota // Scans single-sided pages.
-	duplex               // Scans double-sided pages.
-	ack                  // Turns a red lamp green.
-	reboot               // Reboots the machine.
-)
-
-const (
-	// BasePath is where are the GPIO special files are.
-	BasePath = "/sys/class/gpio"
-)
+// Buttons keeps track of the buttons and reports them as inputs.
+type Buttons struct {
+	Inputs Inputs
 
-type input struct {
-	File *os.File
-}
+	// How long a line must be stable to count, and how long a button
+	// must be held for a long press. Zero means defaults.
+	Debounce  time.Duration
+	LongPress time.Duration
 
-func openInput(n int) (*input, error) {
-	f, err := os.Open(path.Join(BasePath, fmt.Sprintf("gpio%d", n), "value"))
-	if err != nil {
-		return nil, err
-	}
-	return &input{
-		File: f,
-	}, nil
+	events chan gpio.Event
+	pins   []int
+	lines  []gpio.Input
 }
 
-// New opens GPIO pins and creates a new Buttons.
-func New(s, b, a, r int) (*Buttons, error) {
-	ret := &Buttons{}
-	var err error
-
-	ret.Single, err = openInput(s)
-	if err != nil {
-		return nil, fmt.Errorf("opening single pin %d: %v", a, err)
-	}
-
-	ret.Duplex, err = openInput(b)
-	if err != nil {
-		return nil, fmt.Errorf("opening duplex pin %d: %v", a, err)
-	}
-
-	ret.ACK, err = openInput(a)
-	if err != nil {
-		return nil, fmt.Errorf("opening ACK pin %d: %v", a, err)
+// New requests the GPIO lines for the buttons and creates a new Buttons.
+func New(chip gpio.Chip, cfg gpio.InputConfig, pins ...int) (*Buttons, error) {
+	ret := &Buttons{
+		events: make(chan gpio.Event, 16),
 	}
-
-	ret.Reboot, err = openInput(r)
-	if err != nil {
-		return nil, fmt.Errorf("opening reboot pin %d: %v", a, err)
+	for _, pin := range pins {
+		l, err := chip.Input(pin, cfg, ret.events)
+		if err != nil {
+			ret.Close()
+			return nil, fmt.Errorf("opening button pin %d: %v", pin, err)
+		}
+		ret.lines = append(ret.lines, l)
+		ret.pins = append(ret.pins, pin)
 	}
-
 	return ret, nil
 }
 
-// wait for a button to be pressed, and return that button.
-func (b *Buttons) waitButton() button {
-	btns := map[button]*input{
-		single: b.Single,
-		duplex: b.Duplex,
-		ack:    b.ACK,
-		reboot: b.Reboot,
-	}
-	// Poll for button status.
-	// This is an ugly ugly hack, but the 'gpio' package is unstable.
-	// TODO: Switch to edge triggering, or a stable package that does edge triggering.
-	// This loop takes around 1% CPU. Crazy, I know.
-	for {
-		time.Sleep(100 * time.Millisecond)
-		for k, v := range btns {
-			v.File.Seek(0, 0)
-			r := bufio.NewReader(v.File)
-			l, _ := r.ReadString('\n')
-			if len(l) > 0 && l[0] == '1' {
-				return k
-			}
+// Close releases the GPIO lines.
+func (b *Buttons) Close() error {
+	var ret error
+	for _, l := range b.lines {
+		if err := l.Close(); err != nil && ret == nil {
+			ret = err
 		}
 	}
+	b.lines = nil
+	return ret
 }
 
 // Run listens to button presses. Forever.
 func (b *Buttons) Run() {
 	log.Printf("Starting button reading loop.")
+	debounce, longPress := b.Debounce, b.LongPress
+	if debounce == 0 {
+		debounce = DefaultDebounce
+	}
+	if longPress == 0 {
+		longPress = DefaultLongPress
+	}
+	d := newDebouncer(debounce, longPress)
+	for _, pin := range b.pins {
+		d.add(pin)
+	}
+	timer := time.NewTimer(0)
 	for {
-		btn := b.waitButton()
-		switch btn {
-		case single:
-			log.Printf("SINGLE button pressed.")
-			b.Backend.Run(false)
-		case duplex:
-			log.Printf("DUPLEX button pressed.")
-			b.Backend.Run(true)
-		case ack:
-			log.Printf("ACK button pressed.")
-			b.Progress <- leds.GREEN
-		case reboot:
-			log.Printf("REBOOT button pressed.")
+		var timeout <-chan time.Time
+		if t, ok := d.next(); ok {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(time.Until(t))
+			timeout = timer.C
+		}
+		select {
+		case ev, ok := <-b.events:
+			if !ok {
+				return
+			}
+			d.edge(ev, time.Now())
+		case <-timeout:
+		}
+		for _, ev := range d.check(time.Now()) {
+			for _, in := range ev.Inputs() {
+				// Errors are logged by the dispatcher.
+				b.Inputs.Input(in)
+			}
 		}
-		time.Sleep(time.Second)
 	}
 }
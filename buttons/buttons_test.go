@@ -0,0 +1,112 @@
+package buttons
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ThomasHabets/autoscan/gpio"
+)
+
+type fakeInputs struct {
+	inputs chan string
+}
+
+func (f *fakeInputs) Input(name string) error {
+	f.inputs <- name
+	return nil
+}
+
+// expect waits for the wanted inputs, in order.
+func (f *fakeInputs) expect(t *testing.T, want ...string) {
+	t.Helper()
+	for _, w := range want {
+		select {
+		case got := <-f.inputs:
+			if got != w {
+				t.Errorf("Got input %q, want %q", got, w)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for input %q", w)
+		}
+	}
+	select {
+	case got := <-f.inputs:
+		t.Errorf("Got unexpected input %q", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestButtons(t *testing.T) {
+	chip := gpio.NewFake()
+	b, err := New(chip, gpio.InputConfig{}, 5, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	in := &fakeInputs{inputs: make(chan string, 10)}
+	b.Inputs = in
+	b.Debounce = 20 * time.Millisecond
+	b.LongPress = 200 * time.Millisecond
+	go b.Run()
+
+	// Bouncing tap is one tap.
+	chip.Set(6, true)
+	chip.Set(6, false)
+	chip.Set(6, true)
+	time.Sleep(50 * time.Millisecond)
+	chip.Set(6, false)
+	chip.Set(6, true)
+	chip.Set(6, false)
+	in.expect(t, "gpio:6:press", "gpio:6:release", "gpio:6:tap")
+
+	// Hold is not a tap.
+	chip.Set(5, true)
+	in.expect(t, "gpio:5:press", "gpio:5:long")
+	chip.Set(5, false)
+	in.expect(t, "gpio:5:release")
+
+	// Chord is neither tap nor long press.
+	chip.Set(6, true)
+	time.Sleep(50 * time.Millisecond)
+	chip.Set(5, true)
+	time.Sleep(300 * time.Millisecond)
+	chip.Set(5, false)
+	chip.Set(6, false)
+	in.expect(t, "gpio:6:press", "gpio:5:press", "gpio:5+6:chord", "gpio:5:release", "gpio:6:release")
+
+	if _, err := New(chip, gpio.InputConfig{}, 5, 6); err == nil {
+		t.Errorf("Requested busy lines twice")
+	}
+}
+
+func TestDebouncer(t *testing.T) {
+	d := newDebouncer(10*time.Millisecond, time.Second)
+	d.add(1)
+	d.add(2)
+	start := time.Now()
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+
+	d.edge(gpio.Event{Offset: 1, Edge: gpio.Rising}, at(0))
+	if evs := d.check(at(5)); len(evs) != 0 {
+		t.Errorf("Events before debounce time: %v", evs)
+	}
+	if next, _ := d.next(); !next.Equal(at(10)) {
+		t.Errorf("next() = %v, want %v", next.Sub(start), 10*time.Millisecond)
+	}
+	if evs := d.check(at(10)); len(evs) != 1 || evs[0].Kind != Press {
+		t.Errorf("Want press, got %v", evs)
+	}
+	d.edge(gpio.Event{Offset: 2, Edge: gpio.Rising}, at(100))
+	evs := d.check(at(200))
+	if len(evs) != 2 || evs[1] != (Event{Kind: Chord, Pin: 1, Other: 2}) {
+		t.Errorf("Want press and chord, got %v", evs)
+	}
+	if evs := d.check(at(5000)); len(evs) != 0 {
+		t.Errorf("Long press during chord: %v", evs)
+	}
+	d.edge(gpio.Event{Offset: 1, Edge: gpio.Falling}, at(6000))
+	evs = d.check(at(6010))
+	if len(evs) != 1 || evs[0].Kind != Release || evs[0].Tap || evs[0].Held != 6*time.Second {
+		t.Errorf("Want non-tap release, got %v", evs)
+	}
+}
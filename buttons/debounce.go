@@ -0,0 +1,184 @@
+package buttons
+
+// Turning raw GPIO edges into button events.
+//
+// A button is considered pressed or released once its line has been
+// stable for Debounce. A button held down for LongPress gets a
+// LongPress event, and pressing a second button while one is held down
+// is a Chord. Buttons that took part in a chord don't get long-press
+// or tap events, so a chord is never also two single presses.
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ThomasHabets/autoscan/gpio"
+)
+
+// Defaults for Buttons.Debounce and Buttons.LongPress.
+const (
+	DefaultDebounce  = 50 * time.Millisecond
+	DefaultLongPress = time.Second
+)
+
+// Kind is the kind of button event.
+type Kind int
+
+// Button event kinds.
+const (
+	Press     Kind = iota + 1 // Button went down.
+	Release                   // Button went up.
+	LongPress                 // Button has been held down for LongPress.
+	Chord                     // A second button went down while the first was held.
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Press:
+		return "press"
+	case Release:
+		return "release"
+	case LongPress:
+		return "long-press"
+	case Chord:
+		return "chord"
+	}
+	return "unknown"
+}
+
+// Event is a debounced button event.
+type Event struct {
+	Kind Kind
+	Pin  int
+
+	// For Chord, the pin of the button pressed second.
+	Other int
+
+	// For Release, how long the button was held down, and whether it
+	// was a tap: released before LongPress and not part of a chord.
+	Held time.Duration
+	Tap  bool
+}
+
+// Inputs returns the input names of the event, as used in bindings.
+// See package actions.
+func (e Event) Inputs() []string {
+	switch e.Kind {
+	case Press:
+		return []string{fmt.Sprintf("gpio:%d:press", e.Pin)}
+	case Release:
+		ret := []string{fmt.Sprintf("gpio:%d:release", e.Pin)}
+		if e.Tap {
+			ret = append(ret, fmt.Sprintf("gpio:%d:tap", e.Pin))
+		}
+		return ret
+	case LongPress:
+		return []string{fmt.Sprintf("gpio:%d:long", e.Pin)}
+	case Chord:
+		a, b := e.Pin, e.Other
+		if a > b {
+			a, b = b, a
+		}
+		return []string{fmt.Sprintf("gpio:%d+%d:chord", a, b)}
+	}
+	return nil
+}
+
+// lineState is the debouncing state of one button.
+type lineState struct {
+	pin int
+
+	raw      bool // Last value seen on the line.
+	rawSince time.Time
+
+	down      bool // Debounced value.
+	downSince time.Time
+	long      bool // LongPress sent for this press.
+	chord     bool // Part of a chord during this press.
+}
+
+// debouncer turns raw edges into button events.
+type debouncer struct {
+	debounce  time.Duration
+	longPress time.Duration
+	lines     map[int]*lineState
+	order     []*lineState // Deterministic event order.
+}
+
+func newDebouncer(debounce, longPress time.Duration) *debouncer {
+	return &debouncer{
+		debounce:  debounce,
+		longPress: longPress,
+		lines:     make(map[int]*lineState),
+	}
+}
+
+func (d *debouncer) add(offset int) {
+	s := &lineState{pin: offset}
+	d.lines[offset] = s
+	d.order = append(d.order, s)
+}
+
+// edge records a raw edge.
+func (d *debouncer) edge(ev gpio.Event, now time.Time) {
+	s := d.lines[ev.Offset]
+	if s == nil {
+		return
+	}
+	s.raw = ev.Edge == gpio.Rising
+	s.rawSince = now
+}
+
+// next returns when check() next needs to be called, if ever.
+func (d *debouncer) next() (time.Time, bool) {
+	var ret time.Time
+	found := false
+	consider := func(t time.Time) {
+		if !found || t.Before(ret) {
+			ret, found = t, true
+		}
+	}
+	for _, s := range d.order {
+		if s.raw != s.down {
+			consider(s.rawSince.Add(d.debounce))
+		}
+		if s.down && !s.long && !s.chord {
+			consider(s.downSince.Add(d.longPress))
+		}
+	}
+	return ret, found
+}
+
+// check returns the events that have happened as of now.
+func (d *debouncer) check(now time.Time) []Event {
+	var ret []Event
+	for _, s := range d.order {
+		if s.raw != s.down && now.Sub(s.rawSince) >= d.debounce {
+			s.down = s.raw
+			if s.down {
+				s.downSince = s.rawSince
+				s.long, s.chord = false, false
+				ret = append(ret, Event{Kind: Press, Pin: s.pin})
+				for _, o := range d.order {
+					if o != s && o.down && !o.chord {
+						o.chord, s.chord = true, true
+						ret = append(ret, Event{Kind: Chord, Pin: o.pin, Other: s.pin})
+						break
+					}
+				}
+			} else {
+				ret = append(ret, Event{
+					Kind: Release,
+					Pin:  s.pin,
+					Held: s.rawSince.Sub(s.downSince),
+					Tap:  !s.long && !s.chord,
+				})
+			}
+		}
+		if s.down && !s.long && !s.chord && now.Sub(s.downSince) >= d.longPress {
+			s.long = true
+			ret = append(ret, Event{Kind: LongPress, Pin: s.pin})
+		}
+	}
+	return ret
+}
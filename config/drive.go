@@ -0,0 +1,116 @@
+// Package config reads and writes the autoscan config files.
+package config
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	oauth "golang.org/x/oauth2"
+	drive "google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+)
+
+const (
+	// Scope is the OAuth scope autoscan asks for.
+	Scope = "https://www.googleapis.com/auth/drive"
+
+	// Google's OAuth endpoints.
+	DefaultAuthURL  = "https://accounts.google.com/o/oauth2/auth"
+	DefaultTokenURL = "https://oauth2.googleapis.com/token"
+)
+
+// Endpoints are the Google endpoints to use. Empty means Google's.
+// They can be changed to run against a fake server.
+type Endpoints struct {
+	AuthURL  string // OAuth authorization URL.
+	TokenURL string // OAuth token URL.
+	Drive    string // Google Drive API base URL.
+}
+
+// Drive is the Google Drive account and folder to upload to.
+//
+// It's stored as four lines in the config file: client ID, client
+// secret, refresh token and parent folder ID.
+type Drive struct {
+	ClientID     string
+	ClientSecret string
+	RefreshToken string
+	Parent       string
+
+	// Not stored in the file.
+	Endpoints Endpoints
+}
+
+// ReadDrive reads the Drive config from a file. It uses Google's
+// endpoints.
+func ReadDrive(fn string) (*Drive, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	s := strings.Split(strings.Trim(string(b), "\n\r "), "\n")
+	if len(s) < 4 {
+		// Setup may have been interrupted before a folder was picked.
+		s = append(s, make([]string, 4-len(s))...)
+	}
+	for n := range s {
+		s[n] = strings.TrimSpace(s[n])
+	}
+	return &Drive{
+		ClientID:     s[0],
+		ClientSecret: s[1],
+		RefreshToken: s[2],
+		Parent:       s[3],
+	}, nil
+}
+
+// Write writes the Drive config to a file, readable only by the owner.
+func (d *Drive) Write(fn string) error {
+	return ioutil.WriteFile(fn, []byte(fmt.Sprintf("%s\n%s\n%s\n%s\n", d.ClientID, d.ClientSecret, d.RefreshToken, d.Parent)), 0600)
+}
+
+// Authorized returns true if there's a refresh token.
+func (d *Drive) Authorized() bool {
+	return d.ClientID != "" && d.ClientSecret != "" && d.RefreshToken != ""
+}
+
+// Complete returns true if autoscan has everything it needs to upload.
+func (d *Drive) Complete() bool {
+	return d.Authorized() && d.Parent != ""
+}
+
+// OAuth returns the OAuth config for this client, redirecting to redirect.
+func (d *Drive) OAuth(redirect string) *oauth.Config {
+	ep := oauth.Endpoint{
+		AuthURL:  d.Endpoints.AuthURL,
+		TokenURL: d.Endpoints.TokenURL,
+	}
+	if ep.AuthURL == "" {
+		ep.AuthURL = DefaultAuthURL
+	}
+	if ep.TokenURL == "" {
+		ep.TokenURL = DefaultTokenURL
+	}
+	return &oauth.Config{
+		ClientID:     d.ClientID,
+		ClientSecret: d.ClientSecret,
+		Endpoint:     ep,
+		Scopes:       []string{Scope},
+		RedirectURL:  redirect,
+	}
+}
+
+// Service returns a Drive client authorized by the refresh token.
+func (d *Drive) Service(ctx context.Context) (*drive.Service, error) {
+	if !d.Authorized() {
+		return nil, fmt.Errorf("not authorized to Google Drive")
+	}
+	client := d.OAuth("").Client(ctx, &oauth.Token{RefreshToken: d.RefreshToken})
+	opts := []option.ClientOption{option.WithHTTPClient(client)}
+	if d.Endpoints.Drive != "" {
+		opts = append(opts, option.WithEndpoint(d.Endpoints.Drive))
+	}
+	return drive.NewService(ctx, opts...)
+}
@@ -0,0 +1,135 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Station is how one installation is wired up: scanners, scan
+// profiles, where scans can go, which inputs trigger which actions,
+// and the LCD menu.
+//
+// It's stored as JSON, e.g.:
+//
+//	{
+//	  "scanners": [
+//	    {"name": "feeder", "device": "fujitsu:fi-6130dj:12345"},
+//	    {"name": "flatbed", "device": "genesys:libusb:001:004", "uis": ["leds"]},
+//	    {"name": "office", "saned": "office-pi.local"},
+//	    {"name": "printer", "escl": "http://printer.local/eSCL"}
+//	  ],
+//	  "profiles": {
+//	    "receipts": {"duplex": false, "mode": "Gray", "resolution": 200},
+//	    "photo": {"scanner": "flatbed", "source": "Flatbed"}
+//	  },
+//	  "destinations": {"taxes": "1a2B3c4D5e6F7g8H9i0J"},
+//	  "users": {"alice": "0J9i8H7g6F5e4D3c2B1a"},
+//	  "bindings": {
+//	    "gpio:5:tap": "start:receipts",
+//	    "gpio:5:long": "start:duplex",
+//	    "gpio:24+25:chord": "cancel",
+//	    "lcd:select": "start:single"
+//	  },
+//	  "menu": [
+//	    {"label": "Scan receipts", "action": "start:receipts"},
+//	    {"label": "To taxes", "action": "destination:taxes"},
+//	    {"label": "Network", "items": [
+//	      {"label": "IP address", "show": "ip"}
+//	    ]}
+//	  ]
+//	}
+//
+// See package actions for input and action names.
+type Station struct {
+	// Scanners. The first is the default, used by the built-in
+	// profiles. Default is one scanner using -scanimage.
+	Scanners []Scanner `json:"scanners"`
+
+	Profiles map[string]Profile `json:"profiles"`
+
+	// Google Drive folder IDs to upload to instead of the one set up
+	// in the web UI, by name. Picked with the destination and user
+	// actions, e.g. from the LCD menu.
+	Destinations map[string]string `json:"destinations"`
+	Users        map[string]string `json:"users"`
+
+	// Input name to action. An empty action unbinds the input.
+	Bindings map[string]string `json:"bindings"`
+
+	// LCD menu. Default is a built-in menu.
+	Menu []MenuItem `json:"menu"`
+}
+
+// MenuItem is an entry in the LCD menu. It runs an action, shows some
+// information, or opens a submenu. Exactly one of those must be set.
+type MenuItem struct {
+	Label  string     `json:"label"`
+	Action string     `json:"action,omitempty"` // E.g. "start:receipts".
+	Show   string     `json:"show,omitempty"`   // See adafruit.Menu for what can be shown.
+	Items  []MenuItem `json:"items,omitempty"`
+
+	// Ask before running the action, e.g. for reboot.
+	Confirm bool `json:"confirm,omitempty"`
+}
+
+// Scanner is a scanner device. Each has its own scan jobs, queue of
+// scans waiting to be uploaded, and UIs.
+type Scanner struct {
+	Name string `json:"name"`
+
+	// SANE device, passed to scanimage as -d. Default is scanimage's,
+	// or whatever the scanimage wrapper script picks. With Saned, the
+	// device on that host, default its first.
+	Device string `json:"device,omitempty"`
+
+	// Scanimage binary or wrapper script. Default is -scanimage.
+	Scanimage string `json:"scanimage,omitempty"`
+
+	// Host running saned to scan from over the network, as host or
+	// host:port, instead of running scanimage.
+	Saned string `json:"saned,omitempty"`
+
+	// URL of a network scanner's eSCL service, also known as AirScan,
+	// e.g. "http://printer.local/eSCL", to scan from without SANE.
+	ESCL string `json:"escl,omitempty"`
+
+	// UIs showing this scanner: "lcd", "leds", "term" and "log". Each
+	// can only show one scanner. The first scanner gets the ones no
+	// other scanner has.
+	UIs []string `json:"uis,omitempty"`
+}
+
+// Profile is a named set of scan settings.
+type Profile struct {
+	Duplex bool `json:"duplex"`
+
+	// Scanner options, named like in scanimage. Defaults are 300 DPI,
+	// "Color", and "ADF Front", or "ADF Duplex" if Duplex is set.
+	Resolution int    `json:"resolution,omitempty"`
+	Mode       string `json:"mode,omitempty"`   // E.g. "Gray".
+	Source     string `json:"source,omitempty"` // E.g. "Flatbed".
+
+	// Which scanner to use. Default is the first.
+	Scanner string `json:"scanner,omitempty"`
+
+	// Google Drive folder ID to upload to. Default is the destination
+	// or user picked, if any, or else the folder set up in the web UI.
+	Folder string `json:"folder,omitempty"`
+}
+
+// ReadStation reads the station config from a file.
+func ReadStation(fn string) (*Station, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	var s Station
+	if err := dec.Decode(&s); err != nil {
+		return nil, fmt.Errorf("parsing %q: %v", fn, err)
+	}
+	return &s, nil
+}
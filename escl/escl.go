@@ -0,0 +1,460 @@
+// Package escl is a client for eSCL, also known as AirScan, the
+// driverless scanning protocol of network scanners and multifunction
+// printers. It's HTTP with XML, see
+// https://mopria.org/mopria-escl-specification
+package escl
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// DefaultRetry is how long to wait before asking again for a page
+// that's not ready yet.
+const DefaultRetry = time.Second
+
+// Namespaces of the XML.
+const (
+	nsScan = "http://schemas.hp.com/imaging/escl/2011/05/03"
+	nsPWG  = "http://www.pwg.org/schemas/2010/12/sm"
+)
+
+// Input sources.
+const (
+	Platen = "Platen"
+	Feeder = "Feeder"
+)
+
+// Color modes.
+const (
+	BlackAndWhite1 = "BlackAndWhite1"
+	Grayscale8     = "Grayscale8"
+	RGB24          = "RGB24"
+)
+
+// Job states.
+const (
+	JobPending    = "Pending"
+	JobProcessing = "Processing"
+	JobCompleted  = "Completed"
+	JobCanceled   = "Canceled"
+	JobAborted    = "Aborted"
+)
+
+// ADF states, the ones that tell why a job failed.
+const (
+	AdfEmpty     = "ScannerAdfEmpty"
+	AdfJam       = "ScannerAdfJam"
+	AdfDoorOpen  = "ScannerAdfDoorOpen"
+	AdfHatchOpen = "ScannerAdfHatchOpen"
+)
+
+// ErrNoMoreDocuments is returned by NextDocument when the job has no
+// more pages, either because it's done or because it failed.
+var ErrNoMoreDocuments = errors.New("no more documents")
+
+// StatusError is an HTTP error from the scanner.
+type StatusError struct {
+	Op   string
+	Code int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s: %d %s", e.Op, e.Code, http.StatusText(e.Code))
+}
+
+// Busy returns true if the error is the scanner being busy, or not
+// ready, e.g. because the feeder is empty.
+func (e *StatusError) Busy() bool {
+	return e.Code == http.StatusConflict || e.Code == http.StatusServiceUnavailable
+}
+
+// Client talks to a scanner.
+type Client struct {
+	// Where the eSCL service is, e.g. "http://printer.local/eSCL".
+	URL string
+
+	// Default is http.DefaultClient.
+	HTTP *http.Client
+
+	// How long to wait before asking again for a page that's not
+	// ready. Zero is DefaultRetry.
+	Retry time.Duration
+}
+
+func (c *Client) http() *http.Client {
+	if c.HTTP == nil {
+		return http.DefaultClient
+	}
+	return c.HTTP
+}
+
+// do makes a request to a path of the service, or an absolute URL,
+// and returns the response if the status is one of ok.
+func (c *Client) do(ctx context.Context, method, p string, body []byte, ok ...int) (*http.Response, error) {
+	u, err := c.resolve(p)
+	if err != nil {
+		return nil, err
+	}
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "text/xml")
+	}
+	resp, err := c.http().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range ok {
+		if resp.StatusCode == code {
+			return resp, nil
+		}
+	}
+	resp.Body.Close()
+	return nil, &StatusError{Op: method + " " + u, Code: resp.StatusCode}
+}
+
+// resolve returns the URL of a path relative to the service, or of
+// an absolute path or URL as returned by the scanner for jobs.
+func (c *Client) resolve(p string) (string, error) {
+	base, err := url.Parse(strings.TrimSuffix(c.URL, "/") + "/")
+	if err != nil {
+		return "", err
+	}
+	ref, err := url.Parse(p)
+	if err != nil {
+		return "", err
+	}
+	return base.ResolveReference(ref).String(), nil
+}
+
+// get fetches and parses XML.
+func (c *Client) get(ctx context.Context, p string, v interface{}) error {
+	resp, err := c.do(ctx, "GET", p, nil, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := xml.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("parsing %s: %v", p, err)
+	}
+	return nil
+}
+
+// InputCaps is what an input source can do.
+type InputCaps struct {
+	// Largest scan area, in 1/300 inch.
+	MaxWidth  int `xml:"MaxWidth"`
+	MaxHeight int `xml:"MaxHeight"`
+
+	Profiles []struct {
+		ColorModes      []string `xml:"ColorModes>ColorMode"`
+		DocumentFormats []string `xml:"DocumentFormats>DocumentFormat"`
+		Discrete        []struct {
+			X int `xml:"XResolution"`
+			Y int `xml:"YResolution"`
+		} `xml:"SupportedResolutions>DiscreteResolutions>DiscreteResolution"`
+		Range *struct {
+			Min  int `xml:"Min"`
+			Max  int `xml:"Max"`
+			Step int `xml:"Step"`
+		} `xml:"SupportedResolutions>ResolutionRange>XResolutionRange"`
+	} `xml:"SettingProfiles>SettingProfile"`
+}
+
+// ColorModes returns the supported color modes.
+func (ic *InputCaps) ColorModes() []string {
+	var ret []string
+	for _, p := range ic.Profiles {
+		ret = appendNew(ret, p.ColorModes...)
+	}
+	return ret
+}
+
+// DocumentFormats returns the supported MIME types of pages.
+func (ic *InputCaps) DocumentFormats() []string {
+	var ret []string
+	for _, p := range ic.Profiles {
+		ret = appendNew(ret, p.DocumentFormats...)
+	}
+	return ret
+}
+
+// Resolutions returns the supported discrete resolutions, in DPI,
+// that are the same horizontally and vertically.
+func (ic *InputCaps) Resolutions() []int {
+	var ret []int
+	for _, p := range ic.Profiles {
+		for _, r := range p.Discrete {
+			if r.X == r.Y && !containsInt(ret, r.X) {
+				ret = append(ret, r.X)
+			}
+		}
+	}
+	return ret
+}
+
+// ResolutionRange returns the supported range of resolutions, if the
+// scanner has one instead of discrete resolutions.
+func (ic *InputCaps) ResolutionRange() (min, max, step int, ok bool) {
+	for _, p := range ic.Profiles {
+		if r := p.Range; r != nil {
+			return r.Min, r.Max, r.Step, true
+		}
+	}
+	return 0, 0, 0, false
+}
+
+// SupportsResolution returns true if the resolution can be used.
+func (ic *InputCaps) SupportsResolution(dpi int) bool {
+	for _, p := range ic.Profiles {
+		for _, r := range p.Discrete {
+			if r.X == dpi && r.Y == dpi {
+				return true
+			}
+		}
+		if r := p.Range; r != nil && dpi >= r.Min && dpi <= r.Max && (r.Step <= 0 || (dpi-r.Min)%r.Step == 0) {
+			return true
+		}
+	}
+	return false
+}
+
+func appendNew(l []string, vs ...string) []string {
+	for _, v := range vs {
+		if !contains(l, v) {
+			l = append(l, v)
+		}
+	}
+	return l
+}
+
+func containsInt(l []int, v int) bool {
+	for _, x := range l {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(l []string, v string) bool {
+	for _, x := range l {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Capabilities is what the scanner can do. Sources it doesn't have
+// are nil.
+type Capabilities struct {
+	Version      string     `xml:"Version"`
+	MakeAndModel string     `xml:"MakeAndModel"`
+	Platen       *InputCaps `xml:"Platen>PlatenInputCaps"`
+	ADFSimplex   *InputCaps `xml:"Adf>AdfSimplexInputCaps"`
+	ADFDuplex    *InputCaps `xml:"Adf>AdfDuplexInputCaps"`
+	ADFOptions   []string   `xml:"Adf>AdfOptions>AdfOption"`
+}
+
+// Input returns the capabilities of a source, or nil if the scanner
+// doesn't have it.
+func (c *Capabilities) Input(source string, duplex bool) *InputCaps {
+	switch {
+	case source == Platen:
+		return c.Platen
+	case source != Feeder:
+		return nil
+	case !duplex:
+		return c.ADFSimplex
+	case c.ADFDuplex != nil:
+		return c.ADFDuplex
+	case contains(c.ADFOptions, "Duplex"):
+		// Some only say duplex works like simplex.
+		return c.ADFSimplex
+	}
+	return nil
+}
+
+// Capabilities fetches the capabilities of the scanner.
+func (c *Client) Capabilities(ctx context.Context) (*Capabilities, error) {
+	var caps Capabilities
+	if err := c.get(ctx, "ScannerCapabilities", &caps); err != nil {
+		return nil, err
+	}
+	return &caps, nil
+}
+
+// JobInfo is the state of a job.
+type JobInfo struct {
+	URI             string   `xml:"JobUri"`
+	State           string   `xml:"JobState"`
+	Reasons         []string `xml:"JobStateReasons>JobStateReason"`
+	ImagesCompleted int      `xml:"ImagesCompleted"`
+}
+
+// Status is the state of the scanner and its jobs.
+type Status struct {
+	State    string    `xml:"State"` // Idle, Processing, Testing, Stopped or Down.
+	ADFState string    `xml:"AdfState"`
+	Jobs     []JobInfo `xml:"Jobs>JobInfo"`
+}
+
+// Job returns the info of a job, or nil if the scanner has forgotten it.
+func (s *Status) Job(j *Job) *JobInfo {
+	// The URI is a path on the scanner, like the job, but the
+	// job's ID at the end is enough.
+	for n := range s.Jobs {
+		if path.Base(s.Jobs[n].URI) == path.Base(j.path) {
+			return &s.Jobs[n]
+		}
+	}
+	return nil
+}
+
+// Status fetches the state of the scanner and its jobs.
+func (c *Client) Status(ctx context.Context) (*Status, error) {
+	var st Status
+	if err := c.get(ctx, "ScannerStatus", &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+// Settings are how to scan.
+type Settings struct {
+	Source     string // Platen or Feeder.
+	Duplex     bool
+	ColorMode  string // E.g. RGB24.
+	Resolution int    // DPI.
+	Format     string // MIME type, e.g. "image/jpeg".
+
+	// Scan area, in 1/300 inch. Usually the maximum of the source.
+	Width, Height int
+}
+
+// scanSettings is the XML of Settings.
+type scanSettings struct {
+	XMLName   xml.Name `xml:"scan:ScanSettings"`
+	NSScan    string   `xml:"xmlns:scan,attr"`
+	NSPWG     string   `xml:"xmlns:pwg,attr"`
+	Version   string   `xml:"pwg:Version"`
+	Intent    string   `xml:"scan:Intent"`
+	Height    int      `xml:"pwg:ScanRegions>pwg:ScanRegion>pwg:Height"`
+	Width     int      `xml:"pwg:ScanRegions>pwg:ScanRegion>pwg:Width"`
+	XOffset   int      `xml:"pwg:ScanRegions>pwg:ScanRegion>pwg:XOffset"`
+	YOffset   int      `xml:"pwg:ScanRegions>pwg:ScanRegion>pwg:YOffset"`
+	Units     string   `xml:"pwg:ScanRegions>pwg:ScanRegion>pwg:ContentRegionUnits"`
+	Source    string   `xml:"pwg:InputSource"`
+	Duplex    bool     `xml:"scan:Duplex,omitempty"`
+	ColorMode string   `xml:"scan:ColorMode"`
+	XRes      int      `xml:"scan:XResolution"`
+	YRes      int      `xml:"scan:YResolution"`
+	Format    string   `xml:"pwg:DocumentFormat"`
+	FormatExt string   `xml:"scan:DocumentFormatExt"`
+}
+
+// Job is a scan job.
+type Job struct {
+	c    *Client
+	path string // As given by the scanner, e.g. "/eSCL/ScanJobs/1234".
+}
+
+// Scan creates a scan job. Get the pages with NextDocument.
+func (c *Client) Scan(ctx context.Context, s Settings) (*Job, error) {
+	body, err := xml.Marshal(&scanSettings{
+		NSScan:    nsScan,
+		NSPWG:     nsPWG,
+		Version:   "2.0",
+		Intent:    "Document",
+		Height:    s.Height,
+		Width:     s.Width,
+		Units:     "escl:ThreeHundredthsOfInches",
+		Source:    s.Source,
+		Duplex:    s.Duplex,
+		ColorMode: s.ColorMode,
+		XRes:      s.Resolution,
+		YRes:      s.Resolution,
+		Format:    s.Format,
+		FormatExt: s.Format,
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(ctx, "POST", "ScanJobs", append([]byte(xml.Header), body...), http.StatusCreated)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	loc := resp.Header.Get("Location")
+	if loc == "" {
+		return nil, fmt.Errorf("scanner didn't say where the scan job is")
+	}
+	// Relative to the service, or the host.
+	if u, err := url.Parse(loc); err == nil {
+		loc = u.Path
+	}
+	return &Job{c: c, path: loc}, nil
+}
+
+// NextDocument returns the next page, and its MIME type. It waits
+// while the scanner isn't ready, and returns ErrNoMoreDocuments when
+// there are no more pages.
+func (j *Job) NextDocument(ctx context.Context) ([]byte, string, error) {
+	retry := j.c.Retry
+	if retry == 0 {
+		retry = DefaultRetry
+	}
+	for {
+		resp, err := j.c.do(ctx, "GET", j.path+"/NextDocument", nil, http.StatusOK)
+		if se, ok := err.(*StatusError); ok {
+			switch se.Code {
+			case http.StatusNotFound, http.StatusGone:
+				return nil, "", ErrNoMoreDocuments
+			case http.StatusServiceUnavailable:
+				select {
+				case <-ctx.Done():
+					return nil, "", ctx.Err()
+				case <-time.After(retry):
+				}
+				continue
+			}
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, "", fmt.Errorf("reading page: %v", err)
+		}
+		return b, resp.Header.Get("Content-Type"), nil
+	}
+}
+
+// Cancel cancels the job.
+func (j *Job) Cancel(ctx context.Context) error {
+	resp, err := j.c.do(ctx, "DELETE", j.path, nil, http.StatusOK, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
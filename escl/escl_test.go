@@ -0,0 +1,146 @@
+package escl_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ThomasHabets/autoscan/escl"
+	"github.com/ThomasHabets/autoscan/fake"
+)
+
+func TestCapabilities(t *testing.T) {
+	e := fake.NewESCL(fake.Scanner{})
+	defer e.Close()
+	caps, err := (&escl.Client{URL: e.URL()}).Capabilities(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if caps.MakeAndModel != "Fake eSCL scanner" {
+		t.Errorf("MakeAndModel %q", caps.MakeAndModel)
+	}
+	ic := caps.Input(escl.Feeder, true)
+	if ic == nil {
+		t.Fatal("No duplex feeder")
+	}
+	if got, want := ic.ColorModes(), []string{escl.BlackAndWhite1, escl.Grayscale8, escl.RGB24}; len(got) != len(want) {
+		t.Errorf("Colour modes %q, want %q", got, want)
+	}
+	if !ic.SupportsResolution(300) || ic.SupportsResolution(150) {
+		t.Errorf("Resolutions %v", ic.Resolutions())
+	}
+	if ic.MaxWidth != 2550 || ic.MaxHeight != 3508 {
+		t.Errorf("Max size %dx%d", ic.MaxWidth, ic.MaxHeight)
+	}
+}
+
+// scan scans all pages of a job, and returns how many and the status.
+func scan(t *testing.T, c *escl.Client, s escl.Settings) (int, *escl.JobInfo, *escl.Status) {
+	t.Helper()
+	ctx := context.Background()
+	job, err := c.Scan(ctx, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for {
+		b, typ, err := job.NextDocument(ctx)
+		if err == escl.ErrNoMoreDocuments {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Page %d: %v", n+1, err)
+		}
+		if typ != "image/jpeg" || !bytes.HasPrefix(b, []byte("\xff\xd8")) {
+			t.Errorf("Page %d is %q, starting %q", n+1, typ, b[:2])
+		}
+		n++
+	}
+	st, err := c.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n, st.Job(job), st
+}
+
+func TestScan(t *testing.T) {
+	e := fake.NewESCL(fake.Scanner{Sheets: 2})
+	e.Warmup = 2
+	defer e.Close()
+	c := &escl.Client{URL: e.URL(), Retry: time.Millisecond}
+	n, job, _ := scan(t, c, escl.Settings{
+		Source:     escl.Feeder,
+		Duplex:     true,
+		ColorMode:  escl.Grayscale8,
+		Resolution: 200,
+		Format:     "image/jpeg",
+	})
+	if n != 4 {
+		t.Errorf("Scanned %d pages, want 4", n)
+	}
+	if job == nil || job.State != escl.JobCompleted {
+		t.Errorf("Job %+v, want completed", job)
+	}
+	if got := e.Settings(); got["InputSource"] != "Feeder" || got["Duplex"] != "true" || got["ColorMode"] != "Grayscale8" || got["XResolution"] != "200" {
+		t.Errorf("Scanned with settings %v", got)
+	}
+}
+
+func TestScanJam(t *testing.T) {
+	e := fake.NewESCL(fake.Scanner{Sheets: 3, Jam: 2})
+	defer e.Close()
+	c := &escl.Client{URL: e.URL()}
+	n, job, st := scan(t, c, escl.Settings{Source: escl.Feeder, ColorMode: escl.RGB24, Resolution: 300})
+	if n != 2 {
+		t.Errorf("Scanned %d pages, want 2", n)
+	}
+	if job == nil || job.State != escl.JobAborted || st.ADFState != escl.AdfJam {
+		t.Errorf("Job %+v, feeder %q, want aborted by a jam", job, st.ADFState)
+	}
+}
+
+func TestScanEmpty(t *testing.T) {
+	e := fake.NewESCL(fake.Scanner{})
+	defer e.Close()
+	c := &escl.Client{URL: e.URL()}
+	_, err := c.Scan(context.Background(), escl.Settings{Source: escl.Feeder, ColorMode: escl.RGB24, Resolution: 300})
+	se, ok := err.(*escl.StatusError)
+	if !ok || !se.Busy() {
+		t.Fatalf("Scan with empty feeder: %v, want busy", err)
+	}
+	st, err := c.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.ADFState != escl.AdfEmpty {
+		t.Errorf("Feeder %q, want empty", st.ADFState)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	e := fake.NewESCL(fake.Scanner{Sheets: 3})
+	defer e.Close()
+	c := &escl.Client{URL: e.URL()}
+	ctx := context.Background()
+	job, err := c.Scan(ctx, escl.Settings{Source: escl.Feeder, ColorMode: escl.RGB24, Resolution: 300})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := job.NextDocument(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := job.Cancel(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := job.NextDocument(ctx); err != escl.ErrNoMoreDocuments {
+		t.Errorf("Page after cancel: %v", err)
+	}
+	st, err := c.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j := st.Job(job); j == nil || j.State != escl.JobCanceled {
+		t.Errorf("Job %+v, want cancelled", j)
+	}
+}
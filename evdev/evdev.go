@@ -0,0 +1,204 @@
+// Package evdev reads key presses from Linux input devices, such as USB
+// foot pedals and macro keypads, and reports them as inputs named
+// "key:<name>". See package actions.
+//
+// Devices are grabbed exclusively, so the key presses don't also end up
+// on the console. Unplugged devices are re-opened when they come back.
+//
+// There's an in-memory fake for tests. See Fake.
+package evdev
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Inputs is where key presses are sent. Implemented by *actions.Dispatcher.
+type Inputs interface {
+	Input(name string) error
+}
+
+// Opener opens an input device.
+type Opener func(path string) (io.ReadCloser, error)
+
+// DefaultRetry is how often to try to re-open a missing device.
+const DefaultRetry = time.Second
+
+// From linux/input.h.
+const (
+	evKey = 0x01
+
+	keyRelease = 0
+	keyPress   = 1
+	keyRepeat  = 2
+
+	ioctlGrab = 0x40044590 // EVIOCGRAB
+)
+
+// eventSize is the size of struct input_event: a struct timeval of two
+// longs, then type, code and value.
+var eventSize = 2*int(unsafe.Sizeof(uintptr(0))) + 8
+
+// Event is an input event.
+type Event struct {
+	Type  uint16
+	Code  uint16
+	Value int32
+}
+
+// encode returns the event as the kernel sends it, with zero time.
+func (e Event) encode() []byte {
+	b := make([]byte, eventSize)
+	o := eventSize - 8
+	binary.LittleEndian.PutUint16(b[o:], e.Type)
+	binary.LittleEndian.PutUint16(b[o+2:], e.Code)
+	binary.LittleEndian.PutUint32(b[o+4:], uint32(e.Value))
+	return b
+}
+
+// decode parses an event as the kernel sends it.
+func decode(b []byte) Event {
+	o := eventSize - 8
+	return Event{
+		Type:  binary.LittleEndian.Uint16(b[o:]),
+		Code:  binary.LittleEndian.Uint16(b[o+2:]),
+		Value: int32(binary.LittleEndian.Uint32(b[o+4:])),
+	}
+}
+
+// Open opens an input device, such as
+// /dev/input/by-id/usb-PCsensor_FootSwitch-event-kbd, and grabs it.
+func Open(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), ioctlGrab, 1); errno != 0 {
+		f.Close()
+		return nil, fmt.Errorf("grabbing %q: %v", path, errno)
+	}
+	return f, nil
+}
+
+// Device reads key presses from an input device.
+type Device struct {
+	Path   string
+	Inputs Inputs
+
+	// Open opens the device. Default is Open.
+	Open Opener
+
+	// How often to try to re-open the device if it's missing. Zero
+	// means DefaultRetry.
+	Retry time.Duration
+
+	mutex  sync.Mutex
+	r      io.ReadCloser // Open device, or nil.
+	closed bool
+	done   chan struct{}
+}
+
+// New creates a new Device. Nothing is opened until Run.
+func New(path string, in Inputs) *Device {
+	return &Device{
+		Path:   path,
+		Inputs: in,
+		Open:   Open,
+		done:   make(chan struct{}),
+	}
+}
+
+// Close stops Run and closes the device.
+func (d *Device) Close() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closed {
+		return nil
+	}
+	d.closed = true
+	close(d.done)
+	if d.r != nil {
+		r := d.r
+		d.r = nil
+		return r.Close()
+	}
+	return nil
+}
+
+// Run reads key presses, re-opening the device whenever it goes away.
+// Until Close.
+func (d *Device) Run() {
+	retry := d.Retry
+	if retry == 0 {
+		retry = DefaultRetry
+	}
+	var lastErr string
+	for {
+		r, err := d.Open(d.Path)
+		if err == nil {
+			log.Printf("Reading keys from input device %q.", d.Path)
+			err = d.read(r)
+		}
+		select {
+		case <-d.done:
+			return
+		default:
+		}
+		// Only log changes, not every retry while it's unplugged.
+		if err.Error() != lastErr {
+			log.Printf("Input device %q: %v. Retrying every %v.", d.Path, err, retry)
+			lastErr = err.Error()
+		}
+		select {
+		case <-d.done:
+			return
+		case <-time.After(retry):
+		}
+	}
+}
+
+// read reports key presses from r until it fails, then closes it.
+func (d *Device) read(r io.ReadCloser) error {
+	if err := func() error {
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		if d.closed {
+			return fmt.Errorf("closed")
+		}
+		d.r = r
+		return nil
+	}(); err != nil {
+		r.Close()
+		return err
+	}
+	defer func() {
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		if d.r != nil {
+			d.r.Close()
+			d.r = nil
+		}
+	}()
+	buf := make([]byte, eventSize)
+	for {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return err
+		}
+		// Only presses. Releases and key repeats are ignored.
+		ev := decode(buf)
+		if ev.Type != evKey || ev.Value != keyPress {
+			continue
+		}
+		in := "key:" + KeyName(ev.Code)
+		log.Printf("Input device %q: %s", d.Path, in)
+		// Errors are logged by the dispatcher.
+		d.Inputs.Input(in)
+	}
+}
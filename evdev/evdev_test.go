@@ -0,0 +1,83 @@
+package evdev
+
+import (
+	"testing"
+	"time"
+)
+
+type fakeInputs struct {
+	inputs chan string
+}
+
+func (f *fakeInputs) Input(name string) error {
+	f.inputs <- name
+	return nil
+}
+
+func TestEvent(t *testing.T) {
+	ev := Event{Type: evKey, Code: 0x110, Value: -1}
+	if got := decode(ev.encode()); got != ev {
+		t.Errorf("Got %+v, want %+v", got, ev)
+	}
+}
+
+func TestKeyName(t *testing.T) {
+	for code, want := range map[uint16]string{
+		30:  "a",
+		183: "f13",
+		999: "999",
+	} {
+		if got := KeyName(code); got != want {
+			t.Errorf("KeyName(%d) = %q, want %q", code, got, want)
+		}
+	}
+}
+
+func TestDevice(t *testing.T) {
+	const path = "/dev/input/by-id/usb-foot-pedal-event-kbd"
+	f := NewFake()
+	in := &fakeInputs{inputs: make(chan string, 10)}
+	d := New(path, in)
+	d.Open = f.Open
+	d.Retry = 10 * time.Millisecond
+	defer d.Close()
+	go d.Run()
+
+	// Not plugged in yet.
+	time.Sleep(5 * d.Retry)
+	f.Plug(path)
+	send := func(code uint16) {
+		t.Helper()
+		for {
+			if err := f.Key(path, code); err == nil {
+				return
+			}
+			time.Sleep(d.Retry)
+		}
+	}
+	send(48)
+	if got := <-in.inputs; got != "key:b" {
+		t.Errorf("Got input %q, want key:b", got)
+	}
+
+	// Repeats are ignored.
+	if err := f.Send(path, Event{Type: evKey, Code: 30, Value: keyRepeat}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Open(path); err == nil {
+		t.Errorf("Opened grabbed device")
+	}
+
+	// Re-opened when plugged back in.
+	f.Unplug(path)
+	f.Plug(path)
+	send(0x110)
+	if got := <-in.inputs; got != "key:btn_left" {
+		t.Errorf("Got input %q, want key:btn_left", got)
+	}
+	select {
+	case got := <-in.inputs:
+		t.Errorf("Extra input %q", got)
+	default:
+	}
+}
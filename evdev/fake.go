@@ -0,0 +1,107 @@
+package evdev
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// Fake is a set of in-memory input devices for tests.
+type Fake struct {
+	mutex   sync.Mutex
+	devices map[string]*fakeDevice // Plugged in devices.
+}
+
+type fakeDevice struct {
+	w *io.PipeWriter // Non-nil when open.
+}
+
+// NewFake creates a fake with no devices plugged in.
+func NewFake() *Fake {
+	return &Fake{devices: make(map[string]*fakeDevice)}
+}
+
+// Open implements Opener. Devices can only be opened once, like when
+// they're grabbed.
+func (f *Fake) Open(path string) (io.ReadCloser, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	d := f.devices[path]
+	if d == nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: syscall.ENOENT}
+	}
+	if d.w != nil {
+		return nil, fmt.Errorf("grabbing %q: %v", path, syscall.EBUSY)
+	}
+	r, w := io.Pipe()
+	d.w = w
+	return &fakeReader{PipeReader: r, fake: f, dev: d}, nil
+}
+
+type fakeReader struct {
+	*io.PipeReader
+	fake *Fake
+	dev  *fakeDevice
+}
+
+// Close releases the device.
+func (r *fakeReader) Close() error {
+	r.fake.mutex.Lock()
+	defer r.fake.mutex.Unlock()
+	if r.dev.w != nil {
+		r.dev.w.Close()
+		r.dev.w = nil
+	}
+	return r.PipeReader.Close()
+}
+
+// Plug plugs in a device.
+func (f *Fake) Plug(path string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.devices[path] == nil {
+		f.devices[path] = &fakeDevice{}
+	}
+}
+
+// Unplug unplugs a device. Reads fail like they do on real devices.
+func (f *Fake) Unplug(path string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if d := f.devices[path]; d != nil && d.w != nil {
+		d.w.CloseWithError(syscall.ENODEV)
+	}
+	delete(f.devices, path)
+}
+
+// Send sends events from an open device, each followed by a sync
+// event like real devices do. Blocks until they're read.
+func (f *Fake) Send(path string, evs ...Event) error {
+	f.mutex.Lock()
+	d := f.devices[path]
+	var w *io.PipeWriter
+	if d != nil {
+		w = d.w
+	}
+	f.mutex.Unlock()
+	if w == nil {
+		return fmt.Errorf("input device %q not open", path)
+	}
+	for _, ev := range evs {
+		for _, e := range []Event{ev, {}} {
+			if _, err := w.Write(e.encode()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Key sends a key press and release from an open device.
+func (f *Fake) Key(path string, code uint16) error {
+	return f.Send(path,
+		Event{Type: evKey, Code: code, Value: keyPress},
+		Event{Type: evKey, Code: code, Value: keyRelease})
+}
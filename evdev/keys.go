@@ -0,0 +1,35 @@
+package evdev
+
+import "strconv"
+
+// keyNames are the lower case names of the keys in linux/input-event-codes.h
+// that foot pedals and macro keypads tend to send.
+var keyNames = map[uint16]string{
+	1: "esc", 2: "1", 3: "2", 4: "3", 5: "4", 6: "5", 7: "6", 8: "7", 9: "8", 10: "9", 11: "0",
+	12: "minus", 13: "equal", 14: "backspace", 15: "tab",
+	16: "q", 17: "w", 18: "e", 19: "r", 20: "t", 21: "y", 22: "u", 23: "i", 24: "o", 25: "p",
+	28: "enter", 29: "leftctrl",
+	30: "a", 31: "s", 32: "d", 33: "f", 34: "g", 35: "h", 36: "j", 37: "k", 38: "l",
+	42: "leftshift",
+	44: "z", 45: "x", 46: "c", 47: "v", 48: "b", 49: "n", 50: "m",
+	56: "leftalt", 57: "space",
+	59: "f1", 60: "f2", 61: "f3", 62: "f4", 63: "f5", 64: "f6", 65: "f7", 66: "f8", 67: "f9", 68: "f10",
+	87: "f11", 88: "f12",
+	102: "home", 103: "up", 104: "pageup", 105: "left", 106: "right", 107: "end", 108: "down", 109: "pagedown",
+	113: "mute", 114: "volumedown", 115: "volumeup",
+	163: "nextsong", 164: "playpause", 165: "previoussong",
+	183: "f13", 184: "f14", 185: "f15", 186: "f16", 187: "f17", 188: "f18",
+	189: "f19", 190: "f20", 191: "f21", 192: "f22", 193: "f23", 194: "f24",
+	0x100: "btn_0", 0x101: "btn_1", 0x102: "btn_2", 0x103: "btn_3", 0x104: "btn_4",
+	0x105: "btn_5", 0x106: "btn_6", 0x107: "btn_7", 0x108: "btn_8", 0x109: "btn_9",
+	0x110: "btn_left", 0x111: "btn_right", 0x112: "btn_middle",
+}
+
+// KeyName returns the name of a key code, e.g. "a" or "f13", or the
+// code in decimal for keys without a name.
+func KeyName(code uint16) string {
+	if n, ok := keyNames[code]; ok {
+		return n
+	}
+	return strconv.Itoa(int(code))
+}
@@ -0,0 +1,511 @@
+// Package fake has fakes of the external things autoscan talks to:
+// Google Drive (and its OAuth token endpoint), scanimage and convert.
+//
+// They're for tests and for developing without a scanner or a Google
+// account.
+package fake
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThomasHabets/autoscan/config"
+)
+
+const (
+	folderMimeType = "application/vnd.google-apps.folder"
+
+	// RootID is the ID of the top folder ("My Drive").
+	RootID = "root"
+)
+
+var (
+	reParent   = regexp.MustCompile(`'([^']*)' in parents`)
+	reMimeType = regexp.MustCompile(`mimeType = '([^']*)'`)
+)
+
+// File is a file or folder in the fake Drive.
+type File struct {
+	ID          string
+	Name        string
+	Description string
+	MimeType    string
+	Parents     []string
+	Created     time.Time
+	Content     []byte
+}
+
+// Drive is an in-process fake of the subset of the Google Drive v3 API
+// that autoscan uses: uploads (multipart and resumable), listing
+// children, getting and deleting files, and thumbnails. It also has
+// fake OAuth authorization and token endpoints, and serves the files
+// at their web view links.
+type Drive struct {
+	Server *httptest.Server
+
+	mutex    sync.Mutex
+	files    map[string]*File
+	uploads  map[string]*resumable
+	nextID   int
+	revoked  bool
+	failNext int
+	dir      string
+}
+
+// resumable is an upload session in progress.
+type resumable struct {
+	meta File
+	data []byte
+}
+
+// NewDrive starts a fake Drive, with an empty root folder.
+func NewDrive() *Drive {
+	d := &Drive{
+		files: map[string]*File{
+			RootID: {ID: RootID, Name: "My Drive", MimeType: folderMimeType, Created: time.Now()},
+		},
+		uploads: make(map[string]*resumable),
+	}
+	m := http.NewServeMux()
+	m.HandleFunc("/auth", d.handleAuth)
+	m.HandleFunc("/token", d.handleToken)
+	m.HandleFunc("/view/", d.handleView)
+	m.HandleFunc("/drive/v3/files", d.authed(d.handleList))
+	m.HandleFunc("/drive/v3/files/", d.authed(d.handleFile))
+	m.HandleFunc("/drive/v3/drives", d.authed(d.handleDrives))
+	m.HandleFunc("/upload/drive/v3/files", d.authed(d.handleUpload))
+	m.HandleFunc("/thumbnails/", d.handleThumbnail)
+	d.Server = httptest.NewServer(m)
+	return d
+}
+
+// Close shuts down the fake.
+func (d *Drive) Close() {
+	d.Server.Close()
+}
+
+// Endpoints returns the endpoints to use the fake, for config.Drive.
+func (d *Drive) Endpoints() config.Endpoints {
+	return config.Endpoints{
+		AuthURL:  d.Server.URL + "/auth",
+		TokenURL: d.TokenURL(),
+		Drive:    d.Endpoint(),
+	}
+}
+
+// Endpoint returns the Drive API base URL, for option.WithEndpoint() or -drive_endpoint.
+func (d *Drive) Endpoint() string {
+	return d.Server.URL + "/drive/v3/"
+}
+
+// TokenURL returns the OAuth token URL, for -oauth_token_url.
+func (d *Drive) TokenURL() string {
+	return d.Server.URL + "/token"
+}
+
+// SetRevoked makes the fake reject all credentials, as if the user
+// revoked access, or allow them again.
+func (d *Drive) SetRevoked(r bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.revoked = r
+}
+
+// FailUploads makes the next n upload requests fail with a transient
+// error, like a network blip.
+func (d *Drive) FailUploads(n int) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.failNext = n
+}
+
+// SetDir makes the fake also write uploaded files to a local directory.
+func (d *Drive) SetDir(dir string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.dir = dir
+}
+
+// AddFolder creates a folder, and returns its ID.
+func (d *Drive) AddFolder(name, parent string) string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.add(File{Name: name, MimeType: folderMimeType, Parents: []string{parent}}).ID
+}
+
+// Files returns copies of the files in a folder, oldest first.
+func (d *Drive) Files(parent string) []File {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	var ret []File
+	for _, f := range d.children(parent, "") {
+		ret = append(ret, *f)
+	}
+	return ret
+}
+
+// add adds a file. Call with mutex held.
+func (d *Drive) add(f File) *File {
+	d.nextID++
+	f.ID = fmt.Sprintf("fake-%d", d.nextID)
+	f.Created = time.Now()
+	d.files[f.ID] = &f
+	return &f
+}
+
+// children returns the files in a folder, oldest first. Call with mutex held.
+func (d *Drive) children(parent, mimeType string) []*File {
+	var ret []*File
+	for _, f := range d.files {
+		if mimeType != "" && f.MimeType != mimeType {
+			continue
+		}
+		for _, p := range f.Parents {
+			if p == parent {
+				ret = append(ret, f)
+				break
+			}
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Created.Equal(ret[j].Created) {
+			return ret[i].ID < ret[j].ID
+		}
+		return ret[i].Created.Before(ret[j].Created)
+	})
+	return ret
+}
+
+// apiFile is a File as the Drive API returns it.
+type apiFile struct {
+	ID            string   `json:"id"`
+	Name          string   `json:"name"`
+	Description   string   `json:"description,omitempty"`
+	MimeType      string   `json:"mimeType"`
+	Parents       []string `json:"parents,omitempty"`
+	CreatedTime   string   `json:"createdTime"`
+	Md5Checksum   string   `json:"md5Checksum,omitempty"`
+	Size          int64    `json:"size,omitempty,string"`
+	WebViewLink   string   `json:"webViewLink"`
+	ThumbnailLink string   `json:"thumbnailLink,omitempty"`
+}
+
+func (d *Drive) toAPI(f *File) *apiFile {
+	ret := &apiFile{
+		ID:          f.ID,
+		Name:        f.Name,
+		Description: f.Description,
+		MimeType:    f.MimeType,
+		Parents:     f.Parents,
+		CreatedTime: f.Created.UTC().Format(time.RFC3339Nano),
+		WebViewLink: d.Server.URL + "/view/" + f.ID,
+	}
+	if f.MimeType == folderMimeType {
+		return ret
+	}
+	ret.ThumbnailLink = d.Server.URL + "/thumbnails/" + f.ID
+	if !strings.HasPrefix(f.MimeType, "application/vnd.google-apps.") {
+		// Converted documents have no checksum.
+		sum := md5.Sum(f.Content)
+		ret.Md5Checksum = hex.EncodeToString(sum[:])
+		ret.Size = int64(len(f.Content))
+	}
+	return ret
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(v)
+}
+
+func apiError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{"code": code, "message": msg},
+	})
+}
+
+// handleAuth authorizes right away, redirecting back with a code that
+// handleToken takes, like after the user clicked Allow.
+func (d *Drive) handleAuth(w http.ResponseWriter, r *http.Request) {
+	redirect, err := url.Parse(r.FormValue("redirect_uri"))
+	if err != nil || redirect.Scheme == "" {
+		http.Error(w, "Fake OAuth: bad redirect_uri", http.StatusBadRequest)
+		return
+	}
+	q := redirect.Query()
+	q.Set("state", r.FormValue("state"))
+	q.Set("code", "fake-code")
+	redirect.RawQuery = q.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (d *Drive) handleToken(w http.ResponseWriter, r *http.Request) {
+	d.mutex.Lock()
+	revoked := d.revoked
+	d.mutex.Unlock()
+	if revoked {
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"error": "invalid_grant", "error_description": "Token has been expired or revoked."}`)
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"access_token":  "fake-access-token",
+		"token_type":    "Bearer",
+		"refresh_token": "fake-refresh-token",
+		"expires_in":    3600,
+	})
+}
+
+// authed wraps a handler, failing requests with 401 if access is revoked.
+func (d *Drive) authed(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		d.mutex.Lock()
+		revoked := d.revoked
+		d.mutex.Unlock()
+		if revoked {
+			apiError(w, http.StatusUnauthorized, "Invalid Credentials")
+			return
+		}
+		h(w, r)
+	}
+}
+
+func (d *Drive) handleList(w http.ResponseWriter, r *http.Request) {
+	q := r.FormValue("q")
+	m := reParent.FindStringSubmatch(q)
+	if m == nil {
+		apiError(w, http.StatusBadRequest, fmt.Sprintf("fake only supports listing by parent, got q=%q", q))
+		return
+	}
+	var mimeType string
+	if mm := reMimeType.FindStringSubmatch(q); mm != nil {
+		mimeType = mm[1]
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	files := d.children(m[1], mimeType)
+	switch r.FormValue("orderBy") {
+	case "", "createdTime":
+	case "createdTime desc":
+		for i, j := 0, len(files)-1; i < j; i, j = i+1, j-1 {
+			files[i], files[j] = files[j], files[i]
+		}
+	case "name":
+		sort.SliceStable(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	default:
+		apiError(w, http.StatusBadRequest, fmt.Sprintf("fake doesn't support orderBy=%q", r.FormValue("orderBy")))
+		return
+	}
+	ret := struct {
+		Files []*apiFile `json:"files"`
+	}{Files: []*apiFile{}}
+	for _, f := range files {
+		ret.Files = append(ret.Files, d.toAPI(f))
+	}
+	writeJSON(w, &ret)
+}
+
+func (d *Drive) handleFile(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/drive/v3/files/")
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	f, found := d.files[id]
+	if !found {
+		apiError(w, http.StatusNotFound, "File not found: "+id)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		writeJSON(w, d.toAPI(f))
+	case "DELETE":
+		delete(d.files, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		apiError(w, http.StatusMethodNotAllowed, "fake doesn't support "+r.Method)
+	}
+}
+
+func (d *Drive) handleDrives(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]interface{}{"drives": []interface{}{}})
+}
+
+// finishUpload stores an uploaded file. Call with mutex held.
+func (d *Drive) finishUpload(w http.ResponseWriter, meta File, data []byte) {
+	meta.Content = data
+	if len(meta.Parents) == 0 {
+		meta.Parents = []string{RootID}
+	}
+	for _, p := range meta.Parents {
+		if _, found := d.files[p]; !found {
+			apiError(w, http.StatusNotFound, "File not found: "+p)
+			return
+		}
+	}
+	f := d.add(meta)
+	if d.dir != "" {
+		fn := path.Join(d.dir, f.ID+"-"+path.Base(f.Name))
+		if err := ioutil.WriteFile(fn, f.Content, 0644); err != nil {
+			delete(d.files, f.ID)
+			apiError(w, http.StatusInternalServerError, "Writing file: "+err.Error())
+			return
+		}
+		log.Printf("Fake Drive: Wrote upload to %q", fn)
+	}
+	writeJSON(w, d.toAPI(f))
+}
+
+func (d *Drive) handleUpload(w http.ResponseWriter, r *http.Request) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.failNext > 0 {
+		d.failNext--
+		apiError(w, http.StatusServiceUnavailable, "Fake network blip")
+		return
+	}
+	switch r.FormValue("uploadType") {
+	case "multipart":
+		d.uploadMultipart(w, r)
+	case "resumable":
+		if id := r.FormValue("upload_id"); id != "" {
+			d.uploadChunk(w, r, id)
+			return
+		}
+		var meta File
+		if err := json.NewDecoder(r.Body).Decode(&meta); err != nil {
+			apiError(w, http.StatusBadRequest, "Bad metadata: "+err.Error())
+			return
+		}
+		d.nextID++
+		id := fmt.Sprintf("upload-%d", d.nextID)
+		d.uploads[id] = &resumable{meta: meta}
+		w.Header().Set("Location", d.Server.URL+"/upload/drive/v3/files?uploadType=resumable&upload_id="+id)
+	default:
+		apiError(w, http.StatusBadRequest, fmt.Sprintf("fake doesn't support uploadType=%q", r.FormValue("uploadType")))
+	}
+}
+
+func (d *Drive) uploadMultipart(w http.ResponseWriter, r *http.Request) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "Bad Content-Type: "+err.Error())
+		return
+	}
+	mr := multipart.NewReader(r.Body, params["boundary"])
+	var meta File
+	var data []byte
+	for n := 0; n < 2; n++ {
+		p, err := mr.NextPart()
+		if err != nil {
+			apiError(w, http.StatusBadRequest, "Bad multipart body: "+err.Error())
+			return
+		}
+		if n == 0 {
+			err = json.NewDecoder(p).Decode(&meta)
+		} else {
+			data, err = ioutil.ReadAll(p)
+		}
+		if err != nil {
+			apiError(w, http.StatusBadRequest, "Bad multipart body: "+err.Error())
+			return
+		}
+	}
+	d.finishUpload(w, meta, data)
+}
+
+func (d *Drive) uploadChunk(w http.ResponseWriter, r *http.Request, id string) {
+	u, found := d.uploads[id]
+	if !found {
+		apiError(w, http.StatusNotFound, "No such upload session: "+id)
+		return
+	}
+	// "bytes 0-999/*", "bytes 0-999/1000" or "bytes */1000".
+	var first, last, total int64 = 0, -1, -1
+	cr := strings.TrimPrefix(r.Header.Get("Content-Range"), "bytes ")
+	rng, tot := cr, "*"
+	if i := strings.Index(cr, "/"); i >= 0 {
+		rng, tot = cr[:i], cr[i+1:]
+	}
+	if rng != "*" {
+		if _, err := fmt.Sscanf(rng, "%d-%d", &first, &last); err != nil {
+			apiError(w, http.StatusBadRequest, "Bad Content-Range: "+cr)
+			return
+		}
+	}
+	if tot != "*" {
+		if _, err := fmt.Sscanf(tot, "%d", &total); err != nil {
+			apiError(w, http.StatusBadRequest, "Bad Content-Range: "+cr)
+			return
+		}
+	}
+	if first > int64(len(u.data)) {
+		apiError(w, http.StatusBadRequest, fmt.Sprintf("Chunk starts at %d, have %d", first, len(u.data)))
+		return
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "Reading chunk: "+err.Error())
+		return
+	}
+	// Retried chunks overwrite what's already there.
+	u.data = append(u.data[:first], data...)
+	if total >= 0 && int64(len(u.data)) == total {
+		delete(d.uploads, id)
+		d.finishUpload(w, u.meta, u.data)
+		return
+	}
+	w.Header().Set("X-Http-Status-Code-Override", "308")
+	if len(u.data) > 0 {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(u.data)-1))
+	}
+}
+
+// handleView serves a file's content, at its web view link.
+func (d *Drive) handleView(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/view/")
+	d.mutex.Lock()
+	f, found := d.files[id]
+	d.mutex.Unlock()
+	if !found || f.MimeType == folderMimeType {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", f.MimeType)
+	w.Write(f.Content)
+}
+
+// handleThumbnail serves a grey thumbnail for any file.
+func (d *Drive) handleThumbnail(w http.ResponseWriter, r *http.Request) {
+	img := image.NewGray(image.Rect(0, 0, 85, 110))
+	for i := range img.Pix {
+		img.Pix[i] = 0xc0
+	}
+	img.SetGray(42, 55, color.Gray{})
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(buf.Bytes())
+}
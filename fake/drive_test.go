@@ -0,0 +1,46 @@
+package fake
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	drive "google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+func TestResumableUpload(t *testing.T) {
+	d := NewDrive()
+	defer d.Close()
+	svc, err := drive.NewService(context.Background(), option.WithHTTPClient(http.DefaultClient), option.WithEndpoint(d.Endpoint()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	folder := d.AddFolder("Scans", RootID)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), googleapi.MinUploadChunkSize/16*3+1)
+	create := func() (*drive.File, error) {
+		return svc.Files.Create(&drive.File{Name: "big.pdf", Parents: []string{folder}}).
+			Media(bytes.NewReader(data), googleapi.ChunkSize(googleapi.MinUploadChunkSize), googleapi.ChunkRetryDeadline(time.Minute)).
+			Fields("id,md5Checksum").
+			Do()
+	}
+
+	// Four chunks.
+	if _, err := create(); err != nil {
+		t.Fatal(err)
+	}
+	files := d.Files(folder)
+	if len(files) != 1 || !bytes.Equal(files[0].Content, data) {
+		t.Fatalf("Upload didn't arrive intact")
+	}
+
+	// Starting the upload is not retried by the Drive client.
+	d.FailUploads(1)
+	if _, err := create(); err == nil {
+		t.Fatalf("Upload succeeded despite failing session start")
+	}
+}
@@ -0,0 +1,295 @@
+package fake
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// esclCapabilities is what the fake eSCL scanner can do: a platen,
+// and a feeder that can scan both sides.
+const esclCapabilities = `<?xml version="1.0" encoding="UTF-8"?>
+<scan:ScannerCapabilities xmlns:scan="http://schemas.hp.com/imaging/escl/2011/05/03" xmlns:pwg="http://www.pwg.org/schemas/2010/12/sm">
+  <pwg:Version>2.63</pwg:Version>
+  <pwg:MakeAndModel>Fake eSCL scanner</pwg:MakeAndModel>
+  <scan:Platen>
+    <scan:PlatenInputCaps>` + esclInputCaps + `</scan:PlatenInputCaps>
+  </scan:Platen>
+  <scan:Adf>
+    <scan:AdfSimplexInputCaps>` + esclInputCaps + `</scan:AdfSimplexInputCaps>
+    <scan:AdfDuplexInputCaps>` + esclInputCaps + `</scan:AdfDuplexInputCaps>
+    <scan:AdfOptions><scan:AdfOption>DetectPaperLoaded</scan:AdfOption><scan:AdfOption>Duplex</scan:AdfOption></scan:AdfOptions>
+  </scan:Adf>
+</scan:ScannerCapabilities>
+`
+
+const esclInputCaps = `
+      <scan:MinWidth>16</scan:MinWidth>
+      <scan:MaxWidth>2550</scan:MaxWidth>
+      <scan:MinHeight>16</scan:MinHeight>
+      <scan:MaxHeight>3508</scan:MaxHeight>
+      <scan:SettingProfiles>
+        <scan:SettingProfile>
+          <scan:ColorModes>
+            <scan:ColorMode>BlackAndWhite1</scan:ColorMode>
+            <scan:ColorMode>Grayscale8</scan:ColorMode>
+            <scan:ColorMode>RGB24</scan:ColorMode>
+          </scan:ColorModes>
+          <scan:DocumentFormats>
+            <pwg:DocumentFormat>image/jpeg</pwg:DocumentFormat>
+            <pwg:DocumentFormat>application/pdf</pwg:DocumentFormat>
+          </scan:DocumentFormats>
+          <scan:SupportedResolutions>
+            <scan:DiscreteResolutions>
+              <scan:DiscreteResolution><scan:XResolution>100</scan:XResolution><scan:YResolution>100</scan:YResolution></scan:DiscreteResolution>
+              <scan:DiscreteResolution><scan:XResolution>200</scan:XResolution><scan:YResolution>200</scan:YResolution></scan:DiscreteResolution>
+              <scan:DiscreteResolution><scan:XResolution>300</scan:XResolution><scan:YResolution>300</scan:YResolution></scan:DiscreteResolution>
+              <scan:DiscreteResolution><scan:XResolution>600</scan:XResolution><scan:YResolution>600</scan:YResolution></scan:DiscreteResolution>
+            </scan:DiscreteResolutions>
+          </scan:SupportedResolutions>
+        </scan:SettingProfile>
+      </scan:SettingProfiles>
+    `
+
+// esclJob is a scan job of the fake eSCL scanner.
+type esclJob struct {
+	id      int
+	pages   int // To scan.
+	scanned int
+	settle  int // Status replies left before Completed.
+	state   string
+	reason  string
+}
+
+// ESCL is a fake eSCL network scanner, with a feeder scanning like the
+// fake scanimage.
+type ESCL struct {
+	Scanner Scanner
+
+	// NextDocument says the scanner isn't ready this many times at
+	// the start of each job, like while warming up.
+	Warmup int
+
+	// After the last page the job stays Processing for this many
+	// status replies, like while ejecting the last sheet.
+	Settle int
+
+	server *httptest.Server
+
+	mutex    sync.Mutex
+	settings map[string]string
+	jobs     []*esclJob
+	adfState string
+}
+
+// NewESCL starts a fake eSCL scanner.
+func NewESCL(s Scanner) *ESCL {
+	e := &ESCL{
+		Scanner:  s,
+		settings: make(map[string]string),
+		adfState: "ScannerAdfLoaded",
+	}
+	if s.Sheets == 0 {
+		e.adfState = "ScannerAdfEmpty"
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/eSCL/ScannerCapabilities", e.handleCapabilities)
+	mux.HandleFunc("/eSCL/ScannerStatus", e.handleStatus)
+	mux.HandleFunc("/eSCL/ScanJobs", e.handleScanJobs)
+	mux.HandleFunc("/eSCL/ScanJobs/", e.handleJob)
+	e.server = httptest.NewServer(mux)
+	return e
+}
+
+// URL returns the URL of the eSCL service.
+func (e *ESCL) URL() string {
+	return e.server.URL + "/eSCL"
+}
+
+// Close shuts down the fake.
+func (e *ESCL) Close() {
+	e.server.Close()
+}
+
+// Settings returns the settings of the last scan job, by element name,
+// e.g. "InputSource".
+func (e *ESCL) Settings() map[string]string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	ret := make(map[string]string)
+	for k, v := range e.settings {
+		ret[k] = v
+	}
+	return ret
+}
+
+func (e *ESCL) handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/xml")
+	fmt.Fprint(w, esclCapabilities)
+}
+
+func (e *ESCL) handleStatus(w http.ResponseWriter, r *http.Request) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	state := "Idle"
+	var jobs bytes.Buffer
+	for _, j := range e.jobs {
+		if j.state == "Processing" {
+			state = "Processing"
+		}
+		fmt.Fprintf(&jobs, `
+    <scan:JobInfo>
+      <pwg:JobUri>/eSCL/ScanJobs/job-%d</pwg:JobUri>
+      <pwg:JobUuid>job-%d</pwg:JobUuid>
+      <pwg:ImagesCompleted>%d</pwg:ImagesCompleted>
+      <pwg:JobState>%s</pwg:JobState>
+      <pwg:JobStateReasons><pwg:JobStateReason>%s</pwg:JobStateReason></pwg:JobStateReasons>
+    </scan:JobInfo>`, j.id, j.id, j.scanned, j.state, j.reason)
+		if j.settle > 0 {
+			if j.settle--; j.settle == 0 {
+				j.state, j.reason = "Completed", "JobCompletedSuccessfully"
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "text/xml")
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<scan:ScannerStatus xmlns:scan="http://schemas.hp.com/imaging/escl/2011/05/03" xmlns:pwg="http://www.pwg.org/schemas/2010/12/sm">
+  <pwg:Version>2.63</pwg:Version>
+  <pwg:State>%s</pwg:State>
+  <scan:AdfState>%s</scan:AdfState>
+  <scan:Jobs>%s
+  </scan:Jobs>
+</scan:ScannerStatus>
+`, state, e.adfState, jobs.String())
+}
+
+func (e *ESCL) handleScanJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Only POST allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	// Element names are enough, so ignore the namespaces.
+	var s struct {
+		InputSource string
+		Duplex      string
+		ColorMode   string
+		XResolution string
+		YResolution string
+		Format      string `xml:"DocumentFormat"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&s); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.settings = map[string]string{
+		"InputSource":    s.InputSource,
+		"Duplex":         s.Duplex,
+		"ColorMode":      s.ColorMode,
+		"XResolution":    s.XResolution,
+		"YResolution":    s.YResolution,
+		"DocumentFormat": s.Format,
+	}
+	for _, j := range e.jobs {
+		if j.state == "Processing" {
+			http.Error(w, "Busy.", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	if s.InputSource == "Feeder" && e.Scanner.Sheets == 0 {
+		// Like real scanners, refuse right away.
+		http.Error(w, "Feeder empty.", http.StatusConflict)
+		return
+	}
+	pages := e.Scanner.Sheets
+	if s.InputSource != "Feeder" {
+		pages = 1
+	} else if s.Duplex == "true" {
+		pages *= 2
+	}
+	j := &esclJob{
+		id:    len(e.jobs) + 1,
+		pages: pages,
+		state: "Processing",
+	}
+	e.jobs = append(e.jobs, j)
+	w.Header().Set("Location", fmt.Sprintf("%s/eSCL/ScanJobs/job-%d", e.server.URL, j.id))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// job returns the job with a path like "/eSCL/ScanJobs/job-1/...".
+// Only call under mutex lock.
+func (e *ESCL) job(p string) *esclJob {
+	var id int
+	if _, err := fmt.Sscanf(strings.TrimPrefix(p, "/eSCL/ScanJobs/"), "job-%d", &id); err != nil || id < 1 || id > len(e.jobs) {
+		return nil
+	}
+	return e.jobs[id-1]
+}
+
+func (e *ESCL) handleJob(w http.ResponseWriter, r *http.Request) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	j := e.job(r.URL.Path)
+	if j == nil {
+		http.NotFound(w, r)
+		return
+	}
+	switch {
+	case r.Method == "DELETE":
+		if j.state == "Processing" {
+			j.state, j.reason = "Canceled", "JobCanceledByUser"
+		}
+		return
+	case r.Method != "GET" || !strings.HasSuffix(r.URL.Path, "/NextDocument"):
+		http.Error(w, "Not supported.", http.StatusMethodNotAllowed)
+		return
+	case j.state != "Processing":
+		http.NotFound(w, r)
+		return
+	}
+	if j.scanned == 0 && e.Warmup > 0 {
+		e.Warmup--
+		http.Error(w, "Warming up.", http.StatusServiceUnavailable)
+		return
+	}
+	if e.Scanner.Jam > 0 && j.scanned == e.Scanner.Jam {
+		j.state, j.reason = "Aborted", "AbortedBySystem"
+		e.adfState = "ScannerAdfJam"
+		http.NotFound(w, r)
+		return
+	}
+	if j.scanned == j.pages {
+		if j.settle = e.Settle; j.settle == 0 {
+			j.state, j.reason = "Completed", "JobCompletedSuccessfully"
+		}
+		http.NotFound(w, r)
+		return
+	}
+	j.scanned++
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Write(jpegPage(j.scanned))
+}
+
+// jpegPage returns page n as JPEG.
+func jpegPage(n int) []byte {
+	pix := pixels(n)
+	img := image.NewRGBA(image.Rect(0, 0, pageWidth, pageHeight))
+	for y := 0; y < pageHeight; y++ {
+		for x := 0; x < pageWidth; x++ {
+			p := pix[(y*pageWidth+x)*3:]
+			img.Set(x, y, color.RGBA{p[0], p[1], p[2], 0xff})
+		}
+	}
+	var b bytes.Buffer
+	jpeg.Encode(&b, img, nil)
+	return b.Bytes()
+}
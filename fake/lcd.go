@@ -0,0 +1,42 @@
+package fake
+
+import (
+	"log"
+	"sync"
+
+	"github.com/ThomasHabets/autoscan/adafruit"
+	"github.com/ThomasHabets/autoscan/backend"
+)
+
+// LCD emulates the 16x2 LCD display, logging what it would show.
+// It implements backend.UI.
+type LCD struct {
+	mutex sync.Mutex
+	color adafruit.Color
+	lines [2]string
+}
+
+// Show shows an event, like the real display would.
+func (l *LCD) Show(ev backend.Event) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	var lines [2]string
+	l.color, lines = adafruit.Render(ev)
+	for n, s := range lines {
+		if len(s) > adafruit.Width {
+			s = s[:adafruit.Width]
+		}
+		l.lines[n] = s
+	}
+	log.Printf("LCD: %s [%-16s] [%-16s]", l.color, l.lines[0], l.lines[1])
+}
+
+// Run does nothing, since there are no buttons.
+func (l *LCD) Run() {}
+
+// Lines returns what's on the display.
+func (l *LCD) Lines() (color adafruit.Color, line1, line2 string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.color, l.lines[0], l.lines[1]
+}
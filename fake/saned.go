@@ -0,0 +1,466 @@
+package fake
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SANE network protocol calls, status codes and option details, as
+// used by Saned.
+const (
+	saneInit                 = 0
+	saneGetDevices           = 1
+	saneOpen                 = 2
+	saneClose                = 3
+	saneGetOptionDescriptors = 4
+	saneControlOption        = 5
+	saneGetParameters        = 6
+	saneStart                = 7
+	saneCancel               = 8
+	saneExit                 = 10
+
+	saneStatusGood    = 0
+	saneStatusInval   = 4
+	saneStatusEOF     = 5
+	saneStatusIOError = 9
+
+	saneTypeBool   = 0
+	saneTypeInt    = 1
+	saneTypeFixed  = 2
+	saneTypeString = 3
+	saneTypeGroup  = 5
+
+	saneCapSettable = 1 | 4 // Soft select and detect.
+	saneCapInactive = 32
+
+	saneActionSet     = 1
+	saneInfoReload    = 2
+	saneFormatGray    = 0
+	saneFormatRGB     = 1
+	saneUnitMM        = 3
+	saneUnitDPI       = 4
+	saneLittleEndian  = 0x1234
+	saneRecordMaxSize = 4096
+)
+
+// saneOption is an option of the fake device.
+type saneOption struct {
+	name, title, desc string
+	typ, unit, size   int32
+	inactive          bool
+	list              []string // String list constraint.
+	min, max          int32    // Range constraint, if max > 0.
+}
+
+// saneOptions are the options of the fake device, like the fake
+// scanimage -A shows. Option 0 is the number of options.
+var saneOptions = []saneOption{
+	{title: "Number of options", typ: saneTypeInt, size: 4},
+	{title: "Standard", typ: saneTypeGroup},
+	{name: "source", title: "Scan source", desc: "Selects the scan source (such as a document-feeder).", typ: saneTypeString, size: 32, list: []string{"ADF Front", "ADF Back", "ADF Duplex"}},
+	{name: "mode", title: "Scan mode", desc: "Selects the scan mode (e.g., lineart, monochrome, or color).", typ: saneTypeString, size: 16, list: []string{"Lineart", "Gray", "Color"}},
+	{name: "resolution", title: "Scan resolution", desc: "Sets the resolution of the scanned image.", typ: saneTypeInt, unit: saneUnitDPI, size: 4, min: 50, max: 600},
+	{title: "Geometry", typ: saneTypeGroup},
+	{name: "tl-x", title: "Top-left x", desc: "Top-left x position of scan area.", typ: saneTypeFixed, unit: saneUnitMM, size: 4, min: 0, max: 215872 * 65536 / 1000},
+	{title: "Enhancement", typ: saneTypeGroup},
+	{name: "swcrop", title: "Software crop", desc: "Request driver to remove border from pages digitally.", typ: saneTypeBool, size: 4},
+}
+
+// Saned is a fake saned, with one device scanning like the fake
+// scanimage.
+type Saned struct {
+	Scanner Scanner
+
+	l net.Listener
+
+	mutex    sync.Mutex
+	settings map[string]string
+}
+
+// NewSaned starts a fake saned on a local port.
+func NewSaned(s Scanner) (*Saned, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	d := &Saned{
+		Scanner:  s,
+		l:        l,
+		settings: make(map[string]string),
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go d.serve(conn)
+		}
+	}()
+	return d, nil
+}
+
+// Addr returns the host:port to connect to.
+func (d *Saned) Addr() string {
+	return d.l.Addr().String()
+}
+
+// Close stops listening. Connections already made keep working.
+func (d *Saned) Close() error {
+	return d.l.Close()
+}
+
+// Settings returns the options clients have set, by name.
+func (d *Saned) Settings() map[string]string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	ret := make(map[string]string)
+	for k, v := range d.settings {
+		ret[k] = v
+	}
+	return ret
+}
+
+// saneConn reads and writes the SANE network protocol encoding.
+type saneConn struct {
+	r   *bufio.Reader
+	w   *bufio.Writer
+	err error
+}
+
+func (c *saneConn) word() int32 {
+	var v int32
+	if c.err == nil {
+		c.err = binary.Read(c.r, binary.BigEndian, &v)
+	}
+	return v
+}
+
+func (c *saneConn) bytes(n int32) []byte {
+	if c.err != nil || n < 0 || n > 1<<20 {
+		return nil
+	}
+	b := make([]byte, n)
+	_, c.err = io.ReadFull(c.r, b)
+	return b
+}
+
+func (c *saneConn) string() string {
+	b := c.bytes(c.word())
+	if len(b) > 0 {
+		b = b[:len(b)-1]
+	}
+	return string(b)
+}
+
+func (c *saneConn) put(vs ...int32) {
+	for _, v := range vs {
+		binary.Write(c.w, binary.BigEndian, v)
+	}
+}
+
+func (c *saneConn) putString(s string) {
+	c.put(int32(len(s) + 1))
+	c.w.WriteString(s + "\x00")
+}
+
+// putNull writes a NULL string. NULL pointers are a 1.
+func (c *saneConn) putNull() {
+	c.put(0)
+}
+
+// device is the state of a connection's open device.
+type device struct {
+	values map[string]string
+	page   int // Pages scanned since start of the batch.
+}
+
+func (d *Saned) serve(conn net.Conn) {
+	defer conn.Close()
+	c := &saneConn{r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+	dev := &device{values: map[string]string{
+		"source":     "ADF Front",
+		"mode":       "Lineart",
+		"resolution": "600",
+		"tl-x":       "0",
+		"swcrop":     "no",
+	}}
+	for {
+		rpc := c.word()
+		if c.err != nil {
+			return
+		}
+		switch rpc {
+		case saneInit:
+			c.word()
+			c.string()
+			c.put(saneStatusGood, 1<<24|3)
+		case saneGetDevices:
+			c.put(saneStatusGood, 2, 0)
+			for _, s := range []string{Device, "Fake", "sheetfed", "sheetfed scanner"} {
+				c.putString(s)
+			}
+			c.put(1) // NULL pointer.
+		case saneOpen:
+			if name := c.string(); name != Device {
+				c.put(saneStatusInval, 0)
+			} else {
+				c.put(saneStatusGood, 1)
+			}
+			c.putNull()
+		case saneClose:
+			c.word()
+			c.put(0)
+		case saneGetOptionDescriptors:
+			c.word()
+			d.putDescriptors(c, dev)
+		case saneControlOption:
+			d.controlOption(c, dev)
+		case saneGetParameters:
+			c.word()
+			format, depth, bpl := dev.params()
+			c.put(saneStatusGood, format, 1, bpl, pageWidth, -1, depth)
+		case saneStart:
+			c.word()
+			d.start(c, dev)
+		case saneCancel:
+			c.word()
+			dev.page = 0
+			c.put(0)
+		case saneExit:
+			return
+		default:
+			log.Printf("Fake saned: unknown call %d", rpc)
+			return
+		}
+		if c.err != nil || c.w.Flush() != nil {
+			return
+		}
+	}
+}
+
+func (d *Saned) putDescriptors(c *saneConn, dev *device) {
+	c.put(int32(len(saneOptions)))
+	for _, o := range saneOptions {
+		c.put(0) // Not NULL.
+		if o.name == "" {
+			c.putNull()
+		} else {
+			c.putString(o.name)
+		}
+		c.putString(o.title)
+		c.putString(o.desc)
+		caps := int32(saneCapSettable)
+		if o.name == "swcrop" && dev.values["mode"] == "Lineart" {
+			// Like real scanners, only for gray and colour.
+			caps |= saneCapInactive
+		}
+		c.put(o.typ, o.unit, o.size, caps)
+		switch {
+		case len(o.list) > 0:
+			c.put(3, int32(len(o.list)+1))
+			for _, s := range o.list {
+				c.putString(s)
+			}
+			c.putNull()
+		case o.max > 0:
+			c.put(1, 0, o.min, o.max, 0)
+		default:
+			c.put(0)
+		}
+	}
+}
+
+func (d *Saned) controlOption(c *saneConn, dev *device) {
+	c.word() // Handle.
+	n, action, typ, size := c.word(), c.word(), c.word(), c.word()
+	count := c.word()
+	var s string
+	var w int32
+	if typ == saneTypeString {
+		s = string(c.bytes(count))
+		if i := strings.IndexByte(s, 0); i >= 0 {
+			s = s[:i]
+		}
+	} else {
+		for i := int32(0); i < count; i++ {
+			w = c.word()
+		}
+	}
+	if c.err != nil {
+		return
+	}
+	if n < 0 || int(n) >= len(saneOptions) {
+		c.put(saneStatusInval, 0, typ, size, 0)
+		c.putNull()
+		return
+	}
+	o := saneOptions[n]
+	var info int32
+	if action == saneActionSet {
+		v := s
+		switch o.typ {
+		case saneTypeBool:
+			v = "no"
+			if w != 0 {
+				v = "yes"
+			}
+		case saneTypeInt:
+			v = strconv.Itoa(int(w))
+		case saneTypeFixed:
+			v = strconv.FormatFloat(float64(w)/65536, 'g', -1, 64)
+		}
+		if !o.allows(v, w) {
+			c.put(saneStatusInval, 0, typ, size, 0)
+			c.putNull()
+			return
+		}
+		if o.name == "mode" && v != dev.values[o.name] {
+			info |= saneInfoReload
+		}
+		dev.values[o.name] = v
+		func() {
+			d.mutex.Lock()
+			defer d.mutex.Unlock()
+			d.settings[o.name] = v
+		}()
+	}
+	c.put(saneStatusGood, info, o.typ, o.size)
+	v := dev.values[o.name]
+	switch o.typ {
+	case saneTypeString:
+		b := make([]byte, o.size)
+		copy(b, v)
+		c.put(o.size)
+		c.w.Write(b)
+	case saneTypeGroup:
+		c.put(0)
+	default:
+		c.put(1)
+		switch o.typ {
+		case saneTypeBool:
+			if v == "yes" {
+				c.put(1)
+			} else {
+				c.put(0)
+			}
+		case saneTypeFixed:
+			f, _ := strconv.ParseFloat(v, 64)
+			c.put(int32(f * 65536))
+		case saneTypeInt:
+			i, _ := strconv.Atoi(v)
+			c.put(int32(i))
+		default:
+			// The number of options.
+			c.put(int32(len(saneOptions)))
+		}
+	}
+	c.putNull()
+}
+
+// allows returns true if the option can be set to v, or word w.
+func (o *saneOption) allows(v string, w int32) bool {
+	if len(o.list) > 0 {
+		for _, l := range o.list {
+			if l == v {
+				return true
+			}
+		}
+		return false
+	}
+	if o.max > 0 {
+		return w >= o.min && w <= o.max
+	}
+	return o.typ != saneTypeGroup && o.name != ""
+}
+
+// params returns the format, depth and bytes per line of pages.
+func (dev *device) params() (int32, int32, int32) {
+	switch dev.values["mode"] {
+	case "Color":
+		return saneFormatRGB, 8, pageWidth * 3
+	case "Gray":
+		return saneFormatGray, 8, pageWidth
+	}
+	return saneFormatGray, 1, (pageWidth + 7) / 8
+}
+
+// data returns the image data of page n.
+func (dev *device) data(n int) []byte {
+	rgb := pixels(n)
+	format, depth, bpl := dev.params()
+	if format == saneFormatRGB {
+		return rgb
+	}
+	ret := make([]byte, bpl*pageHeight)
+	for y := 0; y < pageHeight; y++ {
+		for x := 0; x < pageWidth; x++ {
+			c := rgb[(y*pageWidth+x)*3]
+			if depth == 8 {
+				ret[y*int(bpl)+x] = c
+			} else if c == 0 {
+				// 1 is black.
+				ret[y*int(bpl)+x/8] |= 0x80 >> uint(x%8)
+			}
+		}
+	}
+	return ret
+}
+
+// start starts scanning the next page, and sends it on a new data port.
+func (d *Saned) start(c *saneConn, dev *device) {
+	pages := d.Scanner.Sheets
+	if dev.values["source"] == "ADF Duplex" {
+		pages *= 2
+	}
+	dev.page++
+	var st int32
+	switch {
+	case d.Scanner.Jam > 0 && dev.page == d.Scanner.Jam+1:
+		st = saneStatusJammed
+	case dev.page > pages:
+		st = saneStatusNoDocs
+	}
+	if st != saneStatusGood {
+		c.put(st, 0, saneLittleEndian)
+		c.putNull()
+		return
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		c.put(saneStatusIOError, 0, saneLittleEndian)
+		c.putNull()
+		return
+	}
+	c.put(saneStatusGood, int32(l.Addr().(*net.TCPAddr).Port), saneLittleEndian)
+	c.putNull()
+	data := dev.data(dev.page)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for len(data) > 0 {
+			n := len(data)
+			if n > saneRecordMaxSize {
+				n = saneRecordMaxSize
+			}
+			if err := binary.Write(conn, binary.BigEndian, uint32(n)); err != nil {
+				return
+			}
+			if _, err := conn.Write(data[:n]); err != nil {
+				return
+			}
+			data = data[n:]
+		}
+		conn.Write([]byte{0xff, 0xff, 0xff, 0xff, saneStatusEOF})
+	}()
+}
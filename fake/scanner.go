@@ -0,0 +1,306 @@
+package fake
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	// Written next to the fakes by Install(), with their Scanner.
+	// See Main().
+	settingsFile = "autoscan-fake.json"
+
+	// scanimage exits with the SANE status.
+	saneStatusJammed = 6
+	saneStatusNoDocs = 7
+
+	// Size of the fake scanned pages. A4 at 12 DPI.
+	pageWidth  = 99
+	pageHeight = 140
+)
+
+// Scanner configures the fake scanimage.
+type Scanner struct {
+	// Sheets of paper in the feeder. Duplex scans give two pages per
+	// sheet. Zero is an empty feeder.
+	Sheets int
+
+	// Jam the feeder after this many pages. Zero means never.
+	Jam int
+
+	// Only a flatbed, with one page on it, instead of a feeder.
+	Flatbed bool
+}
+
+// Install puts fake scanimage and convert programs in dir, and returns
+// their paths. They're links to the running program, which must call
+// Main() first thing. Each dir can have one fake scanner.
+func (s Scanner) Install(dir string) (scanimage, convert string, err error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", "", err
+	}
+	scanimage = path.Join(dir, "scanimage")
+	convert = path.Join(dir, "convert")
+	for _, fn := range []string{scanimage, convert} {
+		if err := os.Symlink(exe, fn); err != nil {
+			return "", "", err
+		}
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return "", "", err
+	}
+	if err := ioutil.WriteFile(path.Join(dir, settingsFile), b, 0644); err != nil {
+		return "", "", err
+	}
+	return scanimage, convert, nil
+}
+
+// Main runs a fake instead of the real program, if this program was run
+// as one of the fakes installed by Install(). Otherwise it does nothing.
+func Main() {
+	name := path.Base(os.Args[0])
+	if name != "scanimage" && name != "convert" {
+		return
+	}
+	b, err := ioutil.ReadFile(path.Join(path.Dir(os.Args[0]), settingsFile))
+	if err != nil {
+		// Not a fake.
+		return
+	}
+	var s Scanner
+	if err := json.Unmarshal(b, &s); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: bad %s: %v\n", name, settingsFile, err)
+		os.Exit(1)
+	}
+	switch name {
+	case "scanimage":
+		err = s.scanimage(os.Args[1:])
+	case "convert":
+		err = convert(os.Args[1:])
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		if e, ok := err.(exitError); ok {
+			os.Exit(int(e))
+		}
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// exitError is a special exit code.
+type exitError int
+
+func (e exitError) Error() string {
+	switch e {
+	case saneStatusJammed:
+		return "sane_read: Document feeder jammed"
+	case saneStatusNoDocs:
+		return "sane_start: Document feeder out of documents"
+	}
+	return fmt.Sprintf("exit code %d", int(e))
+}
+
+// Device is the device the fake scanimage finds.
+const Device = "fake:sheetfed:1"
+
+// options is what the fake scanimage -A shows, like a small sheetfed
+// scanner. flatbedOptions is for a flatbed.
+const options = `
+All options specific to device ` + "`" + Device + `':
+  Standard:
+    --source ADF Front|ADF Back|ADF Duplex [ADF Front]
+        Selects the scan source (such as a document-feeder).
+    --mode Lineart|Gray|Color [Lineart]
+        Selects the scan mode (e.g., lineart, monochrome, or color).
+    --resolution 50..600dpi (in steps of 1) [600]
+        Sets the resolution of the scanned image.
+  Geometry:
+    -l 0..215.872mm (in steps of 0.0211639) [0]
+        Top-left x position of scan area.
+    -t 0..355.6mm (in steps of 0.0211639) [0]
+        Top-left y position of scan area.
+  Enhancement:
+    --swdeskew[=(yes|no)] [no]
+        Request driver to rotate skewed pages digitally.
+    --swcrop[=(yes|no)] [inactive]
+        Request driver to remove border from pages digitally.
+`
+
+const flatbedOptions = `
+All options specific to device ` + "`" + Device + `':
+  Scan Mode:
+    --mode Color|Gray [Color]
+        Selects the scan mode (e.g., lineart, monochrome, or color).
+    --source Flatbed [Flatbed]
+        Selects the scan source (such as a document-feeder).
+    --resolution 75|150|300|600dpi [75]
+        Sets the resolution of the scanned image.
+`
+
+// scanimage pretends to be "scanimage -b --format PNM". It writes
+// out1.pnm, out2.pnm... in the current directory and, like the real
+// thing, exits with status 7 when the feeder is empty. A flatbed must
+// be scanned with --batch-count=1. With -L or -A it lists its device or
+// options.
+func (s Scanner) scanimage(args []string) error {
+	kind, opts := "sheetfed", options
+	if s.Flatbed {
+		kind, opts = "flatbed", flatbedOptions
+	}
+	for n, a := range args {
+		switch a {
+		case "-L":
+			// Only the -f format used by the sane package.
+			if n < 2 || args[n-2] != "-f" {
+				fmt.Printf("device `%s' is a Fake %s scanner\n", Device, kind)
+				return nil
+			}
+			fmt.Printf("%s\tFake\t%s\t%s scanner\n", Device, kind, kind)
+			return nil
+		case "-A":
+			fmt.Print(opts[1:])
+			return nil
+		}
+	}
+	pages, jam := s.Sheets, s.Jam
+	once := false
+	for n, a := range args {
+		switch {
+		case a == "--source" && n+1 < len(args):
+			if s.Flatbed != (args[n+1] == "Flatbed") {
+				return fmt.Errorf("setting of option --source failed (Invalid argument)")
+			}
+			if strings.Contains(args[n+1], "Duplex") {
+				pages *= 2
+			}
+		case a == "--batch-count=1":
+			once = true
+		}
+	}
+	if s.Flatbed {
+		if !once {
+			return fmt.Errorf("flatbed scanned without --batch-count=1 would never stop")
+		}
+		if err := ioutil.WriteFile("out1.pnm", pnm(1), 0644); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Scanned page 1. (scanner status = 5)\n")
+		return nil
+	}
+	for n := 1; n <= pages; n++ {
+		if n == jam+1 && jam > 0 {
+			return exitError(saneStatusJammed)
+		}
+		fn := fmt.Sprintf("out%d.pnm", n)
+		if err := ioutil.WriteFile(fn, pnm(n), 0644); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Scanned page %d. (scanner status = 5)\n", n)
+	}
+	return exitError(saneStatusNoDocs)
+}
+
+// pnm returns a PNM image with n black bars on a white page.
+func pnm(n int) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "P6\n%d %d\n255\n", pageWidth, pageHeight)
+	b.Write(pixels(n))
+	return b.Bytes()
+}
+
+// pixels returns the RGB pixels of page n.
+func pixels(n int) []byte {
+	var b bytes.Buffer
+	for y := 0; y < pageHeight; y++ {
+		for x := 0; x < pageWidth; x++ {
+			c := byte(0xff)
+			if bar := y / 6; y%6 < 3 && bar >= 1 && bar <= n && x > 10 && x < pageWidth-10 {
+				c = 0
+			}
+			b.Write([]byte{c, c, c})
+		}
+	}
+	return b.Bytes()
+}
+
+// convert pretends to be ImageMagick convert, turning PNM and JPEG
+// files into a PDF. The last argument is the output. The PDF has one
+// page per input file, with the page number on it instead of the image.
+func convert(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: convert <in.pnm>... [options] <out.pdf>")
+	}
+	var pages int
+	for _, a := range args[:len(args)-1] {
+		var magic string
+		switch {
+		case strings.HasSuffix(a, ".pnm"):
+			magic = "P"
+		case strings.HasSuffix(a, ".jpg"):
+			magic = "\xff\xd8"
+		default:
+			continue
+		}
+		f, err := os.Open(a)
+		if err != nil {
+			return err
+		}
+		b := make([]byte, len(magic))
+		_, err = io.ReadFull(f, b)
+		f.Close()
+		if err != nil || string(b) != magic {
+			return fmt.Errorf("%q is not a %s file", a, path.Ext(a))
+		}
+		pages++
+	}
+	if pages == 0 {
+		return fmt.Errorf("no input files")
+	}
+	return ioutil.WriteFile(args[len(args)-1], pdf(pages), 0644)
+}
+
+// pdf returns a minimal PDF with the given number of pages.
+func pdf(pages int) []byte {
+	var objs []string
+	// 1: Catalog, 2: Pages, 3: Font, then page and content for each page.
+	kids := make([]string, pages)
+	for n := range kids {
+		kids[n] = fmt.Sprintf("%d 0 R", 4+2*n)
+	}
+	objs = append(objs,
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), pages),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>",
+	)
+	for n := 0; n < pages; n++ {
+		content := fmt.Sprintf("BT /F1 24 Tf 72 720 Td (Fake page %d) Tj ET", n+1)
+		objs = append(objs,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 595 842] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>", 5+2*n),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content),
+		)
+	}
+
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objs))
+	for n, o := range objs {
+		offsets[n] = b.Len()
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", n+1, o)
+	}
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f \n", len(objs)+1)
+	for _, o := range offsets {
+		fmt.Fprintf(&b, "%010d 00000 n \n", o)
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objs)+1, xref)
+	return b.Bytes()
+}
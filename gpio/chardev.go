@@ -0,0 +1,234 @@
+package gpio
+
+// The GPIO v2 character device ABI, from linux/gpio.h. Structs are
+// serialized by hand, since Go on 32bit ARM doesn't align uint64 like
+// the kernel's __aligned_u64.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	consumer = "autoscan"
+
+	lineFlagActiveLow    = 1 << 1
+	lineFlagInput        = 1 << 2
+	lineFlagOutput       = 1 << 3
+	lineFlagEdgeRising   = 1 << 4
+	lineFlagEdgeFalling  = 1 << 5
+	lineFlagBiasPullUp   = 1 << 8
+	lineFlagBiasPullDown = 1 << 9
+	lineFlagBiasDisabled = 1 << 10
+
+	lineAttrIDOutputValues = 2
+
+	lineEventRisingEdge  = 1
+	lineEventFallingEdge = 2
+
+	// Sizes of structs.
+	sizeLineRequest = 592
+	sizeLineValues  = 16
+	sizeLineEvent   = 48
+
+	// Offsets in struct gpio_v2_line_request.
+	offConsumer   = 256
+	offConfig     = 288
+	offNumAttrs   = offConfig + 8
+	offAttrs      = offConfig + 32
+	offNumLines   = 560
+	offRequestFD  = 588
+	sizeAttribute = 24
+
+	// _IOWR(0xB4, nr, size)
+	ioctlGetLine   = 3<<30 | sizeLineRequest<<16 | 0xB4<<8 | 0x07
+	ioctlGetValues = 3<<30 | sizeLineValues<<16 | 0xB4<<8 | 0x0E
+	ioctlSetValues = 3<<30 | sizeLineValues<<16 | 0xB4<<8 | 0x0F
+)
+
+var native = binary.NativeEndian
+
+func ioctl(fd uintptr, req uintptr, buf []byte) error {
+	for {
+		_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(unsafe.Pointer(&buf[0])))
+		switch errno {
+		case 0:
+			return nil
+		case syscall.EINTR:
+			continue
+		}
+		return errno
+	}
+}
+
+// chip is a GPIO chip character device.
+type chip struct {
+	name string
+	f    *os.File
+
+	mutex sync.Mutex
+	lines map[*line]bool
+}
+
+// Open opens a GPIO chip, such as /dev/gpiochip0.
+func Open(name string) (Chip, error) {
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &chip{
+		name:  name,
+		f:     f,
+		lines: make(map[*line]bool),
+	}, nil
+}
+
+// request requests one line, returning its file.
+func (c *chip) request(offset int, flags uint64, outputValue bool) (*os.File, error) {
+	var req [sizeLineRequest]byte
+	native.PutUint32(req[0:], uint32(offset))
+	copy(req[offConsumer:offConsumer+31], consumer)
+	native.PutUint64(req[offConfig:], flags)
+	if flags&lineFlagOutput != 0 {
+		native.PutUint32(req[offNumAttrs:], 1)
+		attr := req[offAttrs : offAttrs+sizeAttribute]
+		native.PutUint32(attr[0:], lineAttrIDOutputValues)
+		if outputValue {
+			native.PutUint64(attr[8:], 1)
+		}
+		native.PutUint64(attr[16:], 1) // Mask.
+	}
+	native.PutUint32(req[offNumLines:], 1)
+	if err := ioctl(c.f.Fd(), ioctlGetLine, req[:]); err != nil {
+		return nil, fmt.Errorf("requesting line %d of %s: %v", offset, c.name, err)
+	}
+	fd := int(int32(native.Uint32(req[offRequestFD:])))
+	// Non-blocking, so that the runtime poller can interrupt reads on Close().
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), fmt.Sprintf("%s:%d", c.name, offset)), nil
+}
+
+func (c *chip) add(l *line) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.lines[l] = true
+}
+
+// Input implements Chip.
+func (c *chip) Input(offset int, cfg InputConfig, events chan<- Event) (Input, error) {
+	flags := uint64(lineFlagInput | lineFlagEdgeRising | lineFlagEdgeFalling)
+	if cfg.ActiveLow {
+		flags |= lineFlagActiveLow
+	}
+	switch cfg.Bias {
+	case Disabled:
+		flags |= lineFlagBiasDisabled
+	case PullUp:
+		flags |= lineFlagBiasPullUp
+	case PullDown:
+		flags |= lineFlagBiasPullDown
+	}
+	f, err := c.request(offset, flags, false)
+	if err != nil {
+		return nil, err
+	}
+	l := &line{chip: c, f: f, offset: offset}
+	c.add(l)
+	go l.readEvents(events)
+	return l, nil
+}
+
+// Output implements Chip.
+func (c *chip) Output(offset int, initial bool) (Output, error) {
+	f, err := c.request(offset, lineFlagOutput, initial)
+	if err != nil {
+		return nil, err
+	}
+	l := &line{chip: c, f: f, offset: offset}
+	c.add(l)
+	return l, nil
+}
+
+// Close implements Chip.
+func (c *chip) Close() error {
+	c.mutex.Lock()
+	var lines []*line
+	for l := range c.lines {
+		lines = append(lines, l)
+	}
+	c.mutex.Unlock()
+	for _, l := range lines {
+		l.Close()
+	}
+	return c.f.Close()
+}
+
+// line is a requested line, input or output.
+type line struct {
+	chip   *chip
+	f      *os.File
+	offset int
+}
+
+func (l *line) readEvents(events chan<- Event) {
+	buf := make([]byte, sizeLineEvent)
+	for {
+		if _, err := io.ReadFull(l.f, buf); err != nil {
+			// Closed.
+			return
+		}
+		ev := Event{
+			Offset: int(native.Uint32(buf[12:])),
+			Time:   time.Duration(native.Uint64(buf[0:])),
+		}
+		switch native.Uint32(buf[8:]) {
+		case lineEventRisingEdge:
+			ev.Edge = Rising
+		case lineEventFallingEdge:
+			ev.Edge = Falling
+		default:
+			continue
+		}
+		events <- ev
+	}
+}
+
+// Value implements Input.
+func (l *line) Value() (bool, error) {
+	var v [sizeLineValues]byte
+	native.PutUint64(v[8:], 1) // Mask.
+	if err := ioctl(l.f.Fd(), ioctlGetValues, v[:]); err != nil {
+		return false, fmt.Errorf("reading line %d: %v", l.offset, err)
+	}
+	return native.Uint64(v[0:])&1 != 0, nil
+}
+
+// Set implements Output.
+func (l *line) Set(on bool) error {
+	var v [sizeLineValues]byte
+	if on {
+		native.PutUint64(v[0:], 1)
+	}
+	native.PutUint64(v[8:], 1) // Mask.
+	if err := ioctl(l.f.Fd(), ioctlSetValues, v[:]); err != nil {
+		return fmt.Errorf("setting line %d: %v", l.offset, err)
+	}
+	return nil
+}
+
+// Close releases the line.
+func (l *line) Close() error {
+	l.chip.mutex.Lock()
+	delete(l.chip.lines, l)
+	l.chip.mutex.Unlock()
+	return l.f.Close()
+}
@@ -0,0 +1,131 @@
+package gpio
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Fake is an in-memory GPIO chip for tests.
+type Fake struct {
+	start time.Time
+
+	mutex   sync.Mutex
+	inputs  map[int]*fakeLine
+	outputs map[int]*fakeLine
+}
+
+type fakeLine struct {
+	fake   *Fake
+	offset int
+	value  bool
+	events chan<- Event
+	output bool
+}
+
+// NewFake creates a fake chip with no lines requested.
+func NewFake() *Fake {
+	return &Fake{
+		start:   time.Now(),
+		inputs:  make(map[int]*fakeLine),
+		outputs: make(map[int]*fakeLine),
+	}
+}
+
+func (f *Fake) busy(offset int) bool {
+	return f.inputs[offset] != nil || f.outputs[offset] != nil
+}
+
+// Input implements Chip. The input is initially inactive.
+func (f *Fake) Input(offset int, cfg InputConfig, events chan<- Event) (Input, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.busy(offset) {
+		return nil, fmt.Errorf("line %d busy", offset)
+	}
+	l := &fakeLine{fake: f, offset: offset, events: events}
+	f.inputs[offset] = l
+	return l, nil
+}
+
+// Output implements Chip.
+func (f *Fake) Output(offset int, initial bool) (Output, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.busy(offset) {
+		return nil, fmt.Errorf("line %d busy", offset)
+	}
+	l := &fakeLine{fake: f, offset: offset, value: initial, output: true}
+	f.outputs[offset] = l
+	return l, nil
+}
+
+// Close implements Chip.
+func (f *Fake) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.inputs = make(map[int]*fakeLine)
+	f.outputs = make(map[int]*fakeLine)
+	return nil
+}
+
+// Set sets an input line, as if the pin changed, sending an event if
+// the value changed. Blocks until the event is received.
+func (f *Fake) Set(offset int, v bool) error {
+	f.mutex.Lock()
+	l := f.inputs[offset]
+	if l == nil {
+		f.mutex.Unlock()
+		return fmt.Errorf("line %d not requested as input", offset)
+	}
+	if l.value == v {
+		f.mutex.Unlock()
+		return nil
+	}
+	l.value = v
+	ev := Event{Offset: offset, Edge: Falling, Time: time.Since(f.start)}
+	if v {
+		ev.Edge = Rising
+	}
+	f.mutex.Unlock()
+	l.events <- ev
+	return nil
+}
+
+// Get returns the value of an output line, and false if it's not requested.
+func (f *Fake) Get(offset int) (value, ok bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	l := f.outputs[offset]
+	if l == nil {
+		return false, false
+	}
+	return l.value, true
+}
+
+// Value implements Input.
+func (l *fakeLine) Value() (bool, error) {
+	l.fake.mutex.Lock()
+	defer l.fake.mutex.Unlock()
+	return l.value, nil
+}
+
+// Set implements Output.
+func (l *fakeLine) Set(v bool) error {
+	l.fake.mutex.Lock()
+	defer l.fake.mutex.Unlock()
+	l.value = v
+	return nil
+}
+
+// Close implements Input and Output.
+func (l *fakeLine) Close() error {
+	l.fake.mutex.Lock()
+	defer l.fake.mutex.Unlock()
+	if l.output {
+		delete(l.fake.outputs, l.offset)
+	} else {
+		delete(l.fake.inputs, l.offset)
+	}
+	return nil
+}
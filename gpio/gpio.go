@@ -0,0 +1,97 @@
+// Package gpio accesses GPIO lines through the Linux GPIO character
+// device (/dev/gpiochipN), with kernel edge detection for inputs.
+//
+// The old sysfs interface (/sys/class/gpio) is deprecated, and could
+// only be polled.
+//
+// There's an in-memory fake for tests. See NewFake().
+package gpio
+
+import (
+	"time"
+)
+
+// Edge is a change of an input line's value.
+type Edge int
+
+// Edges. Rising means the line became active, taking ActiveLow into account.
+const (
+	Rising Edge = iota + 1
+	Falling
+)
+
+func (e Edge) String() string {
+	switch e {
+	case Rising:
+		return "rising"
+	case Falling:
+		return "falling"
+	}
+	return "unknown"
+}
+
+// Event is an edge on an input line.
+type Event struct {
+	Offset int
+	Edge   Edge
+
+	// When the edge happened, on a monotonic clock with unspecified start.
+	Time time.Duration
+}
+
+// Bias is the pull-up or pull-down configuration of an input line.
+type Bias int
+
+// Biases.
+const (
+	AsIs Bias = iota // Leave it as it is.
+	Disabled
+	PullUp
+	PullDown
+)
+
+// ParseBias parses a bias name, as used in flags.
+func ParseBias(s string) (Bias, bool) {
+	b, ok := map[string]Bias{
+		"as-is":     AsIs,
+		"disabled":  Disabled,
+		"pull-up":   PullUp,
+		"pull-down": PullDown,
+	}[s]
+	return b, ok
+}
+
+// InputConfig configures an input line.
+type InputConfig struct {
+	Bias Bias
+
+	// Line is active (true, Rising) when low. Use with PullUp for
+	// buttons connecting the pin to ground.
+	ActiveLow bool
+}
+
+// Input is an input line. Edges are sent on the channel given when it
+// was requested.
+type Input interface {
+	Value() (bool, error)
+	Close() error
+}
+
+// Output is an output line.
+type Output interface {
+	Set(bool) error
+	Close() error
+}
+
+// Chip is a GPIO chip, a set of lines.
+type Chip interface {
+	// Input requests a line as input. Edge events are sent to events,
+	// which is not closed when the line is.
+	Input(offset int, cfg InputConfig, events chan<- Event) (Input, error)
+
+	// Output requests a line as output.
+	Output(offset int, initial bool) (Output, error)
+
+	// Close releases all lines requested from the chip.
+	Close() error
+}
@@ -0,0 +1,57 @@
+package i2c
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Device is a fake I2C device.
+type Device interface {
+	Tx(w, r []byte) error
+}
+
+// Fake is an in-memory I2C bus for tests, with fake devices.
+type Fake struct {
+	mutex   sync.Mutex
+	devices map[uint16]Device
+	err     error
+}
+
+// NewFake creates a fake bus with no devices.
+func NewFake() *Fake {
+	return &Fake{devices: make(map[uint16]Device)}
+}
+
+// Add adds a device to the bus.
+func (f *Fake) Add(addr uint16, d Device) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.devices[addr] = d
+}
+
+// SetError makes all transactions fail with err, as if the bus was
+// unplugged. Nil makes them work again.
+func (f *Fake) SetError(err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.err = err
+}
+
+// Tx implements Bus.
+func (f *Fake) Tx(addr uint16, w, r []byte) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	d := f.devices[addr]
+	if d == nil {
+		return fmt.Errorf("no device at I2C address 0x%02x", addr)
+	}
+	return d.Tx(w, r)
+}
+
+// Close implements Bus.
+func (f *Fake) Close() error {
+	return nil
+}
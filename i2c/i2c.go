@@ -0,0 +1,67 @@
+// Package i2c talks to devices on an I2C bus through Linux's
+// /dev/i2c-N character devices.
+//
+// There's an in-memory fake for tests. See Fake.
+package i2c
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// Bus is an I2C bus.
+type Bus interface {
+	// Tx writes w to the device at addr, then reads len(r) bytes
+	// from it. Either may be empty.
+	Tx(addr uint16, w, r []byte) error
+	Close() error
+}
+
+// ioctl request to set the device address, from linux/i2c-dev.h.
+const ioctlSlave = 0x0703
+
+// bus is an I2C character device.
+type bus struct {
+	mutex sync.Mutex
+	f     *os.File
+	addr  int // Current device address, or -1.
+}
+
+// Open opens an I2C bus, such as /dev/i2c-1.
+func Open(name string) (Bus, error) {
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &bus{f: f, addr: -1}, nil
+}
+
+// Tx implements Bus.
+func (b *bus) Tx(addr uint16, w, r []byte) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if int(addr) != b.addr {
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, b.f.Fd(), ioctlSlave, uintptr(addr)); errno != 0 {
+			return fmt.Errorf("setting I2C address 0x%02x: %v", addr, errno)
+		}
+		b.addr = int(addr)
+	}
+	if len(w) > 0 {
+		if _, err := b.f.Write(w); err != nil {
+			return fmt.Errorf("writing to I2C device 0x%02x: %v", addr, err)
+		}
+	}
+	if len(r) > 0 {
+		if _, err := b.f.Read(r); err != nil {
+			return fmt.Errorf("reading from I2C device 0x%02x: %v", addr, err)
+		}
+	}
+	return nil
+}
+
+// Close implements Bus.
+func (b *bus) Close() error {
+	return b.f.Close()
+}
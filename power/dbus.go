@@ -0,0 +1,364 @@
+package power
+
+// Just enough of the D-Bus wire protocol to call a method with one
+// boolean argument, and wait for the reply.
+//
+// https://dbus.freedesktop.org/doc/dbus-specification.html
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultBus is the D-Bus system bus socket.
+const DefaultBus = "/run/dbus/system_bus_socket"
+
+// dbusTimeout is how long to wait for the whole call.
+const dbusTimeout = 30 * time.Second
+
+// maxMessage is the largest message part that's read.
+const maxMessage = 1 << 20
+
+// Message types.
+const (
+	msgCall   = 1
+	msgReturn = 2
+	msgError  = 3
+	msgSignal = 4
+)
+
+// Header fields.
+const (
+	fieldPath        = 1
+	fieldInterface   = 2
+	fieldMember      = 3
+	fieldErrorName   = 4
+	fieldReplySerial = 5
+	fieldDestination = 6
+	fieldSignature   = 8
+)
+
+// dbusMsg is a D-Bus message.
+type dbusMsg struct {
+	Type        byte
+	Serial      uint32
+	ReplySerial uint32
+	Path        string
+	Interface   string
+	Member      string
+	ErrorName   string
+	Destination string
+	Signature   string
+	Body        []byte // Marshalled in Order.
+
+	// Byte order of a received message. Sent ones are little endian.
+	Order binary.ByteOrder
+}
+
+// encoder marshals little endian D-Bus data.
+type encoder struct {
+	b []byte
+}
+
+func (e *encoder) align(n int) {
+	for len(e.b)%n != 0 {
+		e.b = append(e.b, 0)
+	}
+}
+
+func (e *encoder) uint32(v uint32) {
+	e.align(4)
+	e.b = binary.LittleEndian.AppendUint32(e.b, v)
+}
+
+func (e *encoder) string(s string) {
+	e.uint32(uint32(len(s)))
+	e.b = append(append(e.b, s...), 0)
+}
+
+func (e *encoder) signature(s string) {
+	e.b = append(append(append(e.b, byte(len(s))), s...), 0)
+}
+
+// field adds a header field, if it's set.
+func (e *encoder) field(code byte, sig, s string, u uint32) {
+	if s == "" && u == 0 {
+		return
+	}
+	e.align(8)
+	e.b = append(e.b, code)
+	e.signature(sig)
+	switch sig {
+	case "g":
+		e.signature(s)
+	case "u":
+		e.uint32(u)
+	default:
+		e.string(s)
+	}
+}
+
+// marshal returns the message on the wire.
+func (m *dbusMsg) marshal() []byte {
+	e := &encoder{b: []byte{'l', m.Type, 0, 1}}
+	e.uint32(uint32(len(m.Body)))
+	e.uint32(m.Serial)
+	e.uint32(0) // Length of header fields, filled in below.
+	e.field(fieldPath, "o", m.Path, 0)
+	e.field(fieldInterface, "s", m.Interface, 0)
+	e.field(fieldMember, "s", m.Member, 0)
+	e.field(fieldErrorName, "s", m.ErrorName, 0)
+	e.field(fieldReplySerial, "u", "", m.ReplySerial)
+	e.field(fieldDestination, "s", m.Destination, 0)
+	e.field(fieldSignature, "g", m.Signature, 0)
+	binary.LittleEndian.PutUint32(e.b[12:], uint32(len(e.b)-16))
+	e.align(8)
+	return append(e.b, m.Body...)
+}
+
+// decoder unmarshals D-Bus data. Offsets are from the message start,
+// for alignment.
+type decoder struct {
+	b     []byte
+	off   int // Offset of b[0] in the message.
+	pos   int
+	order binary.ByteOrder
+}
+
+func (d *decoder) align(n int) {
+	for (d.off+d.pos)%n != 0 {
+		d.pos++
+	}
+}
+
+func (d *decoder) need(n int) error {
+	if d.pos+n > len(d.b) {
+		return fmt.Errorf("message truncated")
+	}
+	return nil
+}
+
+func (d *decoder) uint32() (uint32, error) {
+	d.align(4)
+	if err := d.need(4); err != nil {
+		return 0, err
+	}
+	v := d.order.Uint32(d.b[d.pos:])
+	d.pos += 4
+	return v, nil
+}
+
+func (d *decoder) string() (string, error) {
+	n, err := d.uint32()
+	if err != nil {
+		return "", err
+	}
+	if err := d.need(int(n) + 1); err != nil {
+		return "", err
+	}
+	s := string(d.b[d.pos : d.pos+int(n)])
+	d.pos += int(n) + 1
+	return s, nil
+}
+
+func (d *decoder) signature() (string, error) {
+	if err := d.need(1); err != nil {
+		return "", err
+	}
+	n := int(d.b[d.pos])
+	d.pos++
+	if err := d.need(n + 1); err != nil {
+		return "", err
+	}
+	s := string(d.b[d.pos : d.pos+n])
+	d.pos += n + 1
+	return s, nil
+}
+
+// readMessage reads one message.
+func readMessage(r io.Reader) (*dbusMsg, error) {
+	var h [16]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return nil, err
+	}
+	var order binary.ByteOrder
+	switch h[0] {
+	case 'l':
+		order = binary.LittleEndian
+	case 'B':
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("bad endianness %q", h[0])
+	}
+	m := &dbusMsg{
+		Type:   h[1],
+		Serial: order.Uint32(h[8:]),
+		Order:  order,
+	}
+	bodyLen := order.Uint32(h[4:])
+	fieldsLen := order.Uint32(h[12:])
+	if bodyLen > maxMessage || fieldsLen > maxMessage {
+		return nil, fmt.Errorf("message too large")
+	}
+	// Header fields are padded to 8 bytes.
+	fields := make([]byte, (fieldsLen+7)&^7)
+	if _, err := io.ReadFull(r, fields); err != nil {
+		return nil, err
+	}
+	m.Body = make([]byte, bodyLen)
+	if _, err := io.ReadFull(r, m.Body); err != nil {
+		return nil, err
+	}
+
+	d := &decoder{b: fields[:fieldsLen], off: 16, order: order}
+	for d.pos < len(d.b) {
+		d.align(8)
+		if err := d.need(1); err != nil {
+			return nil, err
+		}
+		code := d.b[d.pos]
+		d.pos++
+		sig, err := d.signature()
+		if err != nil {
+			return nil, err
+		}
+		var s string
+		var u uint32
+		switch sig {
+		case "s", "o":
+			s, err = d.string()
+		case "g":
+			s, err = d.signature()
+		case "u":
+			u, err = d.uint32()
+		default:
+			err = fmt.Errorf("unsupported header field type %q", sig)
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch code {
+		case fieldPath:
+			m.Path = s
+		case fieldInterface:
+			m.Interface = s
+		case fieldMember:
+			m.Member = s
+		case fieldErrorName:
+			m.ErrorName = s
+		case fieldReplySerial:
+			m.ReplySerial = u
+		case fieldDestination:
+			m.Destination = s
+		case fieldSignature:
+			m.Signature = s
+		}
+	}
+	return m, nil
+}
+
+// auth authenticates as the user running this process.
+func auth(c io.Writer, r *bufio.Reader) error {
+	uid := hex.EncodeToString([]byte(strconv.Itoa(os.Getuid())))
+	if _, err := fmt.Fprintf(c, "\x00AUTH EXTERNAL %s\r\n", uid); err != nil {
+		return err
+	}
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "OK ") {
+		return fmt.Errorf("auth rejected: %q", strings.TrimSpace(line))
+	}
+	_, err = fmt.Fprintf(c, "BEGIN\r\n")
+	return err
+}
+
+// waitReply reads messages until the reply to serial. Others, e.g.
+// signals, are skipped.
+func waitReply(r io.Reader, serial uint32) error {
+	for {
+		m, err := readMessage(r)
+		if err != nil {
+			return err
+		}
+		if m.ReplySerial != serial {
+			continue
+		}
+		switch m.Type {
+		case msgReturn:
+			return nil
+		case msgError:
+			// The body is usually the error message.
+			if strings.HasPrefix(m.Signature, "s") {
+				d := &decoder{b: m.Body, order: m.Order}
+				if msg, err := d.string(); err == nil {
+					return fmt.Errorf("%s: %s", m.ErrorName, msg)
+				}
+			}
+			return fmt.Errorf("%s", m.ErrorName)
+		}
+	}
+}
+
+// dbusCall calls a method with one boolean argument on the bus, and
+// waits for it to return.
+func dbusCall(socket, dest, path, iface, member string, arg bool) error {
+	c, err := net.DialTimeout("unix", socket, dbusTimeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(dbusTimeout))
+	r := bufio.NewReader(c)
+	if err := auth(c, r); err != nil {
+		return fmt.Errorf("D-Bus: %v", err)
+	}
+
+	// Must say hello before anything else.
+	hello := &dbusMsg{
+		Type:        msgCall,
+		Serial:      1,
+		Path:        "/org/freedesktop/DBus",
+		Interface:   "org.freedesktop.DBus",
+		Member:      "Hello",
+		Destination: "org.freedesktop.DBus",
+	}
+	if _, err := c.Write(hello.marshal()); err != nil {
+		return err
+	}
+	if err := waitReply(r, hello.Serial); err != nil {
+		return fmt.Errorf("D-Bus Hello: %v", err)
+	}
+
+	// Booleans are marshalled as uint32.
+	var b uint32
+	if arg {
+		b = 1
+	}
+	call := &dbusMsg{
+		Type:        msgCall,
+		Serial:      2,
+		Path:        path,
+		Interface:   iface,
+		Member:      member,
+		Destination: dest,
+		Signature:   "b",
+		Body:        binary.LittleEndian.AppendUint32(nil, b),
+	}
+	if _, err := c.Write(call.marshal()); err != nil {
+		return err
+	}
+	if err := waitReply(r, call.Serial); err != nil {
+		return fmt.Errorf("%s.%s: %v", iface, member, err)
+	}
+	return nil
+}
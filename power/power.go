@@ -0,0 +1,61 @@
+// Package power reboots and shuts down the machine, either by running
+// a command or by asking systemd-logind over D-Bus.
+//
+// Asking logind works without root, if polkit allows the user to.
+// E.g. on Raspberry Pi OS, users logged in locally are allowed.
+package power
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+)
+
+// logind.
+const (
+	logindDest  = "org.freedesktop.login1"
+	logindPath  = "/org/freedesktop/login1"
+	logindIface = "org.freedesktop.login1.Manager"
+)
+
+// Power reboots and shuts down the machine.
+type Power struct {
+	// Commands to run, e.g. {"sudo", "reboot"}. If empty, logind is
+	// asked over D-Bus.
+	RebootCommand   []string
+	PoweroffCommand []string
+
+	// D-Bus system bus socket. Default is DefaultBus.
+	Bus string
+}
+
+// Reboot reboots the machine.
+func (p *Power) Reboot() error {
+	return p.do("reboot", p.RebootCommand, "Reboot")
+}
+
+// Poweroff shuts down the machine.
+func (p *Power) Poweroff() error {
+	return p.do("poweroff", p.PoweroffCommand, "PowerOff")
+}
+
+func (p *Power) do(what string, cmd []string, method string) error {
+	if len(cmd) > 0 {
+		log.Printf("Power: %s by running %q", what, cmd)
+		if out, err := exec.Command(cmd[0], cmd[1:]...).CombinedOutput(); err != nil {
+			return fmt.Errorf("%s: running %q: %v: %s", what, cmd, err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+	bus := p.Bus
+	if bus == "" {
+		bus = DefaultBus
+	}
+	log.Printf("Power: %s by asking logind", what)
+	// Not interactive, since there's nobody to ask for a password.
+	if err := dbusCall(bus, logindDest, logindPath, logindIface, method, false); err != nil {
+		return fmt.Errorf("%s: asking logind: %v", what, err)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package power
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"path"
+	"strings"
+	"testing"
+)
+
+// fakeBus is a D-Bus daemon with logind on it, that answers calls with
+// reply, or an error if errName is set.
+func fakeBus(t *testing.T, errName string) (string, <-chan *dbusMsg) {
+	t.Helper()
+	fn := path.Join(t.TempDir(), "bus")
+	l, err := net.Listen("unix", fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	calls := make(chan *dbusMsg, 10)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		r := bufio.NewReader(c)
+		if b, err := r.ReadByte(); err != nil || b != 0 {
+			t.Errorf("Bad first byte %d: %v", b, err)
+			return
+		}
+		if line, _ := r.ReadString('\n'); !strings.HasPrefix(line, "AUTH EXTERNAL ") {
+			t.Errorf("Bad auth %q", line)
+			return
+		}
+		c.Write([]byte("OK 0123456789abcdef\r\n"))
+		if line, _ := r.ReadString('\n'); line != "BEGIN\r\n" {
+			t.Errorf("Bad begin %q", line)
+			return
+		}
+		for serial := uint32(1); ; serial++ {
+			m, err := readMessage(r)
+			if err != nil {
+				return
+			}
+			calls <- m
+			// A signal first, which must be ignored.
+			c.Write((&dbusMsg{Type: msgSignal, Serial: serial * 10, Path: "/", Interface: "x.y", Member: "Z"}).marshal())
+			reply := &dbusMsg{Type: msgReturn, Serial: serial*10 + 1, ReplySerial: m.Serial}
+			if errName != "" && m.Member != "Hello" {
+				reply.Type = msgError
+				reply.ErrorName = errName
+				reply.Signature = "s"
+				e := &encoder{}
+				e.string("Interactive authentication required.")
+				reply.Body = e.b
+			}
+			c.Write(reply.marshal())
+		}
+	}()
+	return fn, calls
+}
+
+func TestLogind(t *testing.T) {
+	bus, calls := fakeBus(t, "")
+	p := &Power{Bus: bus}
+	if err := p.Reboot(); err != nil {
+		t.Fatal(err)
+	}
+	if m := <-calls; m.Member != "Hello" {
+		t.Errorf("First call %q, want Hello", m.Member)
+	}
+	m := <-calls
+	if m.Destination != logindDest || m.Path != logindPath || m.Interface != logindIface || m.Member != "Reboot" {
+		t.Errorf("Called %s %s %s.%s", m.Destination, m.Path, m.Interface, m.Member)
+	}
+	if m.Signature != "b" || len(m.Body) != 4 || binary.LittleEndian.Uint32(m.Body) != 0 {
+		t.Errorf("Called with %q %v, want interactive=false", m.Signature, m.Body)
+	}
+}
+
+func TestLogindError(t *testing.T) {
+	bus, _ := fakeBus(t, "org.freedesktop.DBus.Error.InteractiveAuthorizationRequired")
+	p := &Power{Bus: bus}
+	err := p.Poweroff()
+	if err == nil || !strings.Contains(err.Error(), "InteractiveAuthorizationRequired: Interactive authentication required.") {
+		t.Errorf("Got error %v", err)
+	}
+}
+
+// TestBigEndianError checks that error messages are decoded in the byte
+// order the bus sent them in.
+func TestBigEndianError(t *testing.T) {
+	be := binary.BigEndian
+	str := func(b []byte, s string) []byte {
+		return append(append(be.AppendUint32(b, uint32(len(s))), s...), 0)
+	}
+	pad := func(b []byte) []byte {
+		for len(b)%8 != 0 {
+			b = append(b, 0)
+		}
+		return b
+	}
+	body := str(nil, "Access denied.")
+	m := []byte{'B', msgError, 0, 1}
+	m = be.AppendUint32(m, uint32(len(body)))
+	m = be.AppendUint32(m, 7)
+	m = be.AppendUint32(m, 0) // Length of header fields, filled in below.
+	m = be.AppendUint32(append(m, fieldReplySerial, 1, 'u', 0), 2)
+	m = str(append(m, fieldErrorName, 1, 's', 0), "x.Denied")
+	m = append(pad(m), fieldSignature, 1, 'g', 0, 1, 's', 0)
+	be.PutUint32(m[12:], uint32(len(m)-16))
+	m = append(pad(m), body...)
+
+	err := waitReply(bufio.NewReader(bytes.NewReader(m)), 2)
+	if err == nil || err.Error() != "x.Denied: Access denied." {
+		t.Errorf("Got error %v", err)
+	}
+}
+
+func TestCommand(t *testing.T) {
+	p := &Power{
+		RebootCommand:   []string{"true"},
+		PoweroffCommand: []string{"sh", "-c", "echo not allowed; exit 1"},
+	}
+	if err := p.Reboot(); err != nil {
+		t.Error(err)
+	}
+	if err := p.Poweroff(); err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Errorf("Got error %v, want command output", err)
+	}
+}
@@ -0,0 +1,790 @@
+package sane
+
+// A client for the SANE network protocol, spoken by saned. See
+// http://www.sane-project.org/html/doc017.html
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultPort is the port saned listens on.
+const DefaultPort = "6566"
+
+// closeTimeout is how long Close waits to say goodbye.
+const closeTimeout = 5 * time.Second
+
+// Status is a SANE status code. Not good ones are errors.
+type Status int32
+
+// Status codes.
+const (
+	StatusGood         Status = 0
+	StatusUnsupported  Status = 1
+	StatusCancelled    Status = 2
+	StatusDeviceBusy   Status = 3
+	StatusInval        Status = 4
+	StatusEOF          Status = 5
+	StatusJammed       Status = 6
+	StatusNoDocs       Status = 7
+	StatusCoverOpen    Status = 8
+	StatusIOError      Status = 9
+	StatusNoMem        Status = 10
+	StatusAccessDenied Status = 11
+)
+
+func (s Status) Error() string {
+	switch s {
+	case StatusGood:
+		return "success"
+	case StatusUnsupported:
+		return "operation not supported"
+	case StatusCancelled:
+		return "operation was cancelled"
+	case StatusDeviceBusy:
+		return "device busy"
+	case StatusInval:
+		return "invalid argument"
+	case StatusEOF:
+		return "end of file reached"
+	case StatusJammed:
+		return "document feeder jammed"
+	case StatusNoDocs:
+		return "document feeder out of documents"
+	case StatusCoverOpen:
+		return "scanner cover is open"
+	case StatusIOError:
+		return "error during device I/O"
+	case StatusNoMem:
+		return "out of memory"
+	case StatusAccessDenied:
+		return "access to resource has been denied"
+	}
+	return fmt.Sprintf("SANE status %d", int32(s))
+}
+
+// err returns the status as an error, or nil if it's good.
+func (s Status) err() error {
+	if s == StatusGood {
+		return nil
+	}
+	return s
+}
+
+// Remote procedure calls.
+const (
+	rpcInit                 = 0
+	rpcGetDevices           = 1
+	rpcOpen                 = 2
+	rpcClose                = 3
+	rpcGetOptionDescriptors = 4
+	rpcControlOption        = 5
+	rpcGetParameters        = 6
+	rpcStart                = 7
+	rpcCancel               = 8
+	rpcExit                 = 10
+)
+
+// Protocol version 3, of SANE 1.0.
+const version = 1<<24 | 0<<16 | 3
+
+// Option value types, units, capabilities and constraints.
+const (
+	typeBool   = 0
+	typeInt    = 1
+	typeFixed  = 2
+	typeString = 3
+	typeButton = 4
+	typeGroup  = 5
+
+	capSoftSelect = 1
+	capInactive   = 32
+
+	constraintRange      = 1
+	constraintWordList   = 2
+	constraintStringList = 3
+
+	actionGet = 0
+	actionSet = 1
+
+	infoReloadOptions = 2
+)
+
+// units are the unit names, like scanimage shows them.
+var units = []string{"", "pel", "bit", "mm", "dpi", "%", "us"}
+
+// Frame formats.
+const (
+	FormatGray  = 0
+	FormatRGB   = 1
+	FormatRed   = 2
+	FormatGreen = 3
+	FormatBlue  = 4
+)
+
+// Client is a connection to saned.
+type Client struct {
+	host string
+	conn net.Conn
+
+	mutex sync.Mutex // Calls are one at a time.
+	w     *wire
+}
+
+// Dial connects to saned. addr is host or host:port.
+func Dial(ctx context.Context, addr string) (*Client, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, DefaultPort
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{
+		host: host,
+		conn: conn,
+		w:    newWire(conn),
+	}
+	// The user name is only for the saned log.
+	var st Status
+	if err := c.call(ctx, rpcInit, func(w *wire) {
+		w.putWord(version)
+		w.putString("autoscan")
+	}, func(w *wire) {
+		st = Status(w.word())
+		w.word() // Server version.
+	}); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("saned %s: %v", addr, err)
+	}
+	if err := st.err(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("saned %s: %v", addr, err)
+	}
+	return c, nil
+}
+
+// call makes a remote procedure call, with req writing the arguments
+// and reply reading the reply. Cancelling ctx cancels the call, after
+// which the client can't be used.
+func (c *Client) call(ctx context.Context, rpc int32, req, reply func(w *wire)) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	w := c.w
+	if w.err != nil {
+		return w.err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			// Unblock reads and writes.
+			c.conn.Close()
+		}
+	}()
+	w.putWord(rpc)
+	if req != nil {
+		req(w)
+	}
+	if err := w.flush(); err == nil {
+		reply(w)
+	}
+	if w.err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return w.err
+}
+
+// Close says goodbye and closes the connection.
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+	c.w.putWord(rpcExit)
+	c.w.flush()
+	return c.conn.Close()
+}
+
+// Devices lists the devices of the host.
+func (c *Client) Devices(ctx context.Context) ([]Device, error) {
+	var st Status
+	var ret []Device
+	if err := c.call(ctx, rpcGetDevices, nil, func(w *wire) {
+		st = Status(w.word())
+		n := w.length()
+		for i := 0; i < n && w.err == nil; i++ {
+			if w.null() {
+				continue
+			}
+			ret = append(ret, Device{
+				Name:   w.string(),
+				Vendor: w.string(),
+				Model:  w.string(),
+				Type:   w.string(),
+			})
+		}
+	}); err != nil {
+		return nil, err
+	}
+	if err := st.err(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// descriptor is an option descriptor.
+type descriptor struct {
+	name, title, desc     string
+	typ, unit, size, caps int32
+	constraint            int32
+	min, max, quant       int32
+	words                 []int32
+	strings               []string
+}
+
+// Handle is an open device.
+type Handle struct {
+	c      *Client
+	handle int32
+	descs  []descriptor // Nil until fetched.
+}
+
+// Open opens a device.
+func (c *Client) Open(ctx context.Context, name string) (*Handle, error) {
+	var st Status
+	var handle int32
+	var resource string
+	if err := c.call(ctx, rpcOpen, func(w *wire) {
+		w.putString(name)
+	}, func(w *wire) {
+		st = Status(w.word())
+		handle = w.word()
+		resource = w.string()
+	}); err != nil {
+		return nil, err
+	}
+	if resource != "" {
+		return nil, fmt.Errorf("opening %q: saned wants a password, which isn't supported", name)
+	}
+	if err := st.err(); err != nil {
+		return nil, fmt.Errorf("opening %q: %v", name, err)
+	}
+	return &Handle{c: c, handle: handle}, nil
+}
+
+// Close closes the device.
+func (h *Handle) Close(ctx context.Context) error {
+	return h.c.call(ctx, rpcClose, func(w *wire) {
+		w.putWord(h.handle)
+	}, func(w *wire) {
+		w.word()
+	})
+}
+
+// Cancel stops scanning, e.g. after the feeder is empty.
+func (h *Handle) Cancel(ctx context.Context) error {
+	return h.c.call(ctx, rpcCancel, func(w *wire) {
+		w.putWord(h.handle)
+	}, func(w *wire) {
+		w.word()
+	})
+}
+
+// descriptors fetches the option descriptors, if they're not already.
+func (h *Handle) descriptors(ctx context.Context) error {
+	if h.descs != nil {
+		return nil
+	}
+	return h.c.call(ctx, rpcGetOptionDescriptors, func(w *wire) {
+		w.putWord(h.handle)
+	}, func(w *wire) {
+		n := w.length()
+		h.descs = make([]descriptor, 0, n)
+		for i := 0; i < n && w.err == nil; i++ {
+			var d descriptor
+			if !w.null() {
+				d = readDescriptor(w)
+			}
+			h.descs = append(h.descs, d)
+		}
+	})
+}
+
+func readDescriptor(w *wire) descriptor {
+	d := descriptor{
+		name:       w.string(),
+		title:      w.string(),
+		desc:       w.string(),
+		typ:        w.word(),
+		unit:       w.word(),
+		size:       w.word(),
+		caps:       w.word(),
+		constraint: w.word(),
+	}
+	switch d.constraint {
+	case constraintRange:
+		if !w.null() {
+			d.min, d.max, d.quant = w.word(), w.word(), w.word()
+		}
+	case constraintWordList:
+		// The first word is the number of words, again.
+		n := w.length()
+		for i := 0; i < n; i++ {
+			d.words = append(d.words, w.word())
+		}
+		if len(d.words) > 0 {
+			d.words = d.words[1:]
+		}
+	case constraintStringList:
+		// NULL terminated.
+		n := w.length()
+		for i := 0; i < n; i++ {
+			if s := w.string(); s != "" {
+				d.strings = append(d.strings, s)
+			}
+		}
+	}
+	return d
+}
+
+// format returns a word of a value as text.
+func (d *descriptor) format(v int32) string {
+	switch d.typ {
+	case typeBool:
+		if v != 0 {
+			return "yes"
+		}
+		return "no"
+	case typeFixed:
+		return strconv.FormatFloat(float64(v)/65536, 'g', -1, 64)
+	}
+	return strconv.Itoa(int(v))
+}
+
+// parse returns the value of a word from text.
+func (d *descriptor) parse(s string) (int32, error) {
+	switch d.typ {
+	case typeBool:
+		switch s {
+		case "yes", "true", "1":
+			return 1, nil
+		case "no", "false", "0":
+			return 0, nil
+		}
+		return 0, fmt.Errorf("%q is not yes or no", s)
+	case typeFixed:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return 0, err
+		}
+		return int32(math.Round(f * 65536)), nil
+	}
+	v, err := strconv.ParseInt(s, 10, 32)
+	return int32(v), err
+}
+
+// option returns the descriptor as an Option, without value.
+func (d *descriptor) option(group string) Option {
+	o := Option{
+		Name:     d.name,
+		Group:    group,
+		Help:     d.desc,
+		ReadOnly: d.caps&capSoftSelect == 0,
+	}
+	if d.unit >= 0 && int(d.unit) < len(units) {
+		o.Unit = units[d.unit]
+	}
+	switch d.constraint {
+	case constraintRange:
+		o.Range = true
+		o.Min, o.Max, o.Step = float64(d.min), float64(d.max), float64(d.quant)
+		if d.typ == typeFixed {
+			o.Min, o.Max, o.Step = o.Min/65536, o.Max/65536, o.Step/65536
+		}
+	case constraintWordList:
+		for _, v := range d.words {
+			o.List = append(o.List, d.format(v))
+		}
+	case constraintStringList:
+		o.List = d.strings
+	}
+	if d.typ == typeBool {
+		o.List = []string{"yes", "no"}
+	}
+	return o
+}
+
+// Options lists the options of the device, with their values.
+func (h *Handle) Options(ctx context.Context) ([]Option, error) {
+	if err := h.descriptors(ctx); err != nil {
+		return nil, err
+	}
+	var ret []Option
+	var group string
+	// Option 0 is the number of options.
+	for n := 1; n < len(h.descs); n++ {
+		d := &h.descs[n]
+		switch {
+		case d.typ == typeGroup:
+			group = d.title
+			continue
+		case d.name == "":
+			continue
+		}
+		o := d.option(group)
+		switch {
+		case d.caps&capInactive != 0:
+			o.Value = "inactive"
+		case d.typ == typeButton:
+		case d.typ == typeString || d.size == 4:
+			// Not arrays, like gamma tables.
+			v, err := h.get(ctx, n)
+			if err != nil {
+				return nil, fmt.Errorf("getting %q: %v", d.name, err)
+			}
+			o.Value = v
+		}
+		ret = append(ret, o)
+	}
+	return ret, nil
+}
+
+// putValue writes an option value, as an array of words or bytes.
+func (d *descriptor) putValue(w *wire, words []int32, s string) {
+	w.putWord(d.typ)
+	w.putWord(d.size)
+	switch d.typ {
+	case typeString:
+		b := make([]byte, d.size)
+		copy(b, s)
+		w.putWord(d.size)
+		if w.err == nil {
+			_, w.err = w.w.Write(b)
+		}
+	case typeButton:
+		w.putWord(0)
+	default:
+		w.putWord(d.size / 4)
+		for i := int32(0); i < d.size/4; i++ {
+			var v int32
+			if int(i) < len(words) {
+				v = words[i]
+			}
+			w.putWord(v)
+		}
+	}
+}
+
+// readValue reads an option value, returning it as text.
+func (d *descriptor) readValue(w *wire) string {
+	typ := w.word()
+	w.word() // Size.
+	n := w.length()
+	switch typ {
+	case typeString:
+		b := make([]byte, n)
+		if _, err := io.ReadFull(w.r, b); err != nil && w.err == nil {
+			w.err = err
+		}
+		if i := bytes.IndexByte(b, 0); i >= 0 {
+			b = b[:i]
+		}
+		return string(b)
+	case typeButton, typeGroup:
+		return ""
+	}
+	var vs []string
+	for i := 0; i < n; i++ {
+		vs = append(vs, d.format(w.word()))
+	}
+	return strings.Join(vs, ",")
+}
+
+// control gets or sets option n. Returns the value, and whether the
+// options need to be reloaded.
+func (h *Handle) control(ctx context.Context, n int, action int32, words []int32, s string) (string, bool, error) {
+	d := &h.descs[n]
+	var st Status
+	var info int32
+	var v, resource string
+	if err := h.c.call(ctx, rpcControlOption, func(w *wire) {
+		w.putWord(h.handle)
+		w.putWord(int32(n))
+		w.putWord(action)
+		d.putValue(w, words, s)
+	}, func(w *wire) {
+		st = Status(w.word())
+		info = w.word()
+		v = d.readValue(w)
+		resource = w.string()
+	}); err != nil {
+		return "", false, err
+	}
+	if resource != "" {
+		return "", false, fmt.Errorf("saned wants a password, which isn't supported")
+	}
+	return v, info&infoReloadOptions != 0, st.err()
+}
+
+// get returns the value of option n.
+func (h *Handle) get(ctx context.Context, n int) (string, error) {
+	v, _, err := h.control(ctx, n, actionGet, nil, "")
+	return v, err
+}
+
+// Set sets an option, named like by Options.
+func (h *Handle) Set(ctx context.Context, name, value string) error {
+	if err := h.descriptors(ctx); err != nil {
+		return err
+	}
+	for n := 1; n < len(h.descs); n++ {
+		d := &h.descs[n]
+		if d.name != name || d.typ == typeGroup {
+			continue
+		}
+		if d.typ == typeString && int32(len(value)) >= d.size {
+			return fmt.Errorf("option %q: %q is too long", name, value)
+		}
+		var words []int32
+		if d.typ != typeString && d.typ != typeButton {
+			v, err := d.parse(value)
+			if err != nil {
+				return fmt.Errorf("option %q: %v", name, err)
+			}
+			words = []int32{v}
+		}
+		_, reload, err := h.control(ctx, n, actionSet, words, value)
+		if err != nil {
+			return fmt.Errorf("setting %q to %q: %v", name, value, err)
+		}
+		if reload {
+			// E.g. other options become active.
+			h.descs = nil
+		}
+		return nil
+	}
+	return fmt.Errorf("no option %q", name)
+}
+
+// Params describes a frame.
+type Params struct {
+	Format       int32
+	LastFrame    bool
+	BytesPerLine int32
+	Pixels       int32
+	Lines        int32 // -1 if not known until the end, e.g. for feeders.
+	Depth        int32
+}
+
+// params returns the parameters of the frame about to be scanned.
+func (h *Handle) params(ctx context.Context) (Params, error) {
+	var st Status
+	var p Params
+	if err := h.c.call(ctx, rpcGetParameters, func(w *wire) {
+		w.putWord(h.handle)
+	}, func(w *wire) {
+		st = Status(w.word())
+		p.Format = w.word()
+		p.LastFrame = w.word() != 0
+		p.BytesPerLine = w.word()
+		p.Pixels = w.word()
+		p.Lines = w.word()
+		p.Depth = w.word()
+	}); err != nil {
+		return p, err
+	}
+	return p, st.err()
+}
+
+// Byte orders of the image data.
+const (
+	littleEndian = 0x1234
+	bigEndian    = 0x4321
+)
+
+// start starts scanning a frame, and returns the port and byte order
+// of the data.
+func (h *Handle) start(ctx context.Context) (int32, int32, error) {
+	var st Status
+	var port, order int32
+	var resource string
+	if err := h.c.call(ctx, rpcStart, func(w *wire) {
+		w.putWord(h.handle)
+	}, func(w *wire) {
+		st = Status(w.word())
+		port = w.word()
+		order = w.word()
+		resource = w.string()
+	}); err != nil {
+		return 0, 0, err
+	}
+	if resource != "" {
+		return 0, 0, fmt.Errorf("saned wants a password, which isn't supported")
+	}
+	return port, order, st.err()
+}
+
+// Page is a scanned page.
+type Page struct {
+	Params
+	Data []byte
+}
+
+// Read scans a page. When the feeder is empty it returns
+// StatusNoDocs. Cancelling ctx cancels the scan, after which the
+// client can't be used.
+func (h *Handle) Read(ctx context.Context) (*Page, error) {
+	var page *Page
+	var rgb [3][]byte // For one frame per colour.
+	for {
+		port, order, err := h.start(ctx)
+		if err != nil {
+			return nil, err
+		}
+		// Parameters are only certain after start.
+		p, err := h.params(ctx)
+		if err != nil {
+			return nil, err
+		}
+		data, err := h.readFrame(ctx, port)
+		if err != nil {
+			return nil, err
+		}
+		if p.Depth == 16 && order == littleEndian {
+			// PNM is big endian.
+			for i := 0; i+1 < len(data); i += 2 {
+				data[i], data[i+1] = data[i+1], data[i]
+			}
+		}
+		if p.BytesPerLine > 0 {
+			p.Lines = int32(len(data)) / p.BytesPerLine
+		}
+		switch p.Format {
+		case FormatRed, FormatGreen, FormatBlue:
+			rgb[p.Format-FormatRed] = data
+		default:
+			page = &Page{Params: p, Data: data}
+		}
+		if !p.LastFrame {
+			continue
+		}
+		if page == nil {
+			// Interleave the colours.
+			p.Format = FormatRGB
+			p.BytesPerLine *= 3
+			page = &Page{Params: p}
+			bpp := int(p.Depth / 8)
+			if bpp == 0 {
+				return nil, fmt.Errorf("can't combine %d bit frames", p.Depth)
+			}
+			if len(rgb[0]) != len(rgb[1]) || len(rgb[0]) != len(rgb[2]) {
+				return nil, fmt.Errorf("colour frames differ in size: %d, %d and %d bytes", len(rgb[0]), len(rgb[1]), len(rgb[2]))
+			}
+			for i := 0; i+bpp <= len(rgb[0]); i += bpp {
+				for _, c := range rgb {
+					page.Data = append(page.Data, c[i:i+bpp]...)
+				}
+			}
+		}
+		return page, nil
+	}
+}
+
+// readFrame reads the image data of a frame, from the data port.
+func (h *Handle) readFrame(ctx context.Context, port int32) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(h.c.host, strconv.Itoa(int(port))))
+	if err != nil {
+		return nil, fmt.Errorf("connecting to data port: %v", err)
+	}
+	defer conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			// Unblock reads. The control connection may be
+			// waiting for data too.
+			conn.Close()
+			h.c.conn.Close()
+		}
+	}()
+
+	// Records of a length and data, until a length of all ones and
+	// then a status byte.
+	var data bytes.Buffer
+	for {
+		var n uint32
+		if err := binary.Read(conn, binary.BigEndian, &n); err != nil {
+			return nil, fmt.Errorf("reading data: %v", err)
+		}
+		if n == 0xffffffff {
+			break
+		}
+		if _, err := io.CopyN(&data, conn, int64(n)); err != nil {
+			return nil, fmt.Errorf("reading data: %v", err)
+		}
+	}
+	var st [1]byte
+	if _, err := io.ReadFull(conn, st[:]); err != nil {
+		return nil, fmt.Errorf("reading data status: %v", err)
+	}
+	if s := Status(st[0]); s != StatusEOF {
+		return nil, s
+	}
+	return data.Bytes(), nil
+}
+
+// WritePNM writes the page as a PNM image.
+func (p *Page) WritePNM(w io.Writer) error {
+	var magic string
+	switch {
+	case p.Format == FormatGray && p.Depth == 1:
+		magic = "P4"
+	case p.Format == FormatGray:
+		magic = "P5"
+	case p.Format == FormatRGB && p.Depth != 1:
+		magic = "P6"
+	default:
+		return fmt.Errorf("can't write format %d with depth %d as PNM", p.Format, p.Depth)
+	}
+	// Lines can have padding, which PNM doesn't.
+	width := (int(p.Pixels)*int(p.Depth) + 7) / 8
+	if p.Format == FormatRGB {
+		width *= 3
+	}
+	if p.Lines > 0 && len(p.Data) < int(p.Lines-1)*int(p.BytesPerLine)+width {
+		return fmt.Errorf("%d bytes of data is too short for %d lines", len(p.Data), p.Lines)
+	}
+	hdr := fmt.Sprintf("%s\n%d %d\n", magic, p.Pixels, p.Lines)
+	if p.Depth != 1 {
+		hdr += fmt.Sprintf("%d\n", 1<<uint(p.Depth)-1)
+	}
+	if _, err := io.WriteString(w, hdr); err != nil {
+		return err
+	}
+	for l := 0; l < int(p.Lines); l++ {
+		start := l * int(p.BytesPerLine)
+		if _, err := w.Write(p.Data[start : start+width]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
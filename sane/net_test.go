@@ -0,0 +1,220 @@
+package sane_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ThomasHabets/autoscan/fake"
+	"github.com/ThomasHabets/autoscan/sane"
+)
+
+// open connects to a fake saned, and opens its device.
+func open(t *testing.T, s fake.Scanner) (*fake.Saned, *sane.Handle) {
+	d, err := fake.NewSaned(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close() })
+	c, err := sane.Dial(context.Background(), d.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	devs, err := c.Devices(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devs) != 1 || devs[0].Name != fake.Device {
+		t.Fatalf("Got devices %+v", devs)
+	}
+	if _, err := c.Open(context.Background(), "nonexistent"); err == nil {
+		t.Errorf("Opened nonexistent device")
+	}
+	h, err := c.Open(context.Background(), fake.Device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d, h
+}
+
+func TestNetOptions(t *testing.T) {
+	d, h := open(t, fake.Scanner{})
+	opts, err := h.Options(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []sane.Option{
+		{
+			Name:  "source",
+			Group: "Standard",
+			Help:  "Selects the scan source (such as a document-feeder).",
+			List:  []string{"ADF Front", "ADF Back", "ADF Duplex"},
+			Value: "ADF Front",
+		},
+		{
+			Name:  "resolution",
+			Group: "Standard",
+			Help:  "Sets the resolution of the scanned image.",
+			Range: true,
+			Min:   50,
+			Max:   600,
+			Unit:  "dpi",
+			Value: "600",
+		},
+		{
+			Name:  "swcrop",
+			Group: "Enhancement",
+			Help:  "Request driver to remove border from pages digitally.",
+			List:  []string{"yes", "no"},
+			Value: "inactive",
+		},
+	} {
+		got := sane.Find(opts, want.Name)
+		if got == nil || got.Constraint() != want.Constraint() || got.Value != want.Value || got.Group != want.Group || got.Help != want.Help {
+			t.Errorf("Got\n%+v\nwant\n%+v", got, want)
+		}
+	}
+	if o := sane.Find(opts, "tl-x"); o == nil || !o.Range || math.Abs(o.Max-215.872) > 1e-4 || o.Unit != "mm" {
+		t.Errorf("Got fixed point option %+v", o)
+	}
+
+	for name, v := range map[string]string{"mode": "Gray", "resolution": "300"} {
+		if err := h.Set(context.Background(), name, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := d.Settings(), map[string]string{"mode": "Gray", "resolution": "300"}; len(got) != 2 || got["mode"] != want["mode"] || got["resolution"] != want["resolution"] {
+		t.Errorf("Fake saned got settings %v, want %v", got, want)
+	}
+	// Gray makes swcrop active.
+	if opts, err = h.Options(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if o := sane.Find(opts, "swcrop"); o.Value != "no" {
+		t.Errorf("After setting mode, swcrop is %q", o.Value)
+	}
+	if err := h.Set(context.Background(), "swcrop", "yes"); err != nil {
+		t.Error(err)
+	}
+
+	for _, o := range []sane.Option{
+		{Name: "resolution", Value: "1200"},
+		{Name: "resolution", Value: "high"},
+		{Name: "mode", Value: "Halftone"},
+		{Name: "nonexistent", Value: "1"},
+	} {
+		if err := h.Set(context.Background(), o.Name, o.Value); err == nil {
+			t.Errorf("Set %s to %q", o.Name, o.Value)
+		}
+	}
+}
+
+func TestNetRead(t *testing.T) {
+	for _, test := range []struct {
+		mode, source string
+		pages        int
+		magic        string
+		size         int
+	}{
+		{"Color", "ADF Front", 2, "P6\n99 140\n255\n", 99 * 140 * 3},
+		{"Gray", "ADF Duplex", 4, "P5\n99 140\n255\n", 99 * 140},
+		{"Lineart", "ADF Front", 2, "P4\n99 140\n", 13 * 140},
+	} {
+		_, h := open(t, fake.Scanner{Sheets: 2})
+		if err := h.Set(context.Background(), "mode", test.mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.Set(context.Background(), "source", test.source); err != nil {
+			t.Fatal(err)
+		}
+		var pages []*sane.Page
+		for {
+			p, err := h.Read(context.Background())
+			if err == sane.StatusNoDocs {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", test.mode, err)
+			}
+			pages = append(pages, p)
+		}
+		if err := h.Cancel(context.Background()); err != nil {
+			t.Error(err)
+		}
+		if len(pages) != test.pages {
+			t.Fatalf("%s: got %d pages, want %d", test.mode, len(pages), test.pages)
+		}
+		var b bytes.Buffer
+		if err := pages[0].WritePNM(&b); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(b.String(), test.magic) || b.Len() != len(test.magic)+test.size {
+			t.Errorf("%s: got %d bytes of PNM starting %q, want %q and %d bytes of image", test.mode, b.Len(), b.String()[:12], test.magic, test.size)
+		}
+	}
+}
+
+func TestWritePNMShort(t *testing.T) {
+	// E.g. colour frames of different sizes, interleaved.
+	p := &sane.Page{Params: sane.Params{Format: sane.FormatRGB, Depth: 8, Pixels: 2, Lines: 2, BytesPerLine: 6}, Data: make([]byte, 9)}
+	var b bytes.Buffer
+	if err := p.WritePNM(&b); err == nil {
+		t.Error("WritePNM succeeded with short data")
+	}
+	if b.Len() != 0 {
+		t.Errorf("wrote %d bytes, want none", b.Len())
+	}
+}
+
+func TestNetJam(t *testing.T) {
+	_, h := open(t, fake.Scanner{Sheets: 3, Jam: 1})
+	if _, err := h.Read(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var st sane.Status
+	if _, err := h.Read(context.Background()); !errors.As(err, &st) || st != sane.StatusJammed {
+		t.Errorf("Got %v, want jammed", err)
+	}
+}
+
+func TestNetCancel(t *testing.T) {
+	_, h := open(t, fake.Scanner{Sheets: 1})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := h.Read(ctx); err == nil {
+		t.Errorf("Read with cancelled context worked")
+	}
+}
+
+// TestNetHang checks that calls to a saned that doesn't answer end when
+// the context does.
+func TestNetHang(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			// Read, but never reply.
+			go io.Copy(ioutil.Discard, c)
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := sane.Dial(ctx, l.Addr().String()); err == nil || !strings.Contains(err.Error(), "deadline exceeded") {
+		t.Errorf("Got %v, want deadline exceeded", err)
+	}
+}
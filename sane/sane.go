@@ -0,0 +1,259 @@
+// Package sane finds scanners and what they support, by running
+// scanimage from SANE.
+package sane
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Device is a scanner, as listed by scanimage -L.
+type Device struct {
+	Name   string // For scanimage -d, e.g. "fujitsu:fi-6130dj:12345".
+	Vendor string
+	Model  string
+	Type   string // E.g. "sheetfed scanner".
+}
+
+// Option is a device option, as listed by scanimage -A.
+type Option struct {
+	Name  string // Without dashes, e.g. "resolution" or "l".
+	Group string // E.g. "Standard" or "Geometry".
+	Help  string
+
+	// What it can be set to. List for a list of values, Range for a
+	// range from Min to Max in steps of Step (zero for any). Neither
+	// for other options, e.g. strings.
+	List           []string
+	Range          bool
+	Min, Max, Step float64
+	Unit           string // E.g. "dpi" or "mm".
+
+	// Current value, or "inactive" if it can't be set now. Empty for
+	// buttons.
+	Value string
+
+	// Only shows what the scanner reports, e.g. a button on it.
+	ReadOnly bool
+}
+
+// Inactive returns true if the option can't be set, e.g. because it
+// depends on another option.
+func (o Option) Inactive() bool {
+	return o.Value == "inactive"
+}
+
+// Allows returns true if the option can be set to v.
+func (o Option) Allows(v string) bool {
+	if o.Inactive() || o.ReadOnly {
+		return false
+	}
+	if len(o.List) > 0 {
+		for _, l := range o.List {
+			if l == v {
+				return true
+			}
+		}
+		return false
+	}
+	if o.Range {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < o.Min || f > o.Max {
+			return false
+		}
+		if o.Step > 0 {
+			// Allow for rounding, e.g. in steps of 0.0211639.
+			n := (f - o.Min) / o.Step
+			return math.Abs(n-math.Round(n)) < 1e-6
+		}
+	}
+	return true
+}
+
+// Constraint returns what the option can be set to, like scanimage
+// shows it.
+func (o Option) Constraint() string {
+	switch {
+	case len(o.List) > 0:
+		return strings.Join(o.List, "|") + o.Unit
+	case o.Range:
+		s := fmt.Sprintf("%g..%g%s", o.Min, o.Max, o.Unit)
+		if o.Step > 0 {
+			s += fmt.Sprintf(" (in steps of %g)", o.Step)
+		}
+		return s
+	}
+	return ""
+}
+
+// Find returns the option with a name, or nil.
+func Find(opts []Option, name string) *Option {
+	for n := range opts {
+		if opts[n].Name == name {
+			return &opts[n]
+		}
+	}
+	return nil
+}
+
+// Check returns an error if the option can't be set to v.
+func Check(opts []Option, name, v string) error {
+	o := Find(opts, name)
+	if o == nil {
+		return fmt.Errorf("no option %q", name)
+	}
+	if !o.Allows(v) {
+		return fmt.Errorf("option %q can't be %q, only %s", name, v, o.Constraint())
+	}
+	return nil
+}
+
+// run runs scanimage and returns its output.
+func run(ctx context.Context, scanimage string, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, scanimage, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("running %q %q: %v. Stderr: %q", scanimage, args, err, stderr.String())
+	}
+	return stdout.Bytes(), nil
+}
+
+// Devices lists the scanners scanimage can find.
+func Devices(ctx context.Context, scanimage string) ([]Device, error) {
+	out, err := run(ctx, scanimage, "-f", "%d\t%v\t%m\t%t%n", "-L")
+	if err != nil {
+		return nil, err
+	}
+	return parseDevices(out)
+}
+
+// parseDevices parses the tab separated output of Devices.
+func parseDevices(out []byte) ([]Device, error) {
+	var ret []Device
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		if s.Text() == "" {
+			continue
+		}
+		f := strings.Split(s.Text(), "\t")
+		if len(f) != 4 {
+			return nil, fmt.Errorf("bad device line %q", s.Text())
+		}
+		ret = append(ret, Device{Name: f[0], Vendor: f[1], Model: f[2], Type: f[3]})
+	}
+	return ret, s.Err()
+}
+
+// Options lists the options of a device. An empty device is
+// scanimage's default.
+func Options(ctx context.Context, scanimage, device string) ([]Option, error) {
+	var args []string
+	if device != "" {
+		args = append(args, "-d", device)
+	}
+	out, err := run(ctx, scanimage, append(args, "-A")...)
+	if err != nil {
+		return nil, err
+	}
+	return parseOptions(out)
+}
+
+var (
+	// E.g. "    --resolution 50..600dpi (in steps of 1) [600]" or
+	// "    --swdeskew[=(yes|no)] [no]".
+	reOption = regexp.MustCompile(`^\s+--?([\w-]+)(?:\[=\((.*?)\)\])?(.*)$`)
+	reRange  = regexp.MustCompile(`^(-?[\d.]+)\.\.(-?[\d.]+)([a-z%]*)(?: \(in steps of ([\d.]+)\))?$`)
+	reUnit   = regexp.MustCompile(`^(.*?\d)([a-z%]+)$`)
+)
+
+// parseOptions parses the output of scanimage -A.
+func parseOptions(out []byte) ([]Option, error) {
+	var ret []Option
+	var group string
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		line := s.Text()
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "" || strings.HasPrefix(line, "All options"):
+		case strings.HasPrefix(trimmed, "-"):
+			m := reOption.FindStringSubmatch(line)
+			if m == nil {
+				return nil, fmt.Errorf("bad option line %q", line)
+			}
+			o := Option{
+				Name:  m[1],
+				Group: group,
+			}
+			// The value, then flags like "[read-only]" or
+			// "[hardware]", each in brackets.
+			rest := m[3]
+			var brackets []string
+			for strings.HasSuffix(rest, "]") {
+				i := strings.LastIndex(rest, " [")
+				if i < 0 {
+					break
+				}
+				brackets = append([]string{rest[i+2 : len(rest)-1]}, brackets...)
+				rest = rest[:i]
+			}
+			for n, b := range brackets {
+				if n == 0 {
+					o.Value = b
+				} else if b == "read-only" {
+					o.ReadOnly = true
+				}
+			}
+			c := strings.TrimSpace(rest)
+			if m[2] != "" {
+				c = m[2]
+			}
+			parseConstraint(&o, c)
+			ret = append(ret, o)
+		case strings.HasSuffix(trimmed, ":") && !strings.HasPrefix(line, "        "):
+			group = strings.TrimSuffix(trimmed, ":")
+		case len(ret) > 0:
+			// Help text, on the lines after the option.
+			o := &ret[len(ret)-1]
+			o.Help = strings.TrimSpace(o.Help + " " + trimmed)
+		}
+	}
+	return ret, s.Err()
+}
+
+// parseConstraint parses what an option can be set to, e.g.
+// "Lineart|Gray|Color", "75|150|300dpi", "Flatbed" or
+// "0..224.846mm (in steps of 0.0211639)".
+func parseConstraint(o *Option, c string) {
+	if m := reRange.FindStringSubmatch(c); m != nil {
+		o.Range = true
+		o.Min, _ = strconv.ParseFloat(m[1], 64)
+		o.Max, _ = strconv.ParseFloat(m[2], 64)
+		o.Unit = m[3]
+		if m[4] != "" {
+			o.Step, _ = strconv.ParseFloat(m[4], 64)
+		}
+		return
+	}
+	// Free form, like "<string>" or "<int>".
+	if c == "" || strings.HasPrefix(c, "<") {
+		return
+	}
+	o.List = strings.Split(c, "|")
+	last := o.List[len(o.List)-1]
+	if m := reUnit.FindStringSubmatch(last); m != nil {
+		if _, err := strconv.ParseFloat(m[1], 64); err == nil {
+			o.List[len(o.List)-1] = m[1]
+			o.Unit = m[2]
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package sane
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// From a Fujitsu fi-6130, cut down.
+const fujitsu = "All options specific to device `fujitsu:fi-6130dj:12345':" + `
+  Standard:
+    --source ADF Front|ADF Back|ADF Duplex [ADF Front]
+        Selects the scan source (such as a document-feeder).
+    --mode Lineart|Halftone|Gray|Color [Lineart]
+        Selects the scan mode (e.g., lineart, monochrome, or color).
+    --resolution 50..600dpi (in steps of 1) [600]
+        Sets the resolution of the scanned image.
+  Geometry:
+    -l 0..224.846mm (in steps of 0.0211639) [0]
+        Top-left x position of scan area.
+    --page-width 0..224.846mm (in steps of 0.0211639) [215.872]
+        Specifies the width of the media.  Required for automatic centering
+        of sheet-fed scans.
+  Enhancement:
+    --brightness -127..127 (in steps of 1) [0]
+        Controls the brightness of the acquired image.
+    --swcrop[=(yes|no)] [inactive]
+        Request driver to remove border from pages digitally.
+    --swskip 0..100% (in steps of 0.100006) [0]
+        Request driver to discard pages with low percentage of dark pixels
+  Sensors:
+    --page-loaded[=(yes|no)] [no] [hardware]
+        Paper available.
+    --button-3 <int> [0] [read-only]
+        Button number.
+`
+
+func TestParseOptions(t *testing.T) {
+	opts, err := parseOptions([]byte(fujitsu))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, o := range opts {
+		names = append(names, o.Name)
+	}
+	if got, want := strings.Join(names, ","), "source,mode,resolution,l,page-width,brightness,swcrop,swskip,page-loaded,button-3"; got != want {
+		t.Fatalf("Got options %q, want %q", got, want)
+	}
+	for _, want := range []Option{
+		{
+			Name:  "source",
+			Group: "Standard",
+			Help:  "Selects the scan source (such as a document-feeder).",
+			List:  []string{"ADF Front", "ADF Back", "ADF Duplex"},
+			Value: "ADF Front",
+		},
+		{
+			Name:  "resolution",
+			Group: "Standard",
+			Help:  "Sets the resolution of the scanned image.",
+			Range: true,
+			Min:   50,
+			Max:   600,
+			Step:  1,
+			Unit:  "dpi",
+			Value: "600",
+		},
+		{
+			Name:  "page-width",
+			Group: "Geometry",
+			Help:  "Specifies the width of the media.  Required for automatic centering of sheet-fed scans.",
+			Range: true,
+			Max:   224.846,
+			Step:  0.0211639,
+			Unit:  "mm",
+			Value: "215.872",
+		},
+		{
+			Name:  "swcrop",
+			Group: "Enhancement",
+			Help:  "Request driver to remove border from pages digitally.",
+			List:  []string{"yes", "no"},
+			Value: "inactive",
+		},
+		{
+			Name:     "button-3",
+			Group:    "Sensors",
+			Help:     "Button number.",
+			Value:    "0",
+			ReadOnly: true,
+		},
+	} {
+		if got := Find(opts, want.Name); !reflect.DeepEqual(*got, want) {
+			t.Errorf("Got\n%+v\nwant\n%+v", *got, want)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	opts, err := parseOptions([]byte(fujitsu + `
+    --gamma 75|100|150dpi [100]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name, value string
+		ok          bool
+	}{
+		{"source", "ADF Duplex", true},
+		{"source", "Flatbed", false},
+		{"mode", "Color", true},
+		{"resolution", "300", true},
+		{"resolution", "1200", false},
+		{"resolution", "high", false},
+		{"brightness", "-127", true},
+		{"l", "0.0423278", true},
+		{"l", "0.03", false},
+		{"gamma", "150", true},
+		{"gamma", "150dpi", false},
+		{"swcrop", "yes", false},
+		{"button-3", "1", false},
+		{"nonexistent", "1", false},
+	} {
+		if err := Check(opts, test.name, test.value); (err == nil) != test.ok {
+			t.Errorf("%s=%q: got %v, want ok=%t", test.name, test.value, err, test.ok)
+		}
+	}
+}
+
+func TestParseDevices(t *testing.T) {
+	got, err := parseDevices([]byte("fujitsu:fi-6130dj:12345\tFUJITSU\tfi-6130dj\tscanner\nhpaio:/usb/Officejet?serial=X\tHewlett-Packard\tOfficejet\tall-in-one\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Device{
+		{"fujitsu:fi-6130dj:12345", "FUJITSU", "fi-6130dj", "scanner"},
+		{"hpaio:/usb/Officejet?serial=X", "Hewlett-Packard", "Officejet", "all-in-one"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %+v, want %+v", got, want)
+	}
+	if _, err := parseDevices([]byte("device `x' is a y\n")); err == nil {
+		t.Errorf("Accepted scanimage -L output without -f")
+	}
+}
@@ -0,0 +1,95 @@
+package sane
+
+// Encoding of the SANE network protocol. Everything is built from
+// big endian 32 bit words:
+//
+//	Word    4 bytes.
+//	String  Word length, including a NUL, then the bytes. Length 0 is NULL.
+//	Array   Word length, then the elements.
+//	Pointer Word that's 1 for NULL, then the element unless NULL.
+//
+// Structs are their members in order.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// maxLen is the longest string or array accepted, against garbage.
+const maxLen = 1 << 20
+
+// wire reads and writes the encoding. Errors stick, so that a message
+// can be read or written as a whole and then checked with err().
+type wire struct {
+	r   *bufio.Reader
+	w   *bufio.Writer
+	err error
+}
+
+func newWire(rw io.ReadWriter) *wire {
+	return &wire{
+		r: bufio.NewReader(rw),
+		w: bufio.NewWriter(rw),
+	}
+}
+
+func (w *wire) putWord(v int32) {
+	if w.err == nil {
+		w.err = binary.Write(w.w, binary.BigEndian, v)
+	}
+}
+
+func (w *wire) putString(s string) {
+	w.putWord(int32(len(s) + 1))
+	if w.err == nil {
+		_, w.err = w.w.WriteString(s + "\x00")
+	}
+}
+
+// flush sends what's been written.
+func (w *wire) flush() error {
+	if w.err == nil {
+		w.err = w.w.Flush()
+	}
+	return w.err
+}
+
+func (w *wire) word() int32 {
+	var v int32
+	if w.err == nil {
+		w.err = binary.Read(w.r, binary.BigEndian, &v)
+	}
+	return v
+}
+
+// length reads the length of a string or array.
+func (w *wire) length() int {
+	n := w.word()
+	if w.err == nil && (n < 0 || n > maxLen) {
+		w.err = fmt.Errorf("bad length %d", n)
+	}
+	if w.err != nil {
+		return 0
+	}
+	return int(n)
+}
+
+func (w *wire) string() string {
+	n := w.length()
+	if n == 0 {
+		return ""
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(w.r, b); err != nil && w.err == nil {
+		w.err = err
+	}
+	return strings.TrimRight(string(b), "\x00")
+}
+
+// null reads a pointer, returning true if it's NULL.
+func (w *wire) null() bool {
+	return w.word() != 0
+}
@@ -0,0 +1,194 @@
+package main
+
+// Scanners. Each scanner device has its own backend, so its own scan
+// jobs, scans waiting to be uploaded, failures and UIs. See
+// config.Station.
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/ThomasHabets/autoscan/backend"
+	"github.com/ThomasHabets/autoscan/config"
+	"github.com/ThomasHabets/autoscan/sane"
+)
+
+var checkProfiles = flag.Bool("check_profiles", true, "Check at startup that the scanners support the scan profiles. Scanners that are off are skipped.")
+
+// checkTimeout is how long to wait for a scanner to list its options.
+const checkTimeout = 30 * time.Second
+
+// UIs that can show a scanner. See config.Scanner.
+const (
+	uiLCD  = "lcd"
+	uiLEDs = "leds"
+	uiTerm = "term"
+	uiLog  = "log"
+)
+
+// Scanner names end up in file names.
+var reScannerName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// scanner is a scanner device and its backend.
+type scanner struct {
+	name string
+	b    *backend.Backend
+	ui   *backend.MultiUI
+	uis  []string // See config.Scanner.UIs.
+}
+
+// newScanners creates a backend for each scanner in st, or one for
+// -scanimage if there are none. The first is the default.
+func newScanners(st *config.Station) ([]*scanner, error) {
+	cfgs := st.Scanners
+	if len(cfgs) == 0 {
+		cfgs = []config.Scanner{{Name: "default"}}
+	}
+	var ret []*scanner
+	owner := make(map[string]string) // UI to scanner name.
+	for n, c := range cfgs {
+		if !reScannerName.MatchString(c.Name) {
+			return nil, fmt.Errorf("invalid scanner name %q, must be letters, digits, - and _", c.Name)
+		}
+		if findScanner(ret, c.Name) != nil {
+			return nil, fmt.Errorf("scanner %q defined twice", c.Name)
+		}
+		if c.Saned != "" && c.ESCL != "" {
+			return nil, fmt.Errorf("scanner %q: can't scan from both saned and eSCL", c.Name)
+		}
+		for _, u := range c.UIs {
+			switch u {
+			case uiLCD, uiLEDs, uiTerm, uiLog:
+			default:
+				return nil, fmt.Errorf("scanner %q: unknown UI %q", c.Name, u)
+			}
+			if o, ok := owner[u]; ok {
+				return nil, fmt.Errorf("UI %q on both scanner %q and %q", u, o, c.Name)
+			}
+			owner[u] = c.Name
+		}
+		ui := &backend.MultiUI{}
+		b := &backend.Backend{
+			Name:       c.Name,
+			Scanner:    newScanner(c),
+			Convert:    *convert,
+			SpoolDir:   *spoolDir,
+			SpoolRetry: *spoolRetry,
+			UI:         ui,
+
+			ChunkSize:     *uploadChunkSize,
+			RetryDeadline: *uploadRetry,
+			ConvertToDocs: *convertToDocs,
+			FailureFile:   *failFile,
+		}
+		// The first scanner uses the flags as is, like when there was
+		// only one.
+		if n > 0 {
+			b.SpoolDir = path.Join(os.TempDir(), "autoscan-spool-"+c.Name)
+			if *spoolDir != "" {
+				b.SpoolDir = *spoolDir + "-" + c.Name
+			}
+			if b.FailureFile != "" {
+				b.FailureFile += "." + c.Name
+			}
+		}
+		if err := b.LoadFailure(); err != nil {
+			log.Printf("Loading earlier failure of scanner %q: %v", c.Name, err)
+		}
+		ret = append(ret, &scanner{
+			name: c.Name,
+			b:    b,
+			ui:   ui,
+			uis:  c.UIs,
+		})
+	}
+	for name, p := range st.Profiles {
+		if p.Scanner != "" && findScanner(ret, p.Scanner) == nil {
+			return nil, fmt.Errorf("profile %q: no scanner %q", name, p.Scanner)
+		}
+	}
+	return ret, nil
+}
+
+// newScanner returns the driver for a scanner.
+func newScanner(c config.Scanner) backend.Scanner {
+	if c.ESCL != "" {
+		return &backend.ESCL{URL: c.ESCL}
+	}
+	if c.Saned != "" {
+		return &backend.Saned{Addr: c.Saned, Device: c.Device}
+	}
+	s := &backend.Scanimage{Path: *scanimage, Device: c.Device}
+	if c.Scanimage != "" {
+		s.Path = c.Scanimage
+	}
+	return s
+}
+
+// findScanner returns the scanner with a name, or nil.
+func findScanner(scanners []*scanner, name string) *scanner {
+	for _, s := range scanners {
+		if s.name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// scannerFor returns the scanner a UI shows.
+func scannerFor(scanners []*scanner, ui string) *scanner {
+	for _, s := range scanners {
+		for _, u := range s.uis {
+			if u == ui {
+				return s
+			}
+		}
+	}
+	return scanners[0]
+}
+
+// checkScanners checks that each scanner supports the options its
+// profiles scan with. A scanner that can't list its options, e.g.
+// because it's off, is only logged.
+func checkScanners(scanners []*scanner, profiles map[string]config.Profile) error {
+	// Sorted, for the same error every time.
+	var names []string
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, s := range scanners {
+		l, ok := s.b.Scanner.(backend.OptionLister)
+		if !ok {
+			continue
+		}
+		opts, err := func() ([]sane.Option, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+			defer cancel()
+			return l.Options(ctx)
+		}()
+		if err != nil {
+			log.Printf("Can't check profiles of scanner %q: %v", s.name, err)
+			continue
+		}
+		for _, name := range names {
+			p := profiles[name]
+			if p.Scanner != s.name && (p.Scanner != "" || s != scanners[0]) {
+				continue
+			}
+			for _, o := range backend.ScanOptions(p) {
+				if err := sane.Check(opts, o.Name, o.Value); err != nil {
+					return fmt.Errorf("profile %q: scanner %q: %v", name, s.name, err)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+// Simulation mode runs the whole daemon without a scanner, Raspberry
+// Pi hardware or Google account. Scans come from a fake scanimage,
+// saned or eSCL scanner, the LCD is emulated in the log, and uploads go
+// to a fake Google Drive that saves them in a local directory.
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+
+	"github.com/ThomasHabets/autoscan/backend"
+	"github.com/ThomasHabets/autoscan/config"
+	"github.com/ThomasHabets/autoscan/fake"
+)
+
+var (
+	simulate       = flag.Bool("simulate", false, "Simulate scanner, hardware and Google Drive. For development.")
+	simulateSheets = flag.Int("simulate_sheets", 3, "In simulation, sheets of paper in the feeder. 0 means empty.")
+	simulateJam    = flag.Int("simulate_jam", 0, "In simulation, jam the feeder after this many pages. 0 means never.")
+	simulateDir    = flag.String("simulate_dir", "", "In simulation, save uploads here. Default is a temp dir.")
+)
+
+// startSimulation sets up the scanners to use fakes, adds a fake LCD to
+// the first, and returns the config file to use.
+func startSimulation(scanners []*scanner) (string, error) {
+	tmp, err := ioutil.TempDir("", "autoscan-simulate-")
+	if err != nil {
+		return "", err
+	}
+	dir := *simulateDir
+	if dir == "" {
+		dir = path.Join(tmp, "uploads")
+		if err := os.Mkdir(dir, 0700); err != nil {
+			return "", err
+		}
+	}
+
+	fakeScanimage, convert, err := fake.Scanner{
+		Sheets: *simulateSheets,
+		Jam:    *simulateJam,
+	}.Install(tmp)
+	if err != nil {
+		return "", fmt.Errorf("installing fake scanner: %v", err)
+	}
+	// Network scanners scan from a fake saned or eSCL scanner instead.
+	var saned *fake.Saned
+	var escl *fake.ESCL
+	for _, s := range scanners {
+		s.b.Convert = convert
+		s.b.SpoolDir = path.Join(tmp, "spool-"+s.name)
+		switch sc := s.b.Scanner.(type) {
+		case *backend.Scanimage:
+			sc.Path = fakeScanimage
+		case *backend.Saned:
+			if saned == nil {
+				if saned, err = fake.NewSaned(fake.Scanner{Sheets: *simulateSheets, Jam: *simulateJam}); err != nil {
+					return "", fmt.Errorf("starting fake saned: %v", err)
+				}
+			}
+			sc.Addr, sc.Device = saned.Addr(), fake.Device
+		case *backend.ESCL:
+			if escl == nil {
+				escl = fake.NewESCL(fake.Scanner{Sheets: *simulateSheets, Jam: *simulateJam})
+			}
+			sc.URL = escl.URL()
+		}
+	}
+	scanners[0].ui.Add(&fake.LCD{})
+
+	d := fake.NewDrive()
+	d.SetDir(dir)
+	*scanimage = fakeScanimage // For the devices page.
+	*oauthAuthURL = d.Server.URL + "/auth"
+	*oauthTokenURL = d.TokenURL()
+	*driveEndpoint = d.Endpoint()
+	cfg := &config.Drive{
+		ClientID:     "fake-client",
+		ClientSecret: "fake-secret",
+		RefreshToken: "fake-refresh-token",
+		Parent:       d.AddFolder("Autoscan", fake.RootID),
+		Endpoints:    googleEndpoints(),
+	}
+	// Don't touch the real config file.
+	cfgFile := path.Join(tmp, "autoscan.conf")
+	if err := cfg.Write(cfgFile); err != nil {
+		return "", err
+	}
+	svc, err := cfg.Service(context.Background())
+	if err != nil {
+		return "", err
+	}
+	for _, s := range scanners {
+		s.b.SetDrive(svc, cfg.Parent)
+	}
+	log.Printf("Simulating. Uploads are saved in %q", dir)
+	return cfgFile, nil
+}
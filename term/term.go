@@ -0,0 +1,301 @@
+// Package term is a UI on the terminal, for running headless over SSH
+// and for developing without the LCD plate.
+//
+// It shows the 16x2 display as the LCD plate would, and below it the
+// state, uploads waiting, the last result and the latest log lines.
+// Key presses are inputs named "term:<key>", e.g. term:s or term:up.
+// See package actions. Up and down also page through long messages.
+package term
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThomasHabets/autoscan/adafruit"
+	"github.com/ThomasHabets/autoscan/backend"
+)
+
+// Inputs is where key presses are sent. Implemented by *actions.Dispatcher.
+type Inputs interface {
+	Input(name string) error
+}
+
+// How many log lines to show.
+const logLines = 8
+
+// Keys is the help text. Matches the default bindings.
+const Keys = "s: scan single  d: scan duplex  c: cancel  f: finish  a: ack  up/down: page"
+
+// display is an emulated 16x2 display.
+type display struct {
+	color adafruit.Color
+	lines [2]string
+}
+
+// SetColor implements adafruit.Display.
+func (d *display) SetColor(c adafruit.Color) error {
+	d.color = c
+	return nil
+}
+
+// Print implements adafruit.Display.
+func (d *display) Print(line int, s string) error {
+	d.lines[line] = s
+	return nil
+}
+
+// CreateChar implements adafruit.Display. The only custom characters
+// are the progress bar ones, which are drawn with adafruit.Unicode().
+func (d *display) CreateChar(int, [8]byte) error { return nil }
+
+// ANSI colours for the backlight.
+var colors = map[adafruit.Color]string{
+	adafruit.Off:     "\x1b[90m",
+	adafruit.Red:     "\x1b[31m",
+	adafruit.Green:   "\x1b[32m",
+	adafruit.Blue:    "\x1b[34m",
+	adafruit.Magenta: "\x1b[35m",
+	adafruit.White:   "\x1b[37m",
+}
+
+// Terminal is a UI on a terminal. It implements backend.UI.
+type Terminal struct {
+	in     io.Reader
+	out    io.Writer
+	inputs Inputs
+	status adafruit.Status
+
+	redraw chan struct{}
+
+	mutex   sync.Mutex
+	display display
+	screen  *adafruit.Screen
+	last    backend.Event
+	logs    []string
+	partial []byte // Log line not yet ended.
+	restore func() // Restores the terminal, if it was made raw.
+	drawn   string // What's on the terminal.
+}
+
+// New creates a terminal UI reading keys from in and drawing on out,
+// normally os.Stdin and os.Stdout.
+func New(in io.Reader, out io.Writer, inputs Inputs, status adafruit.Status) *Terminal {
+	t := &Terminal{
+		in:     in,
+		out:    out,
+		inputs: inputs,
+		status: status,
+		redraw: make(chan struct{}, 1),
+	}
+	t.screen = adafruit.NewScreen(&t.display)
+	t.screen.Dim = 0
+	return t
+}
+
+// wake makes Run redraw.
+func (t *Terminal) wake() {
+	select {
+	case t.redraw <- struct{}{}:
+	default:
+	}
+}
+
+// Show implements backend.UI.
+func (t *Terminal) Show(ev backend.Event) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.last = ev
+	t.screen.Show(ev, time.Now())
+	t.wake()
+}
+
+// Write adds log output to show below the display. Use with
+// log.SetOutput(), since logging to the terminal would mess it up.
+func (t *Terminal) Write(p []byte) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.partial = append(t.partial, p...)
+	for {
+		n := bytes.IndexByte(t.partial, '\n')
+		if n < 0 {
+			break
+		}
+		t.logs = append(t.logs, string(t.partial[:n]))
+		t.partial = t.partial[n+1:]
+	}
+	if n := len(t.logs) - logLines; n > 0 {
+		t.logs = t.logs[n:]
+	}
+	t.wake()
+	return len(p), nil
+}
+
+// Close restores the terminal.
+func (t *Terminal) Close() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.restore != nil {
+		t.restore()
+		t.restore = nil
+	}
+}
+
+// Run reads keys and draws the screen. Forever.
+func (t *Terminal) Run() {
+	if f, ok := t.in.(*os.File); ok {
+		if restore, err := makeRaw(f); err != nil {
+			log.Printf("Terminal UI: not a terminal, keys need Enter: %v", err)
+		} else {
+			func() {
+				t.mutex.Lock()
+				defer t.mutex.Unlock()
+				t.restore = restore
+			}()
+		}
+	}
+	go t.readKeys()
+
+	ticker := time.NewTicker(adafruit.ScrollStep)
+	defer ticker.Stop()
+	for {
+		t.draw()
+		select {
+		case <-ticker.C:
+			func() {
+				t.mutex.Lock()
+				defer t.mutex.Unlock()
+				t.screen.Tick()
+			}()
+		case <-t.redraw:
+		}
+	}
+}
+
+// readKeys sends key presses as inputs, until in is closed.
+func (t *Terminal) readKeys() {
+	buf := make([]byte, 64)
+	for {
+		n, err := t.in.Read(buf)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Terminal UI: reading keys: %v", err)
+			}
+			return
+		}
+		for _, k := range keyNames(buf[:n]) {
+			switch k {
+			case "up", "down":
+				func() {
+					t.mutex.Lock()
+					defer t.mutex.Unlock()
+					if k == "up" {
+						t.screen.Page(-1, time.Now())
+					} else {
+						t.screen.Page(1, time.Now())
+					}
+				}()
+				t.wake()
+			}
+			// Errors are logged by the dispatcher.
+			t.inputs.Input("term:" + k)
+		}
+	}
+}
+
+// Escape sequences for special keys.
+var escapes = map[string]string{
+	"\x1b[A": "up",
+	"\x1b[B": "down",
+	"\x1b[C": "right",
+	"\x1b[D": "left",
+}
+
+// keyNames returns the names of the keys in what was read: the
+// character for printable ones, or e.g. "enter" and "up".
+func keyNames(b []byte) []string {
+	var ret []string
+	for len(b) > 0 {
+		if b[0] == 0x1b {
+			n := 1
+			for e, name := range escapes {
+				if bytes.HasPrefix(b, []byte(e)) {
+					ret = append(ret, name)
+					n = len(e)
+					break
+				}
+			}
+			if n == 1 {
+				ret = append(ret, "esc")
+			}
+			b = b[n:]
+			continue
+		}
+		switch c := b[0]; {
+		case c == '\r' || c == '\n':
+			ret = append(ret, "enter")
+		case c == ' ':
+			ret = append(ret, "space")
+		case c > ' ' && c < 0x7f:
+			ret = append(ret, string(c))
+		}
+		b = b[1:]
+	}
+	return ret
+}
+
+// draw draws the whole screen.
+func (t *Terminal) draw() {
+	// Not under mutex, since it's the backend's.
+	st, stErr := t.status.Status()
+	res := t.status.LastResult()
+	spooled := t.status.Spooled()
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if err := t.screen.Draw(time.Now()); err != nil {
+		// Can't happen with the emulated display.
+		return
+	}
+	var b strings.Builder
+	// Home and clear.
+	b.WriteString("\x1b[H\x1b[2J")
+	color := colors[t.display.color]
+	if color == "" {
+		color = colors[adafruit.White]
+	}
+	border := strings.Repeat("─", adafruit.Width)
+	fmt.Fprintf(&b, "┌%s┐\n", border)
+	for n := range t.display.lines {
+		fmt.Fprintf(&b, "│%s%s\x1b[0m│\n", color, adafruit.Unicode(t.display.lines[n]))
+	}
+	fmt.Fprintf(&b, "└%s┘ %s\n\n", border, t.display.color)
+
+	fmt.Fprintf(&b, "State:           %s\n", strings.ToLower(string(st)))
+	if t.last.Profile != "" && st != backend.IDLE {
+		fmt.Fprintf(&b, "Job:             %s, %d pages\n", t.last.Profile, t.last.Pages)
+	}
+	fmt.Fprintf(&b, "Uploads waiting: %d\n", spooled)
+	switch {
+	case stErr != nil:
+		fmt.Fprintf(&b, "Last result:     failed: %v\n", stErr)
+	case res != nil:
+		fmt.Fprintf(&b, "Last result:     %s %s\n", res.Title, res.URL)
+	default:
+		fmt.Fprintf(&b, "Last result:     none\n")
+	}
+	fmt.Fprintf(&b, "\n%s\n\n", Keys)
+	for _, l := range t.logs {
+		fmt.Fprintf(&b, "%s\n", l)
+	}
+	if b.String() == t.drawn {
+		return
+	}
+	t.drawn = b.String()
+	io.WriteString(t.out, t.drawn)
+}
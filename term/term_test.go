@@ -0,0 +1,86 @@
+package term
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ThomasHabets/autoscan/backend"
+)
+
+type fakeInputs struct {
+	inputs chan string
+}
+
+func (f *fakeInputs) Input(name string) error {
+	f.inputs <- name
+	return nil
+}
+
+type fakeStatus struct{}
+
+func (fakeStatus) Status() (backend.State, error) { return backend.IDLE, errors.New("paper jam") }
+func (fakeStatus) Spooled() int                   { return 2 }
+func (fakeStatus) LastResult() *backend.Result    { return nil }
+
+// screens gets everything drawn.
+type screens chan string
+
+func (s screens) Write(p []byte) (int, error) {
+	s <- string(p)
+	return len(p), nil
+}
+
+// waitFor returns the first screen with all of want on it.
+func (s screens) waitFor(t *testing.T, want ...string) string {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case got := <-s:
+			ok := true
+			for _, w := range want {
+				ok = ok && strings.Contains(got, w)
+			}
+			if ok {
+				return got
+			}
+		case <-timeout:
+			t.Fatalf("Never drew %q", want)
+		}
+	}
+}
+
+func TestKeyNames(t *testing.T) {
+	got := keyNames([]byte("s\x1b[Bq \r\x1bx"))
+	want := []string{"s", "down", "q", "space", "enter", "esc", "x"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %q, want %q", got, want)
+	}
+}
+
+func TestTerminal(t *testing.T) {
+	r, w := io.Pipe()
+	defer w.Close()
+	out := make(screens, 100)
+	in := &fakeInputs{inputs: make(chan string, 10)}
+	term := New(r, out, in, fakeStatus{})
+	go term.Run()
+
+	term.Show(backend.Event{Kind: backend.JobFailed, ErrKind: backend.ScannerError, Err: errors.New("scanner said something long and unhelpful")})
+	out.waitFor(t, "1/3", "Uploads waiting: 2", "failed: paper jam", Keys)
+
+	io.WriteString(w, "a\x1b[B")
+	for _, want := range []string{"term:a", "term:down"} {
+		if got := <-in.inputs; got != want {
+			t.Errorf("Got input %q, want %q", got, want)
+		}
+	}
+	out.waitFor(t, "2/3")
+
+	term.Write([]byte("log line\n"))
+	out.waitFor(t, "log line")
+}
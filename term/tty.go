@@ -0,0 +1,32 @@
+package term
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// makeRaw turns off line buffering and echo on a terminal, so that
+// keys are read as they're pressed. Ctrl-C still works. Returns a
+// function that restores the terminal.
+func makeRaw(f *os.File) (func(), error) {
+	var old syscall.Termios
+	if err := ioctl(f, syscall.TCGETS, &old); err != nil {
+		return nil, err
+	}
+	raw := old
+	raw.Lflag &^= syscall.ICANON | syscall.ECHO
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	if err := ioctl(f, syscall.TCSETS, &raw); err != nil {
+		return nil, err
+	}
+	return func() { ioctl(f, syscall.TCSETS, &old) }, nil
+}
+
+func ioctl(f *os.File, req uintptr, t *syscall.Termios) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), req, uintptr(unsafe.Pointer(t))); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package web
+
+// The devices page lists the configured scanners and their options, for
+// what profiles can scan with, and the other scanners SANE finds, for
+// their device names for the station config.
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/ThomasHabets/autoscan/backend"
+	"github.com/ThomasHabets/autoscan/sane"
+)
+
+// device is a device and its options, or why they couldn't be listed.
+type device struct {
+	// Name in the station config. Empty for a device that's found but
+	// not configured, or the only scanner.
+	Scanner    string `json:",omitempty"`
+	Configured bool
+
+	sane.Device
+	Options []sane.Option
+	Err     string `json:",omitempty"`
+}
+
+// SetSANE adds the devices page, finding devices with scanimage.
+func (f *Frontend) SetSANE(scanimage string) {
+	f.scanimage = scanimage
+	f.Mux.HandleFunc("/devices", f.handleDevices)
+	f.Mux.HandleFunc("/api/devices", f.handleAPIDevices)
+}
+
+// devices lists the configured scanners with their options, asking
+// their drivers, and then the other devices scanimage finds. A device
+// that's busy scanning can't list its options, so that's an error for
+// only that device. The error is from finding devices.
+func (f *Frontend) devices(ctx context.Context) ([]device, error) {
+	scanners := f.scanners
+	if len(scanners) == 0 {
+		scanners = []scanner{{b: f.backend}}
+	}
+	var ret []device
+	configured := make(map[string]bool)
+	for _, s := range scanners {
+		dev := device{Scanner: s.name, Configured: true}
+		switch d := s.b.Scanner.(type) {
+		case *backend.Scanimage:
+			dev.Name = d.Device
+			configured[d.Device] = true
+		case *backend.Saned:
+			dev.Name = d.Addr + " " + d.Device
+		case *backend.ESCL:
+			dev.Name = d.URL
+		}
+		if l, ok := s.b.Scanner.(backend.OptionLister); !ok {
+			dev.Err = "can't list options"
+		} else if opts, err := l.Options(ctx); err != nil {
+			dev.Err = err.Error()
+		} else {
+			dev.Options = opts
+		}
+		ret = append(ret, dev)
+	}
+
+	ds, err := sane.Devices(ctx, f.scanimage)
+	if err != nil {
+		return ret, err
+	}
+	for _, d := range ds {
+		if !configured[d.Name] {
+			ret = append(ret, device{Device: d})
+		}
+	}
+	return ret, nil
+}
+
+func (f *Frontend) handleDevices(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	data := struct {
+		Devices []device
+		Err     error
+	}{}
+	data.Devices, data.Err = f.devices(r.Context())
+	f.tmplDevices.Execute(w, &data)
+}
+
+func (f *Frontend) handleAPIDevices(w http.ResponseWriter, r *http.Request) {
+	ds, err := f.devices(r.Context())
+	if err != nil {
+		// The configured scanners are still worth showing.
+		log.Printf("Finding devices: %v", err)
+	}
+	b, err := json.Marshal(ds)
+	if err != nil {
+		http.Error(w, "Internal error: JSON encoding error.", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Write(b)
+}
@@ -0,0 +1,117 @@
+package web
+
+// The LCD page shows what the LCD plate shows, and has its keys and the
+// GPIO buttons, for helping someone at the scanner remotely and for
+// trying out the UI without hardware.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/ThomasHabets/autoscan/adafruit"
+)
+
+// LCD is the LCD plate, real or emulated. Implemented by the adafruit UI.
+type LCD interface {
+	Lines() (adafruit.Color, [2]string)
+	Press(key string) error
+}
+
+// Button is a GPIO button.
+type Button struct {
+	Label string
+	Pin   int
+}
+
+// SetLCD adds the LCD page for the LCD and buttons. Button presses go to
+// the inputs given to New, as "gpio:<pin>:tap" and "gpio:<pin>:long"
+// from "web:gpio:<pin>:tap" and "web:gpio:<pin>:long", so they're not
+// mistaken for the real buttons.
+func (f *Frontend) SetLCD(lcd LCD, buttons []Button) {
+	f.lcd = lcd
+	f.buttons = buttons
+	f.Mux.HandleFunc("/lcd", f.handleLCD)
+	f.Mux.HandleFunc("/api/lcd", f.handleAPILCD)
+	f.Mux.HandleFunc("/api/press", f.handleAPIPress)
+}
+
+func (f *Frontend) handleLCD(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	data := struct {
+		Keys    []string
+		Buttons []Button
+	}{
+		Buttons: f.buttons,
+	}
+	// As on the plate.
+	for _, k := range []adafruit.Key{adafruit.Left, adafruit.Up, adafruit.Down, adafruit.Right, adafruit.Select} {
+		data.Keys = append(data.Keys, k.String())
+	}
+	f.tmplLCD.Execute(w, &data)
+}
+
+func (f *Frontend) handleAPILCD(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	c, lines := f.lcd.Lines()
+	data := struct {
+		Color string // Backlight: off, red, green, etc.
+		Lines [2]string
+	}{
+		Color: c.String(),
+	}
+	for n, l := range lines {
+		data.Lines[n] = adafruit.Unicode(l)
+	}
+	b, err := json.Marshal(&data)
+	if err != nil {
+		http.Error(w, "Internal error: JSON encoding error.", http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
+
+// handleAPIPress presses an LCD key, with key=<name>, or taps a button,
+// with button=<pin>, holding it if long is set.
+func (f *Frontend) handleAPIPress(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Only POST allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	r.ParseForm()
+	if err := f.press(r.FormValue("key"), r.FormValue("button"), r.FormValue("long") != ""); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	fmt.Fprintln(w, "OK")
+}
+
+// press presses an LCD key or a button.
+func (f *Frontend) press(key, button string, long bool) error {
+	if key != "" {
+		return f.lcd.Press(key)
+	}
+	pin, err := strconv.Atoi(button)
+	if err != nil {
+		return fmt.Errorf("missing key or button")
+	}
+	for _, b := range f.buttons {
+		if b.Pin != pin {
+			continue
+		}
+		if f.inputs == nil {
+			return fmt.Errorf("no inputs configured")
+		}
+		how := "tap"
+		if long {
+			how = "long"
+		}
+		// Errors are logged by the dispatcher, like for real buttons.
+		in := fmt.Sprintf("gpio:%d:%s", pin, how)
+		f.inputs.InputFrom("web:"+in, in)
+		return nil
+	}
+	return fmt.Errorf("no button on pin %d", pin)
+}
@@ -0,0 +1,102 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/ThomasHabets/autoscan/adafruit"
+)
+
+type fakeLCD struct {
+	keys []string
+}
+
+func (*fakeLCD) Lines() (adafruit.Color, [2]string) {
+	return adafruit.Blue, [2]string{"Uploading...", "3 pages \x05\x05\x02"}
+}
+
+func (f *fakeLCD) Press(key string) error {
+	f.keys = append(f.keys, key)
+	return nil
+}
+
+type fakeInputs []string
+
+func (f *fakeInputs) Input(name string) error {
+	*f = append(*f, name)
+	return nil
+}
+
+func (f *fakeInputs) InputFrom(from, name string) error {
+	*f = append(*f, from+" "+name)
+	return nil
+}
+
+func (f *fakeInputs) Do(from, action string) error {
+	*f = append(*f, from+" "+action)
+	return nil
+}
+
+func TestLCD(t *testing.T) {
+	lcd := &fakeLCD{}
+	in := &fakeInputs{}
+	f := New("templates", "static", nil, "", in)
+	f.SetLCD(lcd, []Button{{Label: "Single", Pin: 5}})
+	s := httptest.NewServer(f.Mux)
+	defer s.Close()
+
+	resp, err := http.Get(s.URL + "/api/lcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Color string
+		Lines [2]string
+	}
+	err = json.NewDecoder(resp.Body).Decode(&got)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Color != "blue" || got.Lines[1] != "3 pages ██▍" {
+		t.Errorf("Got %+v", got)
+	}
+
+	for _, tc := range []struct {
+		form url.Values
+		code int
+	}{
+		{url.Values{"key": {"select"}}, http.StatusOK},
+		{url.Values{"button": {"5"}}, http.StatusOK},
+		{url.Values{"button": {"5"}, "long": {"1"}}, http.StatusOK},
+		{url.Values{"button": {"6"}}, http.StatusBadRequest},
+		{url.Values{}, http.StatusBadRequest},
+	} {
+		resp, err := http.PostForm(s.URL+"/api/press", tc.form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.code {
+			t.Errorf("Pressing %v: got %d, want %d", tc.form, resp.StatusCode, tc.code)
+		}
+	}
+	if len(lcd.keys) != 1 || lcd.keys[0] != "select" {
+		t.Errorf("LCD keys pressed: %q", lcd.keys)
+	}
+	if len(*in) != 2 || (*in)[0] != "web:gpio:5:tap gpio:5:tap" || (*in)[1] != "web:gpio:5:long gpio:5:long" {
+		t.Errorf("Inputs: %q", *in)
+	}
+
+	resp, err = http.Get(s.URL + "/lcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("LCD page: %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,329 @@
+package web
+
+// Google account setup.
+//
+// The user brings their own OAuth client ID (type "Desktop app") and
+// authorizes autoscan with a loopback redirect back to this web UI.
+// Google only allows loopback redirects for desktop clients, so if
+// the web UI is accessed over the network the browser will end up on
+// a page that doesn't load. The URL of that page can be pasted into
+// the setup page to finish the setup.
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	oauth "golang.org/x/oauth2"
+	drive "google.golang.org/api/drive/v3"
+
+	"github.com/ThomasHabets/autoscan/config"
+)
+
+const folderMimeType = "application/vnd.google-apps.folder"
+
+// pendingSetup is an OAuth flow that has been started but not finished.
+type pendingSetup struct {
+	conf     *config.Drive
+	oauth    *oauth.Config
+	state    string
+	verifier string
+}
+
+// readDriveConfig returns the current Drive config, or an empty one if there is none.
+func (f *Frontend) readDriveConfig() (*config.Drive, error) {
+	c, err := config.ReadDrive(f.driveConfig)
+	if os.IsNotExist(err) {
+		return &config.Drive{Endpoints: f.Endpoints}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.Endpoints = f.Endpoints
+	return c, nil
+}
+
+// saveDriveConfig writes the config and hands the new Drive client to the backends.
+func (f *Frontend) saveDriveConfig(ctx context.Context, c *config.Drive) error {
+	if err := c.Write(f.driveConfig); err != nil {
+		return fmt.Errorf("writing config file %q: %v", f.driveConfig, err)
+	}
+	if !c.Complete() {
+		for _, b := range f.backends() {
+			b.SetDrive(nil, "")
+		}
+		return nil
+	}
+	// Not the request context, since the client outlives the request.
+	d, err := c.Service(context.Background())
+	if err != nil {
+		return fmt.Errorf("creating Google Drive client: %v", err)
+	}
+	for _, b := range f.backends() {
+		b.SetDrive(d, c.Parent)
+	}
+	return nil
+}
+
+// redirectURL returns where Google should send the browser after authorization.
+func (f *Frontend) redirectURL(r *http.Request) string {
+	if f.OAuthRedirect != "" {
+		return f.OAuthRedirect
+	}
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host, port = r.Host, ""
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		host = "127.0.0.1"
+	}
+	if port != "" {
+		host = net.JoinHostPort(host, port)
+	}
+	return "http://" + host + "/oauth2callback"
+}
+
+func randomState() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (f *Frontend) handleSetup(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	conf, err := f.readDriveConfig()
+	if err != nil {
+		log.Printf("Reading config: %v", err)
+		http.Error(w, "Internal error: reading config.", http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		Conf    *config.Drive
+		Pending bool
+		Err     error
+	}{
+		Conf: conf,
+	}
+
+	if r.Method == "POST" {
+		switch {
+		case r.FormValue("authorize") != "":
+			u, err := f.startSetup(r, conf)
+			if err == nil {
+				http.Redirect(w, r, u, http.StatusFound)
+				return
+			}
+			data.Err = err
+		case r.FormValue("finish") != "":
+			u, err := url.Parse(strings.TrimSpace(r.FormValue("url")))
+			if err == nil {
+				err = f.finishSetup(r.Context(), u.Query())
+			}
+			if err == nil {
+				http.Redirect(w, r, "folder", http.StatusFound)
+				return
+			}
+			data.Err = err
+		}
+		log.Printf("Setup failed: %v", data.Err)
+	}
+
+	func() {
+		f.setupMutex.Lock()
+		defer f.setupMutex.Unlock()
+		data.Pending = f.setup != nil
+	}()
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	f.tmplSetup.Execute(w, &data)
+}
+
+// startSetup starts the OAuth flow and returns the URL to send the user to.
+func (f *Frontend) startSetup(r *http.Request, old *config.Drive) (string, error) {
+	conf := &config.Drive{
+		ClientID:     strings.TrimSpace(r.FormValue("client_id")),
+		ClientSecret: strings.TrimSpace(r.FormValue("client_secret")),
+		Parent:       old.Parent,
+		Endpoints:    f.Endpoints,
+	}
+	if conf.ClientSecret == "" && conf.ClientID == old.ClientID {
+		conf.ClientSecret = old.ClientSecret
+	}
+	if conf.ClientID == "" || conf.ClientSecret == "" {
+		return "", fmt.Errorf("client ID and client secret are both needed")
+	}
+	state, err := randomState()
+	if err != nil {
+		return "", fmt.Errorf("generating state: %v", err)
+	}
+	p := &pendingSetup{
+		conf:     conf,
+		oauth:    conf.OAuth(f.redirectURL(r)),
+		state:    state,
+		verifier: oauth.GenerateVerifier(),
+	}
+	f.setupMutex.Lock()
+	defer f.setupMutex.Unlock()
+	f.setup = p
+	return p.oauth.AuthCodeURL(p.state,
+		oauth.AccessTypeOffline,
+		oauth.ApprovalForce, // Or there may not be a new refresh token.
+		oauth.S256ChallengeOption(p.verifier)), nil
+}
+
+// finishSetup exchanges the code from the OAuth redirect for a refresh token, and saves it.
+func (f *Frontend) finishSetup(ctx context.Context, q url.Values) error {
+	p := func() *pendingSetup {
+		f.setupMutex.Lock()
+		defer f.setupMutex.Unlock()
+		return f.setup
+	}()
+	if p == nil {
+		return fmt.Errorf("no Google account setup in progress")
+	}
+	if e := q.Get("error"); e != "" {
+		return fmt.Errorf("authorization failed: %s", e)
+	}
+	if q.Get("state") != p.state {
+		return fmt.Errorf("OAuth state mismatch, is the URL from the most recent attempt?")
+	}
+	code := q.Get("code")
+	if code == "" {
+		return fmt.Errorf("no authorization code in URL")
+	}
+	tok, err := p.oauth.Exchange(ctx, code, oauth.VerifierOption(p.verifier))
+	if err != nil {
+		return fmt.Errorf("exchanging authorization code: %v", err)
+	}
+	if tok.RefreshToken == "" {
+		return fmt.Errorf("no refresh token received")
+	}
+	conf := *p.conf
+	conf.RefreshToken = tok.RefreshToken
+	if err := f.saveDriveConfig(ctx, &conf); err != nil {
+		return err
+	}
+	log.Printf("Google account set up with client ID %q", conf.ClientID)
+
+	f.setupMutex.Lock()
+	defer f.setupMutex.Unlock()
+	if f.setup == p {
+		f.setup = nil
+	}
+	return nil
+}
+
+func (f *Frontend) handleOAuthCallback(w http.ResponseWriter, r *http.Request) {
+	if err := f.finishSetup(r.Context(), r.URL.Query()); err != nil {
+		log.Printf("Setup failed: %v", err)
+		http.Error(w, "Setup failed: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, "folder", http.StatusFound)
+}
+
+// handleFolder lets the user browse Drive folders and pick the one to upload to.
+func (f *Frontend) handleFolder(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	conf, err := f.readDriveConfig()
+	if err != nil {
+		log.Printf("Reading config: %v", err)
+		http.Error(w, "Internal error: reading config.", http.StatusInternalServerError)
+		return
+	}
+	if !conf.Authorized() {
+		http.Redirect(w, r, "setup", http.StatusFound)
+		return
+	}
+
+	if r.Method == "POST" {
+		conf.Parent = r.FormValue("id")
+		if conf.Parent == "" {
+			http.Error(w, "No folder selected.", http.StatusBadRequest)
+			return
+		}
+		if err := f.saveDriveConfig(r.Context(), conf); err != nil {
+			log.Printf("Saving folder: %v", err)
+			http.Error(w, "Internal error: saving config.", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Upload folder set to %q", conf.Parent)
+		http.Redirect(w, r, ".", http.StatusFound)
+		return
+	}
+
+	d, err := conf.Service(r.Context())
+	if err != nil {
+		log.Printf("Creating Google Drive client: %v", err)
+		http.Error(w, "Internal error: connecting to Google Drive.", http.StatusInternalServerError)
+		return
+	}
+	id := r.FormValue("id")
+	if id == "" {
+		id = conf.Parent
+	}
+	if id == "" {
+		id = "root"
+	}
+	type folder struct {
+		ID, Title string
+	}
+	data := struct {
+		Current  folder
+		Parent   string
+		Selected string
+		Folders  []folder
+	}{
+		Selected: conf.Parent,
+	}
+	cur, err := d.Files.Get(id).Fields("id,name,parents,driveId").SupportsAllDrives(true).Do()
+	if err != nil {
+		log.Printf("Failed folder Files.Get(%q): %v", id, err)
+		http.Error(w, "Internal error: getting folder.", http.StatusInternalServerError)
+		return
+	}
+	data.Current = folder{ID: cur.Id, Title: cur.Name}
+	if len(cur.Parents) > 0 {
+		data.Parent = cur.Parents[0]
+	} else if cur.DriveId != "" {
+		// Top of a shared drive.
+		data.Parent = "root"
+	}
+	if id == "root" {
+		// Shared drives are reachable from the top.
+		if err := d.Drives.List().Fields("nextPageToken,drives(id,name)").Pages(r.Context(), func(l *drive.DriveList) error {
+			for _, i := range l.Drives {
+				data.Folders = append(data.Folders, folder{ID: i.Id, Title: i.Name + " (shared drive)"})
+			}
+			return nil
+		}); err != nil {
+			log.Printf("Failed Drives.List: %v", err)
+			http.Error(w, "Internal error: listing shared drives.", http.StatusInternalServerError)
+			return
+		}
+	}
+	q := fmt.Sprintf("'%s' in parents and mimeType = '%s' and trashed = false", strings.Replace(cur.Id, "'", `\'`, -1), folderMimeType)
+	if err := d.Files.List().Q(q).OrderBy("name").Fields("nextPageToken,files(id,name)").
+		SupportsAllDrives(true).IncludeItemsFromAllDrives(true).
+		Pages(r.Context(), func(l *drive.FileList) error {
+			for _, i := range l.Files {
+				data.Folders = append(data.Folders, folder{ID: i.Id, Title: i.Name})
+			}
+			return nil
+		}); err != nil {
+		log.Printf("Failed folder Files.List: %v", err)
+		http.Error(w, "Internal error: listing folders.", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	f.tmplFolder.Execute(w, &data)
+}
@@ -0,0 +1,142 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/ThomasHabets/autoscan/backend"
+	"github.com/ThomasHabets/autoscan/config"
+)
+
+// fakeGoogle is a fake OAuth token endpoint and a fake Drive with one folder.
+func fakeGoogle(t *testing.T) *httptest.Server {
+	m := http.NewServeMux()
+	m.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		switch r.FormValue("grant_type") {
+		case "authorization_code":
+			if got, want := r.FormValue("code"), "good-code"; got != want {
+				t.Errorf("token exchange code = %q, want %q", got, want)
+			}
+			if r.FormValue("code_verifier") == "" {
+				t.Errorf("token exchange without PKCE verifier")
+			}
+		case "refresh_token":
+			if got, want := r.FormValue("refresh_token"), "refresh-1"; got != want {
+				t.Errorf("refresh token = %q, want %q", got, want)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token":  "access-1",
+			"token_type":    "Bearer",
+			"refresh_token": "refresh-1",
+			"expires_in":    3600,
+		})
+	})
+	m.HandleFunc("/drive/v3/files/root", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": "root-id", "name": "My Drive"})
+	})
+	m.HandleFunc("/drive/v3/drives", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"drives": []map[string]string{{"id": "shared-id", "name": "Office"}},
+		})
+	})
+	m.HandleFunc("/drive/v3/files", func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.FormValue("q"), "'root-id' in parents") {
+			t.Errorf("unexpected folder query %q", r.FormValue("q"))
+		}
+		if r.FormValue("supportsAllDrives") != "true" {
+			t.Errorf("folder list without supportsAllDrives")
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"files": []map[string]string{{"id": "scans-id", "name": "Scans"}},
+		})
+	})
+	return httptest.NewServer(m)
+}
+
+func postForm(target string, v url.Values) *http.Request {
+	r := httptest.NewRequest("POST", target, strings.NewReader(v.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+func TestSetup(t *testing.T) {
+	g := fakeGoogle(t)
+	defer g.Close()
+
+	fn := path.Join(t.TempDir(), "autoscan.conf")
+	b := &backend.Backend{}
+	f := New("templates", "static", b, fn, nil)
+	f.Endpoints = config.Endpoints{
+		AuthURL:  g.URL + "/auth",
+		TokenURL: g.URL + "/token",
+		Drive:    g.URL + "/drive/v3/",
+	}
+
+	// Start authorization.
+	w := httptest.NewRecorder()
+	f.Mux.ServeHTTP(w, postForm("http://scanner:8080/setup", url.Values{
+		"authorize":     {"1"},
+		"client_id":     {"client-1"},
+		"client_secret": {"secret-1"},
+	}))
+	if w.Code != http.StatusFound {
+		t.Fatalf("authorize: status %d: %s", w.Code, w.Body)
+	}
+	auth, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := auth.Query().Get("redirect_uri"), "http://127.0.0.1:8080/oauth2callback"; got != want {
+		t.Errorf("redirect_uri = %q, want %q", got, want)
+	}
+
+	// Paste the URL the browser failed to load.
+	w = httptest.NewRecorder()
+	f.Mux.ServeHTTP(w, postForm("http://scanner:8080/setup", url.Values{
+		"finish": {"1"},
+		"url":    {"http://127.0.0.1:8080/oauth2callback?code=good-code&state=" + auth.Query().Get("state")},
+	}))
+	if w.Code != http.StatusFound {
+		t.Fatalf("finish: status %d: %s", w.Code, w.Body)
+	}
+	c, err := config.ReadDrive(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (config.Drive{ClientID: "client-1", ClientSecret: "secret-1", RefreshToken: "refresh-1"}); *c != want {
+		t.Errorf("config = %+v, want %+v", *c, want)
+	}
+	if d, _ := b.Drive(); d != nil {
+		t.Errorf("backend got Drive client before folder was picked")
+	}
+
+	// Browse folders.
+	w = httptest.NewRecorder()
+	f.Mux.ServeHTTP(w, httptest.NewRequest("GET", "/folder", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("folder: status %d: %s", w.Code, w.Body)
+	}
+	for _, want := range []string{"folder?id=scans-id", "folder?id=shared-id"} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("folder list missing %q: %s", want, w.Body)
+		}
+	}
+
+	// Pick folder.
+	w = httptest.NewRecorder()
+	f.Mux.ServeHTTP(w, postForm("/folder", url.Values{"id": {"scans-id"}}))
+	if w.Code != http.StatusFound {
+		t.Fatalf("pick folder: status %d: %s", w.Code, w.Body)
+	}
+	if d, parent := b.Drive(); d == nil || parent != "scans-id" {
+		t.Errorf("backend Drive() = %v, %q, want client and %q", d, parent, "scans-id")
+	}
+}
@@ -0,0 +1,24 @@
+function updateLCD() {
+    $.ajax({
+	dataType: "json",
+	url: "api/lcd",
+	success: function(data) {
+	    $("#lcd-line0").text(data["Lines"][0]);
+	    $("#lcd-line1").text(data["Lines"][1]);
+	    var o = $("#lcd");
+	    o.removeClass();
+	    o.addClass("lcd lcd-" + data["Color"]);
+	},
+	complete: function() {
+	    // As often as the LCD scrolls.
+	    setTimeout(updateLCD, 300);
+	},
+    });
+}
+function press(key) {
+    $.post("api/press", {key: key});
+}
+function tap(pin, hold) {
+    $.post("api/press", hold ? {button: pin, long: "1"} : {button: pin});
+}
+setTimeout(updateLCD, 100);
@@ -1,8 +1,17 @@
+// scannerQuery returns the query string for the picked scanner, if
+// there's more than one.
+function scannerQuery() {
+    var s = $("#scanner");
+    if (s.length == 0) {
+	return "";
+    }
+    return "?scanner=" + encodeURIComponent(s.val());
+}
 function updateButtons() {
     var delay = 1000;
     $.ajax({
 	dataType: "json",
-	url: "api/status",
+	url: "api/status" + scannerQuery(),
 	success: function(data) {
 	    $(".scan-button").each(function(){
 		if (data["State"] == "IDLE") {
@@ -17,4 +26,7 @@ function updateButtons() {
 	},
     });
 }
+function showStatus() {
+    window.location = "status" + scannerQuery();
+}
 setTimeout(updateButtons, 100);
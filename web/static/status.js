@@ -2,7 +2,7 @@ function updateStatus() {
     var delay = 1000;
     $.ajax({
 	dataType: "json",
-	url: "api/status",
+	url: "api/status" + window.location.search,
 	success: function(data) {
 	    var o = $("#status-div");
 	    classes = "msg"
@@ -10,7 +10,7 @@ function updateStatus() {
 	    if (data["State"] == "IDLE") {
 		if (data["LastFail"] != "") {
 		    classes += " fail";
-		    o.text("Last scan FAILED: " + data["LastFail"]);
+		    o.text("Scan FAILED, not yet acknowledged: " + data["LastFail"]);
 		} else {
 		    classes += " success";
 		    o.text("Last scan succeeded");
@@ -22,10 +22,46 @@ function updateStatus() {
 	    }
 	    o.removeClass();
 	    o.addClass(classes);
+	    if (data["Reauth"] != "") {
+		$("#reauth-div").show();
+	    } else {
+		$("#reauth-div").hide();
+	    }
+	    var f = data["Failure"];
+	    if (f) {
+		if (f["AckedBy"] != "") {
+		    $("#ack-text").text("Last failure acknowledged by " + f["AckedBy"] + " at " + new Date(f["AckedAt"]).toLocaleString() + ".");
+		    $("#ack-button").hide();
+		} else {
+		    $("#ack-text").text("");
+		    $("#ack-button").show();
+		}
+		$("#ack-div").show();
+	    } else {
+		$("#ack-div").hide();
+	    }
+	    var d = $("#degraded-div").empty();
+	    $.each(data["Degraded"] || {}, function(k, v) {
+		d.append($("<div>").text("Not working, scanning still works: " + k + ": " + v));
+	    });
+	    d.toggle(!d.is(":empty"));
+	    if (data["LastURL"] != "") {
+		$("#result-link").attr("href", data["LastURL"]);
+		$("#result-div").show();
+	    }
+	    if (data["Spooled"] > 0) {
+		$("#spool-div").text(data["Spooled"] + " scan(s) waiting to be uploaded.").show();
+	    } else {
+		$("#spool-div").hide();
+	    }
 	},
 	complete: function() {
 	    setTimeout(updateStatus, delay);
 	},
     });
 }
+function ack() {
+    var s = new URLSearchParams(window.location.search).get("scanner");
+    $.post("api/input", {name: s ? "ack:" + s : "ack"});
+}
 setTimeout(updateStatus, 100);
@@ -2,63 +2,176 @@
 package web
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"html/template"
 	"log"
 	"net/http"
 	"path"
+	"strings"
+	"sync"
 
+	"github.com/ThomasHabets/autoscan/actions"
 	"github.com/ThomasHabets/autoscan/backend"
-	drive "google.golang.org/api/drive/v2"
+	"github.com/ThomasHabets/autoscan/config"
+	drive "google.golang.org/api/drive/v3"
 )
 
+// Inputs is where inputs from the web UI are sent. Implemented by *actions.Dispatcher.
+type Inputs interface {
+	Input(name string) error
+	InputFrom(from, name string) error
+	Do(from, action string) error
+}
+
 // Frontend is a Web UI for autoscan.
 type Frontend struct {
 	Mux *http.ServeMux
 
-	backend    *backend.Backend
-	tmplRoot   *template.Template
-	tmplScan   *template.Template
-	tmplStatus *template.Template
-	tmplLast   *template.Template
-	staticDir  string
-	drive      *drive.Service
-        parent     string
+	// Google endpoints for the account setup. Empty means Google's.
+	Endpoints config.Endpoints
+
+	// Where Google redirects back to after authorization. Default is
+	// a loopback URL derived from the request. See setup.go.
+	OAuthRedirect string
+
+	// Scan profiles with a button on the start page, besides single
+	// and duplex.
+	Profiles []string
+
+	backend     *backend.Backend
+	inputs      Inputs
+	tmplRoot    *template.Template
+	tmplScan    *template.Template
+	tmplStatus  *template.Template
+	tmplLast    *template.Template
+	tmplSetup   *template.Template
+	tmplFolder  *template.Template
+	tmplLCD     *template.Template
+	tmplDevices *template.Template
+	staticDir   string
+
+	// Scanners to pick from with scanner=<name>, if more than one.
+	// See AddScanner.
+	scanners []scanner
+
+	// LCD page. See lcd.go.
+	lcd     LCD
+	buttons []Button
+
+	// Devices page. See devices.go.
+	scanimage string
+
+	// Google account setup. See setup.go.
+	driveConfig string
+	setupMutex  sync.Mutex
+	setup       *pendingSetup
 }
 
 // New creates a new Frontend.
 // tmplDir is the directory that contains HTML templates.
 // staticDir is the directory that contains static files, like css files, that will be accessible under /static/.
 // b is the Autoscan backend.
-	func New(d *drive.Service, p, tmpldir, staticDir string, b *backend.Backend) *Frontend {
+// driveConfig is the config file that the Google account setup writes to.
+// in receives inputs posted to /api/input, as "http:<name>". May be nil.
+func New(tmpldir, staticDir string, b *backend.Backend, driveConfig string, in Inputs) *Frontend {
 	f := &Frontend{
-		tmplRoot:   template.Must(template.ParseFiles(path.Join(tmpldir, "root.html"))),
-		tmplScan:   template.Must(template.ParseFiles(path.Join(tmpldir, "scan.html"))),
-		tmplStatus: template.Must(template.ParseFiles(path.Join(tmpldir, "status.html"))),
-		tmplLast:   template.Must(template.ParseFiles(path.Join(tmpldir, "last.html"))),
-		staticDir:  staticDir,
-		backend:    b,
-		drive:      d,
-		parent: p,
-		Mux:        http.NewServeMux(),
+		tmplRoot:    template.Must(template.ParseFiles(path.Join(tmpldir, "root.html"))),
+		tmplScan:    template.Must(template.ParseFiles(path.Join(tmpldir, "scan.html"))),
+		tmplStatus:  template.Must(template.ParseFiles(path.Join(tmpldir, "status.html"))),
+		tmplLast:    template.Must(template.ParseFiles(path.Join(tmpldir, "last.html"))),
+		tmplSetup:   template.Must(template.ParseFiles(path.Join(tmpldir, "setup.html"))),
+		tmplFolder:  template.Must(template.ParseFiles(path.Join(tmpldir, "folder.html"))),
+		tmplLCD:     template.Must(template.ParseFiles(path.Join(tmpldir, "lcd.html"))),
+		tmplDevices: template.Must(template.ParseFiles(path.Join(tmpldir, "devices.html"))),
+		staticDir:   staticDir,
+		backend:     b,
+		inputs:      in,
+		Mux:         http.NewServeMux(),
+
+		driveConfig: driveConfig,
 	}
 	f.Mux.HandleFunc("/", f.handleRoot)
 	f.Mux.HandleFunc("/scan", f.handleScan)
 	f.Mux.HandleFunc("/status", f.handleStatus)
 	f.Mux.HandleFunc("/last", f.handleLast)
 	f.Mux.HandleFunc("/api/status", f.handleAPIStatus)
+	f.Mux.HandleFunc("/api/input", f.handleAPIInput)
+	f.Mux.HandleFunc("/setup", f.handleSetup)
+	f.Mux.HandleFunc("/oauth2callback", f.handleOAuthCallback)
+	f.Mux.HandleFunc("/folder", f.handleFolder)
 	f.Mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir(f.staticDir))))
 	return f
 }
 
+// scanner is a named backend.
+type scanner struct {
+	name string
+	b    *backend.Backend
+}
+
+// AddScanner adds a scanner to pick with scanner=<name> on the pages
+// and in the API. The backend given to New is the default. Add it too,
+// to be able to pick it by name.
+func (f *Frontend) AddScanner(name string, b *backend.Backend) {
+	f.scanners = append(f.scanners, scanner{name: name, b: b})
+}
+
+// scannerNames returns the names of the scanners that can be picked.
+func (f *Frontend) scannerNames() []string {
+	var ret []string
+	for _, s := range f.scanners {
+		ret = append(ret, s.name)
+	}
+	return ret
+}
+
+// pick returns the backend picked by the scanner form value, and its
+// name, or the default backend if none is picked.
+func (f *Frontend) pick(r *http.Request) (*backend.Backend, string, error) {
+	name := r.FormValue("scanner")
+	if name == "" {
+		for _, s := range f.scanners {
+			if s.b == f.backend {
+				return s.b, s.name, nil
+			}
+		}
+		return f.backend, "", nil
+	}
+	for _, s := range f.scanners {
+		if s.name == name {
+			return s.b, s.name, nil
+		}
+	}
+	return nil, "", fmt.Errorf("no such scanner %q", name)
+}
+
+// backends returns all the backends.
+func (f *Frontend) backends() []*backend.Backend {
+	ret := []*backend.Backend{f.backend}
+	for _, s := range f.scanners {
+		if s.b != f.backend {
+			ret = append(ret, s.b)
+		}
+	}
+	return ret
+}
+
 func (f *Frontend) handleRoot(w http.ResponseWriter, r *http.Request) {
 	if len(r.URL.Path) > 1 {
 		http.NotFound(w, r)
 		return
 	}
 	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
-	f.tmplRoot.Execute(w, nil)
+	data := struct {
+		Scanners []string
+		Profiles []string
+	}{
+		Scanners: f.scannerNames(),
+		Profiles: f.Profiles,
+	}
+	f.tmplRoot.Execute(w, &data)
 }
 
 func (f *Frontend) handleScan(w http.ResponseWriter, r *http.Request) {
@@ -66,80 +179,128 @@ func (f *Frontend) handleScan(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
 
 	data := struct {
-		Err error
+		Err     error
+		Scanner string
 	}{}
 
-	_, single := r.Form["single"]
-	_, double := r.Form["double"]
-	if double && single {
-		data.Err = fmt.Errorf("both 'double' and 'single' set. Which button was pressed?")
-		log.Print(data.Err)
-	} else if !double && !single {
-		data.Err = fmt.Errorf("neither 'double' or 'single' set. Which button was pressed?")
+	_, name, err := f.pick(r)
+	// The picked scanner is for the single and double buttons. Other
+	// profiles say which scanner they use.
+	var profiles []string
+	picked := r.FormValue("scanner") != ""
+	if _, ok := r.Form["single"]; ok {
+		profiles = append(profiles, "single")
+	}
+	if _, ok := r.Form["double"]; ok {
+		profiles = append(profiles, "duplex")
+	}
+	if p := r.FormValue("profile"); p != "" {
+		profiles = append(profiles, p)
+		picked = false
+	}
+	data.Scanner = name
+	switch {
+	case err != nil:
+		data.Err = err
+	case len(profiles) > 1:
+		data.Err = fmt.Errorf("more than one of 'single', 'double' and 'profile' set. Which button was pressed?")
+	case len(profiles) == 0:
+		data.Err = fmt.Errorf("none of 'single', 'double' or 'profile' set. Which button was pressed?")
+	case f.inputs == nil:
+		data.Err = fmt.Errorf("no inputs configured")
+	default:
+		action := actions.Start + ":" + profiles[0]
+		if picked {
+			action += ":" + name
+		}
+		data.Err = f.inputs.Do("web:scan", action)
+	}
+	if data.Err != nil {
 		log.Print(data.Err)
-	} else {
-		go f.backend.Run(double)
 	}
 	f.tmplScan.Execute(w, &data)
 }
 
 func (f *Frontend) handleStatus(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	b, name, err := f.pick(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
 	data := struct {
-		State    backend.State
-		LastFail error
-	}{}
-	data.State, data.LastFail = f.backend.Status()
+		Scanner    string
+		Scanners   []string
+		State      backend.State
+		LastFail   error
+		LastResult *backend.Result
+		Reauth     error
+		Spooled    int
+		Degraded   map[string]error
+		Failure    *backend.Failure
+	}{
+		Scanner:  name,
+		Scanners: f.scannerNames(),
+	}
+	data.State, data.LastFail = b.Status()
+	data.LastResult = b.LastResult()
+	data.Reauth = b.Reauth()
+	data.Spooled = b.Spooled()
+	data.Degraded = b.Degraded()
+	data.Failure = b.Failure()
 	f.tmplStatus.Execute(w, &data)
 }
 
-func driveList(d *drive.Service, id, order string) ([]*drive.ChildReference, error) {
-	var pageToken string
-	var ret []*drive.ChildReference
-        for {
-                l, err := d.Children.List(id).PageToken(pageToken).OrderBy(order).Do()
-                if err != nil {
-			return nil, err
-                }
-		ret = append(ret, l.Items...)
-		pageToken = l.NextPageToken
-		if pageToken == "" {
-			return ret, nil
-		}
-        }
+// driveList lists the files in a folder.
+func driveList(ctx context.Context, d *drive.Service, id, order string) ([]*drive.File, error) {
+	var ret []*drive.File
+	q := fmt.Sprintf("'%s' in parents and trashed = false", strings.Replace(id, "'", `\'`, -1))
+	if err := d.Files.List().Q(q).OrderBy(order).
+		Fields("nextPageToken,files(id,mimeType,thumbnailLink,webViewLink)").
+		SupportsAllDrives(true).IncludeItemsFromAllDrives(true).
+		Pages(ctx, func(l *drive.FileList) error {
+			ret = append(ret, l.Files...)
+			return nil
+		}); err != nil {
+		return nil, err
+	}
+	return ret, nil
 }
 
 func (f *Frontend) handleLast(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
 	type page struct {
-			ThumbURL, URL string
+		ThumbURL, URL string
 	}
 	data := struct {
 		Pages []page
 	}{}
-	folders, err := driveList(f.drive, f.parent, "createdDate desc")
+	d, parent := f.backend.Drive()
+	if d == nil {
+		http.Error(w, "Google Drive not set up. Go to the setup page.", http.StatusServiceUnavailable)
+		return
+	}
+	files, err := driveList(r.Context(), d, parent, "createdTime desc")
 	if err != nil {
-		log.Printf("Failed folder Children.List: %v\n", err)
+		log.Printf("Failed folder Files.List: %v\n", err)
 		http.Error(w, "Internal error: listing drive files.", http.StatusInternalServerError)
 		return
 	}
-	if len(folders) > 0 {
-		images, err := driveList(f.drive, folders[0].Id, "createdDate")
-		if err != nil {
-			log.Printf("Failed image Children.List: %v\n", err)
-			http.Error(w, "Internal error: listing drive files.", http.StatusInternalServerError)
-			return
-		}
-		for _, i := range images {
-			f, err := f.drive.Files.Get(i.Id).Fields("thumbnailLink,webContentLink,alternateLink").Do()
+	if len(files) > 0 {
+		images := files[:1]
+		if files[0].MimeType == folderMimeType {
+			// One image per page, in a folder.
+			images, err = driveList(r.Context(), d, files[0].Id, "createdTime")
 			if err != nil {
-				log.Printf("Failed image Files.Get: %v\n", err)
-				http.Error(w, "Internal error: fetching thumbnails.", http.StatusInternalServerError)
+				log.Printf("Failed image Files.List: %v\n", err)
+				http.Error(w, "Internal error: listing drive files.", http.StatusInternalServerError)
 				return
 			}
+		}
+		for _, i := range images {
 			data.Pages = append(data.Pages, page{
-				URL:      f.AlternateLink,
-				ThumbURL: f.ThumbnailLink,
+				URL:      i.WebViewLink,
+				ThumbURL: i.ThumbnailLink,
 			})
 		}
 	}
@@ -148,20 +309,73 @@ func (f *Frontend) handleLast(w http.ResponseWriter, r *http.Request) {
 }
 
 func (f *Frontend) handleAPIStatus(w http.ResponseWriter, r *http.Request) {
+	b, name, err := f.pick(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	data := struct {
-		State    backend.State
-		LastFail string
-	}{}
+		Scanner    string   // Empty if there's only one.
+		Scanners   []string // To pick from with scanner=<name>.
+		State      backend.State
+		LastFail   string
+		LastFileID string
+		LastURL    string
+		Reauth     string
+		Spooled    int
+		Degraded   map[string]string // Non-essential parts not working.
+		Failure    *backend.Failure  // Latest failure, acknowledged or not.
+	}{
+		Scanner:  name,
+		Scanners: f.scannerNames(),
+	}
 	var lf error
-	data.State, lf = f.backend.Status()
+	data.State, lf = b.Status()
 	if lf != nil {
 		data.LastFail = lf.Error()
 	}
-	b, err := json.Marshal(&data)
+	if res := b.LastResult(); res != nil {
+		data.LastFileID = res.FileID
+		data.LastURL = res.URL
+	}
+	if err := b.Reauth(); err != nil {
+		data.Reauth = err.Error()
+	}
+	data.Spooled = b.Spooled()
+	data.Failure = b.Failure()
+	data.Degraded = make(map[string]string)
+	for k, v := range b.Degraded() {
+		data.Degraded[k] = v.Error()
+	}
+	js, err := json.Marshal(&data)
 	if err != nil {
 		http.Error(w, "Internal error: JSON encoding error.", http.StatusInternalServerError)
 		return
 	}
-	w.Write(b)
+	w.Write(js)
+}
+
+// handleAPIInput triggers whatever action the input is bound to.
+func (f *Frontend) handleAPIInput(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Only POST allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	if f.inputs == nil {
+		http.Error(w, "No inputs configured.", http.StatusNotFound)
+		return
+	}
+	r.ParseForm()
+	name := r.FormValue("name")
+	if name == "" {
+		http.Error(w, "Missing input name.", http.StatusBadRequest)
+		return
+	}
+	if err := f.inputs.Input("http:" + name); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=UTF-8")
+	fmt.Fprintln(w, "OK")
 }
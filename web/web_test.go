@@ -0,0 +1,105 @@
+package web
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ThomasHabets/autoscan/backend"
+)
+
+func TestScanners(t *testing.T) {
+	feeder := &backend.Backend{SpoolDir: t.TempDir()}
+	flatbed := &backend.Backend{SpoolDir: t.TempDir()}
+	f := New("templates", "static", feeder, "", nil)
+	f.AddScanner("feeder", feeder)
+	f.AddScanner("flatbed", flatbed)
+	s := httptest.NewServer(f.Mux)
+	defer s.Close()
+
+	for q, want := range map[string]string{
+		"":                 "feeder",
+		"?scanner=flatbed": "flatbed",
+		"?scanner=nope":    "",
+	} {
+		resp, err := http.Get(s.URL + "/api/status" + q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got struct {
+			Scanner  string
+			Scanners []string
+		}
+		err = json.NewDecoder(resp.Body).Decode(&got)
+		resp.Body.Close()
+		if want == "" {
+			if resp.StatusCode != http.StatusNotFound {
+				t.Errorf("Status of %q: %d, want not found", q, resp.StatusCode)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Scanner != want || len(got.Scanners) != 2 {
+			t.Errorf("Status of %q: %+v, want %s", q, got, want)
+		}
+	}
+
+	for _, p := range []string{"/", "/status?scanner=flatbed"} {
+		resp, err := http.Get(s.URL + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Page %q: %d", p, resp.StatusCode)
+		}
+	}
+}
+
+// TestScan checks that the scan buttons start profiles through the
+// inputs.
+func TestScan(t *testing.T) {
+	feeder := &backend.Backend{SpoolDir: t.TempDir()}
+	in := &fakeInputs{}
+	f := New("templates", "static", feeder, "", in)
+	f.AddScanner("feeder", feeder)
+	f.AddScanner("flatbed", &backend.Backend{SpoolDir: t.TempDir()})
+	f.Profiles = []string{"photo"}
+	s := httptest.NewServer(f.Mux)
+	defer s.Close()
+
+	for _, form := range []url.Values{
+		{"single": {"Single sided"}},
+		{"double": {"Double sided"}, "scanner": {"flatbed"}},
+		{"profile": {"photo"}, "scanner": {"feeder"}},
+		{"single": {"Single sided"}, "profile": {"photo"}},
+		{"scanner": {"nope"}, "single": {"Single sided"}},
+	} {
+		resp, err := http.PostForm(s.URL+"/scan", form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	want := []string{"web:scan start:single", "web:scan start:duplex:flatbed", "web:scan start:photo"}
+	if !reflect.DeepEqual([]string(*in), want) {
+		t.Errorf("Inputs: %q, want %q", *in, want)
+	}
+
+	resp, err := http.Get(s.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), `name="profile" value="photo"`) {
+		t.Errorf("No button for the photo profile:\n%s", body)
+	}
+}